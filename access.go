@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Actions recorded in the document access log
+const (
+	AccessOpen     = "open"     // Opened to edit
+	AccessView     = "view"     // Opened read-only
+	AccessEdit     = "edit"     // Changed the content
+	AccessSnapshot = "snapshot" // Fetched content saved before a truncating edit
+)
+
+// DocumentAccess is one entry of the access log
+type DocumentAccess struct {
+	ID         int64     `json:"id"`
+	DocumentID string    `json:"documentID"`
+	Username   string    `json:"username"`
+	Action     string    `json:"action"`
+	Time       time.Time `json:"time"`
+}
+
+// DocumentAccessPage answers GET /documents/access: a document's latest
+// access log entries, oldest first
+type DocumentAccessPage struct {
+	DocumentID string           `json:"documentID"`
+	Entries    []DocumentAccess `json:"entries"`
+	HasMore    bool             `json:"hasMore"` // Older entries can be fetched with before set to the first ID
+}
+
+// documentAccesses buffers access log entries for the background writer, so
+// that logging never slows down opening or editing a document
+var documentAccesses = make(chan DocumentAccess, 1024)
+
+// InitAccessLogTables creates the access_log table
+func InitAccessLogTables() error {
+	createAccessLogTable := `
+	CREATE TABLE IF NOT EXISTS access_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		action TEXT NOT NULL,
+		timestamp DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_access_log_document ON access_log(document_id, id);`
+
+	_, err := db.Exec(createAccessLogTable)
+	return err
+}
+
+// RecordDocumentAccess queues an access log entry when DOC_ACCESS_LOG is on.
+// If the writer has fallen behind, the entry is dropped rather than stalling
+// the caller.
+func RecordDocumentAccess(docID, username, action string) {
+	if !config.DocAccessLog {
+		return
+	}
+	entry := DocumentAccess{
+		DocumentID: docID,
+		Username:   username,
+		Action:     action,
+		Time:       time.Now(),
+	}
+
+	select {
+	case documentAccesses <- entry:
+	default:
+		log.Printf("Access log queue full, dropping %s of %s by %s", action, docID, username)
+	}
+}
+
+// RunAccessLogWriter persists queued access log entries to store. It runs in
+// its own goroutine until stop is closed, then saves what is still queued
+// and returns. The server never stops it and passes a nil stop.
+func RunAccessLogWriter(store *sql.DB, stop <-chan struct{}) {
+	save := func(entry DocumentAccess) {
+		err := retryBusy("writing the access log", func() error {
+			_, err := store.Exec(`
+				INSERT INTO access_log (document_id, username, action, timestamp)
+				VALUES (?, ?, ?, ?)
+			`, entry.DocumentID, entry.Username, entry.Action, entry.Time)
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to save access log entry: %v", err)
+		}
+	}
+	for {
+		select {
+		case entry := <-documentAccesses:
+			save(entry)
+		case <-stop:
+			for {
+				select {
+				case entry := <-documentAccesses:
+					save(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// GetDocumentAccessLog retrieves up to limit access log entries of a
+// document older than the entry before (0 for the latest), oldest first,
+// and whether there are older ones
+func GetDocumentAccessLog(docID string, before int64, limit int) ([]DocumentAccess, bool, error) {
+	query := `
+		SELECT id, document_id, username, action, timestamp
+		FROM access_log
+		WHERE document_id = ? AND (? = 0 OR id < ?)
+		ORDER BY id DESC
+		LIMIT ?
+	`
+
+	// One more than asked tells whether there are older entries
+	rows, err := db.Query(query, docID, before, before, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	entries := []DocumentAccess{}
+	for rows.Next() {
+		var entry DocumentAccess
+		if err := rows.Scan(&entry.ID, &entry.DocumentID, &entry.Username, &entry.Action, &entry.Time); err != nil {
+			return nil, false, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(entries) > limit
+	if hasMore {
+		entries = entries[:limit]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, hasMore, nil
+}
+
+// HandleDocumentAccess returns the access log of a document (GET, with the
+// documentID and optional before and limit query parameters) to its owner
+// and to admins. Admins can also read the log of deleted documents.
+func HandleDocumentAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	docID := r.URL.Query().Get("documentID")
+	if docID == "" {
+		http.Error(w, "documentID is required", http.StatusBadRequest)
+		return
+	}
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	limit = clampLimit(limit, config.HistoryPageSize, config.HistoryMaxPageSize)
+
+	if roleOf(claims.Username, claims.Role == RoleGuest) != RoleAdmin {
+		doc, err := GetDocument(docID)
+		if err != nil {
+			log.Printf("Error getting document %s: %v", docID, err)
+			http.Error(w, "Failed to read the access log", http.StatusInternalServerError)
+			return
+		}
+		if doc == nil {
+			http.Error(w, "Document not found", http.StatusNotFound)
+			return
+		}
+		if doc.CreatedBy != claims.Username {
+			http.Error(w, "Only the owner and admins can see who accessed this document", http.StatusForbidden)
+			return
+		}
+	}
+
+	entries, hasMore, err := GetDocumentAccessLog(docID, before, limit)
+	if err != nil {
+		log.Printf("Error reading access log of %s: %v", docID, err)
+		http.Error(w, "Failed to read the access log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DocumentAccessPage{DocumentID: docID, Entries: entries, HasMore: hasMore})
+}
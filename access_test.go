@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// accessActions returns who did what to a document, oldest first, once the
+// access log writer caught up
+func accessActions(t *testing.T, docID string) []string {
+	t.Helper()
+	flushBackgroundWriters(t)
+	entries, _, err := GetDocumentAccessLog(docID, 0, 50)
+	if err != nil {
+		t.Fatalf("GetDocumentAccessLog: %v", err)
+	}
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Username+" "+entry.Action)
+	}
+	return actions
+}
+
+func TestAccessLogRecordsOpensAndEdits(t *testing.T) {
+	setupTest(t)
+	config.DocAccessLog = true
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "draft"}}
+	receive(t, bob, DocUpdate)
+
+	got := fmt.Sprint(accessActions(t, doc.ID))
+	if want := "[alice open bob open alice edit]"; got != want {
+		t.Errorf("the access log holds %s, want %s", got, want)
+	}
+}
+
+func TestAccessLogIsOptIn(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "draft"}}
+	receive(t, bob, DocUpdate)
+
+	if got := accessActions(t, doc.ID); len(got) != 0 {
+		t.Errorf("with DOC_ACCESS_LOG off, the access log holds %v", got)
+	}
+}
+
+func TestHandleDocumentAccess(t *testing.T) {
+	setupTest(t)
+	config.DocAccessLog = true
+	config.AdminUsers = []string{"root"}
+	aliceToken := createTestUser(t, "alice")
+	bobToken := createTestUser(t, "bob")
+	rootToken := createTestUser(t, "root")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	newTestHub(t) // Starts the access log writer
+	for i := 0; i < 3; i++ {
+		RecordDocumentAccess(doc.ID, "bob", AccessView)
+	}
+	flushBackgroundWriters(t)
+
+	get := func(token, query string) (*DocumentAccessPage, int) {
+		w := callHandler(t, HandleDocumentAccess, "GET", "/documents/access?documentID="+doc.ID+query, token, nil)
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		var page DocumentAccessPage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return &page, w.Code
+	}
+
+	if _, code := get(bobToken, ""); code != http.StatusForbidden {
+		t.Errorf("someone else reading the log = %d, want 403", code)
+	}
+	if page, _ := get(rootToken, ""); page == nil || len(page.Entries) != 3 {
+		t.Errorf("an admin read %+v", page)
+	}
+
+	// Owners page back through the log
+	newest, _ := get(aliceToken, "&limit=2")
+	if newest == nil || len(newest.Entries) != 2 || !newest.HasMore {
+		t.Fatalf("the first page is %+v", newest)
+	}
+	older, _ := get(aliceToken, fmt.Sprintf("&limit=2&before=%d", newest.Entries[0].ID))
+	if older == nil || len(older.Entries) != 1 || older.HasMore || older.Entries[0].ID >= newest.Entries[0].ID {
+		t.Errorf("the older page is %+v", older)
+	}
+
+	if w := callHandler(t, HandleDocumentAccess, "GET", "/documents/access", aliceToken, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("reading without a documentID = %d, want 400", w.Code)
+	}
+}
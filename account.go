@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// What becomes of the messages, comments and other traces of a deleted
+// account, set with ACCOUNT_DELETE_MESSAGES
+const (
+	AccountAnonymize = "anonymize" // Keep them under deletedUsername
+	AccountDelete    = "delete"    // Delete the messages and comments the user wrote
+	AccountKeep      = "keep"      // Leave them under the user's name
+)
+
+// What becomes of the documents of a deleted account, set with
+// ACCOUNT_DELETE_DOCUMENTS
+const (
+	AccountDocumentsDelete   = "delete"
+	AccountDocumentsReassign = "reassign" // Hand them to ACCOUNT_DOCUMENTS_HEIR
+)
+
+// CloseAccountRemoved is the WebSocket close code sent to the connections
+// of an account that was deleted, renamed or merged into another. Clients
+// should not reconnect: the account is gone under that name, and so are its
+// tokens. The reason says what became of it.
+const CloseAccountRemoved = 4005
+
+// deletedUsername replaces the name of deleted users on what they leave
+// behind. It can't be registered.
+const deletedUsername = "deleted-user"
+
+// errWrongPassword is returned when a password confirmation doesn't match
+var errWrongPassword = errors.New("wrong password")
+
+// checkAccount reports unknown account deletion policies, or when documents
+// are to be reassigned to nobody
+func (c *Config) checkAccount(p *configProblems) {
+	switch c.AccountDeleteMessages {
+	case AccountAnonymize, AccountDelete, AccountKeep:
+	default:
+		p.add("Invalid ACCOUNT_DELETE_MESSAGES %q, expected %s, %s or %s", c.AccountDeleteMessages, AccountAnonymize, AccountDelete, AccountKeep)
+	}
+	switch c.AccountDeleteDocuments {
+	case AccountDocumentsDelete:
+	case AccountDocumentsReassign:
+		if c.AccountDocumentsHeir == "" {
+			p.add("ACCOUNT_DELETE_DOCUMENTS=%s requires ACCOUNT_DOCUMENTS_HEIR", AccountDocumentsReassign)
+		}
+	default:
+		p.add("Invalid ACCOUNT_DELETE_DOCUMENTS %q, expected %s or %s", c.AccountDeleteDocuments, AccountDocumentsDelete, AccountDocumentsReassign)
+	}
+}
+
+// InitAccountTables creates the token_revocations table
+func InitAccountTables() error {
+	createRevocationsTable := `
+	CREATE TABLE IF NOT EXISTS token_revocations (
+		username TEXT PRIMARY KEY,
+		revoked_at DATETIME NOT NULL
+	);`
+
+	_, err := db.Exec(createRevocationsTable)
+	return err
+}
+
+// TokenRevoked reports whether the tokens of a user issued at issuedAt were
+// revoked. Revocation covers every token issued up to the second it
+// happened, so that a new account under the same name doesn't revive them.
+func TokenRevoked(username string, issuedAt time.Time) (bool, error) {
+	var revokedAt time.Time
+	err := db.QueryRow(`SELECT revoked_at FROM token_revocations WHERE username = ?`, username).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return issuedAt.Unix() <= revokedAt.Unix(), nil
+}
+
+// revokeTokens revokes the tokens issued so far to a username, within the
+// transaction tx
+func revokeTokens(tx execer, username string) error {
+	_, err := tx.Exec(`
+		INSERT INTO token_revocations (username, revoked_at) VALUES (?, ?)
+		ON CONFLICT(username) DO UPDATE SET revoked_at = excluded.revoked_at
+	`, username, time.Now())
+	return err
+}
+
+// runStatements executes statements that each take the same arguments
+func runStatements(e execer, statements []string, args ...any) error {
+	for _, statement := range statements {
+		if _, err := e.Exec(statement, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteUser deletes an account in one transaction, along with its
+// preferences, read positions, group memberships and document shares, and
+// revokes its tokens. Its documents are deleted or reassigned according to
+// ACCOUNT_DELETE_DOCUMENTS, its messages, comments and reactions anonymized,
+// deleted or kept according to ACCOUNT_DELETE_MESSAGES. It returns the IDs
+// of the deleted documents.
+func DeleteUser(username string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Documents. The heir can't inherit from themselves, theirs are deleted.
+	var deleted []string
+	if config.AccountDeleteDocuments == AccountDocumentsReassign && username != config.AccountDocumentsHeir {
+		var heirExists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, config.AccountDocumentsHeir).Scan(&heirExists); err != nil {
+			return nil, err
+		}
+		if !heirExists {
+			return nil, errors.New("the heir of deleted accounts' documents doesn't exist")
+		}
+		if err := runStatements(tx, []string{
+			`UPDATE documents SET created_by = ? WHERE created_by = ?`,
+			`UPDATE document_share_links SET created_by = ? WHERE created_by = ?`,
+		}, config.AccountDocumentsHeir, username); err != nil {
+			return nil, err
+		}
+	} else {
+		rows, err := tx.Query(`SELECT id FROM documents WHERE created_by = ?`, username)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var docID string
+			if err := rows.Scan(&docID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			deleted = append(deleted, docID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		for _, docID := range deleted {
+			if err := deleteDocument(tx, docID); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// What only mattered to the user
+	if err := runStatements(tx, []string{
+		`DELETE FROM document_permissions WHERE username = ?`,
+		`DELETE FROM notification_preferences WHERE username = ?`,
+		`DELETE FROM last_read WHERE username = ?`,
+		`DELETE FROM conversation_members WHERE username = ?`,
+	}, username); err != nil {
+		return nil, err
+	}
+
+	// What others still see
+	switch config.AccountDeleteMessages {
+	case AccountAnonymize:
+		// Client keys are only unique per sender, and all deleted users
+		// become the same sender
+		err = runStatements(tx, []string{
+			`UPDATE messages SET username = ?, client_key = '' WHERE username = ?`,
+			`UPDATE messages SET from_user = ? WHERE from_user = ?`,
+			`UPDATE messages SET to_user = ? WHERE to_user = ?`,
+			`UPDATE OR IGNORE message_reactions SET username = ? WHERE username = ?`,
+			`UPDATE document_comments SET username = ? WHERE username = ?`,
+			`UPDATE document_events SET username = ? WHERE username = ?`,
+			`UPDATE access_log SET username = ? WHERE username = ?`,
+			`UPDATE document_snapshots SET username = ? WHERE username = ?`,
+			`UPDATE conversations SET created_by = ? WHERE created_by = ?`,
+		}, deletedUsername, username)
+		if err == nil {
+			// Reactions that were already made under the deleted name
+			_, err = tx.Exec(`DELETE FROM message_reactions WHERE username = ?`, username)
+		}
+	case AccountDelete:
+		err = runStatements(tx, []string{
+			`DELETE FROM message_reactions WHERE username = ?1 OR message_id IN (SELECT id FROM messages WHERE username = ?1)`,
+			`DELETE FROM messages WHERE username = ?1`,
+			`DELETE FROM document_comments WHERE username = ?1`,
+		}, username)
+		if err == nil {
+			// Private messages sent to the user are the sender's
+			err = runStatements(tx, []string{
+				`UPDATE messages SET to_user = ? WHERE to_user = ?`,
+				`UPDATE document_events SET username = ? WHERE username = ?`,
+				`UPDATE access_log SET username = ? WHERE username = ?`,
+				`UPDATE document_snapshots SET username = ? WHERE username = ?`,
+				`UPDATE conversations SET created_by = ? WHERE created_by = ?`,
+			}, deletedUsername, username)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM users WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+	if err := revokeTokens(tx, username); err != nil {
+		return nil, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// deleteAccount checks a user's password and deletes their account, ending
+// their connections and the editing sessions of their deleted documents
+func deleteAccount(hub *Hub, username, password string) error {
+	valid, err := ValidateUser(username, password)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errWrongPassword
+	}
+
+	deleted, err := DeleteUser(username)
+	if err != nil {
+		return err
+	}
+	log.Printf("%s deleted their account and %d documents", username, len(deleted))
+
+	hub.CloseUserConnections(username, permanentClose(CloseAccountRemoved, "account deleted"))
+	if len(deleted) > 0 {
+		hub.DocumentsRemoved <- documentRemoval{DocumentIDs: deleted, Reason: DocumentDeleted}
+		hub.DocumentLists <- struct{}{}
+	}
+	return nil
+}
+
+// HandleAccount deletes (DELETE) the account of the user whose token is in
+// the Authorization header. The body must confirm the user's password, as
+// {"password": "..."}.
+func HandleAccount(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, err := ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if claims.Role == RoleGuest {
+			http.Error(w, "Guests have no account to delete", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+			http.Error(w, "Invalid request: password is required", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = deleteAccount(hub, claims.Username, req.Password)
+		if errors.Is(err, errWrongPassword) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(AuthResponse{Success: false, Message: "Wrong password"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting account of %s: %v", claims.Username, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(AuthResponse{Success: false, Message: "Failed to delete account"})
+			return
+		}
+		json.NewEncoder(w).Encode(AuthResponse{Success: true, Message: "Account deleted"})
+	}
+}
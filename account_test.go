@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// savePrivateMessage stores a private message from one user to another
+func savePrivateMessage(t *testing.T, from, to, content string) int64 {
+	t.Helper()
+	id, err := SaveMessage(Msg{Type: PrivateMessage, Username: from, From: from, To: to, Content: content})
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	return id
+}
+
+func TestHandleAccount(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	token := createTestUser(t, "alice")
+
+	if w := callHandler(t, HandleAccount(hub), "DELETE", "/api/account", token, map[string]string{"password": "wrong"}); w.Code != http.StatusForbidden {
+		t.Errorf("deleting with the wrong password = %d, want 403", w.Code)
+	}
+	if w := callHandler(t, HandleAccount(hub), "DELETE", "/api/account", token, map[string]string{}); w.Code != http.StatusBadRequest {
+		t.Errorf("deleting without a password = %d, want 400", w.Code)
+	}
+	if exists, err := UserExists("alice"); err != nil || !exists {
+		t.Fatalf("a refused deletion removed the account: %v", err)
+	}
+
+	w := callHandler(t, HandleAccount(hub), "DELETE", "/api/account", token, map[string]string{"password": "secret1"})
+	var resp AuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.Success {
+		t.Fatalf("deleting the account = %d %+v, %v", w.Code, resp, err)
+	}
+	if exists, err := UserExists("alice"); err != nil || exists {
+		t.Errorf("the account is still there: %v", err)
+	}
+	if _, err := ValidateToken(token); err == nil {
+		t.Error("the deleted account's token still verifies")
+	}
+
+	// The name can be registered again, without reviving the old tokens
+	createTestUser(t, "alice")
+	if _, err := ValidateToken(token); err == nil {
+		t.Error("the old token verifies for the new account")
+	}
+}
+
+func TestDeleteUserAnonymizes(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	public := saveTestMessage(t, "alice", "hello from alice")
+	sent := savePrivateMessage(t, "alice", "bob", "psst")
+	received := savePrivateMessage(t, "bob", "alice", "hi alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	bobs := createTestDocument(t, "bob.txt", "bob")
+
+	deleted, err := DeleteUser("alice")
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != doc.ID {
+		t.Errorf("DeleteUser deleted documents %v, want alice's", deleted)
+	}
+	if got, err := GetDocument(doc.ID); err == nil && got != nil {
+		t.Error("alice's document is still there")
+	}
+	if got, err := GetDocument(bobs.ID); err != nil || got == nil {
+		t.Errorf("bob's document went too: %v", err)
+	}
+
+	if msg, err := GetMessage(public); err != nil || msg == nil || msg.Username != deletedUsername || msg.Content != "hello from alice" {
+		t.Errorf("alice's message became %+v, %v", msg, err)
+	}
+	if msg, err := GetMessage(sent); err != nil || msg == nil || msg.From != deletedUsername || msg.To != "bob" {
+		t.Errorf("alice's private message became %+v, %v", msg, err)
+	}
+	if msg, err := GetMessage(received); err != nil || msg == nil || msg.From != "bob" || msg.To != deletedUsername {
+		t.Errorf("the private message to alice became %+v, %v", msg, err)
+	}
+}
+
+func TestDeleteUserDeletesMessages(t *testing.T) {
+	setupTest(t)
+	config.AccountDeleteMessages = AccountDelete
+	createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	public := saveTestMessage(t, "alice", "hello from alice")
+	reply := saveTestMessage(t, "bob", "hello alice")
+	received := savePrivateMessage(t, "bob", "alice", "hi alice")
+
+	if _, err := DeleteUser("alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if msg, err := GetMessage(public); err != nil || msg != nil {
+		t.Errorf("alice's message is still there: %+v, %v", msg, err)
+	}
+	if msg, err := GetMessage(reply); err != nil || msg == nil || msg.Username != "bob" {
+		t.Errorf("bob's message became %+v, %v", msg, err)
+	}
+	// What bob sent stays bob's
+	if msg, err := GetMessage(received); err != nil || msg == nil || msg.To != deletedUsername {
+		t.Errorf("the private message to alice became %+v, %v", msg, err)
+	}
+}
+
+func TestDeleteUserKeepsMessages(t *testing.T) {
+	setupTest(t)
+	config.AccountDeleteMessages = AccountKeep
+	createTestUser(t, "alice")
+	public := saveTestMessage(t, "alice", "hello from alice")
+
+	if _, err := DeleteUser("alice"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if msg, err := GetMessage(public); err != nil || msg == nil || msg.Username != "alice" {
+		t.Errorf("alice's message became %+v, %v", msg, err)
+	}
+}
+
+func TestDeleteUserReassignsDocuments(t *testing.T) {
+	setupTest(t)
+	config.AccountDeleteDocuments = AccountDocumentsReassign
+	config.AccountDocumentsHeir = "archivist"
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+
+	// The heir must exist
+	if _, err := DeleteUser("alice"); err == nil {
+		t.Fatal("DeleteUser reassigned documents to a missing heir")
+	}
+	if exists, err := UserExists("alice"); err != nil || !exists {
+		t.Fatalf("the failed deletion removed the account: %v", err)
+	}
+
+	createTestUser(t, "archivist")
+	deleted, err := DeleteUser("alice")
+	if err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("DeleteUser deleted documents %v", deleted)
+	}
+	if got, err := GetDocument(doc.ID); err != nil || got == nil || got.CreatedBy != "archivist" {
+		t.Errorf("alice's document became %+v, %v", got, err)
+	}
+
+	// The heir's own documents can't be handed to themselves
+	createTestDocument(t, "archive.txt", "archivist")
+	if deleted, err := DeleteUser("archivist"); err != nil || len(deleted) != 2 {
+		t.Errorf("deleting the heir deleted %v, %v, want both documents", deleted, err)
+	}
+}
+
+func TestDeleteAccountClosesConnections(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	conn := dial(t, server, createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	if err := deleteAccount(hub, "alice", "secret1"); err != nil {
+		t.Fatalf("deleteAccount: %v", err)
+	}
+	closeErr, _ := conn.expectClose()
+	if closeErr.Code != CloseAccountRemoved {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseAccountRemoved)
+	}
+	eventually(t, "alice to leave the hub", func() bool { return len(hub.ConnectedClients()) == 0 })
+}
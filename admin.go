@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Operations admin tooling can ask the hub to run
+const (
+	AdminListClients = "list-clients" // Describe every connection
+	AdminDisconnect  = "disconnect"   // Drop the connections of a user, or one connection by session ID
+	AdminAnnounce    = "announce"     // Send a system notice to every chat client
+	AdminCloseAll    = "close-all"    // Tell every client the server is shutting down
+	AdminListEditors = "list-editors" // Describe who has which document open
+)
+
+// ClientInfo describes one connection to the hub
+type ClientInfo struct {
+	ID         string   `json:"id"`
+	Username   string   `json:"username"`
+	Role       string   `json:"role"`
+	InChat     bool     `json:"inChat"`
+	DocumentID string   `json:"documentID,omitempty"` // The document the connection has open
+	ReadOnly   bool     `json:"readOnly,omitempty"`   // The document is open for viewing only
+	Rooms      []string `json:"rooms,omitempty"`
+	LatencyMs  float64  `json:"latencyMs,omitempty"` // Round-trip time of the latest answered ping
+}
+
+// DocumentSession describes the editing session of an open document
+type DocumentSession struct {
+	DocumentID string           `json:"documentID"`
+	Name       string           `json:"name,omitempty"`
+	Mode       string           `json:"mode"`
+	Turn       string           `json:"turn,omitempty"` // Who holds the turn in ModeTurns
+	Editors    []DocumentEditor `json:"editors"`
+}
+
+// DocumentEditor is one connection in an editing session
+type DocumentEditor struct {
+	Username  string    `json:"username"`
+	SessionID string    `json:"sessionID"`
+	ReadOnly  bool      `json:"readOnly,omitempty"`
+	JoinedAt  time.Time `json:"joinedAt"` // When the connection opened the document
+}
+
+// adminCommand asks the hub to run an admin operation. Like the other hub
+// requests it is handled by Run, so it never races with the hub's state.
+type adminCommand struct {
+	Op      string      // AdminListClients, AdminDisconnect, AdminAnnounce, AdminCloseAll or AdminListEditors
+	Target  string      // AdminDisconnect: a username or session ID
+	Content string      // AdminAnnounce: the notice to send
+	Close   *closeFrame // AdminDisconnect: how to end the connections, a kick when nil
+	Reply   chan adminResult
+}
+
+// adminResult is the outcome of an adminCommand
+type adminResult struct {
+	Clients  []ClientInfo      // AdminListClients: the connections, by username
+	Sessions []DocumentSession // AdminListEditors: the open documents, by ID
+	Count    int               // AdminDisconnect, AdminAnnounce, AdminCloseAll: how many connections were affected
+}
+
+// runAdminCommand carries out an admin operation inside Run
+func (h *Hub) runAdminCommand(cmd adminCommand) adminResult {
+	switch cmd.Op {
+	case AdminListClients:
+		return adminResult{Clients: h.clientInfos()}
+
+	case AdminDisconnect:
+		// A session ID picks out one connection, anything else is a username
+		var targets []*Client
+		if client := h.clientBySession(cmd.Target); client != nil {
+			targets = append(targets, client)
+		} else {
+			for client := range h.Clients {
+				if client.Username == cmd.Target {
+					targets = append(targets, client)
+				}
+			}
+		}
+		frame := cmd.Close
+		if frame == nil {
+			frame = permanentClose(CloseKicked, "disconnected by an admin")
+		}
+		for _, client := range targets {
+			log.Printf("Disconnecting %s (connection %s): %s", client.Username, client.ID, frame.Text)
+			client.requestClose(frame)
+		}
+		return adminResult{Count: len(targets)}
+
+	case AdminAnnounce:
+		count := 0
+		for client := range h.Clients {
+			if client.InChat {
+				count++
+			}
+		}
+		h.notifyChat(newSystemMessage(cmd.Content))
+		return adminResult{Count: count}
+
+	case AdminCloseAll:
+		return adminResult{Count: h.closeAll()}
+
+	case AdminListEditors:
+		return adminResult{Sessions: h.documentSessions()}
+	}
+
+	log.Printf("Unknown admin command %q", cmd.Op)
+	return adminResult{}
+}
+
+// clientInfos describes the hub's connections, sorted by username
+func (h *Hub) clientInfos() []ClientInfo {
+	rooms := make(map[*Client][]string)
+	for room, members := range h.Rooms {
+		for client := range members {
+			rooms[client] = append(rooms[client], room)
+		}
+	}
+
+	infos := []ClientInfo{}
+	for client := range h.Clients {
+		sort.Strings(rooms[client])
+		infos = append(infos, ClientInfo{
+			ID:         client.ID,
+			Username:   client.Username,
+			Role:       client.Role,
+			InChat:     client.InChat,
+			DocumentID: client.CurrentDocumentID,
+			ReadOnly:   client.ReadOnly,
+			Rooms:      rooms[client],
+			LatencyMs:  float64(client.Latency().Microseconds()) / 1000,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Username != infos[j].Username {
+			return infos[i].Username < infos[j].Username
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// documentSessions describes the open documents and their editors, sorted
+// by document ID, editors by when they joined
+func (h *Hub) documentSessions() []DocumentSession {
+	sessions := []DocumentSession{}
+	for docID, clients := range h.DocumentClients {
+		if len(clients) == 0 {
+			continue
+		}
+		session := DocumentSession{DocumentID: docID, Editors: []DocumentEditor{}}
+		if history, ok := h.DocumentHistories[docID]; ok {
+			session.Mode = history.Mode
+			session.Turn = history.Turn
+		}
+		for client := range clients {
+			session.Editors = append(session.Editors, DocumentEditor{
+				Username:  client.Username,
+				SessionID: client.ID,
+				ReadOnly:  client.ReadOnly,
+				JoinedAt:  client.DocumentJoined,
+			})
+		}
+		sort.Slice(session.Editors, func(i, j int) bool {
+			return session.Editors[i].JoinedAt.Before(session.Editors[j].JoinedAt)
+		})
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].DocumentID < sessions[j].DocumentID
+	})
+	return sessions
+}
+
+// adminRequest sends an admin command to the hub and waits for the result
+func (h *Hub) adminRequest(cmd adminCommand) adminResult {
+	cmd.Reply = make(chan adminResult, 1)
+	h.Admin <- cmd
+	return <-cmd.Reply
+}
+
+// ConnectedClients describes every connection to the hub. It is safe to
+// call from outside Run.
+func (h *Hub) ConnectedClients() []ClientInfo {
+	return h.adminRequest(adminCommand{Op: AdminListClients}).Clients
+}
+
+// DisconnectClients drops the connections of a user, or the one connection
+// with the given session ID, and returns how many were dropped. It is safe to call
+// from outside Run.
+func (h *Hub) DisconnectClients(target string) int {
+	return h.adminRequest(adminCommand{Op: AdminDisconnect, Target: target}).Count
+}
+
+// CloseUserConnections drops the connections of a user, or the one
+// connection with the given session ID, with the given close frame, and
+// returns how many were dropped. It is safe to call from outside Run.
+func (h *Hub) CloseUserConnections(username string, frame *closeFrame) int {
+	return h.adminRequest(adminCommand{Op: AdminDisconnect, Target: username, Close: frame}).Count
+}
+
+// Announce sends a system notice to every chat client and returns how many
+// received it. Like other notices it isn't stored. It is safe to call from
+// outside Run.
+func (h *Hub) Announce(content string) int {
+	return h.adminRequest(adminCommand{Op: AdminAnnounce, Content: content}).Count
+}
+
+// CloseConnections sends every client a close frame saying the server is
+// shutting down and when to reconnect, and returns how many were told. It
+// is safe to call from outside Run.
+func (h *Hub) CloseConnections() int {
+	return h.adminRequest(adminCommand{Op: AdminCloseAll}).Count
+}
+
+// DocumentSessions describes who is editing which document. It is safe to
+// call from outside Run.
+func (h *Hub) DocumentSessions() []DocumentSession {
+	return h.adminRequest(adminCommand{Op: AdminListEditors}).Sessions
+}
+
+// requireAdmin checks that a request carries the token of an admin,
+// answering it with an error otherwise
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	claims, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if roleOf(claims.Username, claims.Role == RoleGuest) != RoleAdmin {
+		http.Error(w, "Only admins can do this", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+// adminCountResponse reports how many connections an admin action affected
+type adminCountResponse struct {
+	Count int `json:"count"`
+}
+
+// HandleAdminClients lists the connected clients to admins
+func HandleAdminClients(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := requireAdmin(w, r); !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.ConnectedClients())
+	}
+}
+
+// HandleAdminDocuments shows admins who is editing which document, with the
+// documents' names and when each editor opened them
+func HandleAdminDocuments(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := requireAdmin(w, r); !ok {
+			return
+		}
+
+		sessions := hub.DocumentSessions()
+		for i := range sessions {
+			doc, err := GetDocument(sessions[i].DocumentID)
+			if err != nil {
+				log.Printf("Error getting document %s: %v", sessions[i].DocumentID, err)
+				continue
+			}
+			if doc != nil {
+				sessions[i].Name = doc.Name
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// HandleAdminDisconnect lets admins drop the connections of a user, or a
+// single connection by its session ID
+func HandleAdminDisconnect(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Target string `json:"target"` // A username or session ID
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Target) == "" {
+			http.Error(w, "Invalid request: target is required", http.StatusBadRequest)
+			return
+		}
+
+		count := hub.DisconnectClients(strings.TrimSpace(req.Target))
+		log.Printf("%s disconnected %d connections of %s", claims.Username, count, req.Target)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adminCountResponse{Count: count})
+	}
+}
+
+// HandleAdminAnnounce lets admins send a system notice to everyone in the
+// chat
+func HandleAdminAnnounce(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+			http.Error(w, "Invalid request: content is required", http.StatusBadRequest)
+			return
+		}
+
+		count := hub.Announce(strings.TrimSpace(req.Content))
+		log.Printf("%s announced to %d connections: %s", claims.Username, count, req.Content)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adminCountResponse{Count: count})
+	}
+}
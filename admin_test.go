@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAdminListsClientsAndSessions(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	createTestUser(t, "root")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	joinTestRoom(t, hub, alice, "dev")
+	editor := openTestDocument(t, hub, "root", doc.ID)
+
+	clients := hub.ConnectedClients()
+	if len(clients) != 2 {
+		t.Fatalf("ConnectedClients = %+v, want alice and root", clients)
+	}
+	if got := clients[0]; got.ID != alice.ID || !got.InChat || len(got.Rooms) != 1 || got.Rooms[0] != "dev" || got.Role != RoleUser {
+		t.Errorf("alice is listed as %+v", got)
+	}
+	if got := clients[1]; got.ID != editor.ID || got.InChat || got.DocumentID != doc.ID || got.Role != RoleAdmin {
+		t.Errorf("root is listed as %+v", got)
+	}
+
+	rootToken, _ := GenerateToken("root")
+	aliceToken, _ := GenerateToken("alice")
+	if w := callHandler(t, HandleAdminClients(hub), "GET", "/admin/clients", aliceToken, nil); w.Code != http.StatusForbidden {
+		t.Errorf("a user listing clients = %d, want 403", w.Code)
+	}
+	w := callHandler(t, HandleAdminClients(hub), "GET", "/admin/clients", rootToken, nil)
+	var listed []ClientInfo
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil || len(listed) != 2 || listed[1].DocumentID != doc.ID {
+		t.Errorf("GET /admin/clients = %d %+v, %v", w.Code, listed, err)
+	}
+}
+
+func TestAdminDisconnectsOneConnection(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+	rootToken := createTestUser(t, "root")
+	laptop := dial(t, server, token, nil)
+	eventually(t, "the laptop to connect", func() bool { return len(hub.ConnectedClients()) == 1 })
+	laptopID := hub.ConnectedClients()[0].ID
+	phone := dial(t, server, token, nil)
+	eventually(t, "the phone to connect", func() bool { return len(hub.ConnectedClients()) == 2 })
+
+	w := callHandler(t, HandleAdminDisconnect(hub), "POST", "/admin/disconnect", rootToken, map[string]string{"target": laptopID})
+	var resp adminCountResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Count != 1 {
+		t.Fatalf("disconnecting one session = %d %+v, %v", w.Code, resp, err)
+	}
+	laptop.expectClose()
+	eventually(t, "the laptop to leave the hub", func() bool { return len(hub.ConnectedClients()) == 1 })
+
+	// The phone still works
+	phone.send(Msg{Type: DocLanguages})
+	phone.expect(DocLanguages)
+
+	if w := callHandler(t, HandleAdminDisconnect(hub), "POST", "/admin/disconnect", rootToken, map[string]string{"target": " "}); w.Code != http.StatusBadRequest {
+		t.Errorf("disconnecting without a target = %d, want 400", w.Code)
+	}
+	if count := hub.DisconnectClients("nobody"); count != 0 {
+		t.Errorf("disconnecting an unknown user affected %d connections", count)
+	}
+}
+
+func TestAdminAnnounce(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	rootToken := createTestUser(t, "root")
+	alice := fakeClient("alice", true)
+	editor := fakeClient("bob", false)
+	register(t, hub, alice)
+	register(t, hub, editor)
+	drain(editor)
+
+	w := callHandler(t, HandleAdminAnnounce(hub), "POST", "/admin/announce", rootToken, map[string]string{"content": "  restarting at noon "})
+	var resp adminCountResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Count != 1 {
+		t.Fatalf("announcing = %d %+v, %v, want 1 chat connection", w.Code, resp, err)
+	}
+	for {
+		msg := receive(t, alice, SystemMessage)
+		if msg.Content == "restarting at noon" {
+			break
+		}
+	}
+	for _, msg := range drain(editor) {
+		if msg.Content == "restarting at noon" {
+			t.Error("an editor-only connection got the announcement")
+		}
+	}
+}
+
+func TestChannelDepths(t *testing.T) {
+	setupTest(t)
+	// Without Run, nothing drains the channels
+	hub := NewHub()
+	for i := 0; i < 3; i++ {
+		hub.BroadCast <- Msg{Type: PublicMessage, Content: "queued"}
+	}
+	depths := hub.ChannelDepths()
+	if got := depths["broadcast"]; got.Depth != 3 || got.Capacity != cap(hub.BroadCast) {
+		t.Errorf("broadcast depth = %+v, want 3 of %d", got, cap(hub.BroadCast))
+	}
+	for _, name := range []string{"private", "register", "unregister", "document_edits", "join_room", "message_updates"} {
+		if got, ok := depths[name]; !ok || got.Depth != 0 || got.Capacity == 0 {
+			t.Errorf("%s depth = %+v, %v", name, got, ok)
+		}
+	}
+}
+
+func TestAdminClosesAllConnections(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	if count := hub.CloseConnections(); count != 1 {
+		t.Errorf("CloseConnections closed %d connections, want 1", count)
+	}
+	closeErr, _ := conn.expectClose()
+	var hint reconnectHint
+	if closeErr.Code != websocket.CloseGoingAway || json.Unmarshal([]byte(closeErr.Text), &hint) != nil || hint.Reason != HintShutdown {
+		t.Errorf("closed with %d %q, want a shutdown hint", closeErr.Code, closeErr.Text)
+	}
+}
+
+func TestAdminDocumentsFollowSessions(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	rootToken := createTestUser(t, "root")
+	createTestUser(t, "alice")
+	notes := createTestDocument(t, "notes.txt", "alice")
+	plan := createTestDocument(t, "plan.txt", "alice")
+
+	if sessions := hub.DocumentSessions(); len(sessions) != 0 {
+		t.Errorf("sessions before anyone opened a document: %+v", sessions)
+	}
+	aliceToken, _ := GenerateToken("alice")
+	if w := callHandler(t, HandleAdminDocuments(hub), "GET", "/admin/documents", aliceToken, nil); w.Code != http.StatusForbidden {
+		t.Errorf("a user listing editors = %d, want 403", w.Code)
+	}
+
+	before := time.Now()
+	alice := openTestDocument(t, hub, "alice", notes.ID)
+	bob := openTestDocument(t, hub, "bob", notes.ID)
+	carol := openTestDocument(t, hub, "carol", plan.ID)
+
+	byDocument := func() map[string][]DocumentEditor {
+		w := callHandler(t, HandleAdminDocuments(hub), "GET", "/admin/documents", rootToken, nil)
+		var sessions []DocumentSession
+		if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+			t.Fatalf("GET /admin/documents = %d, %v", w.Code, err)
+		}
+		editors := map[string][]DocumentEditor{}
+		for _, session := range sessions {
+			editors[session.DocumentID] = session.Editors
+		}
+		return editors
+	}
+
+	editors := byDocument()
+	if got := editors[notes.ID]; len(got) != 2 || got[0].SessionID != alice.ID || got[1].SessionID != bob.ID {
+		t.Errorf("notes.txt is edited by %+v, want alice then bob", got)
+	}
+	if got := editors[plan.ID]; len(got) != 1 || got[0].Username != "carol" {
+		t.Errorf("plan.txt is edited by %+v, want carol", got)
+	}
+	for _, editor := range append(editors[notes.ID], editors[plan.ID]...) {
+		if editor.JoinedAt.Before(before) || editor.JoinedAt.After(time.Now()) {
+			t.Errorf("%s joined at %v", editor.Username, editor.JoinedAt)
+		}
+	}
+
+	// Switching documents and leaving show up at once
+	bob.handleDocumentOpen(plan.ID, "", hub)
+	receive(t, bob, DocContent)
+	unregister(t, hub, alice)
+	editors = byDocument()
+	if got, open := editors[notes.ID]; open {
+		t.Errorf("notes.txt is still listed with %+v after everyone left", got)
+	}
+	if got := editors[plan.ID]; len(got) != 2 || got[0].SessionID != carol.ID || got[1].SessionID != bob.ID {
+		t.Errorf("plan.txt is edited by %+v, want carol then bob", got)
+	}
+}
+
+func TestKickWritesQueuedMessagesFirst(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	conn := dial(t, server, createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	hub.Announce("maintenance in a minute")
+	if count := hub.DisconnectClients("alice"); count != 1 {
+		t.Fatalf("DisconnectClients dropped %d connections, want 1", count)
+	}
+
+	closeErr, msgs := conn.expectClose()
+	if closeErr.Code != CloseKicked {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseKicked)
+	}
+	announced := false
+	for _, msg := range msgs {
+		announced = announced || msg.Content == "maintenance in a minute"
+	}
+	if !announced {
+		t.Error("the notice queued before the kick wasn't written before the close frame")
+	}
+	eventually(t, "alice to leave the hub", func() bool { return len(hub.ConnectedClients()) == 0 })
+}
+
+// A kicked client that keeps sending must not make the server send on its
+// closed Send channel
+func TestKickWhileClientIsSending(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	conn := dial(t, server, createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Unknown types are answered with errors by readMessages itself
+		for i := 0; i < 500; i++ {
+			if conn.conn.WriteJSON(Msg{Type: "bogus"}) != nil {
+				return
+			}
+		}
+	}()
+
+	hub.CloseUserConnections("alice", permanentClose(CloseKicked, "bye"))
+	closeErr, _ := conn.expectClose()
+	wg.Wait()
+	if closeErr.Code != CloseKicked {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseKicked)
+	}
+	eventually(t, "alice to leave the hub", func() bool { return len(hub.ConnectedClients()) == 0 })
+}
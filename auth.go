@@ -2,19 +2,74 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// JWT secret key - in production, use environment variable
-var jwtSecret = []byte("your-secret-key-change-this-in-production")
+// CloseTokenExpired is the WebSocket close code sent when a connection's
+// token lapses without being refreshed; clients should sign in again
+const CloseTokenExpired = 4001
+
+// defaultKID identifies the built-in key. Tokens without a kid header are
+// verified against it, which keeps tokens issued before rotation valid.
+const defaultKID = "default"
+
+// JWTKeySet holds the keys used to sign and verify tokens. New tokens are
+// signed with the current key; the others are still accepted, so rotating
+// the secret doesn't log everybody out at once.
+type JWTKeySet struct {
+	CurrentKID string
+	Keys       map[string][]byte // kid -> secret
+}
+
+// JWT signing keys - in production, configure them with JWT_KEYS
+var jwtKeys = &JWTKeySet{
+	CurrentKID: defaultKID,
+	Keys: map[string][]byte{
+		defaultKID: []byte("your-secret-key-change-this-in-production"),
+	},
+}
+
+// ParseJWTKeySet parses a comma-separated list of kid:secret pairs. The key
+// named by currentKID signs new tokens; when currentKID is empty the first
+// key in the list is used.
+func ParseJWTKeySet(spec, currentKID string) (*JWTKeySet, error) {
+	keys := &JWTKeySet{Keys: make(map[string][]byte)}
+
+	for _, pair := range strings.Split(spec, ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("invalid JWT key %q, expected kid:secret", pair)
+		}
+		if _, exists := keys.Keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate JWT key id %q", kid)
+		}
+		keys.Keys[kid] = []byte(secret)
+		if keys.CurrentKID == "" {
+			keys.CurrentKID = kid
+		}
+	}
+
+	if currentKID != "" {
+		if _, ok := keys.Keys[currentKID]; !ok {
+			return nil, fmt.Errorf("current JWT key id %q is not in the key set", currentKID)
+		}
+		keys.CurrentKID = currentKID
+	}
+
+	return keys, nil
+}
 
 type Claims struct {
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"` // RoleGuest for guests, empty for registered users
 	jwt.RegisteredClaims
 }
 
@@ -29,9 +84,10 @@ type LoginRequest struct {
 }
 
 type AuthResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Token   string `json:"token,omitempty"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"` // Set for guests, whose name is generated
 }
 
 // HandleRegister handles user registration
@@ -60,6 +116,15 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if IsReservedUsername(req.Username) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success: false,
+			Message: "This username is reserved",
+		})
+		return
+	}
+
 	if len(req.Password) < 6 {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(AuthResponse{
@@ -100,6 +165,7 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	createOnboardingDocument(req.Username)
 
 	// Generate JWT token
 	token, err := GenerateToken(req.Username)
@@ -113,6 +179,7 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setAuthCookie(w, token, tokenTTL)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
 		Success: true,
@@ -121,6 +188,22 @@ func HandleRegister(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// IsReservedUsername reports whether a name is kept from registration: the
+// system identity (current and default), guest names, the name deleted
+// accounts leave behind and any RESERVED_USERNAMES
+func IsReservedUsername(username string) bool {
+	if IsGuestUsername(username) {
+		return true
+	}
+	reserved := append([]string{"System", config.SystemName, deletedUsername}, config.ReservedUsernames...)
+	for _, name := range reserved {
+		if strings.EqualFold(strings.TrimSpace(username), name) {
+			return true
+		}
+	}
+	return false
+}
+
 // HandleLogin handles user login
 func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -171,6 +254,7 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setAuthCookie(w, token, tokenTTL)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
 		Success: true,
@@ -179,12 +263,72 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// HandleRefresh exchanges a valid token, passed in the Authorization header
+// or, from this server's pages, the auth cookie, for a new one. Clients call
+// it before their token expires so that their connection isn't closed.
+// Guest tokens can't be refreshed.
+func HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	token := r.Header.Get("Authorization")
+	if token == "" && cookieOriginAllowed(r) {
+		token = cookieToken(r)
+	}
+	claims, err := ValidateToken(token)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success: false,
+			Message: "Invalid or expired token",
+		})
+		return
+	}
+	if claims.Role == RoleGuest {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success: false,
+			Message: "Guest tokens can't be refreshed",
+		})
+		return
+	}
+
+	token, err = GenerateToken(claims.Username)
+	if err != nil {
+		log.Printf("Error generating token: %v", err)
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success: false,
+			Message: "Failed to generate token",
+		})
+		return
+	}
+
+	setAuthCookie(w, token, tokenTTL)
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success: true,
+		Message: "Token refreshed",
+		Token:   token,
+	})
+}
+
+// tokenTTL is how long the tokens of registered users are valid
+const tokenTTL = 24 * time.Hour
+
 // GenerateToken creates a JWT token for a user
 func GenerateToken(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+	return signToken(username, "", tokenTTL)
+}
+
+// signToken creates a JWT token with the given role, valid for ttl
+func signToken(username, role string, ttl time.Duration) (string, error) {
+	expirationTime := time.Now().Add(ttl)
 
 	claims := &Claims{
 		Username: username,
+		Role:     role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -192,57 +336,84 @@ func GenerateToken(username string) (string, error) {
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	token.Header["kid"] = jwtKeys.CurrentKID
+	return token.SignedString(jwtKeys.Keys[jwtKeys.CurrentKID])
 }
 
-// ValidateToken validates a JWT token and returns the username
-func ValidateToken(tokenString string) (string, error) {
+// ValidateToken validates a JWT token and returns its claims
+func ValidateToken(tokenString string) (*Claims, error) {
 	// Remove "Bearer " prefix if present
 	tokenString = strings.TrimPrefix(tokenString, "Bearer ")
 
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+		// Pick the verification key by the kid the token was signed with
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = defaultKID
+		}
+		key, ok := jwtKeys.Keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if !token.Valid {
-		return "", jwt.ErrSignatureInvalid
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	// Tokens of deleted accounts stop working at once
+	if claims.Role != RoleGuest && claims.IssuedAt != nil {
+		revoked, err := TokenRevoked(claims.Username, claims.IssuedAt.Time)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errors.New("token revoked")
+		}
 	}
 
-	return claims.Username, nil
+	return claims, nil
 }
 
 // AuthMiddleware is a middleware to protect WebSocket connections
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Get token from query parameter (for WebSocket)
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			// Also check Authorization header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != "" {
-				token = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
-
+		// Get the token from the query parameter, Authorization header or
+		// cookie, whichever AUTH_TOKEN_SOURCES lists first
+		token, source := requestToken(r)
 		if token == "" {
 			http.Error(w, "Unauthorized: No token provided", http.StatusUnauthorized)
 			return
 		}
+		if source == TokenFromCookie && !cookieOriginAllowed(r) {
+			http.Error(w, "Forbidden: Cookie authentication from another origin", http.StatusForbidden)
+			return
+		}
 
-		username, err := ValidateToken(token)
+		claims, err := ValidateToken(token)
 		if err != nil {
 			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
 			return
 		}
+		if claims.Role == RoleGuest && !config.GuestAccess {
+			http.Error(w, "Unauthorized: Guest access is disabled", http.StatusUnauthorized)
+			return
+		}
 
-		// Set username in query parameter for WebSocket handler
+		// Set username, role and expiry in query parameters for WebSocket handler
 		q := r.URL.Query()
-		q.Set("username", username)
+		q.Set("username", claims.Username)
+		q.Set("role", claims.Role)
+		q.Del("expires")
+		if claims.ExpiresAt != nil {
+			q.Set("expires", strconv.FormatInt(claims.ExpiresAt.Unix(), 10))
+		}
 		r.URL.RawQuery = q.Encode()
 
 		next.ServeHTTP(w, r)
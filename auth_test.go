@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useJWTKeys switches to the keys of spec until the test ends
+func useJWTKeys(t *testing.T, spec, currentKID string) {
+	t.Helper()
+	keys, err := ParseJWTKeySet(spec, currentKID)
+	if err != nil {
+		t.Fatalf("ParseJWTKeySet(%q): %v", spec, err)
+	}
+	saved := jwtKeys
+	jwtKeys = keys
+	t.Cleanup(func() { jwtKeys = saved })
+}
+
+// tokenKID returns the kid header of a token
+func tokenKID(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	setupTest(t)
+	useJWTKeys(t, "2025:old-secret", "")
+	oldToken := createTestUser(t, "alice")
+
+	// Rotate: new tokens use the new key, the old key still verifies
+	useJWTKeys(t, "2025:old-secret,2026:new-secret", "2026")
+	newToken, err := GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := tokenKID(t, newToken); kid != "2026" {
+		t.Errorf("new token signed with kid %q, want 2026", kid)
+	}
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if claims, err := ValidateToken(token); err != nil || claims.Username != "alice" {
+			t.Errorf("the %s token didn't verify: %v", name, err)
+		}
+	}
+
+	// Once the old key is dropped, its tokens stop working
+	useJWTKeys(t, "2026:new-secret", "")
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Error("a token signed with a dropped key verified")
+	}
+	if _, err := ValidateToken(newToken); err != nil {
+		t.Errorf("the new token didn't verify: %v", err)
+	}
+}
+
+func TestTokenWithUnknownKIDIsRejected(t *testing.T) {
+	setupTest(t)
+	useJWTKeys(t, "2026:new-secret", "")
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{Username: "alice"})
+	token.Header["kid"] = "elsewhere"
+	signed, err := token.SignedString([]byte("new-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(signed); err == nil {
+		t.Error("a token with an unknown kid verified")
+	}
+}
+
+func TestParseJWTKeySet(t *testing.T) {
+	keys, err := ParseJWTKeySet(" a:one , b:two ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.CurrentKID != "a" || string(keys.Keys["b"]) != "two" {
+		t.Errorf("parsed %+v", keys)
+	}
+
+	for _, tt := range []struct{ spec, current string }{
+		{"a", ""},
+		{"a:", ""},
+		{":one", ""},
+		{"a:one,a:two", ""},
+		{"a:one", "b"},
+	} {
+		if _, err := ParseJWTKeySet(tt.spec, tt.current); err == nil {
+			t.Errorf("ParseJWTKeySet(%q, %q) accepted it", tt.spec, tt.current)
+		}
+	}
+}
+
+func TestConnectionClosesWhenTokenExpires(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	createTestUser(t, "alice")
+	token, err := signToken("alice", "", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dial(t, server, token, nil)
+
+	closeErr, _ := conn.expectClose()
+	if closeErr.Code != CloseTokenExpired {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseTokenExpired)
+	}
+	eventually(t, "alice to leave the hub", func() bool { return hub.LoadStatus().Connections.Total == 0 })
+}
+
+func TestRefreshedTokenKeepsConnectionOpen(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	fresh := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	token, err := signToken("alice", "", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dial(t, server, token, nil)
+
+	// Someone else's token is no refresh
+	bobToken, _ := GenerateToken("bob")
+	conn.send(Msg{Type: AuthRefresh, Token: bobToken})
+	if got := conn.expect(ErrorMessage); got.Content != "Invalid token" {
+		t.Errorf("refreshing with bob's token was answered with %q", got.Content)
+	}
+
+	conn.send(Msg{Type: AuthRefresh, Token: fresh})
+	conn.expect(AuthRefresh)
+
+	// Past the old token's expiry the connection still works
+	time.Sleep(3 * time.Second)
+	conn.send(Msg{Type: DocLanguages})
+	conn.expect(DocLanguages)
+}
+
+func TestHandleRefresh(t *testing.T) {
+	setupTest(t)
+	token := createTestUser(t, "alice")
+
+	w := callHandler(t, HandleRefresh, "POST", "/refresh", token, nil)
+	var resp AuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.Success {
+		t.Fatalf("POST /refresh = %d %+v, %v", w.Code, resp, err)
+	}
+	if claims, err := ValidateToken(resp.Token); err != nil || claims.Username != "alice" {
+		t.Errorf("the refreshed token is for %+v, %v", claims, err)
+	}
+
+	if w := callHandler(t, HandleRefresh, "POST", "/refresh", "not-a-token", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("refreshing a bad token = %d, want 401", w.Code)
+	}
+	if w := callHandler(t, HandleRefresh, "POST", "/refresh", guestTestToken(t, "guest-1"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("refreshing a guest token = %d, want 403", w.Code)
+	}
+	if w := callHandler(t, HandleRefresh, "GET", "/refresh", token, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /refresh = %d, want 405", w.Code)
+	}
+}
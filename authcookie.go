@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Places AuthMiddleware looks for a token, in the order AUTH_TOKEN_SOURCES
+// lists them
+const (
+	TokenFromQuery  = "query"  // The token query parameter
+	TokenFromHeader = "header" // The Authorization header
+	TokenFromCookie = "cookie" // The AUTH_COOKIE_NAME cookie, when AUTH_COOKIE is on
+)
+
+// checkAuthCookie reports unknown or repeated token sources and a cookie
+// name browsers wouldn't accept
+func (c *Config) checkAuthCookie(p *configProblems) {
+	if len(c.AuthTokenSources) == 0 {
+		p.add("AUTH_TOKEN_SOURCES must list at least one of %s, %s or %s", TokenFromQuery, TokenFromHeader, TokenFromCookie)
+	}
+	seen := map[string]bool{}
+	for _, source := range c.AuthTokenSources {
+		switch source {
+		case TokenFromQuery, TokenFromHeader, TokenFromCookie:
+		default:
+			p.add("Invalid AUTH_TOKEN_SOURCES entry %q, expected %s, %s or %s", source, TokenFromQuery, TokenFromHeader, TokenFromCookie)
+			continue
+		}
+		if seen[source] {
+			p.add("AUTH_TOKEN_SOURCES lists %s twice", source)
+		}
+		seen[source] = true
+	}
+
+	if c.AuthCookie {
+		if err := (&http.Cookie{Name: c.AuthCookieName, Value: "x"}).Valid(); err != nil {
+			p.add("Invalid AUTH_COOKIE_NAME %q", c.AuthCookieName)
+		}
+		for _, origin := range c.AuthCookieOrigins {
+			if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+				p.add("Invalid AUTH_COOKIE_ORIGINS entry %q, expected e.g. https://chat.example.com", origin)
+			}
+		}
+	}
+}
+
+// requestToken finds the token of a request in the first of
+// AUTH_TOKEN_SOURCES that has one, and says which that was. A token that
+// turns out to be invalid doesn't make the next source count.
+func requestToken(r *http.Request) (token, source string) {
+	for _, source := range config.AuthTokenSources {
+		switch source {
+		case TokenFromQuery:
+			token = r.URL.Query().Get("token")
+		case TokenFromHeader:
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		case TokenFromCookie:
+			token = cookieToken(r)
+		}
+		if token != "" {
+			return token, source
+		}
+	}
+	return "", ""
+}
+
+// cookieToken returns the token in the auth cookie, if AUTH_COOKIE is on
+func cookieToken(r *http.Request) string {
+	if !config.AuthCookie {
+		return ""
+	}
+	cookie, err := r.Cookie(config.AuthCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// cookieOriginAllowed guards requests authenticated by the cookie against
+// cross-site request forgery. Browsers attach the cookie to requests any
+// page makes, so only those whose Origin is this server's own, or one of
+// AUTH_COOKIE_ORIGINS, are accepted. A request without an Origin didn't come
+// from a page a browser can be trusted to label, and is refused too.
+func cookieOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range config.AuthCookieOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// setAuthCookie hands a new token to the browser as an HttpOnly cookie,
+// when AUTH_COOKIE is on, expiring with the token. SameSite=Strict keeps
+// other sites' pages from sending it at all in current browsers.
+func setAuthCookie(w http.ResponseWriter, token string, ttl time.Duration) {
+	if !config.AuthCookie {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.AuthCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   config.AuthCookieSecure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// HandleLogout clears the auth cookie (POST). Scripts can't reach an
+// HttpOnly cookie, so this is the only way for a page to sign out of it.
+// The token itself stays valid until it expires.
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if config.AuthCookie {
+		http.SetCookie(w, &http.Cookie{
+			Name:     config.AuthCookieName,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   config.AuthCookieSecure,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// authCookie returns the auth cookie a response sets, if any
+func authCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == config.AuthCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// dialWithCookie connects to a test server with the auth cookie and an
+// Origin header, and returns the status of the upgrade
+func dialWithCookie(t *testing.T, server *httptest.Server, query, token, origin string) int {
+	t.Helper()
+	header := http.Header{}
+	header.Set("Cookie", (&http.Cookie{Name: config.AuthCookieName, Value: token}).String())
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(u, header)
+	if err == nil {
+		defer conn.Close()
+		var msg Msg
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != Session {
+			t.Errorf("the cookie connection got %+v, %v, want its session", msg, err)
+		}
+	}
+	if resp == nil {
+		t.Fatalf("dialing %s: %v", u, err)
+	}
+	return resp.StatusCode
+}
+
+func TestLoginSetsAuthCookie(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	login := func() *httptest.ResponseRecorder {
+		return callHandler(t, HandleLogin, "POST", "/login", "", LoginRequest{Username: "alice", Password: "secret1"})
+	}
+
+	if cookie := authCookie(login()); cookie != nil {
+		t.Errorf("with AUTH_COOKIE off, login set %v", cookie)
+	}
+
+	config.AuthCookie = true
+	cookie := authCookie(login())
+	if cookie == nil {
+		t.Fatal("login set no auth cookie")
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.MaxAge != int(tokenTTL.Seconds()) {
+		t.Errorf("the auth cookie is %+v", cookie)
+	}
+	if claims, err := ValidateToken(cookie.Value); err != nil || claims.Username != "alice" {
+		t.Errorf("the auth cookie holds %+v, %v", claims, err)
+	}
+
+	w := callHandler(t, HandleRegister, "POST", "/register", "", RegisterRequest{Username: "bob", Password: "secret1"})
+	if cookie := authCookie(w); cookie == nil {
+		t.Error("registering set no auth cookie")
+	}
+
+	w = callHandler(t, HandleLogout, "POST", "/logout", "", nil)
+	if cookie := authCookie(w); cookie == nil || cookie.MaxAge >= 0 || cookie.Value != "" {
+		t.Errorf("logging out set %+v, want the cookie cleared", cookie)
+	}
+}
+
+func TestCookieAuthOnUpgrade(t *testing.T) {
+	setupTest(t)
+	config.AuthCookie = true
+	config.AuthCookieOrigins = []string{"https://app.example.com"}
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	for _, tc := range []struct {
+		name, origin string
+		want         int
+	}{
+		{"same origin", server.URL, http.StatusSwitchingProtocols},
+		{"listed origin", "https://app.example.com", http.StatusSwitchingProtocols},
+		{"other origin", "https://evil.example.com", http.StatusForbidden},
+		{"no origin", "", http.StatusForbidden},
+	} {
+		if got := dialWithCookie(t, server, "", token, tc.origin); got != tc.want {
+			t.Errorf("%s: the upgrade answered %d, want %d", tc.name, got, tc.want)
+		}
+		eventually(t, "the connection to go away", func() bool { return len(hub.ConnectedClients()) == 0 })
+	}
+
+	if got := dialWithCookie(t, server, "", "not-a-token", server.URL); got != http.StatusUnauthorized {
+		t.Errorf("an invalid cookie was answered %d, want 401", got)
+	}
+	config.AuthCookie = false
+	if got := dialWithCookie(t, server, "", token, server.URL); got != http.StatusUnauthorized {
+		t.Errorf("with AUTH_COOKIE off, the cookie was answered %d, want 401", got)
+	}
+}
+
+func TestTokenSourceOrder(t *testing.T) {
+	setupTest(t)
+	config.AuthCookie = true
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	// By default the query comes first, and an invalid token there isn't
+	// passed over for the cookie
+	if got := dialWithCookie(t, server, "?token=not-a-token", token, server.URL); got != http.StatusUnauthorized {
+		t.Errorf("an invalid query token with a valid cookie was answered %d, want 401", got)
+	}
+
+	config.AuthTokenSources = []string{TokenFromCookie, TokenFromQuery}
+	if got := dialWithCookie(t, server, "?token=not-a-token", token, server.URL); got != http.StatusSwitchingProtocols {
+		t.Errorf("with the cookie first, the upgrade answered %d, want 101", got)
+	}
+
+	config.AuthTokenSources = []string{TokenFromQuery}
+	if got := dialWithCookie(t, server, "", token, server.URL); got != http.StatusUnauthorized {
+		t.Errorf("without the cookie among the sources, the upgrade answered %d, want 401", got)
+	}
+}
+
+func TestAuthCookieConfigIsValidated(t *testing.T) {
+	c := DefaultConfig()
+	c.AuthCookie = true
+	c.AuthCookieName = "bad name"
+	c.AuthCookieOrigins = []string{"app.example.com"}
+	c.AuthTokenSources = []string{TokenFromQuery, "form", TokenFromQuery}
+	err := c.Validate()
+	for _, want := range []string{"Invalid AUTH_COOKIE_NAME", "Invalid AUTH_COOKIE_ORIGINS", "Invalid AUTH_TOKEN_SOURCES", "lists query twice"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, want %s reported", err, want)
+		}
+	}
+}
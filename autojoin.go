@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Where the room chat clients join on connecting comes from, set with
+// AUTO_JOIN_SOURCE. Either way AUTO_JOIN_ROOM is the fallback.
+const (
+	AutoJoinDefault = "default" // Always AUTO_JOIN_ROOM
+	AutoJoinQuery   = "query"   // The room query parameter of the connection
+	AutoJoinOrigin  = "origin"  // The host name of the page's Origin
+)
+
+// checkAutoJoin reports an unknown AUTO_JOIN_SOURCE or an invalid
+// AUTO_JOIN_ROOM
+func (c *Config) checkAutoJoin(p *configProblems) {
+	switch c.AutoJoinSource {
+	case AutoJoinDefault, AutoJoinQuery, AutoJoinOrigin:
+	default:
+		p.add("Invalid AUTO_JOIN_SOURCE %q, expected %s, %s or %s", c.AutoJoinSource, AutoJoinDefault, AutoJoinQuery, AutoJoinOrigin)
+	}
+	if c.AutoJoinRoom != "" && !validRoomName(c.AutoJoinRoom) {
+		p.add("Invalid AUTO_JOIN_ROOM %q", c.AutoJoinRoom)
+	}
+}
+
+// autoJoinRoom picks the room a connecting chat client joins right away, or
+// "" for none. A room named in the query that isn't a valid room name is an
+// error; an Origin that doesn't make one falls back to AUTO_JOIN_ROOM.
+func autoJoinRoom(r *http.Request) (string, error) {
+	switch config.AutoJoinSource {
+	case AutoJoinQuery:
+		if room := r.URL.Query().Get("room"); room != "" {
+			if !validRoomName(room) {
+				return "", fmt.Errorf("invalid room name %q", room)
+			}
+			return room, nil
+		}
+	case AutoJoinOrigin:
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err == nil && validRoomName(u.Hostname()) {
+				return u.Hostname(), nil
+			}
+			log.Printf("No room to auto-join in Origin %q", origin)
+		}
+	}
+	return config.AutoJoinRoom, nil
+}
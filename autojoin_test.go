@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAutoJoinRoom(t *testing.T) {
+	setupTest(t)
+	request := func(query, origin string) *http.Request {
+		r := httptest.NewRequest("GET", "/ws?"+query, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		source, fallback string
+		query, origin    string
+		want             string
+	}{
+		{AutoJoinDefault, "", "room=dev", "https://team.example.com", ""},
+		{AutoJoinDefault, "lobby", "room=dev", "https://team.example.com", "lobby"},
+		{AutoJoinQuery, "lobby", "room=dev", "", "dev"},
+		{AutoJoinQuery, "lobby", "", "", "lobby"},
+		{AutoJoinOrigin, "lobby", "", "https://team.example.com:8443", "team.example.com"},
+		{AutoJoinOrigin, "lobby", "", "null", "lobby"},
+		{AutoJoinOrigin, "", "", "", ""},
+	} {
+		config.AutoJoinSource = tc.source
+		config.AutoJoinRoom = tc.fallback
+		if got, err := autoJoinRoom(request(tc.query, tc.origin)); err != nil || got != tc.want {
+			t.Errorf("%s with query %q and origin %q joined %q, %v, want %q", tc.source, tc.query, tc.origin, got, err, tc.want)
+		}
+	}
+
+	config.AutoJoinSource = AutoJoinQuery
+	if _, err := autoJoinRoom(request("room="+url.QueryEscape("bell\a"), "")); err == nil {
+		t.Error("an invalid room name in the query was accepted")
+	}
+}
+
+func TestAutoJoinConfigIsValidated(t *testing.T) {
+	c := DefaultConfig()
+	c.AutoJoinSource = "cookie"
+	c.AutoJoinRoom = " lobby "
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Invalid AUTO_JOIN_SOURCE") || !strings.Contains(err.Error(), "Invalid AUTO_JOIN_ROOM") {
+		t.Errorf("Validate = %v, want both settings reported", err)
+	}
+}
+
+// roomsOfConnection returns the rooms of the only connection to the hub
+func roomsOfConnection(t *testing.T, hub *Hub) []string {
+	t.Helper()
+	clients := hub.ConnectedClients()
+	if len(clients) != 1 {
+		t.Fatalf("%d connections, want 1", len(clients))
+	}
+	return clients[0].Rooms
+}
+
+func TestConnectingJoinsTheDefaultRoom(t *testing.T) {
+	setupTest(t)
+	config.AutoJoinRoom = "lobby"
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	conn := dial(t, server, token, nil)
+	conn.expect(Session)
+	if rooms := roomsOfConnection(t, hub); len(rooms) != 1 || rooms[0] != "lobby" {
+		t.Errorf("the chat connection is in %v, want lobby", rooms)
+	}
+	conn.conn.Close()
+	eventually(t, "alice to leave the hub", func() bool { return len(hub.ConnectedClients()) == 0 })
+
+	// Editor connections stay out of the chat, and its rooms
+	editor := dial(t, server, token, url.Values{"mode": {"editor"}})
+	editor.expect(Session)
+	if rooms := roomsOfConnection(t, hub); len(rooms) != 0 {
+		t.Errorf("the editor connection is in %v", rooms)
+	}
+}
+
+func TestConnectingJoinsTheQueryRoom(t *testing.T) {
+	setupTest(t)
+	config.AutoJoinSource = AutoJoinQuery
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	conn := dial(t, server, token, url.Values{"room": {"support"}})
+	conn.expect(Session)
+	if rooms := roomsOfConnection(t, hub); len(rooms) != 1 || rooms[0] != "support" {
+		t.Errorf("the connection is in %v, want support", rooms)
+	}
+
+	// Others in the room see the newcomer's messages
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	joinTestRoom(t, hub, bob, "support")
+	conn.send(Msg{Type: PublicMessage, Room: "support", Content: "hello support"})
+	if got := receive(t, bob, PublicMessage); got.Content != "hello support" || got.Room != "support" {
+		t.Errorf("bob got %+v", got)
+	}
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?" + url.Values{"token": {token}, "room": {"tab\there"}}.Encode()
+	refused, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		refused.Close()
+	}
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("connecting to an invalid room = %v, want a 400", err)
+	}
+}
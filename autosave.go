@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// touchDocument records activity in a document session. When dirty, the
+// session's content has changed and needs saving.
+func (h *Hub) touchDocument(docID string, dirty bool) {
+	now := time.Now()
+	h.DocumentActivity[docID] = now
+	if dirty {
+		h.DocumentDirty[docID] = now
+	}
+}
+
+// saveDocument writes a session's content to the database if it has unsaved
+// changes. With DOC_PERSISTENCE off the changes are let go instead, and
+// the content is lost once the session closes.
+func (h *Hub) saveDocument(docID string) {
+	history, ok := h.DocumentHistories[docID]
+	if _, dirty := h.DocumentDirty[docID]; !ok || !dirty {
+		return
+	}
+	if !config.DocPersistence {
+		delete(h.DocumentDirty, docID)
+		return
+	}
+	err := UpdateDocument(docID, history.Content)
+	if errors.Is(err, ErrDocumentDeleted) {
+		// Nothing to save the changes to; end the session
+		log.Printf("Document %s was deleted while it was being edited", docID)
+		h.closeDocuments([]string{docID}, DocumentDeleted)
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving document %s: %v", docID, err)
+		return
+	}
+	delete(h.DocumentDirty, docID)
+}
+
+// autosaveDocuments is called by Run every DOC_AUTOSAVE_INTERVAL. It saves
+// the documents with unsaved changes, then drops the sessions nobody has
+// had open for DOC_IDLE_TIMEOUT. Their content is saved first, so that
+// whoever opens the document next loads it from the database.
+func (h *Hub) autosaveDocuments() {
+	for docID := range h.DocumentDirty {
+		h.saveDocument(docID)
+	}
+
+	idleTimeout := time.Duration(config.DocIdleTimeout) * time.Second
+	for docID, lastActivity := range h.DocumentActivity {
+		if len(h.DocumentClients[docID]) > 0 || time.Since(lastActivity) < idleTimeout {
+			continue
+		}
+		if _, dirty := h.DocumentDirty[docID]; dirty {
+			// Saving failed above; keep the content until it succeeds
+			continue
+		}
+		log.Printf("Closing idle session of document %s", docID)
+		delete(h.DocumentHistories, docID)
+		delete(h.DocumentActivity, docID)
+		delete(h.DocumentClients, docID)
+	}
+}
+
+// saveQuietDocuments is called by Run every second. It saves the documents
+// nobody has changed for DOC_AUTOSAVE_QUIET seconds, so that a pause in
+// editing doesn't have to wait for the next DOC_AUTOSAVE_INTERVAL.
+func (h *Hub) saveQuietDocuments(now time.Time) {
+	if config.DocAutosaveQuiet <= 0 {
+		return
+	}
+	quiet := time.Duration(config.DocAutosaveQuiet) * time.Second
+	for docID, changed := range h.DocumentDirty {
+		if now.Sub(changed) >= quiet {
+			h.saveDocument(docID)
+		}
+	}
+}
+
+// SaveAllDocuments saves every document with unsaved changes and returns
+// once they are written. It is safe to call from outside Run.
+func (h *Hub) SaveAllDocuments() {
+	done := make(chan struct{})
+	h.FlushDocuments <- done
+	<-done
+}
+
+// checkAutosave reports intervals that can't work
+func (c *Config) checkAutosave(p *configProblems) {
+	if c.DocAutosaveInterval <= 0 {
+		p.add("DOC_AUTOSAVE_INTERVAL must be positive, got %d", c.DocAutosaveInterval)
+	}
+	if c.DocIdleTimeout < 0 {
+		p.add("DOC_IDLE_TIMEOUT can't be negative, got %d", c.DocIdleTimeout)
+	}
+	if c.DocAutosaveQuiet < 0 {
+		p.add("DOC_AUTOSAVE_QUIET can't be negative, got %d", c.DocAutosaveQuiet)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleSessionIsSavedAndDropped(t *testing.T) {
+	setupTest(t)
+	config.DocIdleTimeout = 60
+	doc := createTestDocument(t, "notes.txt", "alice")
+	busy := createTestDocument(t, "busy.txt", "alice")
+
+	// Without Run, the hub's state can be set up and checked directly
+	hub := NewHub()
+	hub.DocumentHistories[doc.ID] = newDocumentHistory("unsaved work")
+	hub.touchDocument(doc.ID, true)
+	hub.DocumentActivity[doc.ID] = time.Now().Add(-time.Hour)
+	hub.DocumentClients[doc.ID] = map[*Client]bool{}
+	hub.DocumentHistories[busy.ID] = newDocumentHistory("")
+	hub.DocumentActivity[busy.ID] = time.Now().Add(-time.Hour)
+	hub.DocumentClients[busy.ID] = map[*Client]bool{fakeClient("bob", false): true}
+
+	hub.autosaveDocuments()
+	saved, err := GetDocument(doc.ID)
+	if err != nil || saved.Content != "unsaved work" {
+		t.Fatalf("the idle session was dropped with content %+v, %v", saved, err)
+	}
+	if _, ok := hub.DocumentHistories[doc.ID]; ok {
+		t.Error("the idle session is still in memory")
+	}
+	if _, ok := hub.DocumentClients[doc.ID]; ok {
+		t.Error("the idle session still has an entry in DocumentClients")
+	}
+	if _, ok := hub.DocumentHistories[busy.ID]; !ok {
+		t.Error("a session with an editor was dropped")
+	}
+}
+
+func TestReopenAfterIdleCleanup(t *testing.T) {
+	setupTest(t)
+	config.DocAutosaveInterval = 1
+	config.DocIdleTimeout = 1
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+	editDocument(t, hub, alice, bob, doc.ID, "written before leaving")
+	unregister(t, hub, alice)
+	unregister(t, hub, bob)
+
+	eventually(t, "the edit to be saved", func() bool {
+		saved, err := GetDocument(doc.ID)
+		return err == nil && saved.Content == "written before leaving"
+	})
+	// Once the session is gone, the next one starts from the database
+	time.Sleep(2500 * time.Millisecond)
+	if err := UpdateDocument(doc.ID, "changed since"); err != nil {
+		t.Fatal(err)
+	}
+
+	carol := fakeClient("carol", false)
+	register(t, hub, carol)
+	carol.handleDocumentOpen(doc.ID, "", hub)
+	if got := receive(t, carol, DocContent); got.Content != "changed since" {
+		t.Errorf("reopened with %q, want the content from the database", got.Content)
+	}
+}
+
+// storedContent returns the content of a document as stored
+func storedContent(t *testing.T, docID string) string {
+	t.Helper()
+	doc, err := GetDocument(docID)
+	if err != nil || doc == nil {
+		t.Fatalf("GetDocument %s = %v, %v", docID, doc, err)
+	}
+	return doc.Content
+}
+
+func TestQuietDocumentIsFlushed(t *testing.T) {
+	setupTest(t)
+	config.DocAutosaveInterval = 3600
+	config.DocAutosaveQuiet = 1
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "draft"}}
+	receive(t, bob, DocUpdate)
+	if got := storedContent(t, doc.ID); got != "" {
+		t.Errorf("the edit was saved at once as %q, before the quiet period", got)
+	}
+	eventually(t, "the quiet document to be saved", func() bool { return storedContent(t, doc.ID) == "draft" })
+}
+
+func TestLastEditorLeavingFlushes(t *testing.T) {
+	setupTest(t)
+	config.DocAutosaveInterval = 3600
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "draft"}}
+	receive(t, bob, DocUpdate)
+	hub.LeaveDocument <- alice
+	receive(t, bob, UserLeft)
+	if got := storedContent(t, doc.ID); got != "" {
+		t.Errorf("the edit was saved as %q while bob still had the document open", got)
+	}
+
+	hub.LeaveDocument <- bob
+	eventually(t, "the document to be saved when the last editor left", func() bool { return storedContent(t, doc.ID) == "draft" })
+}
+
+func TestShutdownFlushesDocuments(t *testing.T) {
+	setupTest(t)
+	config.DocAutosaveInterval = 3600
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "draft"}}
+	receive(t, bob, DocUpdate)
+	hub.SaveAllDocuments()
+	if got := storedContent(t, doc.ID); got != "draft" {
+		t.Errorf("after SaveAllDocuments the document holds %q", got)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// checkBatch reports a negative WS_BATCH_INTERVAL, or batches that could
+// never hold a message
+func (c *Config) checkBatch(p *configProblems) {
+	if c.WSBatchInterval < 0 {
+		p.add("WS_BATCH_INTERVAL can't be negative, got %d", c.WSBatchInterval)
+	}
+	if c.WSBatchInterval > 0 && c.WSBatchMax < 1 {
+		p.add("WS_BATCH_MAX must be positive, got %d", c.WSBatchMax)
+	}
+}
+
+// outboundBatch holds the messages waiting to be written to a batched
+// client. The first one starts the clock: none waits longer than
+// WS_BATCH_INTERVAL.
+type outboundBatch struct {
+	messages []Msg
+	timer    *time.Timer
+}
+
+// add queues a message and reports whether the batch may wait for more.
+// A full batch must be written right away.
+func (b *outboundBatch) add(message Msg) bool {
+	b.messages = append(b.messages, message)
+	if len(b.messages) >= config.WSBatchMax {
+		return false
+	}
+	if len(b.messages) == 1 {
+		interval := time.Duration(config.WSBatchInterval) * time.Millisecond
+		if b.timer == nil {
+			b.timer = time.NewTimer(interval)
+		} else {
+			b.timer.Reset(interval)
+		}
+	}
+	return true
+}
+
+// due fires when the batch has waited long enough. It never fires while the
+// batch is empty.
+func (b *outboundBatch) due() <-chan time.Time {
+	if len(b.messages) == 0 {
+		return nil
+	}
+	return b.timer.C
+}
+
+// stop releases the batch's timer
+func (b *outboundBatch) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// flushBatch writes the waiting messages in order and empties the batch. A
+// lone message goes out as is, several as one JSON array. It reports whether
+// the connection is still usable, like writeMessage.
+func (c *Client) flushBatch(b *outboundBatch) bool {
+	if len(b.messages) == 0 {
+		return true
+	}
+	b.stop()
+	messages := b.messages
+	b.messages = b.messages[:0]
+
+	if len(messages) == 1 {
+		return c.writeMessage(messages[0])
+	}
+
+	var frame bytes.Buffer
+	frame.WriteByte('[')
+	for _, message := range messages {
+		data, err := json.Marshal(message)
+		if err != nil {
+			log.Printf("Failed to encode %s message for %s, dropping it: %v", message.Type, c.Username, err)
+			continue
+		}
+		if frame.Len() > 1 {
+			frame.WriteByte(',')
+		}
+		frame.Write(data)
+	}
+	if frame.Len() == 1 {
+		return true
+	}
+	frame.WriteByte(']')
+	return c.writeFrame(frame.Bytes())
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readFrame reads one frame from the server and returns the messages in
+// it, one for a plain frame and several for a batch
+func readFrame(t testing.TB, conn *websocket.Conn) ([]Msg, bool) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	if data[0] == '[' {
+		var msgs []Msg
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			t.Fatalf("decoding a batch: %v", err)
+		}
+		return msgs, true
+	}
+	var msg Msg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("decoding a frame: %v", err)
+	}
+	return []Msg{msg}, false
+}
+
+func TestBatchedFramesReassemble(t *testing.T) {
+	setupTest(t)
+	config.WSBatchInterval = 50
+	config.WSBatchMax = 4
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+	batched := dial(t, server, token, url.Values{"batch": {"1"}})
+	plain := dial(t, server, token, nil)
+	plain.expect(Session)
+	for session := false; !session; {
+		msgs, _ := readFrame(t, batched.conn)
+		for _, msg := range msgs {
+			session = session || msg.Type == Session
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: fmt.Sprintf("m%d", i)}
+	}
+
+	// The batched connection gets them in order, several to a frame but no
+	// more than WS_BATCH_MAX
+	var got []string
+	batches := 0
+	for len(got) < 10 {
+		msgs, batch := readFrame(t, batched.conn)
+		if batch {
+			batches++
+			if len(msgs) < 2 || len(msgs) > 4 {
+				t.Errorf("a batch holds %d messages", len(msgs))
+			}
+		}
+		for _, msg := range msgs {
+			if msg.Type == PublicMessage {
+				got = append(got, msg.Content)
+			}
+		}
+	}
+	if strings.Join(got, ",") != "m0,m1,m2,m3,m4,m5,m6,m7,m8,m9" {
+		t.Errorf("the messages came as %v", got)
+	}
+	if batches == 0 {
+		t.Error("no frame held more than one message")
+	}
+
+	// The other connection didn't ask for batches and gets none
+	for i := 0; i < 10; {
+		msgs, batch := readFrame(t, plain.conn)
+		if batch {
+			t.Fatal("a connection that didn't ask for batches got one")
+		}
+		if msgs[0].Type == PublicMessage {
+			i++
+		}
+	}
+
+	// A lone message goes out as is, after at most WS_BATCH_INTERVAL
+	sent := time.Now()
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: "alone"}
+	msgs, batch := readFrame(t, batched.conn)
+	if batch || msgs[0].Content != "alone" {
+		t.Errorf("the lone message came as %+v in a batch: %v", msgs, batch)
+	}
+	if waited := time.Since(sent); waited > time.Second {
+		t.Errorf("the lone message waited %v", waited)
+	}
+}
+
+// countingListener counts the writes to the connections it accepts
+type countingListener struct {
+	net.Listener
+	writes *atomic.Int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	return countingConn{Conn: conn, writes: l.writes}, err
+}
+
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// BenchmarkBatchedWrites compares how many writes to the socket a burst of
+// messages takes with and without batching
+func BenchmarkBatchedWrites(b *testing.B) {
+	saved := config
+	b.Cleanup(func() { config = saved })
+	config = DefaultConfig()
+	config.WSBatchInterval = 5
+
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%v", batched), func(b *testing.B) {
+			var writes atomic.Int64
+			clients := make(chan *Client, 1)
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					b.Errorf("upgrade: %v", err)
+					return
+				}
+				client := &Client{
+					Username: "alice",
+					Conn:     conn,
+					Send:     make(chan Msg, 256),
+					Closing:  make(chan *closeFrame, 1),
+					Reauth:   make(chan time.Time, 1),
+					Batched:  batched,
+				}
+				go client.writeMessages()
+				clients <- client
+			}))
+			server.Listener = countingListener{Listener: server.Listener, writes: &writes}
+			server.Start()
+			defer server.Close()
+
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			client := <-clients
+			defer close(client.Send)
+
+			received := make(chan struct{})
+			go func() {
+				defer close(received)
+				for count := 0; count < b.N; {
+					_, data, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					var batch []json.RawMessage
+					if json.Unmarshal(data, &batch) == nil {
+						count += len(batch)
+					} else {
+						count++
+					}
+				}
+			}()
+
+			msg := Msg{Type: PublicMessage, Username: "bob", Content: "see you at the standup", Time: time.Now()}
+			writes.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.Send <- msg
+			}
+			<-received
+			b.StopTimer()
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/msg")
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Actions of a DocBulk request
+const (
+	BulkDelete  = "delete"
+	BulkArchive = "archive" // Hide the documents from document lists, keeping them
+)
+
+// Outcomes of a bulk action on one document
+const (
+	BulkSuccess   = "success"
+	BulkForbidden = "forbidden"
+	BulkNotFound  = "not-found"
+)
+
+// maxBulkDocuments is the most documents one bulk request may name
+const maxBulkDocuments = 100
+
+// DocumentResult is the outcome of a bulk action on one document
+type DocumentResult struct {
+	DocumentID string `json:"documentID"`
+	Status     string `json:"status"`
+}
+
+// BulkRequest is the body of POST /documents/bulk
+type BulkRequest struct {
+	Action      string   `json:"action"`
+	DocumentIDs []string `json:"documentIDs"`
+}
+
+// BulkResponse answers POST /documents/bulk
+type BulkResponse struct {
+	Success bool             `json:"success"`
+	Message string           `json:"message,omitempty"`
+	Results []DocumentResult `json:"results,omitempty"`
+}
+
+// BulkUpdateDocuments deletes or archives documents in one transaction. Only
+// their creators and admins may do so; other documents are left alone and
+// reported as forbidden. Nothing is changed when an error is returned.
+func BulkUpdateDocuments(action string, docIDs []string, username, role string) ([]DocumentResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]DocumentResult, 0, len(docIDs))
+	done := make(map[string]bool)
+	for _, docID := range docIDs {
+		if done[docID] {
+			continue
+		}
+		done[docID] = true
+
+		var createdBy string
+		err := tx.QueryRow(`SELECT created_by FROM documents WHERE id = ?`, docID).Scan(&createdBy)
+		if err == sql.ErrNoRows {
+			results = append(results, DocumentResult{DocumentID: docID, Status: BulkNotFound})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if createdBy != username && role != RoleAdmin {
+			results = append(results, DocumentResult{DocumentID: docID, Status: BulkForbidden})
+			continue
+		}
+
+		if action == BulkDelete {
+			err = deleteDocument(tx, docID)
+		} else {
+			_, err = tx.Exec(`UPDATE documents SET archived_at = ? WHERE id = ?`, time.Now(), docID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, DocumentResult{DocumentID: docID, Status: BulkSuccess})
+	}
+
+	return results, tx.Commit()
+}
+
+// bulkDocuments checks and runs a bulk action for a user, closes the editing
+// sessions of deleted documents and has document lists refreshed once
+func bulkDocuments(hub *Hub, username, role, action string, docIDs []string) ([]DocumentResult, error) {
+	if action != BulkDelete && action != BulkArchive {
+		return nil, fmt.Errorf("unknown action '%s', expected %s or %s", action, BulkDelete, BulkArchive)
+	}
+	if len(docIDs) == 0 || len(docIDs) > maxBulkDocuments {
+		return nil, fmt.Errorf("between 1 and %d documents must be given", maxBulkDocuments)
+	}
+
+	results, err := BulkUpdateDocuments(action, docIDs, username, role)
+	if err != nil {
+		log.Printf("Error running bulk %s for %s: %v", action, username, err)
+		return nil, fmt.Errorf("failed to %s documents", action)
+	}
+
+	var changed []string
+	for _, result := range results {
+		if result.Status == BulkSuccess {
+			changed = append(changed, result.DocumentID)
+		}
+	}
+	if len(changed) == 0 {
+		return results, nil
+	}
+
+	log.Printf("%s ran bulk %s on %d documents", username, action, len(changed))
+	if action == BulkDelete {
+		hub.DocumentsRemoved <- documentRemoval{DocumentIDs: changed, Reason: DocumentDeleted}
+	} else {
+		hub.DocumentsRemoved <- documentRemoval{DocumentIDs: changed, Reason: DocumentArchived}
+	}
+	hub.DocumentLists <- struct{}{}
+	return results, nil
+}
+
+// HandleDocumentsBulk deletes or archives several documents at once for the
+// user whose token is in the Authorization header
+func HandleDocumentsBulk(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		claims, err := ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(BulkResponse{Message: "Invalid or expired token"})
+			return
+		}
+		guest := claims.Role == RoleGuest
+		if guest && (!config.GuestAccess || !guestCan(GuestEdit)) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(BulkResponse{Message: "Guests are not allowed to do this, please register"})
+			return
+		}
+
+		var req BulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BulkResponse{Message: "Invalid request body"})
+			return
+		}
+
+		results, err := bulkDocuments(hub, claims.Username, roleOf(claims.Username, guest), req.Action, req.DocumentIDs)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(BulkResponse{Message: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(BulkResponse{Success: true, Results: results})
+	}
+}
+
+// Why the sessions of documents end before their editors close them
+const (
+	DocumentDeleted  = "deleted"
+	DocumentArchived = "archived"
+)
+
+// documentRemoval tells the hub that documents were deleted or archived
+type documentRemoval struct {
+	DocumentIDs []string
+	Reason      string // DocumentDeleted or DocumentArchived
+}
+
+// removeDocuments ends the editing sessions of documents that were deleted
+// or archived. Changes not saved yet are kept with archived documents.
+func (h *Hub) removeDocuments(removal documentRemoval) {
+	if removal.Reason == DocumentArchived {
+		for _, docID := range removal.DocumentIDs {
+			h.saveDocument(docID)
+		}
+	}
+	h.closeDocuments(removal.DocumentIDs, removal.Reason)
+}
+
+// closeDocuments ends the editing sessions of documents, telling their
+// editors why: the reason is DocumentDeleted or DocumentArchived
+func (h *Hub) closeDocuments(docIDs []string, reason string) {
+	for _, docID := range docIDs {
+		closeMsg := Msg{Type: DocClose, DocumentID: docID, Content: "This document was " + reason, Time: time.Now()}
+		for client := range h.DocumentClients[docID] {
+			client.CurrentDocumentID = ""
+			client.ReadOnly = false
+			select {
+			case client.Send <- closeMsg:
+			default:
+				log.Printf("Failed to send document close to %s", client.Username)
+			}
+		}
+		delete(h.DocumentClients, docID)
+		delete(h.DocumentHistories, docID)
+		delete(h.DocumentDirty, docID)
+		delete(h.DocumentActivity, docID)
+	}
+}
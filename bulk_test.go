@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// bulkRequest sends POST /documents/bulk and decodes the answer
+func bulkRequest(t *testing.T, hub *Hub, token string, req BulkRequest) (int, BulkResponse) {
+	t.Helper()
+	w := callHandler(t, HandleDocumentsBulk(hub), "POST", "/documents/bulk", token, req)
+	var resp BulkResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the bulk response: %v", err)
+	}
+	return w.Code, resp
+}
+
+func TestBulkDeleteWithMixedPermissions(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	token := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	mine := createTestDocument(t, "mine.txt", "alice")
+	alsoMine := createTestDocument(t, "also-mine.txt", "alice")
+	bobs := createTestDocument(t, "bobs.txt", "bob")
+	editor := openTestDocument(t, hub, "bob", mine.ID)
+	watcher := fakeClient("carol", true)
+	register(t, hub, watcher)
+	drain(watcher)
+
+	code, resp := bulkRequest(t, hub, token, BulkRequest{
+		Action:      BulkDelete,
+		DocumentIDs: []string{mine.ID, bobs.ID, "no-such-doc", alsoMine.ID, mine.ID},
+	})
+	want := []DocumentResult{
+		{DocumentID: mine.ID, Status: BulkSuccess},
+		{DocumentID: bobs.ID, Status: BulkForbidden},
+		{DocumentID: "no-such-doc", Status: BulkNotFound},
+		{DocumentID: alsoMine.ID, Status: BulkSuccess},
+	}
+	if code != http.StatusOK || !resp.Success || !reflect.DeepEqual(resp.Results, want) {
+		t.Fatalf("bulk delete = %d %+v, want results %+v", code, resp, want)
+	}
+
+	for _, id := range []string{mine.ID, alsoMine.ID} {
+		if doc, err := GetDocument(id); doc != nil || err != nil {
+			t.Errorf("document %s after the bulk delete: %+v, %v", id, doc, err)
+		}
+	}
+	if doc, err := GetDocument(bobs.ID); doc == nil || err != nil {
+		t.Errorf("bob's document is gone: %v", err)
+	}
+	if msg := receive(t, editor, DocClose); msg.DocumentID != mine.ID {
+		t.Errorf("the editor of a deleted document got %+v", msg)
+	}
+
+	lists := 0
+	for _, msg := range drain(watcher) {
+		if msg.Type == DocList {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("document lists were refreshed %d times, want once", lists)
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE type = ?`, DocList).Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("%d document list refreshes were stored as messages, %v", stored, err)
+	}
+}
+
+func TestBulkArchiveByAdmin(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	token := createTestUser(t, "root")
+	createTestUser(t, "bob")
+	bobs := createTestDocument(t, "bobs.txt", "bob")
+
+	code, resp := bulkRequest(t, hub, token, BulkRequest{Action: BulkArchive, DocumentIDs: []string{bobs.ID}})
+	if code != http.StatusOK || len(resp.Results) != 1 || resp.Results[0].Status != BulkSuccess {
+		t.Fatalf("an admin archiving bob's document = %d %+v", code, resp)
+	}
+	archived, err := GetDocumentSummariesByCreator("bob", true, DocumentSort{Field: DocSortUpdated, Order: SortDescending}, 10, 0)
+	if err != nil || len(archived.Documents) != 1 || archived.Documents[0].ID != bobs.ID {
+		t.Errorf("after archiving, bob's archived documents are %+v, %v", archived, err)
+	}
+}
+
+func TestInvalidBulkRequests(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	token := createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	tooMany := make([]string, maxBulkDocuments+1)
+	for i := range tooMany {
+		tooMany[i] = doc.ID
+	}
+
+	for _, req := range []BulkRequest{
+		{Action: "shred", DocumentIDs: []string{doc.ID}},
+		{Action: BulkDelete},
+		{Action: BulkDelete, DocumentIDs: tooMany},
+	} {
+		if code, resp := bulkRequest(t, hub, token, req); code != http.StatusBadRequest || resp.Success {
+			t.Errorf("bulk %s of %d documents = %d %+v, want 400", req.Action, len(req.DocumentIDs), code, resp)
+		}
+	}
+	if code, _ := bulkRequest(t, hub, "", BulkRequest{Action: BulkDelete, DocumentIDs: []string{doc.ID}}); code != http.StatusUnauthorized {
+		t.Errorf("a bulk request without a token = %d, want 401", code)
+	}
+	if doc, err := GetDocument(doc.ID); doc == nil || err != nil {
+		t.Errorf("a refused request deleted the document: %v", err)
+	}
+}
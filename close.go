@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseKicked is the WebSocket close code sent when an admin drops a
+// connection; clients should not reconnect on their own
+const CloseKicked = 4003
+
+// Reasons given in reconnect hints
+const (
+	HintShutdown   = "shutdown"   // The server is stopping or restarting
+	HintOverloaded = "overloaded" // The connection fell behind the messages sent to it
+)
+
+// How long clients are asked to wait before reconnecting, in seconds
+const (
+	shutdownRetryAfter   = 5
+	overloadedRetryAfter = 10
+)
+
+// reconnectHint tells a client whose connection was closed for a passing
+// reason when to come back. It is sent as JSON in the reason of the close
+// frame. Closures that reconnecting can't fix, like an expired token or an
+// admin's kick, carry a plain text reason instead, so clients can tell the
+// two apart by whether the reason parses.
+type reconnectHint struct {
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retryAfter"` // Seconds to wait before reconnecting
+}
+
+// closeFrame is the close message a connection ends with
+type closeFrame struct {
+	Code int
+	Text string
+}
+
+// recoverableClose builds a close frame carrying a reconnect hint
+func recoverableClose(code int, reason string, retryAfter int) *closeFrame {
+	hint, err := json.Marshal(reconnectHint{Reason: reason, RetryAfter: retryAfter})
+	if err != nil {
+		log.Printf("Failed to encode reconnect hint: %v", err)
+	}
+	return &closeFrame{Code: code, Text: string(hint)}
+}
+
+// permanentClose builds a close frame without a reconnect hint
+func permanentClose(code int, text string) *closeFrame {
+	return &closeFrame{Code: code, Text: text}
+}
+
+// closeGracePeriod is how long a connection waits for the client to answer
+// its close frame before it is dropped
+const closeGracePeriod = 2 * time.Second
+
+// requestClose asks the client's writeMessages to write what is queued for
+// it, then the close frame, and close the connection. It reports whether
+// this is the first close asked for. Nothing the client sends from then on
+// is handled. The client stays in the hub until readMessages sees the
+// connection close and unregisters it: Send is only closed then, as
+// readMessages may still be sending on it.
+func (c *Client) requestClose(frame *closeFrame) bool {
+	c.closing.Store(true)
+	select {
+	case c.Closing <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitClose is called by writeMessages once it wrote a close frame. It
+// gives the client up to closeGracePeriod to answer before the connection
+// is dropped: dropping it while the client is still sending would reset it,
+// and the client could lose the close frame. readMessages ends with the
+// answer or the deadline and unregisters the client; until Run then closes
+// Send, what is queued for the client is dropped.
+func (c *Client) awaitClose() {
+	c.closing.Store(true)
+	c.Conn.SetReadDeadline(time.Now().Add(closeGracePeriod))
+	for range c.Send {
+	}
+}
+
+// writeClose sends a close frame within WS_WRITE_TIMEOUT. Like all control
+// frames it may be written while another goroutine writes messages. A nil
+// frame sends an empty close.
+func (c *Client) writeClose(frame *closeFrame) {
+	data := []byte{}
+	if frame != nil {
+		data = websocket.FormatCloseMessage(frame.Code, frame.Text)
+	}
+	c.Conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(time.Duration(config.WSWriteTimeout)*time.Second))
+}
+
+// closeAll tells every client the server is shutting down and when to
+// reconnect. The close frames are written directly, since the hub is about
+// to stop and queued messages won't go out anyway.
+func (h *Hub) closeAll() int {
+	frame := recoverableClose(websocket.CloseGoingAway, HintShutdown, shutdownRetryAfter)
+	var wg sync.WaitGroup
+	for client := range h.Clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.writeClose(frame)
+		}()
+	}
+	wg.Wait()
+	return len(h.Clients)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// parseHint returns the reconnect hint in a close reason, if there is one
+func parseHint(text string) (reconnectHint, bool) {
+	var hint reconnectHint
+	err := json.Unmarshal([]byte(text), &hint)
+	return hint, err == nil
+}
+
+func TestRecoverableClosuresCarryHints(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	eventually(t, "alice to connect", func() bool { return len(hub.ConnectedClients()) == 1 })
+
+	hub.CloseConnections()
+	closeErr, _ := conn.expectClose()
+	hint, ok := parseHint(closeErr.Text)
+	if closeErr.Code != websocket.CloseGoingAway || !ok || hint != (reconnectHint{Reason: HintShutdown, RetryAfter: shutdownRetryAfter}) {
+		t.Errorf("shutdown closed with %d %q", closeErr.Code, closeErr.Text)
+	}
+}
+
+func TestOverloadedClientGetsRetryHint(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	// Nothing reads what is sent to this client
+	slow := fakeClient("alice", true)
+	register(t, hub, slow)
+	for i := 0; i <= cap(slow.Send); i++ {
+		hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: "flood"}
+	}
+
+	var frame *closeFrame
+	eventually(t, "the slow client to be closed", func() bool {
+		select {
+		case frame = <-slow.Closing:
+			return true
+		default:
+			return false
+		}
+	})
+	hint, ok := parseHint(frame.Text)
+	if frame.Code != websocket.CloseTryAgainLater || !ok || hint != (reconnectHint{Reason: HintOverloaded, RetryAfter: overloadedRetryAfter}) {
+		t.Errorf("the slow client was closed with %d %q", frame.Code, frame.Text)
+	}
+	unregister(t, hub, slow)
+}
+
+// A reply to a client that can't take it closes the client as overloaded
+// rather than blocking its reader
+func TestReplyToFullClientClosesIt(t *testing.T) {
+	setupTest(t)
+	slow := fakeClient("alice", true)
+	for i := 0; i < cap(slow.Send); i++ {
+		slow.Send <- Msg{Type: PublicMessage, Content: "unread"}
+	}
+
+	slow.sendError("one too many")
+	slow.sendError("and another")
+	select {
+	case frame := <-slow.Closing:
+		if hint, ok := parseHint(frame.Text); frame.Code != websocket.CloseTryAgainLater || !ok || hint.Reason != HintOverloaded {
+			t.Errorf("the full client was closed with %d %q", frame.Code, frame.Text)
+		}
+	default:
+		t.Fatal("the full client wasn't closed")
+	}
+	if len(slow.Send) != cap(slow.Send) {
+		t.Errorf("%d messages queued, want the replies dropped", len(slow.Send))
+	}
+}
+
+func TestPermanentClosuresHaveNoHint(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	kicked := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	eventually(t, "alice to connect", func() bool { return len(hub.ConnectedClients()) == 1 })
+
+	hub.DisconnectClients("alice")
+	closeErr, _ := kicked.expectClose()
+	if closeErr.Code != CloseKicked || closeErr.Text != "disconnected by an admin" {
+		t.Errorf("closed with %d %q, want %d %q", closeErr.Code, closeErr.Text, CloseKicked, "disconnected by an admin")
+	}
+	if _, ok := parseHint(closeErr.Text); ok {
+		t.Errorf("the permanent closure %d carries a reconnect hint", closeErr.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"time"
+)
+
+// maxCommentLength is the longest document comment accepted, in characters
+const maxCommentLength = 2000
+
+// DocumentComment is a message in a document's discussion, optionally
+// anchored to a line of the document (Line 0 means no anchor)
+type DocumentComment struct {
+	ID         int64     `json:"id"`
+	DocumentID string    `json:"documentID"`
+	Username   string    `json:"username"`
+	Content    string    `json:"content"`
+	Line       int       `json:"line,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// InitCommentTables creates the document_comments table
+func InitCommentTables() error {
+	createCommentsTable := `
+	CREATE TABLE IF NOT EXISTS document_comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		content TEXT NOT NULL,
+		line INTEGER NOT NULL DEFAULT 0,
+		timestamp DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_document_comments_document ON document_comments(document_id, id);`
+
+	_, err := db.Exec(createCommentsTable)
+	return err
+}
+
+// AddDocumentComment stores a comment on a document
+func AddDocumentComment(docID, username, content string, line int) (*DocumentComment, error) {
+	comment := &DocumentComment{
+		DocumentID: docID,
+		Username:   username,
+		Content:    content,
+		Line:       line,
+		Time:       time.Now(),
+	}
+
+	query := `INSERT INTO document_comments (document_id, username, content, line, timestamp) VALUES (?, ?, ?, ?, ?)`
+	result, err := db.Exec(query, docID, username, content, line, comment.Time)
+	if err != nil {
+		return nil, err
+	}
+	comment.ID, err = result.LastInsertId()
+	return comment, err
+}
+
+// GetDocumentComments returns the comments on a document, oldest first
+func GetDocumentComments(docID string) ([]DocumentComment, error) {
+	query := `
+		SELECT id, document_id, username, content, line, timestamp
+		FROM document_comments
+		WHERE document_id = ?
+		ORDER BY id
+	`
+
+	rows, err := db.Query(query, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []DocumentComment{}
+	for rows.Next() {
+		var comment DocumentComment
+		err := rows.Scan(&comment.ID, &comment.DocumentID, &comment.Username, &comment.Content, &comment.Line, &comment.Time)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+// commentOn posts a comment from a client through the hub
+func commentOn(hub *Hub, client *Client, docID, content string, line int) {
+	hub.DocumentComment <- documentEdit{Client: client, Msg: Msg{Type: DocComment, DocumentID: docID, Username: client.Username, Content: content, Line: line}}
+}
+
+func TestDocumentComments(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	plan := createTestDocument(t, "plan.txt", "alice")
+	notes := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", plan.ID)
+	bob := openTestDocument(t, hub, "bob", plan.ID)
+	carol := openTestDocument(t, hub, "carol", notes.ID)
+	if got := receive(t, alice, DocComments); len(got.Comments) != 0 {
+		t.Errorf("a new document came with comments %+v", got.Comments)
+	}
+
+	commentOn(hub, alice, plan.ID, "step 3 needs a date", 3)
+	got := receive(t, bob, DocComment)
+	if got.Comment == nil || got.Comment.Content != "step 3 needs a date" || got.Comment.Line != 3 || got.Comment.Username != "alice" {
+		t.Errorf("bob got the comment %+v", got.Comment)
+	}
+	receive(t, alice, DocComment)
+	for _, msg := range drain(carol) {
+		if msg.Type == DocComment {
+			t.Errorf("carol got a comment on another document: %+v", msg.Comment)
+		}
+	}
+
+	// Comments only go to the document the client has open
+	commentOn(hub, alice, notes.ID, "sneaky", 0)
+	if got := receive(t, alice, ErrorMessage); got.Content != "Open the document to comment on it" {
+		t.Errorf("commenting on a document not open was answered with %q", got.Content)
+	}
+
+	// Whoever opens the document later gets the discussion so far
+	dave := fakeClient("dave", false)
+	register(t, hub, dave)
+	dave.handleDocumentOpen(plan.ID, "", hub)
+	got = receive(t, dave, DocComments)
+	if len(got.Comments) != 1 || got.Comments[0].Content != "step 3 needs a date" {
+		t.Errorf("dave opened the document with comments %+v", got.Comments)
+	}
+
+	if comments, err := GetDocumentComments(notes.ID); err != nil || len(comments) != 0 {
+		t.Errorf("notes.txt has comments %+v, %v", comments, err)
+	}
+}
+
+func TestInvalidCommentsAreRefused(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	conn := dial(t, server, createTestUser(t, "alice"), nil)
+	doc := createTestDocument(t, "plan.txt", "alice")
+	conn.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	conn.expect(DocComments)
+
+	for _, msg := range []Msg{
+		{Type: DocComment, DocumentID: doc.ID, Content: "   "},
+		{Type: DocComment, DocumentID: doc.ID, Content: "hi", Line: -1},
+	} {
+		conn.send(msg)
+		if got := conn.expect(ErrorMessage); got.Content != "Comments must have between 1 and 2000 characters" {
+			t.Errorf("comment %+v was answered with %q", msg, got.Content)
+		}
+	}
+	if comments, err := GetDocumentComments(doc.ID); err != nil || len(comments) != 0 {
+		t.Errorf("invalid comments were stored: %+v, %v", comments, err)
+	}
+}
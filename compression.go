@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Encodings of document content at rest, recorded per row in
+// documents.content_encoding so that rows written under a different
+// DOC_COMPRESSION still read correctly
+const (
+	ContentPlain = ""     // Stored as text
+	ContentGzip  = "gzip" // Stored as a gzip-compressed blob
+)
+
+// checkCompression reports an unknown DOC_COMPRESSION or a negative
+// WS_COMPRESSION_THRESHOLD
+func (c *Config) checkCompression(p *configProblems) {
+	if c.DocCompression != "none" && c.DocCompression != ContentGzip {
+		p.add("DOC_COMPRESSION must be none or gzip, got %q", c.DocCompression)
+	}
+	if c.WSCompressionThreshold < 0 {
+		p.add("WS_COMPRESSION_THRESHOLD can't be negative, got %d", c.WSCompressionThreshold)
+	}
+}
+
+// encodeDocumentContent prepares document content for storage according to
+// DOC_COMPRESSION, returning the value to store and its encoding
+func encodeDocumentContent(content string) (any, string, error) {
+	if config.DocCompression != ContentGzip || content == "" {
+		return content, ContentPlain, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ContentGzip, nil
+}
+
+// decodeDocumentContent turns stored document content back into text
+func decodeDocumentContent(data []byte, encoding string) (string, error) {
+	switch encoding {
+	case ContentPlain:
+		return string(data), nil
+	case ContentGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	}
+	return "", fmt.Errorf("unknown content encoding %q", encoding)
+}
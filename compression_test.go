@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialCompressed connects to a test server offering permessage-deflate, and
+// reports whether the server accepted it
+func dialCompressed(t *testing.T, server, token string) (*testConn, bool) {
+	t.Helper()
+	dialer := websocket.Dialer{EnableCompression: true}
+	u := "ws" + strings.TrimPrefix(server, "http") + "/ws?" + url.Values{"token": {token}}.Encode()
+	conn, resp, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", u, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	return &testConn{t: t, conn: conn}, negotiated
+}
+
+func TestCompressionNegotiationIsCounted(t *testing.T) {
+	setupTest(t)
+	saved := upgrader.EnableCompression
+	upgrader.EnableCompression = true
+	t.Cleanup(func() { upgrader.EnableCompression = saved })
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	compressed, negotiated := dialCompressed(t, server.URL, token)
+	if !negotiated {
+		t.Fatal("the server didn't negotiate compression")
+	}
+	dial(t, server, token, nil)
+	eventually(t, "both connections to register", func() bool {
+		return hub.LoadStatus().Connections.Total == 2
+	})
+
+	connections := hub.LoadStatus().Connections
+	if connections != (ConnectionStats{Total: 2, Compressed: 1}) {
+		t.Errorf("connections = %+v, want 2 with 1 compressed", connections)
+	}
+
+	compressed.conn.Close()
+	eventually(t, "the compressed connection to go", func() bool {
+		return hub.LoadStatus().Connections == ConnectionStats{Total: 1}
+	})
+}
+
+func TestCompressionOffTurnsDownOffers(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+
+	_, negotiated := dialCompressed(t, server.URL, createTestUser(t, "alice"))
+	if negotiated {
+		t.Error("compression was negotiated with WS_COMPRESSION off")
+	}
+	eventually(t, "the connection to register", func() bool {
+		return hub.LoadStatus().Connections.Total == 1
+	})
+	if compressed := hub.LoadStatus().Connections.Compressed; compressed != 0 {
+		t.Errorf("%d connections are counted as compressed", compressed)
+	}
+}
+
+// storedEncoding returns the encoding and size of a document's stored content
+func storedEncoding(t *testing.T, docID string) (string, int) {
+	t.Helper()
+	var encoding string
+	var size int
+	if err := db.QueryRow(`SELECT content_encoding, LENGTH(CAST(content AS BLOB)) FROM documents WHERE id = ?`, docID).Scan(&encoding, &size); err != nil {
+		t.Fatal(err)
+	}
+	return encoding, size
+}
+
+func TestDocumentCompressionRoundTrip(t *testing.T) {
+	setupTest(t)
+	content := strings.Repeat("the same line over and over\n", 200)
+	plain := createTestDocument(t, "plain.txt", "alice")
+	if err := UpdateDocument(plain.ID, content); err != nil {
+		t.Fatal(err)
+	}
+
+	config.DocCompression = ContentGzip
+	packed := createTestDocument(t, "packed.txt", "alice")
+	if err := UpdateDocument(packed.ID, content); err != nil {
+		t.Fatal(err)
+	}
+	if encoding, size := storedEncoding(t, packed.ID); encoding != ContentGzip || size >= len(content) {
+		t.Errorf("stored as %q in %d bytes, want gzip smaller than %d", encoding, size, len(content))
+	}
+	if encoding, _ := storedEncoding(t, plain.ID); encoding != ContentPlain {
+		t.Errorf("the row written before compression was turned on is %q", encoding)
+	}
+
+	// Both read back the same, whatever DOC_COMPRESSION is now
+	for _, compression := range []string{ContentGzip, "none"} {
+		config.DocCompression = compression
+		for _, doc := range []*Document{plain, packed} {
+			if stored, err := GetDocument(doc.ID); err != nil || stored.Content != content {
+				t.Errorf("with DOC_COMPRESSION %s, %s read back %d bytes, %v", compression, doc.Name, len(stored.Content), err)
+			}
+		}
+	}
+
+	// Rewritten with compression off, the row is plain again
+	if err := UpdateDocument(packed.ID, "short"); err != nil {
+		t.Fatal(err)
+	}
+	if encoding, _ := storedEncoding(t, packed.ID); encoding != ContentPlain {
+		t.Errorf("rewritten with compression off, the row is %q", encoding)
+	}
+	if stored, _ := GetDocument(packed.ID); stored.Content != "short" {
+		t.Errorf("read back %q", stored.Content)
+	}
+}
+
+func TestDecodeDocumentContent(t *testing.T) {
+	setupTest(t)
+	config.DocCompression = ContentGzip
+	if value, encoding, _ := encodeDocumentContent(""); value != "" || encoding != ContentPlain {
+		t.Errorf("empty content was encoded as %q", encoding)
+	}
+	value, encoding, err := encodeDocumentContent("hello")
+	if err != nil || encoding != ContentGzip {
+		t.Fatalf("encodeDocumentContent = %q, %v", encoding, err)
+	}
+	if got, err := decodeDocumentContent(value.([]byte), encoding); err != nil || got != "hello" {
+		t.Errorf("decoded %q, %v", got, err)
+	}
+	if _, err := decodeDocumentContent([]byte("not gzip"), ContentGzip); err == nil {
+		t.Error("decoding a corrupt blob succeeded")
+	}
+	if _, err := decodeDocumentContent([]byte("x"), "zstd"); err == nil {
+		t.Error("decoding an unknown encoding succeeded")
+	}
+}
+
+// frameRecorder keeps the bytes read from a connection once recording
+type frameRecorder struct {
+	net.Conn
+	recording bool
+	data      []byte
+}
+
+func (r *frameRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	if r.recording {
+		r.data = append(r.data, p[:n]...)
+	}
+	return n, err
+}
+
+// compressedFlags tells, for each unmasked frame in data, whether its RSV1
+// bit marks it as deflated
+func compressedFlags(data []byte) []bool {
+	var flags []bool
+	for len(data) >= 2 {
+		flags = append(flags, data[0]&0x40 != 0)
+		length, header := int(data[1]&0x7f), 2
+		switch length {
+		case 126:
+			length, header = int(binary.BigEndian.Uint16(data[2:])), 4
+		case 127:
+			length, header = int(binary.BigEndian.Uint64(data[2:])), 10
+		}
+		data = data[min(header+length, len(data)):]
+	}
+	return flags
+}
+
+// compressedPair connects a client to a server connection on which
+// permessage-deflate was negotiated, and returns the server side as a
+// Client along with the client side, whose reads are recorded
+func compressedPair(tb testing.TB) (*Client, *websocket.Conn, *frameRecorder) {
+	tb.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := websocket.Upgrader{EnableCompression: true}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Errorf("upgrade: %v", err)
+			return
+		}
+		serverConns <- conn
+	}))
+	tb.Cleanup(server.Close)
+
+	var recorder *frameRecorder
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			recorder = &frameRecorder{Conn: conn}
+			return recorder, err
+		},
+	}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		tb.Fatal("compression wasn't negotiated")
+	}
+	serverConn := <-serverConns
+	tb.Cleanup(func() { serverConn.Close() })
+	recorder.recording = true
+	return &Client{Username: "alice", Conn: serverConn, Compressed: true}, conn, recorder
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	setupTest(t)
+	config.WSCompressionThreshold = 512
+	client, conn, recorder := compressedPair(t)
+
+	small := Msg{Type: UserJoined, Username: "bob"}
+	large := Msg{Type: DocContent, Content: strings.Repeat("func main() {}\n", 200)}
+	for _, msg := range []Msg{small, large, small} {
+		if !client.writeMessage(msg) {
+			t.Fatalf("writing %s failed", msg.Type)
+		}
+		var got Msg
+		if err := conn.ReadJSON(&got); err != nil || got.Type != msg.Type || got.Content != msg.Content {
+			t.Fatalf("read %s, %v", got.Type, err)
+		}
+	}
+	if flags := compressedFlags(recorder.data); len(flags) != 3 || flags[0] || !flags[1] || flags[2] {
+		t.Errorf("frames were compressed %v, want only the large one", flags)
+	}
+
+	// Without a threshold, everything is deflated
+	config.WSCompressionThreshold = 0
+	recorder.data = nil
+	client.writeMessage(small)
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if flags := compressedFlags(recorder.data); len(flags) != 1 || !flags[0] {
+		t.Errorf("frames were compressed %v with no threshold", flags)
+	}
+}
+
+// BenchmarkCompressionThreshold compares the cost of writing the small
+// messages that make up most traffic, and large document content, with
+// every message deflated and with the default threshold
+func BenchmarkCompressionThreshold(b *testing.B) {
+	saved := config
+	b.Cleanup(func() { config = saved })
+	config = DefaultConfig()
+
+	messages := map[string]Msg{
+		"small": {Type: PublicMessage, Username: "alice", Content: "see you at the standup", Time: time.Now()},
+		"large": {Type: DocContent, Content: strings.Repeat("func main() {}\n", 200)},
+	}
+	for _, threshold := range []int{0, config.WSCompressionThreshold} {
+		for _, size := range []string{"small", "large"} {
+			b.Run(fmt.Sprintf("threshold=%d/%s", threshold, size), func(b *testing.B) {
+				config.WSCompressionThreshold = threshold
+				client, conn, recorder := compressedPair(b)
+				recorder.recording = false
+				go func() {
+					for {
+						if _, _, err := conn.NextReader(); err != nil {
+							return
+						}
+					}
+				}()
+				data, _ := json.Marshal(messages[size])
+				b.SetBytes(int64(len(data)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !client.writeMessage(messages[size]) {
+						b.Fatal("write failed")
+					}
+				}
+			})
+		}
+	}
+}
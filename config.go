@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config holds the server settings. Each one is read from the environment
+// variable named by its env tag, or from the file named by CONFIG_FILE, and
+// keeps the value DefaultConfig gives it when neither sets it.
+type Config struct {
+	// LISTEN_ADDR is the address the server listens on
+	ListenAddr string `env:"LISTEN_ADDR"`
+
+	// TLS_CERT_FILE and TLS_KEY_FILE enable HTTPS with the given certificate.
+	// Alternatively AUTOCERT_DOMAINS lists comma-separated domains to obtain
+	// certificates for from Let's Encrypt, cached in AUTOCERT_CACHE_DIR.
+	TLSCertFile      string   `env:"TLS_CERT_FILE"`
+	TLSKeyFile       string   `env:"TLS_KEY_FILE"`
+	AutocertDomains  []string `env:"AUTOCERT_DOMAINS"`
+	AutocertCacheDir string   `env:"AUTOCERT_CACHE_DIR"`
+
+	// HTTP_REDIRECT_ADDR, when TLS is on, is an extra plain HTTP address (e.g.
+	// ":80") that redirects to HTTPS
+	HTTPRedirectAddr string `env:"HTTP_REDIRECT_ADDR"`
+
+	// WS_COMPRESSION enables permessage-deflate for clients that offer it
+	WSCompression bool `env:"WS_COMPRESSION"`
+
+	// WS_COMPRESSION_THRESHOLD is the size in bytes below which messages are
+	// sent uncompressed even on compressed connections, as deflating small
+	// frames costs more CPU than the bytes it saves (0 compresses everything)
+	WSCompressionThreshold int `env:"WS_COMPRESSION_THRESHOLD"`
+
+	// WS_WRITE_TIMEOUT is how many seconds a write to a client may take before
+	// the client is considered stuck and disconnected
+	WSWriteTimeout int `env:"WS_WRITE_TIMEOUT"`
+
+	// WS_BATCH_INTERVAL is how many milliseconds messages to clients that
+	// connect with batch=1 may wait to be written together, as one JSON array,
+	// instead of one frame each (0 turns batching off). A batch is written as
+	// soon as it holds WS_BATCH_MAX messages.
+	WSBatchInterval int `env:"WS_BATCH_INTERVAL"`
+	WSBatchMax      int `env:"WS_BATCH_MAX"`
+
+	// SSE_HEARTBEAT is how many seconds apart /events sends a comment line,
+	// keeping proxies from closing a stream that has nothing to say
+	SSEHeartbeat int `env:"SSE_HEARTBEAT"`
+
+	// PING_INTERVAL is how often, in seconds, clients are sent an
+	// application-level ping to measure their latency (0 disables pings)
+	PingInterval int `env:"PING_INTERVAL"`
+
+	// RECONNECT_GRACE is how many seconds the rooms and document of a dropped
+	// connection are kept for the user to reconnect before their leave is
+	// announced (0 announces it right away)
+	ReconnectGrace int `env:"RECONNECT_GRACE"`
+
+	// JOIN_LEAVE_WINDOW is how many seconds a user's leave notice is held
+	// back. If they rejoin in the meantime, neither the leave nor the join is
+	// announced, and a second connection of a user already in the chat isn't
+	// announced at all (0 announces every chat connection coming and going).
+	JoinLeaveWindow int `env:"JOIN_LEAVE_WINDOW"`
+
+	// WS_UPGRADE_RATE limits how many WebSocket connection attempts per minute
+	// each client address may make, with bursts of up to WS_UPGRADE_BURST (0
+	// disables the limit). TRUSTED_PROXIES lists comma-separated addresses or
+	// CIDR ranges of reverse proxies whose X-Forwarded-For header is believed.
+	WSUpgradeRate  int      `env:"WS_UPGRADE_RATE"`
+	WSUpgradeBurst int      `env:"WS_UPGRADE_BURST"`
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+
+	// REACTION_RATE limits how many reactions per minute each user may add
+	// or remove, with bursts of up to REACTION_BURST (0 disables the limit)
+	ReactionRate  int `env:"REACTION_RATE"`
+	ReactionBurst int `env:"REACTION_BURST"`
+
+	// WEBHOOKS lists comma-separated URLs that receive server events as JSON
+	// POSTs; see ParseWebhooks. Deliveries time out after WEBHOOK_TIMEOUT
+	// seconds and failures are retried WEBHOOK_RETRIES times.
+	WebhookSpec    string `env:"WEBHOOKS"`
+	WebhookTimeout int    `env:"WEBHOOK_TIMEOUT"`
+	WebhookRetries int    `env:"WEBHOOK_RETRIES"`
+
+	// MESSAGE_VALIDATION controls how messages with missing or unexpected
+	// fields for their type are treated: "strict" rejects them, "warn" only
+	// logs them and "off" skips the check
+	MessageValidation string `env:"MESSAGE_VALIDATION"`
+
+	// INVALID_CONTENT decides what happens to message and document content that
+	// isn't valid UTF-8 or holds null bytes: "sanitize" replaces the invalid
+	// sequences and drops the null bytes, "reject" refuses it
+	InvalidContent string `env:"INVALID_CONTENT"`
+
+	// MESSAGE_CONTROL_CHARS decides what happens to control characters, ANSI
+	// escape sequences and invisible characters such as zero-width spaces and
+	// bidi overrides in chat messages: "keep" stores them, "strip" drops them
+	// and "escape" makes them visible as \uXXXX. Tabs, line breaks and the
+	// joiners inside emoji are always kept.
+	MessageControlChars string `env:"MESSAGE_CONTROL_CHARS"`
+
+	// EMOJI_SHORTCODES turns shortcodes such as :smile: in chat messages into
+	// their emoji before they are stored and delivered, except in code.
+	// EMOJI_SHORTCODES_FILE adds to or replaces the built-in shortcodes.
+	EmojiShortcodes     bool   `env:"EMOJI_SHORTCODES"`
+	EmojiShortcodesFile string `env:"EMOJI_SHORTCODES_FILE"`
+
+	// MESSAGE_MAX_LENGTH is the most characters a chat message may have (0 for
+	// no limit). MESSAGE_LENGTH_POLICY decides what happens to longer ones:
+	// "reject" refuses them, "truncate" cuts them to the limit.
+	MessageMaxLength    int    `env:"MESSAGE_MAX_LENGTH"`
+	MessageLengthPolicy string `env:"MESSAGE_LENGTH_POLICY"`
+
+	// CHAT_PERSISTENCE, when off, makes the chat ephemeral: messages are
+	// delivered live but not stored, so there is no history, search, thread or
+	// export, and private messages to offline users fail
+	ChatPersistence bool `env:"CHAT_PERSISTENCE"`
+
+	// MESSAGE_MAX_TTL is the longest time to live, in seconds, clients may give
+	// a message before it is deleted (0 disables expiring messages). Expired
+	// messages are pruned every MESSAGE_PRUNE_INTERVAL seconds.
+	MessageMaxTTL        int `env:"MESSAGE_MAX_TTL"`
+	MessagePruneInterval int `env:"MESSAGE_PRUNE_INTERVAL"`
+
+	// MESSAGE_DEDUPE_WINDOW is how many seconds the client keys of sent
+	// messages are remembered in memory, so that resends are dropped without a
+	// database lookup. Later resends are still caught by the database.
+	MessageDedupeWindow int `env:"MESSAGE_DEDUPE_WINDOW"`
+
+	// MESSAGE_EDIT_WINDOW is how many minutes after posting users may still
+	// edit a message (0 means forever). Admins can edit their messages anytime.
+	MessageEditWindow int `env:"MESSAGE_EDIT_WINDOW"`
+
+	// MESSAGE_DELETE decides who can delete messages: "own" lets users delete
+	// their own and admins anyone's, "admins" only lets admins, "off" nobody
+	MessageDelete string `env:"MESSAGE_DELETE"`
+
+	// CUSTOM_REACTIONS_FILE is a JSON file of custom reactions shown as
+	// images, see loadCustomReactions. REACTION_POLICY "any" lets users react
+	// with any emoji as well, "custom" only with the custom reactions.
+	CustomReactionsFile string `env:"CUSTOM_REACTIONS_FILE"`
+	ReactionPolicy      string `env:"REACTION_POLICY"`
+
+	// THREAD_MAX_DEPTH is how deeply replies may be nested (0 for no limit).
+	// THREAD_DEPTH_POLICY decides what happens to a reply that would go deeper:
+	// "flatten" posts it next to the message it replies to, "reject" refuses it.
+	ThreadMaxDepth    int    `env:"THREAD_MAX_DEPTH"`
+	ThreadDepthPolicy string `env:"THREAD_DEPTH_POLICY"`
+
+	// AUTH_COOKIE makes /login, /register, /refresh and /guest also set the
+	// token as a Secure (unless AUTH_COOKIE_SECURE is false), HttpOnly,
+	// SameSite=Strict cookie named AUTH_COOKIE_NAME, which WebSocket upgrades
+	// then accept. Cookie-authenticated requests must come from a page on this
+	// server or on one of the comma-separated AUTH_COOKIE_ORIGINS.
+	// AUTH_TOKEN_SOURCES orders where a token is looked for: query, header and
+	// cookie.
+	AuthCookie        bool     `env:"AUTH_COOKIE"`
+	AuthCookieName    string   `env:"AUTH_COOKIE_NAME"`
+	AuthCookieSecure  bool     `env:"AUTH_COOKIE_SECURE"`
+	AuthCookieOrigins []string `env:"AUTH_COOKIE_ORIGINS"`
+	AuthTokenSources  []string `env:"AUTH_TOKEN_SOURCES"`
+
+	// GUEST_ACCESS lets visitors join without registering through /guest. Guest
+	// tokens expire after GUEST_TOKEN_TTL minutes, and guests can only read the
+	// public chat unless GUEST_PERMISSIONS grants comma-separated capabilities
+	// (post, private, react, rooms, search, documents, edit).
+	GuestAccess      bool     `env:"GUEST_ACCESS"`
+	GuestTokenTTL    int      `env:"GUEST_TOKEN_TTL"`
+	GuestPermissions []string `env:"GUEST_PERMISSIONS"`
+
+	// GUEST_SESSION_LIFETIME is how many minutes a guest connection may stay
+	// open, and GUEST_ACTION_LIMIT how many messages it may send, before it
+	// is closed and the guest has to come in again (0 means no limit)
+	GuestSessionLifetime int `env:"GUEST_SESSION_LIFETIME"`
+	GuestActionLimit     int `env:"GUEST_ACTION_LIMIT"`
+
+	// MOTD_FILE points to a message-of-the-day template sent to every user when
+	// they connect. Leave it unset to disable the greeting.
+	MOTDFile string `env:"MOTD_FILE"`
+
+	// STATIC_DIR is the directory holding index.html and editor.html
+	StaticDir string `env:"STATIC_DIR"`
+
+	// JWT_KEYS lists the token signing keys as comma-separated kid:secret
+	// pairs. JWT_CURRENT_KID picks the key that signs new tokens (default: the
+	// first one); the rest are only accepted for verification.
+	JWTKeySpec    string `env:"JWT_KEYS"`
+	JWTCurrentKID string `env:"JWT_CURRENT_KID"`
+
+	// DOC_QUOTA caps how many documents a user may own (0 means unlimited).
+	// DOC_QUOTA_OVERRIDES sets per-user quotas as comma-separated user:quota
+	// pairs, e.g. "admin:0,alice:100".
+	DocQuota          int            `env:"DOC_QUOTA"`
+	DocQuotaOverrides map[string]int `env:"DOC_QUOTA_OVERRIDES"`
+
+	// DOC_CREATE_POLICY decides who may create documents: "all" users,
+	// "admins" only, or the roles listed as "roles:admin,editor". When
+	// DOC_CREATE_POLICY_FILE is set, the policy is read from that file instead
+	// and re-read whenever it changes.
+	DocCreatePolicySpec string `env:"DOC_CREATE_POLICY"`
+	DocCreatePolicyFile string `env:"DOC_CREATE_POLICY_FILE"`
+
+	// DOC_CHUNK_SIZE is the size in bytes above which a document is streamed to
+	// the client in chunks instead of one message (0 disables chunking)
+	DocChunkSize int `env:"DOC_CHUNK_SIZE"`
+
+	// DOC_MAX_EDITORS caps how many clients may edit one document at the same
+	// time (0 means unlimited). Beyond it, clients are refused, or admitted as
+	// read-only viewers when DOC_OVERFLOW_READONLY is set.
+	DocMaxEditors       int  `env:"DOC_MAX_EDITORS"`
+	DocOverflowReadOnly bool `env:"DOC_OVERFLOW_READONLY"`
+
+	// MAX_ROOMS_PER_USER caps how many rooms a user may be in at once, and
+	// MAX_OPEN_DOCUMENTS how many documents they may have open, summed over
+	// their connections (0 means unlimited)
+	MaxRoomsPerUser  int `env:"MAX_ROOMS_PER_USER"`
+	MaxOpenDocuments int `env:"MAX_OPEN_DOCUMENTS"`
+
+	// AUTO_JOIN_ROOM is a room chat clients join as soon as they connect,
+	// without asking (default: none). AUTO_JOIN_SOURCE lets the room come
+	// from the connection instead: "query" takes its room parameter,
+	// "origin" the host name of its Origin, and "default" always uses
+	// AUTO_JOIN_ROOM.
+	AutoJoinRoom   string `env:"AUTO_JOIN_ROOM"`
+	AutoJoinSource string `env:"AUTO_JOIN_SOURCE"`
+
+	// DOC_PERSISTENCE, when off, keeps edits to documents in their editing
+	// session only: the documents themselves are stored, but their content is
+	// never saved and goes back to what it was once nobody has them open
+	DocPersistence bool `env:"DOC_PERSISTENCE"`
+
+	// DOC_ACCESS_LOG records who opened, edited or fetched snapshots of which
+	// document, and when, in the access log that owners and admins can read
+	DocAccessLog bool `env:"DOC_ACCESS_LOG"`
+
+	// DOC_AUTOSAVE_INTERVAL is how often, in seconds, edited documents are saved
+	// to the database. Sessions of documents nobody has had open for
+	// DOC_IDLE_TIMEOUT seconds are then dropped from memory.
+	DocAutosaveInterval int `env:"DOC_AUTOSAVE_INTERVAL"`
+	DocIdleTimeout      int `env:"DOC_IDLE_TIMEOUT"`
+
+	// DOC_AUTOSAVE_QUIET also saves a document once nobody has changed it for
+	// that many seconds (0 only saves every DOC_AUTOSAVE_INTERVAL). Documents
+	// are always saved when their last editor leaves and on shutdown.
+	DocAutosaveQuiet int `env:"DOC_AUTOSAVE_QUIET"`
+
+	// DOC_EXTENSIONS restricts document names to the given comma-separated file
+	// extensions, e.g. "go,py,md" (default: any extension)
+	DocExtensions []string `env:"DOC_EXTENSIONS"`
+
+	// DB_BUSY_RETRIES is how many more times a database write is tried when
+	// SQLite reports the database as busy, after its busy timeout ran out. The
+	// waits between tries start at DB_BUSY_BACKOFF milliseconds and double each
+	// time, with jitter so that writers held up together don't retry together.
+	DBBusyRetries int `env:"DB_BUSY_RETRIES"`
+	DBBusyBackoff int `env:"DB_BUSY_BACKOFF"`
+
+	// DB_MAINTENANCE_INTERVAL is how many minutes apart the database is
+	// maintained (0 turns it off): DB_MAINTENANCE_MODE "checkpoint" truncates
+	// the write-ahead log, "vacuum" also rebuilds the database to give back
+	// the space of deleted rows. Maintenance is put off while the hub sheds
+	// load or more than DB_MAINTENANCE_MAX_CONNECTIONS clients are connected
+	// (0 for any number).
+	DBMaintenanceInterval       int    `env:"DB_MAINTENANCE_INTERVAL"`
+	DBMaintenanceMode           string `env:"DB_MAINTENANCE_MODE"`
+	DBMaintenanceMaxConnections int    `env:"DB_MAINTENANCE_MAX_CONNECTIONS"`
+
+	// DOC_TRUNCATE_PERCENT warns a document's editors when an edit removes at
+	// least that percentage of its content (0 disables the warning), for
+	// documents of at least DOC_TRUNCATE_MIN_SIZE bytes. Unless
+	// DOC_TRUNCATE_SNAPSHOT is turned off, the content before the edit is kept
+	// as a snapshot it can be recovered from.
+	DocTruncatePercent  int  `env:"DOC_TRUNCATE_PERCENT"`
+	DocTruncateMinSize  int  `env:"DOC_TRUNCATE_MIN_SIZE"`
+	DocTruncateSnapshot bool `env:"DOC_TRUNCATE_SNAPSHOT"`
+
+	// DOC_TURN_IDLE frees the turn on a document edited in turns once its
+	// holder hasn't edited for that many seconds (0 keeps it until they give it
+	// up or leave)
+	DocTurnIdle int `env:"DOC_TURN_IDLE"`
+
+	// DOC_CONFLICT_STRATEGY handles edits made against an older revision of a
+	// document than the current one: "last-write-wins" applies them as sent,
+	// "reject" refuses them and "merge" merges them line by line with the
+	// changes made since, refusing them when both changed the same lines.
+	DocConflictStrategy string `env:"DOC_CONFLICT_STRATEGY"`
+
+	// DOC_COMPRESSION is how document content is stored: "none" or "gzip".
+	// Changing it only affects documents saved afterwards.
+	DocCompression string `env:"DOC_COMPRESSION"`
+
+	// DOC_UNTITLED_PREFIX names documents created without a name, as the prefix
+	// followed by the lowest number the creator hasn't used yet, e.g.
+	// "Untitled-3". When it is empty, documents must be given a name.
+	DocUntitledPrefix string `env:"DOC_UNTITLED_PREFIX"`
+
+	// ONBOARDING_DOC_TEMPLATE is a file every user who registers gets a
+	// document of their own from, with {username} replaced by their name
+	// (default: none). ONBOARDING_DOC_NAME and ONBOARDING_DOC_LANGUAGE name
+	// the document and set its language.
+	OnboardingDocTemplate string `env:"ONBOARDING_DOC_TEMPLATE"`
+	OnboardingDocName     string `env:"ONBOARDING_DOC_NAME"`
+	OnboardingDocLanguage string `env:"ONBOARDING_DOC_LANGUAGE"`
+
+	// HISTORY_PAGE_SIZE is how many messages a history reply, and the replay
+	// when joining the chat or a room, holds when the client doesn't ask for a
+	// number, and HISTORY_MAX_PAGE_SIZE the most it may ask for. SEARCH_PAGE_SIZE
+	// and SEARCH_MAX_PAGE_SIZE do the same for search results.
+	HistoryPageSize    int `env:"HISTORY_PAGE_SIZE"`
+	HistoryMaxPageSize int `env:"HISTORY_MAX_PAGE_SIZE"`
+	SearchPageSize     int `env:"SEARCH_PAGE_SIZE"`
+	SearchMaxPageSize  int `env:"SEARCH_MAX_PAGE_SIZE"`
+
+	// DOC_LIST_PAGE_SIZE is how many documents a doc-list reply holds when the
+	// client doesn't ask for a number, and DOC_LIST_MAX_PAGE_SIZE the most it
+	// may ask for.
+	DocListPageSize    int `env:"DOC_LIST_PAGE_SIZE"`
+	DocListMaxPageSize int `env:"DOC_LIST_MAX_PAGE_SIZE"`
+
+	// DOC_LANGUAGES restricts document languages to a comma-separated list of
+	// canonical names (default: a built-in list of common languages).
+	// DOC_DEFAULT_LANGUAGE is used when a document is created without one.
+	DocLanguages       []string `env:"DOC_LANGUAGES"`
+	DocDefaultLanguage string   `env:"DOC_DEFAULT_LANGUAGE"`
+
+	// DOC_LANGUAGE_QUOTAS caps how many documents may use a language across
+	// the server, as comma-separated language:quota pairs, e.g. "python:100".
+	// Languages left out are unlimited.
+	DocLanguageQuotas map[string]int `env:"DOC_LANGUAGE_QUOTAS"`
+
+	// LOAD_WARN_PERCENT is how full (in percent) any hub channel may get before
+	// the server warns users and sheds optional work such as history replay.
+	// It returns to normal once all channels are below LOAD_RECOVER_PERCENT.
+	LoadWarnPercent    int `env:"LOAD_WARN_PERCENT"`
+	LoadRecoverPercent int `env:"LOAD_RECOVER_PERCENT"`
+
+	// SYSTEM_NAME and SYSTEM_COLOR set the identity that server notices are sent
+	// under. The name can't be registered by users.
+	SystemName  string `env:"SYSTEM_NAME"`
+	SystemColor string `env:"SYSTEM_COLOR"`
+
+	// USER_DIRECTORY decides which online users the user list, presence
+	// updates and /api/users show: "all", those sharing a room with the viewer
+	// ("rooms") or nobody but the viewer ("admins"). Admins see everyone.
+	UserDirectoryPolicy string `env:"USER_DIRECTORY"`
+
+	// USER_LIST_PAGE_SIZE is how many users GET /api/users returns when the
+	// request has no ?limit=, and USER_LIST_MAX_PAGE_SIZE the most it may ask for
+	UserListPageSize    int `env:"USER_LIST_PAGE_SIZE"`
+	UserListMaxPageSize int `env:"USER_LIST_MAX_PAGE_SIZE"`
+
+	// ACCOUNT_DELETE_MESSAGES decides what becomes of the messages, comments
+	// and reactions of users who delete their account: "anonymize" keeps them
+	// under a tombstone name, "delete" removes them and "keep" leaves them under
+	// the user's name. ACCOUNT_DELETE_DOCUMENTS either deletes their documents
+	// ("delete") or hands them to the user named by ACCOUNT_DOCUMENTS_HEIR
+	// ("reassign").
+	AccountDeleteMessages  string `env:"ACCOUNT_DELETE_MESSAGES"`
+	AccountDeleteDocuments string `env:"ACCOUNT_DELETE_DOCUMENTS"`
+	AccountDocumentsHeir   string `env:"ACCOUNT_DOCUMENTS_HEIR"`
+
+	// ADMIN_USERS lists comma-separated usernames that have the admin role
+	// regardless of the role stored for them
+	AdminUsers []string `env:"ADMIN_USERS"`
+
+	// RESERVED_USERNAMES lists extra comma-separated names users can't register
+	ReservedUsernames []string `env:"RESERVED_USERNAMES"`
+}
+
+// config is the configuration the server runs with, loaded by main
+var config = DefaultConfig()
+
+// DefaultConfig returns the settings used for anything left unset
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:             ":8080",
+		AutocertCacheDir:       "certs",
+		WSCompressionThreshold: 512,
+		WSWriteTimeout:         10,
+		WSBatchMax:             64,
+		SSEHeartbeat:           15,
+		PingInterval:           30,
+		WSUpgradeRate:          60,
+		WSUpgradeBurst:         20,
+		ReactionRate:           60,
+		ReactionBurst:          10,
+		WebhookTimeout:         5,
+		WebhookRetries:         3,
+		MessageValidation:      ValidationStrict,
+		InvalidContent:         InvalidContentSanitize,
+		MessageControlChars:    ControlCharsKeep,
+		MessageMaxLength:       4000,
+		MessageLengthPolicy:    LengthReject,
+		ChatPersistence:        true,
+		MessageMaxTTL:          7 * 24 * 60 * 60,
+		MessagePruneInterval:   5,
+		MessageDedupeWindow:    300,
+		MessageDelete:          DeleteOwn,
+		ReactionPolicy:         ReactionsAny,
+		ThreadMaxDepth:         5,
+		ThreadDepthPolicy:      ThreadFlatten,
+		AuthCookieName:         "chat_token",
+		AuthCookieSecure:       true,
+		AuthTokenSources:       []string{TokenFromQuery, TokenFromHeader, TokenFromCookie},
+		GuestTokenTTL:          60,
+		StaticDir:              ".",
+		DocCreatePolicySpec:    "all",
+		DocChunkSize:           64 * 1024,
+		MaxRoomsPerUser:        50,
+		MaxOpenDocuments:       10,
+		AutoJoinSource:         AutoJoinDefault,
+		OnboardingDocName:      "Welcome.md",
+		OnboardingDocLanguage:  "markdown",
+		DocPersistence:         true,
+		DocAutosaveInterval:    2,
+		DocIdleTimeout:         300,
+		DBBusyRetries:          3,
+		DBBusyBackoff:          50,
+		DBMaintenanceMode:      MaintenanceCheckpoint,
+		DocTruncatePercent:     80,
+		DocTruncateMinSize:     200,
+		DocTruncateSnapshot:    true,
+		DocTurnIdle:            60,
+		DocConflictStrategy:    ConflictLastWriteWins,
+		DocCompression:         "none",
+		HistoryPageSize:        50,
+		HistoryMaxPageSize:     100,
+		SearchPageSize:         20,
+		SearchMaxPageSize:      100,
+		DocListPageSize:        50,
+		DocListMaxPageSize:     200,
+		DocDefaultLanguage:     "plaintext",
+		LoadWarnPercent:        80,
+		LoadRecoverPercent:     50,
+		SystemName:             "System",
+		UserDirectoryPolicy:    DirectoryRooms,
+		UserListPageSize:       100,
+		UserListMaxPageSize:    500,
+		AccountDeleteMessages:  AccountAnonymize,
+		AccountDeleteDocuments: AccountDocumentsDelete,
+	}
+}
+
+// ConfigError lists everything wrong with a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+// configProblems collects the problems found while loading and checking a
+// configuration, so that they can all be reported at once
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// LoadConfig reads the settings from the environment and, when CONFIG_FILE
+// names one, from a file of KEY=VALUE lines. The environment wins over the
+// file. The settings are validated, and the error lists every problem found.
+func LoadConfig() (*Config, error) {
+	file := map[string]string{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return ParseConfig(func(key string) (string, bool) {
+		if value, ok := os.LookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := file[key]
+		return value, ok
+	})
+}
+
+// ParseConfig builds and validates a configuration from the values lookup
+// returns for the settings' keys, starting from DefaultConfig
+func ParseConfig(lookup func(key string) (string, bool)) (*Config, error) {
+	c := DefaultConfig()
+	var problems configProblems
+
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("env")
+		value, ok := lookup(key)
+		if key == "" || !ok {
+			continue
+		}
+		if err := setConfigField(v.Field(i), value); err != nil {
+			problems.add("Invalid %s: %v", key, err)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		problems = append(problems, err.(*ConfigError).Problems...)
+	}
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return c, nil
+}
+
+// Validate checks the settings and how they fit together. It returns a
+// *ConfigError listing every problem, or nil.
+func (c *Config) Validate() error {
+	var p configProblems
+	if c.JWTKeySpec != "" {
+		if _, err := ParseJWTKeySet(c.JWTKeySpec, c.JWTCurrentKID); err != nil {
+			p.add("Invalid JWT_KEYS: %v", err)
+		}
+	}
+	if c.WebhookSpec != "" {
+		if _, err := ParseWebhooks(c.WebhookSpec); err != nil {
+			p.add("Invalid WEBHOOKS: %v", err)
+		}
+	}
+	c.checkTLS(&p)
+	c.checkLanguage(&p)
+	c.checkLoad(&p)
+	c.checkValidation(&p)
+	c.checkControlChars(&p)
+	c.checkAuthCookie(&p)
+	c.checkGuest(&p)
+	c.checkRateLimit(&p)
+	c.checkAutosave(&p)
+	c.checkCompression(&p)
+	c.checkBatch(&p)
+	c.checkEventStream(&p)
+	c.checkTruncate(&p)
+	c.checkConflict(&p)
+	c.checkDBRetry(&p)
+	c.checkMaintenance(&p)
+	c.checkPaging(&p)
+	c.checkDocCreatePolicy(&p)
+	c.checkMessageTTL(&p)
+	c.checkMessageDelete(&p)
+	c.checkReactionPolicy(&p)
+	c.checkThread(&p)
+	c.checkDirectory(&p)
+	c.checkLength(&p)
+	c.checkAccount(&p)
+	c.checkAutoJoin(&p)
+	c.checkOnboarding(&p)
+
+	if len(p) > 0 {
+		return &ConfigError{Problems: p}
+	}
+	return nil
+}
+
+// setConfigField parses a setting into a field of Config
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case []string:
+		field.Set(reflect.ValueOf(splitList(value)))
+	case map[string]int:
+		values, err := parseIntMap(value)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// readConfigFile reads a file of KEY=VALUE lines, as in a .env file. Blank
+// lines and lines starting with # are skipped, and values may be quoted.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CONFIG_FILE: %w", err)
+	}
+	defer f.Close()
+
+	known := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		known[t.Field(i).Tag.Get("env")] = true
+	}
+
+	values := make(map[string]string)
+	var problems configProblems
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		switch {
+		case !ok:
+			problems.add("%s line %d: expected KEY=VALUE", path, n)
+		case !known[key]:
+			problems.add("%s line %d: unknown setting %s", path, n, key)
+		default:
+			value = strings.TrimSpace(value)
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			values[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading CONFIG_FILE: %w", err)
+	}
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return values, nil
+}
+
+// splitList splits a comma-separated setting into its trimmed, non-empty
+// items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseIntMap parses a setting holding comma-separated name:integer pairs
+func parseIntMap(value string) (map[string]int, error) {
+	values := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, number, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		n, err := strconv.Atoi(number)
+		if !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("entry %q, expected name:number", pair)
+		}
+		values[name] = n
+	}
+	return values, nil
+}
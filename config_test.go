@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lookupIn returns a lookup function for ParseConfig over a fixed set of
+// settings
+func lookupIn(settings map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := settings[key]
+		return value, ok
+	}
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	c, err := ParseConfig(lookupIn(nil))
+	if err != nil {
+		t.Fatalf("the defaults don't validate: %v", err)
+	}
+	// Validate fills in what the checks derive from the settings
+	defaults := DefaultConfig()
+	defaults.Validate()
+	if !reflect.DeepEqual(c, defaults) {
+		t.Error("ParseConfig without settings differs from DefaultConfig")
+	}
+	if c.ListenAddr != ":8080" || c.HistoryPageSize != 50 || !c.ChatPersistence || c.AdminUsers != nil {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+
+	// Every setting can be given
+	v := reflect.ValueOf(*c)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("env") == "" {
+			t.Errorf("%s has no environment variable", v.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestParseConfigValues(t *testing.T) {
+	c, err := ParseConfig(lookupIn(map[string]string{
+		"LISTEN_ADDR":         "127.0.0.1:9000",
+		"HISTORY_PAGE_SIZE":   "20",
+		"CHAT_PERSISTENCE":    "false",
+		"ADMIN_USERS":         " root, ops ,,",
+		"DOC_LANGUAGE_QUOTAS": "go:10, python:5",
+	}))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if c.ListenAddr != "127.0.0.1:9000" || c.HistoryPageSize != 20 || c.ChatPersistence {
+		t.Errorf("parsed %q, %d, %v", c.ListenAddr, c.HistoryPageSize, c.ChatPersistence)
+	}
+	if !reflect.DeepEqual(c.AdminUsers, []string{"root", "ops"}) {
+		t.Errorf("ADMIN_USERS parsed as %q", c.AdminUsers)
+	}
+	if !reflect.DeepEqual(c.DocLanguageQuotas, map[string]int{"go": 10, "python": 5}) {
+		t.Errorf("DOC_LANGUAGE_QUOTAS parsed as %v", c.DocLanguageQuotas)
+	}
+	if c.SearchPageSize != DefaultConfig().SearchPageSize {
+		t.Error("a setting that wasn't given lost its default")
+	}
+}
+
+func TestParseConfigReportsEveryProblem(t *testing.T) {
+	_, err := ParseConfig(lookupIn(map[string]string{
+		"HISTORY_PAGE_SIZE":     "lots",
+		"CHAT_PERSISTENCE":      "maybe",
+		"DOC_LANGUAGE_QUOTAS":   "go",
+		"MESSAGE_MAX_LENGTH":    "-1",
+		"MESSAGE_LENGTH_POLICY": "shout",
+	}))
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("ParseConfig = %v, want a *ConfigError", err)
+	}
+	for _, want := range []string{
+		"Invalid HISTORY_PAGE_SIZE",
+		"Invalid CHAT_PERSISTENCE",
+		"Invalid DOC_LANGUAGE_QUOTAS",
+		"MESSAGE_MAX_LENGTH must not be negative",
+		`Invalid MESSAGE_LENGTH_POLICY "shout"`,
+	} {
+		found := false
+		for _, problem := range configErr.Problems {
+			found = found || strings.HasPrefix(problem, want)
+		}
+		if !found {
+			t.Errorf("%v doesn't report %s", configErr.Problems, want)
+		}
+	}
+	if len(configErr.Problems) != 5 {
+		t.Errorf("%d problems reported, want 5: %v", len(configErr.Problems), configErr.Problems)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.env")
+	file := "# settings\n\nLISTEN_ADDR = \":9090\"\nHISTORY_PAGE_SIZE=10\nADMIN_USERS=root\n"
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("HISTORY_PAGE_SIZE", "30")
+
+	c, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if c.ListenAddr != ":9090" || !reflect.DeepEqual(c.AdminUsers, []string{"root"}) {
+		t.Errorf("read %q and %q from the file", c.ListenAddr, c.AdminUsers)
+	}
+	if c.HistoryPageSize != 30 {
+		t.Errorf("HISTORY_PAGE_SIZE = %d, want the environment's 30", c.HistoryPageSize)
+	}
+
+	if err := os.WriteFile(path, []byte("LISTEN_ADDR=:9090\nNOT_A_SETTING=1\njunk\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadConfig()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || len(configErr.Problems) != 2 {
+		t.Errorf("LoadConfig with a bad file = %v, want both bad lines reported", err)
+	}
+
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.env"))
+	if _, err := LoadConfig(); err == nil {
+		t.Error("LoadConfig with a missing file succeeded")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// Ways of handling an edit made against an older revision of a document
+// than the current one
+const (
+	ConflictLastWriteWins = "last-write-wins" // The edit replaces the content, whatever changed meanwhile
+	ConflictReject        = "reject"          // The edit is refused and the editor sent the current content
+	ConflictMerge         = "merge"           // The changes are merged line by line, refused when they overlap
+)
+
+// maxMergeCells bounds the size of the table used to diff the changed part
+// of a document, in lines of the base times lines of the other side, about
+// 200 changed lines on each. The diff runs on Run, so larger changes are
+// treated as conflicts rather than holding up the hub.
+const maxMergeCells = 40_000
+
+var errEditConflict = errors.New("the document was changed by someone else since your last update")
+
+// staleEdit is an edit based on a revision that isn't the current one
+type staleEdit struct {
+	Base      string // The content the edit was made against
+	BaseKnown bool   // Base is set; it is unknown once the revision fell out of the session's log
+	Current   string // The content now
+	Incoming  string // The content the edit would give
+}
+
+// conflictStrategy decides what becomes of a stale edit: the content to
+// apply instead, or an error to refuse the edit with
+type conflictStrategy interface {
+	Resolve(edit staleEdit) (string, error)
+}
+
+// conflictStrategies holds the strategies DOC_CONFLICT_STRATEGY can select
+var conflictStrategies = map[string]conflictStrategy{
+	ConflictLastWriteWins: lastWriteWins{},
+	ConflictReject:        rejectConflicts{},
+	ConflictMerge:         mergeConflicts{},
+}
+
+// checkConflict reports an unknown conflict strategy
+func (c *Config) checkConflict(p *configProblems) {
+	if _, ok := conflictStrategies[c.DocConflictStrategy]; !ok {
+		p.add("DOC_CONFLICT_STRATEGY must be %s, %s or %s, got %q", ConflictLastWriteWins, ConflictReject, ConflictMerge, c.DocConflictStrategy)
+	}
+}
+
+// lastWriteWins applies every edit as sent
+type lastWriteWins struct{}
+
+func (lastWriteWins) Resolve(edit staleEdit) (string, error) {
+	return edit.Incoming, nil
+}
+
+// rejectConflicts refuses every stale edit
+type rejectConflicts struct{}
+
+func (rejectConflicts) Resolve(edit staleEdit) (string, error) {
+	return "", errEditConflict
+}
+
+// mergeConflicts merges a stale edit with the changes made since its base
+type mergeConflicts struct{}
+
+func (mergeConflicts) Resolve(edit staleEdit) (string, error) {
+	if !edit.BaseKnown {
+		return "", errEditConflict
+	}
+	merged, ok := mergeLines(edit.Base, edit.Current, edit.Incoming)
+	if !ok {
+		return "", errEditConflict
+	}
+	return merged, nil
+}
+
+// lineHunk replaces lines start to end (exclusive) of a base text
+type lineHunk struct {
+	start, end int
+	lines      []string
+}
+
+// splitLines cuts text into lines that keep their line break, so that
+// joining them gives the text back
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the hunks turning base into other, in order, found
+// through the longest common subsequence of their lines. It fails when the
+// changed part is too large to diff.
+func diffLines(base, other []string) ([]lineHunk, bool) {
+	// Lines shared at both ends don't need to go through the table
+	prefix := 0
+	for prefix < len(base) && prefix < len(other) && base[prefix] == other[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(other)-prefix && base[len(base)-1-suffix] == other[len(other)-1-suffix] {
+		suffix++
+	}
+	a := base[prefix : len(base)-suffix]
+	b := other[prefix : len(other)-suffix]
+	if len(a) == 0 && len(b) == 0 {
+		return nil, true
+	}
+	if (len(a)+1)*(len(b)+1) > maxMergeCells {
+		return nil, false
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var hunks []lineHunk
+	var open *lineHunk
+	flush := func() {
+		if open != nil {
+			hunks = append(hunks, *open)
+			open = nil
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			i++
+			j++
+			continue
+		case open == nil:
+			open = &lineHunk{start: prefix + i, end: prefix + i}
+		}
+		if j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]) {
+			open.lines = append(open.lines, b[j])
+			j++
+		} else {
+			i++
+			open.end = prefix + i
+		}
+	}
+	flush()
+	return hunks, true
+}
+
+// hunksConflict reports whether two hunks against the same base touch the
+// same lines, or insert at the same place
+func hunksConflict(x, y lineHunk) bool {
+	return (x.start < y.end && y.start < x.end) || x.start == y.start
+}
+
+// sameHunk reports whether two hunks make the same change
+func sameHunk(x, y lineHunk) bool {
+	return x.start == y.start && x.end == y.end && strings.Join(x.lines, "") == strings.Join(y.lines, "")
+}
+
+// mergeLines makes a three-way merge of the changes from base to ours and
+// from base to theirs. It fails when both change the same lines
+// differently.
+func mergeLines(base, ours, theirs string) (string, bool) {
+	baseLines := splitLines(base)
+	ourHunks, ok := diffLines(baseLines, splitLines(ours))
+	if !ok {
+		return "", false
+	}
+	theirHunks, ok := diffLines(baseLines, splitLines(theirs))
+	if !ok {
+		return "", false
+	}
+
+	var merged strings.Builder
+	pos := 0
+	apply := func(h lineHunk) {
+		for _, line := range baseLines[pos:h.start] {
+			merged.WriteString(line)
+		}
+		for _, line := range h.lines {
+			merged.WriteString(line)
+		}
+		pos = h.end
+	}
+
+	i, j := 0, 0
+	for i < len(ourHunks) || j < len(theirHunks) {
+		switch {
+		case j == len(theirHunks):
+			apply(ourHunks[i])
+			i++
+		case i == len(ourHunks):
+			apply(theirHunks[j])
+			j++
+		case sameHunk(ourHunks[i], theirHunks[j]):
+			apply(ourHunks[i])
+			i++
+			j++
+		case hunksConflict(ourHunks[i], theirHunks[j]):
+			return "", false
+		case ourHunks[i].start < theirHunks[j].start:
+			apply(ourHunks[i])
+			i++
+		default:
+			apply(theirHunks[j])
+			j++
+		}
+	}
+	for _, line := range baseLines[pos:] {
+		merged.WriteString(line)
+	}
+	return merged.String(), true
+}
+
+// resolveStaleEdit runs an edit based on an older revision than the
+// document's current one through DOC_CONFLICT_STRATEGY and returns the
+// content to apply. On a conflict the client is sent the current content to
+// start over from, and ok is false.
+func (h *Hub) resolveStaleEdit(client *Client, history *documentHistory, edit Msg) (string, bool) {
+	base, known := history.ContentAt(edit.Revision)
+	content, err := conflictStrategies[config.DocConflictStrategy].Resolve(staleEdit{
+		Base:      base,
+		BaseKnown: known,
+		Current:   history.Content,
+		Incoming:  edit.Content,
+	})
+	if err == nil {
+		return content, true
+	}
+
+	log.Printf("Refused edit of %s by %s on revision %d, now at %d: %v", edit.DocumentID, client.Username, edit.Revision, history.Revision(), err)
+	select {
+	case client.Send <- Msg{
+		Type:       DocConflict,
+		DocumentID: edit.DocumentID,
+		Content:    history.Content,
+		Revision:   history.Revision(),
+		Stats:      documentStats(history.Content),
+		Errors:     []string{err.Error()},
+		Time:       time.Now(),
+	}:
+	default:
+		log.Printf("Failed to send edit conflict to %s", client.Username)
+	}
+	return "", false
+}
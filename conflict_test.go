@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMergeLines(t *testing.T) {
+	base := "one\ntwo\nthree\n"
+	for _, tc := range []struct {
+		ours, theirs string
+		want         string
+		ok           bool
+	}{
+		{"ONE\ntwo\nthree\n", "one\ntwo\nTHREE\n", "ONE\ntwo\nTHREE\n", true},
+		{"one\ntwo\nthree\nfour\n", "zero\none\ntwo\nthree\n", "zero\none\ntwo\nthree\nfour\n", true},
+		// Both made the same change
+		{"one\n2\nthree\n", "one\n2\nthree\n", "one\n2\nthree\n", true},
+		{"one\nthree\n", "one\ntwo\nthree\n", "one\nthree\n", true},
+		{"one\nTWO\nthree\n", "one\n2\nthree\n", "", false},
+	} {
+		got, ok := mergeLines(base, tc.ours, tc.theirs)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("mergeLines(%q, %q) = %q, %v, want %q, %v", tc.ours, tc.theirs, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// Changes too large to diff cheaply conflict, however far apart they are,
+// while small changes to a large document still merge
+func TestMergeLinesBound(t *testing.T) {
+	lines := func(format string, n int) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf(format, i)
+		}
+		return out
+	}
+	base := strings.Join(lines("line %d", 1000), "\n")
+	rewritten := strings.Join(append(lines("rewritten %d", 300), lines("line %d", 1000)[300:]...), "\n")
+	appended := base + "\nthe end"
+	if _, ok := mergeLines(base, rewritten, appended); ok {
+		t.Error("a rewrite of 300 lines was merged")
+	}
+
+	edited := strings.Replace(base, "line 500\n", "LINE 500\n", 1)
+	if got, ok := mergeLines(base, edited, appended); !ok || got != edited+"\nthe end" {
+		t.Errorf("a one line edit of a 1000 line document didn't merge: %v", ok)
+	}
+}
+
+func TestConflictStrategies(t *testing.T) {
+	const base = "one\ntwo\nthree\n"
+	for _, tc := range []struct {
+		strategy  string
+		bobEdit   string
+		want      string
+		conflicts bool
+	}{
+		{ConflictLastWriteWins, "one\ntwo\nTHREE\n", "one\ntwo\nTHREE\n", false},
+		{ConflictReject, "one\ntwo\nTHREE\n", "ONE\ntwo\nthree\n", true},
+		{ConflictMerge, "one\ntwo\nTHREE\n", "ONE\ntwo\nTHREE\n", false},
+		{ConflictMerge, "uno\ntwo\nthree\n", "ONE\ntwo\nthree\n", true},
+	} {
+		t.Run(tc.strategy, func(t *testing.T) {
+			setupTest(t)
+			config.DocConflictStrategy = tc.strategy
+			hub := newTestHub(t)
+			doc := createTestDocument(t, "notes.txt", "alice")
+			if err := UpdateDocument(doc.ID, base); err != nil {
+				t.Fatal(err)
+			}
+			alice := openTestDocument(t, hub, "alice", doc.ID)
+			bob := fakeClient("bob", false)
+			register(t, hub, bob)
+			bob.handleDocumentOpen(doc.ID, "", hub)
+			revision := receive(t, bob, DocContent).Revision
+
+			// Both edit the same revision; alice's edit lands first
+			hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "ONE\ntwo\nthree\n", Revision: revision}}
+			receive(t, bob, DocUpdate)
+			hub.DocumentEdits <- documentEdit{Client: bob, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "bob", Content: tc.bobEdit, Revision: revision}}
+
+			if tc.conflicts {
+				conflict := receive(t, bob, DocConflict)
+				if conflict.Content != "ONE\ntwo\nthree\n" || len(conflict.Errors) != 1 {
+					t.Errorf("bob's conflict is %+v, want alice's content to start over from", conflict)
+				}
+			} else if ack := receive(t, bob, DocRevision); ack.Revision <= revision {
+				t.Errorf("bob's edit made revision %d, after %d", ack.Revision, revision)
+			}
+			hub.SaveAllDocuments()
+			if got := storedContent(t, doc.ID); got != tc.want {
+				t.Errorf("the document holds %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
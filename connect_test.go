@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRapidConnectDisconnect(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + token
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+			if err != nil {
+				t.Errorf("dialing: %v", err)
+				return
+			}
+			// Gone before reading anything, while the server may still be
+			// setting the connection up
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	eventually(t, "every connection to leave the hub", func() bool { return len(hub.ConnectedClients()) == 0 })
+
+	// The hub is still serving
+	conn := dial(t, server, token, nil)
+	conn.expect(Session)
+	conn.send(Msg{Type: UserListRequest})
+	if got := conn.expect(UserListRequest); len(got.Members) != 1 || got.Members[0].Username != "alice" {
+		t.Errorf("the roster after the churn is %+v", got.Members)
+	}
+}
+
+// An unregistration for a client the hub never had is ignored
+func TestUnregisterUnknownClient(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	ghost := fakeClient("ghost", true)
+	hub.Unregister <- ghost
+
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	if clients := hub.ConnectedClients(); len(clients) != 1 || clients[0].ID != alice.ID {
+		t.Errorf("ConnectedClients = %+v, want only alice", clients)
+	}
+	select {
+	case _, ok := <-ghost.Send:
+		if !ok {
+			t.Error("the unknown client's Send was closed")
+		}
+	default:
+	}
+	unregister(t, hub, alice)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxConversationMembers caps the participants of a group conversation,
+// creator included
+const maxConversationMembers = 50
+
+var (
+	ErrConversationTooSmall = errors.New("a group conversation needs at least one other participant")
+	ErrConversationTooLarge = errors.New("too many participants in the group conversation")
+)
+
+// Conversation is a group direct message thread between a fixed set of users
+type Conversation struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	Members   []string  `json:"members"`
+}
+
+// InitConversationTables creates the conversations and conversation_members
+// tables
+func InitConversationTables() error {
+	createConversationsTable := `
+	CREATE TABLE IF NOT EXISTS conversations (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`
+
+	if _, err := db.Exec(createConversationsTable); err != nil {
+		return err
+	}
+
+	createMembersTable := `
+	CREATE TABLE IF NOT EXISTS conversation_members (
+		conversation_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		PRIMARY KEY (conversation_id, username)
+	);`
+
+	_, err := db.Exec(createMembersTable)
+	return err
+}
+
+// CreateConversation starts a group conversation between the creator and
+// the given users
+func CreateConversation(name, creator string, participants []string) (*Conversation, error) {
+	members := []string{creator}
+	seen := map[string]bool{creator: true}
+	for _, username := range participants {
+		if !seen[username] {
+			seen[username] = true
+			members = append(members, username)
+		}
+	}
+	if len(members) < 2 {
+		return nil, ErrConversationTooSmall
+	}
+	if len(members) > maxConversationMembers {
+		return nil, ErrConversationTooLarge
+	}
+	sort.Strings(members)
+
+	conv := &Conversation{
+		ID:        uuid.New().String(),
+		Name:      name,
+		CreatedBy: creator,
+		CreatedAt: time.Now(),
+		Members:   members,
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO conversations (id, name, created_by, created_at) VALUES (?, ?, ?, ?)`
+	if _, err = tx.Exec(query, conv.ID, conv.Name, conv.CreatedBy, conv.CreatedAt); err != nil {
+		return nil, err
+	}
+	for _, username := range members {
+		query := `INSERT INTO conversation_members (conversation_id, username) VALUES (?, ?)`
+		if _, err = tx.Exec(query, conv.ID, username); err != nil {
+			return nil, err
+		}
+	}
+
+	return conv, tx.Commit()
+}
+
+// GetConversation retrieves a conversation with its members, or nil if it
+// doesn't exist
+func GetConversation(id string) (*Conversation, error) {
+	var conv Conversation
+	query := `SELECT id, name, created_by, created_at FROM conversations WHERE id = ?`
+	err := db.QueryRow(query, id).Scan(&conv.ID, &conv.Name, &conv.CreatedBy, &conv.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT username FROM conversation_members WHERE conversation_id = ? ORDER BY username`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		conv.Members = append(conv.Members, username)
+	}
+
+	return &conv, rows.Err()
+}
+
+// IsMember reports whether the user takes part in the conversation
+func (conv *Conversation) IsMember(username string) bool {
+	return contains(conv.Members, username)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// groupMsgs returns the group messages and creation notices among msgs
+func groupMsgs(msgs []Msg) []Msg {
+	var group []Msg
+	for _, msg := range msgs {
+		if msg.Type == GroupCreate || msg.Type == GroupMessage {
+			group = append(group, msg)
+		}
+	}
+	return group
+}
+
+func TestGroupConversation(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	clients := map[string]*Client{}
+	for _, username := range []string{"alice", "bob", "carol", "dave"} {
+		createTestUser(t, username)
+		clients[username] = fakeClient(username, true)
+		register(t, hub, clients[username])
+		drain(clients[username])
+	}
+
+	clients["alice"].handleGroupCreate("planning", []string{"bob", "carol", "bob"}, hub)
+	created := receive(t, clients["carol"], GroupCreate)
+	if created.ConversationID == "" || created.Name != "planning" || len(created.Participants) != 3 {
+		t.Fatalf("carol was told about %+v", created)
+	}
+	receive(t, clients["alice"], GroupCreate)
+	receive(t, clients["bob"], GroupCreate)
+
+	clients["bob"].handleGroupMessage(Msg{Type: GroupMessage, Username: "bob", Content: "kickoff at 10", ConversationID: created.ConversationID}, hub)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		msg := receive(t, clients[username], GroupMessage)
+		if msg.Content != "kickoff at 10" || msg.ID == 0 {
+			t.Errorf("%s got %+v, want the stored message", username, msg)
+		}
+	}
+
+	// Outsiders can neither read nor post
+	clients["dave"].handleGroupMessage(Msg{Type: GroupMessage, Username: "dave", Content: "let me in", ConversationID: created.ConversationID}, hub)
+	if msg := receive(t, clients["dave"], ErrorMessage); msg.Content != "You are not a member of this conversation" {
+		t.Errorf("dave posting was answered with %q", msg.Content)
+	}
+	if got := groupMsgs(drain(clients["dave"])); len(got) != 0 {
+		t.Errorf("dave got group messages %+v", got)
+	}
+	if got := groupMsgs(drain(clients["alice"])); len(got) != 0 {
+		t.Errorf("dave's post reached alice: %+v", got)
+	}
+}
+
+func TestCreateConversationNeedsParticipants(t *testing.T) {
+	setupTest(t)
+	if _, err := CreateConversation("", "alice", []string{"alice"}); !errors.Is(err, ErrConversationTooSmall) {
+		t.Errorf("a conversation with only its creator: %v, want ErrConversationTooSmall", err)
+	}
+
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	alice.handleGroupCreate("", []string{"nobody"}, hub)
+	if msg := receive(t, alice, ErrorMessage); msg.Content != "User 'nobody' does not exist" {
+		t.Errorf("a conversation with an unknown user was answered with %q", msg.Content)
+	}
+}
@@ -2,41 +2,105 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"time"
 
-	_ "modernc.org/sqlite"
 	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
 )
 
 var db *sql.DB
 
-// InitDB initializes the database connection and creates tables
-func InitDB() error {
-	var err error
-	db, err = sql.Open("sqlite", "./chat.db")
+// dbPath is the SQLite database file
+const dbPath = "./chat.db"
+
+// dbOptions are applied to every connection of the pool, not just the one
+// a PRAGMA statement happens to run on. The busy timeout makes writers wait
+// for each other for up to 5 seconds instead of failing right away, and
+// transactions take the write lock when they begin: one that read first
+// and wrote later would fail at once if another write came in between.
+const dbOptions = "?_pragma=busy_timeout(5000)&_txlock=immediate"
+
+// InitDB initializes the database connection and creates tables. Errors say
+// which step failed, and the connection is closed again when one does.
+func InitDB() (err error) {
+	db, err = sql.Open("sqlite", dbPath+dbOptions)
 	if err != nil {
-		return err
+		return fmt.Errorf("opening database %s: %w", dbPath, err)
 	}
+	defer func() {
+		if err != nil {
+			db.Close()
+			db = nil
+		}
+	}()
 
 	// Test the connection
 	if err = db.Ping(); err != nil {
-		return err
+		return fmt.Errorf("connecting to database %s: %w", dbPath, err)
 	}
 
 	// Enable WAL mode for better concurrency
 	_, err = db.Exec("PRAGMA journal_mode=WAL;")
 	if err != nil {
+		return fmt.Errorf("enabling WAL mode: %w", err)
+	}
+
+	// Create messages table
+	if err = initMessageTables(); err != nil {
 		return err
 	}
 
-	// Set busy timeout to 5 seconds
-	_, err = db.Exec("PRAGMA busy_timeout=5000;")
-	if err != nil {
+	// Create users table
+	createUsersTable := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user'
+	);`
+
+	if _, err = db.Exec(createUsersTable); err != nil {
+		return fmt.Errorf("creating users table: %w", err)
+	}
+	if err = addColumnIfMissing("users", "role", "TEXT NOT NULL DEFAULT 'user'"); err != nil {
 		return err
 	}
 
-	// Create messages table
+	// Create the tables of the other features
+	steps := []struct {
+		name string
+		init func() error
+	}{
+		{"document tables", InitDocumentTables},
+		{"document event log table", InitDocumentEventTables},
+		{"document access log table", InitAccessLogTables},
+		{"document comments table", InitCommentTables},
+		{"document snapshots table", InitSnapshotTables},
+		{"document share links table", InitShareLinkTables},
+		{"message reactions table", InitReactionTables},
+		{"group conversation tables", InitConversationTables},
+		{"read position table", InitReadTables},
+		{"notification preferences table", InitPreferenceTables},
+		{"token revocation table", InitAccountTables},
+		{"message search index", InitSearchTables},
+		{"indexes", InitIndexes},
+	}
+	for _, step := range steps {
+		if err = step.init(); err != nil {
+			return fmt.Errorf("creating %s: %w", step.name, err)
+		}
+	}
+
+	log.Println("Database initialized successfully")
+	return nil
+}
+
+// initMessageTables creates the messages table and brings tables created by
+// older versions up to date
+func initMessageTables() error {
 	createMessagesTable := `
 	CREATE TABLE IF NOT EXISTS messages (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -46,55 +110,242 @@ func InitDB() error {
 		timestamp DATETIME NOT NULL,
 		to_user TEXT,
 		from_user TEXT,
-		is_system BOOLEAN DEFAULT 0
+		is_system BOOLEAN DEFAULT 0,
+		room TEXT NOT NULL DEFAULT '',
+		conversation_id TEXT NOT NULL DEFAULT '',
+		created_at DATETIME,
+		edited_at DATETIME,
+		format TEXT NOT NULL DEFAULT '',
+		format_language TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME,
+		client_key TEXT NOT NULL DEFAULT '',
+		parent_id INTEGER NOT NULL DEFAULT 0,
+		thread_id INTEGER NOT NULL DEFAULT 0,
+		depth INTEGER NOT NULL DEFAULT 0
 	);`
 
-	if _, err = db.Exec(createMessagesTable); err != nil {
+	if _, err := db.Exec(createMessagesTable); err != nil {
+		return fmt.Errorf("creating messages table: %w", err)
+	}
+
+	// Databases created before rooms and group conversations existed lack
+	// their columns
+	if err := addColumnIfMissing("messages", "room", "TEXT NOT NULL DEFAULT ''"); err != nil {
 		return err
 	}
+	if err := addColumnIfMissing("messages", "conversation_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_room ON messages(room, id)`); err != nil {
+		return fmt.Errorf("creating messages room index: %w", err)
+	}
 
-	// Create users table
-	createUsersTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		created_at DATETIME NOT NULL
-	);`
+	// Before messages could be edited, timestamp was the only time kept
+	if err := addColumnIfMissing("messages", "created_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "edited_at", "DATETIME"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE messages SET created_at = timestamp WHERE created_at IS NULL`); err != nil {
+		return fmt.Errorf("filling in messages created_at: %w", err)
+	}
 
-	if _, err = db.Exec(createUsersTable); err != nil {
+	// Messages stored before rendering hints existed are plain text
+	if err := addColumnIfMissing("messages", "format", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "format_language", "TEXT NOT NULL DEFAULT ''"); err != nil {
 		return err
 	}
 
-	// Create documents table
-	if err = InitDocumentTables(); err != nil {
+	// Messages stored before they could expire are kept forever
+	if err := addColumnIfMissing("messages", "expires_at", "DATETIME"); err != nil {
 		return err
 	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages(expires_at) WHERE expires_at IS NOT NULL`); err != nil {
+		return fmt.Errorf("creating messages expiry index: %w", err)
+	}
 
-	log.Println("Database initialized successfully")
+	// Client keys let senders resend a message without posting it twice
+	if err := addColumnIfMissing("messages", "client_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_key ON messages(username, client_key) WHERE client_key != ''`); err != nil {
+		return fmt.Errorf("creating messages client key index: %w", err)
+	}
+
+	// Messages stored before threads existed are all top-level
+	if err := addColumnIfMissing("messages", "parent_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "thread_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("messages", "depth", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_parent ON messages(parent_id) WHERE parent_id != 0`); err != nil {
+		return fmt.Errorf("creating messages parent index: %w", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages(thread_id, id) WHERE thread_id != 0`); err != nil {
+		return fmt.Errorf("creating messages thread index: %w", err)
+	}
+
+	// Document list refreshes used to be broadcast, and stored, like chat
+	// messages; they would show up in history and exports
+	if _, err := db.Exec(`DELETE FROM messages WHERE username = '' AND type = ?`, DocList); err != nil {
+		return fmt.Errorf("deleting stored document list refreshes: %w", err)
+	}
 	return nil
 }
 
-// SaveMessage saves a message to the database
-func SaveMessage(msg Msg) error {
+// InitIndexes creates the indexes of the frequent queries: private message
+// lookups, group conversation history, document lists sorted by update time
+// or filtered by creator or share, document event logs and per-user stats
+func InitIndexes() error {
+	createIndexes := `
+	CREATE INDEX IF NOT EXISTS idx_messages_private ON messages(from_user, to_user);
+	CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id, id);
+	CREATE INDEX IF NOT EXISTS idx_messages_username ON messages(username);
+	CREATE INDEX IF NOT EXISTS idx_documents_created_by ON documents(created_by);
+	CREATE INDEX IF NOT EXISTS idx_documents_updated_at ON documents(updated_at);
+	CREATE INDEX IF NOT EXISTS idx_documents_language ON documents(language);
+	CREATE INDEX IF NOT EXISTS idx_document_permissions_username ON document_permissions(username);
+	CREATE INDEX IF NOT EXISTS idx_document_events_document ON document_events(document_id, id);
+	CREATE INDEX IF NOT EXISTS idx_document_events_username ON document_events(username);`
+
+	_, err := db.Exec(createIndexes)
+	return err
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is
+// already there
+func addColumnIfMissing(table, column, definition string) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name = ?)`
+	if err := db.QueryRow(query, table, column).Scan(&exists); err != nil {
+		return fmt.Errorf("checking column %s of table %s: %w", column, table, err)
+	}
+	if exists {
+		return nil
+	}
+
+	log.Printf("Adding column %s to table %s", column, table)
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return fmt.Errorf("adding column %s to table %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// SaveMessage saves a message to the database and returns its ID. It
+// returns errDuplicateMessage instead when the sender already stored a
+// message with the same client key. Content that isn't valid UTF-8 or
+// holds null bytes is handled according to INVALID_CONTENT. The hub saves
+// messages from Run, which must not sleep, so a write the database is still
+// too busy for after its busy timeout isn't retried.
+func SaveMessage(msg Msg) (int64, error) {
+	content, err := cleanContent(msg.Content)
+	if err != nil {
+		return 0, err
+	}
+
+	stored := newStoredMessage(msg)
+	stored.Content = content
+
 	query := `
-		INSERT INTO messages (type, username, content, timestamp, to_user, from_user, is_system)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (type, username, content, timestamp, created_at, to_user, from_user, is_system, room, conversation_id, format, format_language, expires_at, client_key, parent_id, thread_id, depth)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username, client_key) WHERE client_key != '' DO NOTHING
 	`
-	_, err := db.Exec(query, msg.Type, msg.Username, msg.Content, msg.Time, msg.To, msg.From, msg.IsSystem)
-	return err
+	result, err := db.Exec(query, stored.Type, stored.Username, stored.Content, stored.CreatedAt, stored.CreatedAt, stored.ToUser, stored.FromUser,
+		stored.IsSystem, stored.Room, stored.ConversationID, stored.Format, stored.FormatLanguage, stored.ExpiresAt, stored.ClientKey,
+		stored.ParentID, stored.ThreadID, stored.Depth)
+	if err != nil {
+		return 0, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if inserted == 0 {
+		return 0, errDuplicateMessage
+	}
+	return result.LastInsertId()
+}
+
+// GetMessage retrieves a single message by ID, or nil if it doesn't exist or
+// has expired
+func GetMessage(id int64) (*Msg, error) {
+	query := `
+		SELECT ` + messageColumns("") + `
+		FROM messages
+		WHERE id = ? AND (expires_at IS NULL OR expires_at > ?)
+	`
+
+	var stored StoredMessage
+	err := db.QueryRow(query, id, time.Now()).Scan(stored.fields()...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := stored.Msg()
+	return &msg, nil
+}
+
+// UpdateMessage replaces the content of a message and records when it was
+// edited. The creation time is left untouched. The search index follows
+// through its triggers.
+func UpdateMessage(id int64, content string) (time.Time, error) {
+	content, err := cleanContent(content)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	editedAt := time.Now()
+	result, err := db.Exec(`UPDATE messages SET content = ?, edited_at = ? WHERE id = ?`, content, editedAt, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The message may have been deleted, or expired, since it was looked up
+	if updated, err := result.RowsAffected(); err != nil {
+		return time.Time{}, err
+	} else if updated == 0 {
+		return time.Time{}, errMessageGone
+	}
+	return editedAt, nil
 }
 
-// GetRecentMessages retrieves the last N messages from the database
-func GetRecentMessages(limit int) ([]Msg, error) {
+// GetRoomHistory retrieves the last N messages posted in a room (empty for
+// the lobby) before the message with ID before (0 for the newest), along
+// with how many messages viewer can see in the room and whether there are
+// older ones. Reactions are aggregated for viewer, replies are counted, and
+// private messages are only included when viewer sent or received them.
+func GetRoomHistory(room string, before int64, limit int, viewer string) (*HistoryPage, error) {
+	const visible = `
+		room = ? AND conversation_id = ''
+		AND (COALESCE(to_user, '') = '' OR to_user = ? OR from_user = ?)
+		AND (expires_at IS NULL OR expires_at > ?)
+	`
+	now := time.Now()
+
+	page := &HistoryPage{}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE `+visible, room, viewer, viewer, now).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	// Fetch one extra message to tell whether there are older ones
 	query := `
-		SELECT type, username, content, timestamp, to_user, from_user, is_system
+		SELECT ` + messageColumns("") + `
 		FROM messages
+		WHERE ` + visible + `
+		AND (? = 0 OR id < ?)
 		ORDER BY id DESC
 		LIMIT ?
 	`
 
-	rows, err := db.Query(query, limit)
+	rows, err := db.Query(query, room, viewer, viewer, now, before, before, limit+1)
 	if err != nil {
 		return nil, err
 	}
@@ -102,43 +353,65 @@ func GetRecentMessages(limit int) ([]Msg, error) {
 
 	var messages []Msg
 	for rows.Next() {
-		var msg Msg
-		var toUser, fromUser sql.NullString
-
-		err := rows.Scan(&msg.Type, &msg.Username, &msg.Content, &msg.Time, &toUser, &fromUser, &msg.IsSystem)
-		if err != nil {
+		var stored StoredMessage
+		if err := rows.Scan(stored.fields()...); err != nil {
 			return nil, err
 		}
-
-		if toUser.Valid {
-			msg.To = toUser.String
-		}
-		if fromUser.Valid {
-			msg.From = fromUser.String
-		}
-
+		msg := stored.Msg()
 		messages = append(messages, msg)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		page.HasMore = true
+	}
 
 	// Reverse the slice to get chronological order
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
 
-	return messages, nil
+	// Attach the reaction aggregates
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	reactions, err := GetReactionCounts(ids, viewer)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := GetReplyCounts(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].ReplyCount = replies[messages[i].ID]
+	}
+
+	page.Messages = messages
+	if len(messages) > 0 {
+		page.OldestID = messages[0].ID
+		page.NewestID = messages[len(messages)-1].ID
+	}
+	return page, nil
 }
 
 // CreateUser creates a new user with hashed password
 func CreateUser(username, password string) error {
-	// Hash the password
+	// Hash the password, once; only the insert is retried when busy
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
 	query := `INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)`
-	_, err = db.Exec(query, username, string(hashedPassword), time.Now())
-	return err
+	return retryBusy("registering a user", func() error {
+		_, err := db.Exec(query, username, string(hashedPassword), time.Now())
+		return err
+	})
 }
 
 // ValidateUser checks if username and password are correct
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// checkDBRetry reports a negative DB_BUSY_RETRIES or a DB_BUSY_BACKOFF that
+// isn't positive
+func (c *Config) checkDBRetry(p *configProblems) {
+	if c.DBBusyRetries < 0 {
+		p.add("DB_BUSY_RETRIES must not be negative, got %d", c.DBBusyRetries)
+	}
+	if c.DBBusyBackoff <= 0 {
+		p.add("DB_BUSY_BACKOFF must be positive, got %d", c.DBBusyBackoff)
+	}
+}
+
+// isBusy reports whether err is SQLite saying the database is locked by
+// another connection, which goes away by itself, as opposed to an error
+// retrying won't fix
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended codes like SQLITE_BUSY_SNAPSHOT keep the primary code in
+	// their low byte
+	return sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY
+}
+
+// busyBackoff returns how long to wait before retry number attempt (from 0):
+// DB_BUSY_BACKOFF doubled attempt times, of which a random half or more
+func busyBackoff(attempt int) time.Duration {
+	backoff := time.Duration(config.DBBusyBackoff) * time.Millisecond << attempt
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// retryBusy runs a database write, trying it again up to DB_BUSY_RETRIES
+// times while the database is busy. Any other error is returned right
+// away. op names the write in the log. It sleeps between tries, so Run must
+// not call it.
+func retryBusy(op string, write func() error) error {
+	err := write()
+	for attempt := 0; isBusy(err) && attempt < config.DBBusyRetries; attempt++ {
+		wait := busyBackoff(attempt)
+		log.Printf("Database busy while %s, retrying in %v (%d/%d)", op, wait, attempt+1, config.DBBusyRetries)
+		time.Sleep(wait)
+		err = write()
+	}
+	return err
+}
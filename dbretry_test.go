@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Transactions that read before they write, and plain writes, from many
+// goroutines at once wait for each other instead of failing as busy
+func TestConcurrentWritersWait(t *testing.T) {
+	setupTest(t)
+	config.DBBusyRetries = 0
+	createTestUser(t, "alice")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			past := time.Now().Add(-time.Second)
+			_, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: fmt.Sprint("message ", i), Time: time.Now(), ExpiresAt: &past})
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := DeleteExpiredMessages(time.Now())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write failed: %v", err)
+		}
+	}
+}
+
+// Documents created at the same time count each other against the quota,
+// as the count and the insert share a transaction
+func TestConcurrentCreationsKeepToTheQuota(t *testing.T) {
+	setupTest(t)
+	config.DBBusyRetries = 0
+	config.DocQuota = 3
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := CreateDocument(fmt.Sprintf("doc%d.txt", i), "plaintext", "alice")
+			if err != nil && !errors.Is(err, ErrDocumentQuotaExceeded) {
+				t.Errorf("CreateDocument: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if count, err := CountDocumentsByCreator("alice"); err != nil || count != 3 {
+		t.Errorf("alice owns %d documents (%v), want the quota of 3", count, err)
+	}
+}
+
+// lockDatabase holds the write lock of the test database until the
+// returned function is called, and returns a second connection to it that
+// fails at once, as busy, while the lock is held
+func lockDatabase(t *testing.T) (*sql.DB, func()) {
+	t.Helper()
+	if _, err := db.Exec(`CREATE TABLE writes (n INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO writes VALUES (0)`); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Close() })
+	var once sync.Once
+	unlock := func() { once.Do(func() { tx.Rollback() }) }
+	t.Cleanup(unlock)
+	return other, unlock
+}
+
+func TestRetryBusySucceedsWithinBudget(t *testing.T) {
+	setupTest(t)
+	config.DBBusyRetries = 5
+	config.DBBusyBackoff = 20
+	other, unlock := lockDatabase(t)
+	time.AfterFunc(100*time.Millisecond, unlock)
+
+	attempts := 0
+	err := retryBusy("testing", func() error {
+		attempts++
+		_, err := other.Exec(`INSERT INTO writes VALUES (1)`)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("the write failed after %d attempts: %v", attempts, err)
+	}
+	if attempts < 2 || attempts > 6 {
+		t.Errorf("the write took %d attempts, want a retry or more within the budget of 5", attempts)
+	}
+}
+
+func TestRetryBusyGivesUp(t *testing.T) {
+	setupTest(t)
+	config.DBBusyRetries = 2
+	config.DBBusyBackoff = 1
+	other, _ := lockDatabase(t)
+
+	attempts := 0
+	err := retryBusy("testing", func() error {
+		attempts++
+		_, err := other.Exec(`INSERT INTO writes VALUES (1)`)
+		return err
+	})
+	if !isBusy(err) || attempts != 3 {
+		t.Errorf("after %d attempts the error is %v, want busy after 3", attempts, err)
+	}
+
+	// Other errors aren't retried
+	attempts = 0
+	err = retryBusy("testing", func() error {
+		attempts++
+		_, err := db.Exec(`INSERT INTO no_such_table VALUES (1)`)
+		return err
+	})
+	if err == nil || isBusy(err) || attempts != 1 {
+		t.Errorf("a failing statement was tried %d times: %v", attempts, err)
+	}
+	if isBusy(errors.New("database is locked")) {
+		t.Error("an error that isn't from SQLite counts as busy")
+	}
+}
+
+func TestBusyBackoff(t *testing.T) {
+	setupTest(t)
+	config.DBBusyBackoff = 40
+	for attempt, max := range []time.Duration{40, 80, 160} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if wait := busyBackoff(attempt); wait < max/2 || wait > max {
+				t.Errorf("retry %d waits %v, want between %v and %v", attempt, wait, max/2, max)
+			}
+		}
+	}
+}
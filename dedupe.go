@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// maxClientKeyLength is the longest client key accepted on a message
+const maxClientKeyLength = 64
+
+// errDuplicateMessage is returned by SaveMessage when the sender already
+// stored a message with the same client key
+var errDuplicateMessage = errors.New("duplicate message")
+
+// sentKey is a message client key the hub saw recently
+type sentKey struct {
+	MessageID int64 // 0 when the message wasn't stored
+	Seen      time.Time
+}
+
+// sentKeyOf identifies the client key of a message among all senders'
+func sentKeyOf(msg Msg) string {
+	return msg.Username + "\x00" + msg.ClientKey
+}
+
+// checkClientKey validates the key a client put on a chat message so that
+// resending it doesn't post it twice, telling the client when it is invalid
+func (c *Client) checkClientKey(msg *Msg) bool {
+	if len(msg.ClientKey) > maxClientKeyLength {
+		c.sendError(fmt.Sprintf("Client keys can be at most %d characters long", maxClientKeyLength))
+		return false
+	}
+	return true
+}
+
+// GetMessageIDByClientKey returns the ID of the message a user sent with the
+// given client key, or 0 if there is none
+func GetMessageIDByClientKey(username, clientKey string) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM messages WHERE username = ? AND client_key = ?`, username, clientKey).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// saveMessage stores a chat message and sets its ID, unless
+// CHAT_PERSISTENCE is off. A message whose client key its sender already
+// used is not delivered again: the sender is sent the original's ID instead
+// and false is returned, as for a message whose content INVALID_CONTENT
+// refuses. Keys seen in the last MESSAGE_DEDUPE_WINDOW seconds are caught
+// without asking the database, whether or not messages are stored; older
+// ones only when they are.
+func (h *Hub) saveMessage(msg *Msg) bool {
+	// Deliver the content as it is stored
+	content, err := cleanContent(msg.Content)
+	if err != nil {
+		h.sendUserError(msg.Username, "Message not sent: "+err.Error())
+		return false
+	}
+	msg.Content = expandShortcodes(sanitizeControls(content), msg.Format)
+
+	if msg.ClientKey != "" {
+		if sent, ok := h.SentKeys[sentKeyOf(*msg)]; ok {
+			h.sendDuplicate(*msg, sent.MessageID)
+			return false
+		}
+	}
+	if !config.ChatPersistence {
+		// Delivered live only, without an ID
+		h.rememberClientKey(*msg)
+		return true
+	}
+
+	id, err := SaveMessage(*msg)
+	if errors.Is(err, errDuplicateMessage) {
+		original, err := GetMessageIDByClientKey(msg.Username, msg.ClientKey)
+		if err != nil {
+			log.Printf("Failed to look up duplicate message of %s: %v", msg.Username, err)
+			return false
+		}
+		h.sendDuplicate(*msg, original)
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to save %s message: %v", msg.Type, err)
+		return true
+	}
+
+	msg.ID = id
+	h.rememberClientKey(*msg)
+	return true
+}
+
+// rememberClientKey keeps the client key of a delivered message for
+// MESSAGE_DEDUPE_WINDOW seconds, along with its ID if it was stored
+func (h *Hub) rememberClientKey(msg Msg) {
+	if msg.ClientKey != "" && config.MessageDedupeWindow > 0 {
+		h.SentKeys[sentKeyOf(msg)] = sentKey{MessageID: msg.ID, Seen: time.Now()}
+	}
+}
+
+// sendDuplicate tells the connection that resent a message that it was
+// already stored under the given ID. The user's other connections got the
+// original and have nothing to learn from it.
+func (h *Hub) sendDuplicate(msg Msg, originalID int64) {
+	log.Printf("Dropping duplicate message %d from %s", originalID, msg.Username)
+	client := h.clientBySession(msg.SessionID)
+	if client == nil {
+		return
+	}
+	msg.ID = originalID
+	msg.Duplicate = true
+	select {
+	case client.Send <- msg:
+	default:
+		log.Printf("Failed to send duplicate notice to %s", client.Username)
+	}
+}
+
+// forgetSentKeys drops the client keys seen longer than
+// MESSAGE_DEDUPE_WINDOW ago
+func (h *Hub) forgetSentKeys() {
+	cutoff := time.Now().Add(-time.Duration(config.MessageDedupeWindow) * time.Second)
+	for key, sent := range h.SentKeys {
+		if sent.Seen.Before(cutoff) {
+			delete(h.SentKeys, key)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// countContent counts the messages with the given content among msgs
+func countContent(msgs []Msg, content string) int {
+	count := 0
+	for _, msg := range msgs {
+		if msg.Content == content {
+			count++
+		}
+	}
+	return count
+}
+
+func TestResentMessageIsBroadcastOnce(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	register(t, hub, alice)
+	register(t, hub, bob)
+	drain(alice)
+	drain(bob)
+
+	msg := Msg{Type: PublicMessage, Username: "alice", SessionID: alice.ID, Content: "hello", ClientKey: "key-1"}
+	hub.BroadCast <- msg
+	hub.BroadCast <- msg
+
+	if got := countContent(drain(bob), "hello"); got != 1 {
+		t.Errorf("bob got the message %d times, want once", got)
+	}
+	sent := drain(alice)
+	if got := countContent(sent, "hello"); got != 2 {
+		t.Fatalf("alice got %d messages, want the message and a duplicate notice", got)
+	}
+	if !sent[1].Duplicate || sent[1].ID != sent[0].ID {
+		t.Errorf("the resend was answered with %+v, want a duplicate notice for message %d", sent[1], sent[0].ID)
+	}
+}
+
+func TestResentMessageIsBroadcastOnceWithoutPersistence(t *testing.T) {
+	setupTest(t)
+	config.ChatPersistence = false
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	register(t, hub, alice)
+	register(t, hub, bob)
+	drain(alice)
+	drain(bob)
+
+	msg := Msg{Type: PublicMessage, Username: "alice", SessionID: alice.ID, Content: "hello", ClientKey: "key-1"}
+	hub.BroadCast <- msg
+	hub.BroadCast <- msg
+
+	if got := countContent(drain(bob), "hello"); got != 1 {
+		t.Errorf("bob got the message %d times, want once", got)
+	}
+	sent := drain(alice)
+	if len(sent) != 2 || !sent[1].Duplicate {
+		t.Errorf("alice got %+v, want the message and a duplicate notice", sent)
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Errorf("%d messages were stored with CHAT_PERSISTENCE off", stored)
+	}
+}
+
+func TestResentMessageOverWebSocket(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+
+	msg := Msg{Type: PublicMessage, Content: "hello", ClientKey: "key-1"}
+	conn.send(msg)
+	original := conn.expect(PublicMessage)
+	conn.send(msg)
+	resent := conn.expect(PublicMessage)
+	if original.ID == 0 || original.Duplicate || !resent.Duplicate || resent.ID != original.ID {
+		t.Errorf("sent %+v then %+v, want the message then a duplicate notice with its ID", original, resent)
+	}
+
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE username = 'alice' AND client_key = 'key-1'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("the message was stored %d times, want once", stored)
+	}
+
+	conn.send(Msg{Type: PublicMessage, Content: "hello", ClientKey: strings.Repeat("k", maxClientKeyLength+1)})
+	if got := conn.expect(ErrorMessage); !strings.HasPrefix(got.Content, "Client keys can be at most") {
+		t.Errorf("a long client key was answered with %q", got.Content)
+	}
+}
+
+// Past MESSAGE_DEDUPE_WINDOW the hub has forgotten the key, and the unique
+// constraint on the stored messages catches the resend
+func TestResentMessageIsCaughtByTheDatabase(t *testing.T) {
+	setupTest(t)
+	config.MessageDedupeWindow = 0
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	register(t, hub, alice)
+	register(t, hub, bob)
+	drain(alice)
+	drain(bob)
+
+	msg := Msg{Type: PublicMessage, Username: "alice", SessionID: alice.ID, Content: "hello", ClientKey: "key-1"}
+	hub.BroadCast <- msg
+	hub.BroadCast <- msg
+	if got := countContent(drain(bob), "hello"); got != 1 {
+		t.Errorf("bob got the message %d times, want once", got)
+	}
+	sent := drain(alice)
+	if len(sent) != 2 || !sent[1].Duplicate || sent[1].ID != sent[0].ID {
+		t.Errorf("alice got %+v, want the message and a duplicate notice", sent)
+	}
+
+	if _, err := SaveMessage(msg); !errors.Is(err, errDuplicateMessage) {
+		t.Errorf("SaveMessage of a used key = %v, want errDuplicateMessage", err)
+	}
+}
+
+func TestClientKeysAreScopedToTheSender(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	register(t, hub, alice)
+	register(t, hub, bob)
+	drain(alice)
+	drain(bob)
+
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "alice", SessionID: alice.ID, Content: "from alice", ClientKey: "key-1"}
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", SessionID: bob.ID, Content: "from bob", ClientKey: "key-1"}
+	received := drain(bob)
+	if countContent(received, "from alice") != 1 || countContent(received, "from bob") != 1 {
+		t.Errorf("bob got %+v, want both messages", received)
+	}
+	for _, msg := range received {
+		if msg.Duplicate {
+			t.Errorf("another sender's key made %q a duplicate", msg.Content)
+		}
+	}
+}
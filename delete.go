@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Who may delete chat messages, set with MESSAGE_DELETE
+const (
+	DeleteOwn    = "own"    // Users delete their own messages, admins anyone's
+	DeleteAdmins = "admins" // Only admins delete messages
+	DeleteOff    = "off"    // Messages are only removed when they expire
+)
+
+// errMessageGone is returned when a message was deleted, or expired, between
+// being looked up and being changed
+var errMessageGone = errors.New("message no longer exists")
+
+// checkMessageDelete reports an unknown MESSAGE_DELETE
+func (c *Config) checkMessageDelete(p *configProblems) {
+	switch c.MessageDelete {
+	case DeleteOwn, DeleteAdmins, DeleteOff:
+	default:
+		p.add("Invalid MESSAGE_DELETE %q, expected %s, %s or %s", c.MessageDelete, DeleteOwn, DeleteAdmins, DeleteOff)
+	}
+}
+
+// deleteMessage removes a message with its reactions. The search index
+// follows through its triggers, within the same transaction when e is one.
+func deleteMessage(e execer, id int64) error {
+	if _, err := e.Exec(`DELETE FROM message_reactions WHERE message_id = ?`, id); err != nil {
+		return err
+	}
+	result, err := e.Exec(`DELETE FROM messages WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errMessageGone
+	}
+	return nil
+}
+
+// DeleteMessage removes a message, its reactions and its search index entry
+// in one transaction
+func DeleteMessage(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteMessage(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// forgetMessages drops deleted messages from the client keys of recently
+// stored ones, so that a resend isn't answered with a message that is gone.
+// They are the only copy of messages the server keeps outside the database:
+// messages can't be pinned, so there is no pinned set to update either.
+func (h *Hub) forgetMessages(ids ...int64) {
+	gone := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		gone[id] = true
+	}
+	for key, sent := range h.SentKeys {
+		if gone[sent.MessageID] {
+			delete(h.SentKeys, key)
+		}
+	}
+}
+
+// handleMessageDelete deletes a message as MESSAGE_DELETE allows and tells
+// everyone who can see it to remove it
+func (c *Client) handleMessageDelete(messageID int64, hub *Hub) {
+	if config.MessageDelete == DeleteOff {
+		c.sendError("Deleting messages is disabled")
+		return
+	}
+
+	target, participants := c.findVisibleMessage(messageID, hub)
+	if target == nil {
+		return
+	}
+	admin := c.Role == RoleAdmin
+	if target.IsSystem && !admin {
+		c.sendError("You can only delete your own messages")
+		return
+	}
+	if !admin && (config.MessageDelete == DeleteAdmins || target.Username != c.Username) {
+		if config.MessageDelete == DeleteAdmins {
+			c.sendError("Only admins can delete messages")
+		} else {
+			c.sendError("You can only delete your own messages")
+		}
+		return
+	}
+
+	err := DeleteMessage(messageID)
+	if errors.Is(err, errMessageGone) {
+		c.sendError("Message not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting message %d: %v", messageID, err)
+		c.sendError("Failed to delete the message")
+		return
+	}
+	log.Printf("%s deleted message %d of %s", c.Username, messageID, target.Username)
+
+	hub.MessageUpdates <- Msg{
+		Type:      MessageDelete,
+		Username:  c.Username,
+		Time:      time.Now(),
+		MessageID: messageID,
+		To:        target.To,
+		From:      target.From,
+		Room:      target.Room,
+
+		ConversationID: target.ConversationID,
+		Participants:   participants,
+	}
+}
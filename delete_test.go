@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestEditUpdatesSearchAndHistory(t *testing.T) {
+	setupTest(t)
+	id := saveTestMessage(t, "alice", "meet at the harbour")
+
+	if _, err := UpdateMessage(id, "meet at the station"); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+	if ids := searchIDs(t, "harbour"); len(ids) != 0 {
+		t.Errorf("the old content is still found: %v", ids)
+	}
+	if ids := searchIDs(t, "station"); len(ids) != 1 || ids[0] != id {
+		t.Errorf("the new content found %v, want message %d", ids, id)
+	}
+	history := lobbyHistory(t)
+	if len(history) != 1 || history[0].Content != "meet at the station" || history[0].EditedAt == nil {
+		t.Errorf("replayed %+v, want the edited message", history)
+	}
+}
+
+func TestDeleteUpdatesSearchAndHistory(t *testing.T) {
+	setupTest(t)
+	id := saveTestMessage(t, "alice", "meet at the harbour")
+	kept := saveTestMessage(t, "alice", "or the harbour cafe")
+	if _, err := ToggleReaction(id, "bob", "👍"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteMessage(id); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	if ids := searchIDs(t, "harbour"); len(ids) != 1 || ids[0] != kept {
+		t.Errorf("search found %v, want only message %d", ids, kept)
+	}
+	if history := lobbyHistory(t); len(history) != 1 || history[0].ID != kept {
+		t.Errorf("replayed %+v, want only message %d", history, kept)
+	}
+	var reactions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM message_reactions WHERE message_id = ?`, id).Scan(&reactions); err != nil {
+		t.Fatal(err)
+	}
+	if reactions != 0 {
+		t.Errorf("%d reactions to the deleted message are left", reactions)
+	}
+	if err := DeleteMessage(id); err != errMessageGone {
+		t.Errorf("deleting again: %v, want errMessageGone", err)
+	}
+	if _, err := UpdateMessage(id, "too late"); err != errMessageGone {
+		t.Errorf("editing the deleted message: %v, want errMessageGone", err)
+	}
+}
+
+func TestDeletedMessageCanBeResent(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	drain(alice)
+
+	msg := Msg{Type: PublicMessage, Username: "alice", SessionID: alice.ID, Content: "hello", ClientKey: "key-1"}
+	hub.BroadCast <- msg
+	first := receive(t, alice, PublicMessage)
+
+	alice.handleMessageDelete(first.ID, hub)
+	receive(t, alice, MessageDelete)
+
+	// The client key is forgotten with the message, so sending it again
+	// posts it anew instead of pointing at the deleted one
+	hub.BroadCast <- msg
+	again := receive(t, alice, PublicMessage)
+	if again.Duplicate || again.ID == first.ID {
+		t.Errorf("the resend was answered with %+v, want a new message", again)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Delivery statuses of a private message, reported to its sender
+const (
+	DeliveryDelivered = "delivered" // Handed to at least one of the recipient's chat connections
+	DeliveryQueued    = "queued"    // Stored; the recipient gets it with their history when they next connect
+	DeliveryFailed    = "failed"    // Not stored, there is nobody to deliver it to
+)
+
+// checkRecipient tells the sender that their private message failed when
+// it is addressed to a user that doesn't exist, and reports whether it can
+// be sent. Guests have no account, so whether they can still be reached is
+// up to the hub.
+func (c *Client) checkRecipient(msg Msg) bool {
+	if IsGuestUsername(msg.To) {
+		return true
+	}
+	exists, err := UserExists(msg.To)
+	if err != nil {
+		log.Printf("Error checking user existence: %v", err)
+		c.sendError("Failed to send private message")
+		return false
+	}
+	if !exists {
+		c.reply(failedDelivery(msg, fmt.Sprintf("User '%s' does not exist", msg.To)))
+	}
+	return exists
+}
+
+// failedDelivery is the copy of a private message sent back to its sender
+// when it couldn't be sent, with the reason in place of its content
+func failedDelivery(msg Msg, reason string) Msg {
+	msg.Delivery = DeliveryFailed
+	msg.Content = reason
+	msg.Time = time.Now()
+	return msg
+}
+
+// deliverPrivate stores a private message and hands it to the chat
+// connections of its recipient and sender. Each of the sender's copies
+// carries the delivery status. A guest can't be queued for, since they
+// have no account to come back to, so messages to guests that are gone
+// fail, as do messages to anyone offline when CHAT_PERSISTENCE is off.
+func (h *Hub) deliverPrivate(msg Msg) {
+	if IsGuestUsername(msg.To) && !h.userOnline(msg.To) {
+		h.sendToUser(msg.From, failedDelivery(msg, fmt.Sprintf("Guest '%s' is no longer connected", msg.To)))
+		return
+	}
+	if !h.saveMessage(&msg) {
+		return
+	}
+
+	// Messages to oneself only go out once, as the sender's copy
+	delivered := msg.To == msg.From || h.sendToUser(msg.To, msg) > 0
+	if !delivered && !config.ChatPersistence {
+		h.sendToUser(msg.From, failedDelivery(msg, fmt.Sprintf("%s is offline and messages aren't stored", msg.To)))
+		return
+	}
+	msg.Delivery = DeliveryQueued
+	if delivered {
+		msg.Delivery = DeliveryDelivered
+	}
+	log.Printf("Private message from %s to %s %s", msg.From, msg.To, msg.Delivery)
+	h.sendToUser(msg.From, msg)
+
+	note := newNotification(NotifyPrivate, msg.To, msg.From, fmt.Sprintf("%s sent you a private message", msg.From))
+	note.MessageID = msg.ID
+	h.notify(note)
+}
+
+// sendToUser hands a message to the chat connections of a user and returns
+// how many took it
+func (h *Hub) sendToUser(username string, msg Msg) int {
+	sent := 0
+	for client := range h.Clients {
+		if !client.InChat || client.Username != username {
+			continue
+		}
+		select {
+		case client.Send <- msg:
+			sent++
+		default:
+			log.Printf("Failed to send %s message to %s", msg.Type, client.Username)
+		}
+	}
+	return sent
+}
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+// sendPrivate sends a private message and returns the sender's copy
+func sendPrivate(conn *testConn, to, content string) Msg {
+	conn.t.Helper()
+	conn.send(Msg{Type: PrivateMessage, To: to, Content: content})
+	return conn.expect(PrivateMessage)
+}
+
+func TestPrivateMessageDeliveryStatus(t *testing.T) {
+	setupTest(t)
+	config.GuestAccess = true
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	alice := dial(t, server, createTestUser(t, "alice"), nil)
+	bob := dial(t, server, createTestUser(t, "bob"), nil)
+	carolToken := createTestUser(t, "carol")
+	eventually(t, "alice and bob to connect", func() bool { return len(hub.ConnectedClients()) == 2 })
+
+	if got := sendPrivate(alice, "bob", "hi bob"); got.Delivery != DeliveryDelivered || got.Content != "hi bob" {
+		t.Errorf("a message to an online user came back as %+v", got)
+	}
+	if got := bob.expect(PrivateMessage); got.Content != "hi bob" || got.Delivery != "" {
+		t.Errorf("bob got %+v", got)
+	}
+	if got := sendPrivate(alice, "alice", "note to self"); got.Delivery != DeliveryDelivered {
+		t.Errorf("a message to oneself came back as %q", got.Delivery)
+	}
+
+	if got := sendPrivate(alice, "carol", "hi carol"); got.Delivery != DeliveryQueued || got.ID == 0 {
+		t.Errorf("a message to an offline user came back as %+v", got)
+	}
+	if got := sendPrivate(alice, "dave", "hi dave"); got.Delivery != DeliveryFailed || got.Content != "User 'dave' does not exist" {
+		t.Errorf("a message to nobody came back as %+v", got)
+	}
+	if got := sendPrivate(alice, "guest-1234", "hi guest"); got.Delivery != DeliveryFailed || got.Content != "Guest 'guest-1234' is no longer connected" {
+		t.Errorf("a message to a guest who left came back as %+v", got)
+	}
+
+	// The queued message is waiting for carol
+	carol := dial(t, server, carolToken, nil)
+	for {
+		msg := carol.expect(PrivateMessage)
+		if msg.Content == "hi carol" {
+			break
+		}
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE to_user IN ('dave', 'guest-1234')`).Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("%d failed messages were stored, %v", stored, err)
+	}
+}
+
+func TestPrivateMessageFailsWithoutPersistence(t *testing.T) {
+	setupTest(t)
+	config.ChatPersistence = false
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	alice := dial(t, server, createTestUser(t, "alice"), nil)
+	alice.expect(Session)
+	createTestUser(t, "carol")
+
+	if got := sendPrivate(alice, "carol", "hi carol"); got.Delivery != DeliveryFailed || got.Content != "carol is offline and messages aren't stored" {
+		t.Errorf("a message to an offline user came back as %+v", got)
+	}
+}
+
+// Clients that still send the old "Private" type are understood
+func TestLegacyPrivateMessageType(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	alice := dial(t, server, createTestUser(t, "alice"), nil)
+	bob := dial(t, server, createTestUser(t, "bob"), nil)
+	eventually(t, "alice and bob to connect", func() bool { return len(hub.ConnectedClients()) == 2 })
+
+	alice.send(Msg{Type: legacyPrivateMessage, To: "bob", Content: "old habits"})
+	if got := alice.expect(PrivateMessage); got.Delivery != DeliveryDelivered {
+		t.Errorf("the old type came back as %+v", got)
+	}
+	if got := bob.expect(PrivateMessage); got.Content != "old habits" {
+		t.Errorf("bob got %+v", got)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Who users can see in the user list of chat messages, in presence updates
+// and at /api/users, set with USER_DIRECTORY. Admins always see everyone.
+const (
+	DirectoryAll    = "all"    // Every online user
+	DirectoryRooms  = "rooms"  // Online users sharing a room with the viewer
+	DirectoryAdmins = "admins" // Nobody but the viewer
+)
+
+// checkDirectory reports an unknown USER_DIRECTORY
+func (c *Config) checkDirectory(p *configProblems) {
+	switch c.UserDirectoryPolicy {
+	case DirectoryAll, DirectoryRooms, DirectoryAdmins:
+	default:
+		p.add("Invalid USER_DIRECTORY %q, expected %s, %s or %s", c.UserDirectoryPolicy, DirectoryAll, DirectoryRooms, DirectoryAdmins)
+	}
+}
+
+// directoryRequest asks the hub which online users a user may see
+type directoryRequest struct {
+	Username string
+	Admin    bool
+	Reply    chan []string
+}
+
+// userDirectory is a list of online users along with who shares a room
+// with whom, from which each viewer is given the part USER_DIRECTORY lets
+// it see. It is built and used within Run.
+type userDirectory struct {
+	users     []string
+	roomMates map[string]map[string]bool // Only filled with DirectoryRooms
+}
+
+// userDirectory prepares users for filtering by viewer. Users whose
+// connection dropped within RECONNECT_GRACE still count as members of the
+// rooms they were in.
+func (h *Hub) userDirectory(users []string) *userDirectory {
+	d := &userDirectory{users: users}
+	if config.UserDirectoryPolicy != DirectoryRooms {
+		return d
+	}
+
+	rooms := make(map[string]map[string]bool)
+	addMember := func(room, username string) {
+		if rooms[room] == nil {
+			rooms[room] = make(map[string]bool)
+		}
+		rooms[room][username] = true
+	}
+	for room, members := range h.Rooms {
+		for client := range members {
+			addMember(room, client.Username)
+		}
+	}
+	for username, pending := range h.Pending {
+		for _, p := range pending {
+			for _, room := range p.Rooms {
+				addMember(room, username)
+			}
+		}
+	}
+
+	d.roomMates = make(map[string]map[string]bool)
+	for _, members := range rooms {
+		for username := range members {
+			if d.roomMates[username] == nil {
+				d.roomMates[username] = make(map[string]bool)
+			}
+			for mate := range members {
+				d.roomMates[username][mate] = true
+			}
+		}
+	}
+	return d
+}
+
+// sees reports whether a viewer may see another user. Viewers always see
+// themselves.
+func (d *userDirectory) sees(viewer string, admin bool, username string) bool {
+	switch {
+	case admin || config.UserDirectoryPolicy == DirectoryAll || viewer == username:
+		return true
+	case config.UserDirectoryPolicy == DirectoryRooms:
+		return d.roomMates[viewer][username]
+	}
+	return false
+}
+
+// visibleTo returns the users of the directory a viewer may see
+func (d *userDirectory) visibleTo(viewer string, admin bool) []string {
+	if admin || config.UserDirectoryPolicy == DirectoryAll {
+		return d.users
+	}
+	visible := []string{}
+	for _, username := range d.users {
+		if d.sees(viewer, admin, username) {
+			visible = append(visible, username)
+		}
+	}
+	return visible
+}
+
+// visibleToClient returns the users of the directory a client may see
+func (d *userDirectory) visibleToClient(client *Client) []string {
+	return d.visibleTo(client.Username, client.Role == RoleAdmin)
+}
+
+// refreshRoomPresence sends a fresh presence snapshot to the members of a
+// room following presence diffs, whose view of who is online changes with
+// the room's members when USER_DIRECTORY is "rooms"
+func (h *Hub) refreshRoomPresence(room string) {
+	if config.UserDirectoryPolicy != DirectoryRooms {
+		return
+	}
+	for client := range h.Rooms[room] {
+		if client.Presence == PresenceDiff {
+			h.sendPresenceSnapshot(client)
+		}
+	}
+}
+
+// VisibleUsers returns the online users a user may see, sorted. It is safe
+// to call from outside Run.
+func (h *Hub) VisibleUsers(username string, admin bool) []string {
+	reply := make(chan []string, 1)
+	h.Directory <- directoryRequest{Username: username, Admin: admin, Reply: reply}
+	return <-reply
+}
+
+// HandleUsers lists the online users the requester may see, according to
+// USER_DIRECTORY, a page at a time: ?limit= users (USER_LIST_PAGE_SIZE by
+// default) from ?offset=, with the total and whether there are more
+func HandleUsers(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, err := ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		limit = clampLimit(limit, config.UserListPageSize, config.UserListMaxPageSize)
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		offset = max(offset, 0)
+
+		admin := roleOf(claims.Username, claims.Role == RoleGuest) == RoleAdmin
+		users := hub.VisibleUsers(claims.Username, admin)
+		total := len(users)
+		users = users[min(offset, total):min(offset+limit, total)]
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Users   []string `json:"users"`
+			Total   int      `json:"total"`
+			HasMore bool     `json:"hasMore"`
+		}{Users: users, Total: total, HasMore: offset+len(users) < total})
+	}
+}
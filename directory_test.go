@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestUserDirectoryPolicies(t *testing.T) {
+	if DefaultConfig().UserDirectoryPolicy != DirectoryRooms {
+		t.Errorf("USER_DIRECTORY defaults to %q, want the private %q", DefaultConfig().UserDirectoryPolicy, DirectoryRooms)
+	}
+
+	for _, tc := range []struct {
+		policy string
+		alice  string // Who alice sees
+	}{
+		{DirectoryAll, "alice,bob,carol,root"},
+		{DirectoryRooms, "alice,bob"},
+		{DirectoryAdmins, "alice"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			setupTest(t)
+			config.UserDirectoryPolicy = tc.policy
+			config.AdminUsers = []string{"root"}
+			hub := newTestHub(t)
+			clients := map[string]*Client{}
+			for _, username := range []string{"alice", "bob", "carol", "root"} {
+				createTestUser(t, username)
+				clients[username] = fakeClient(username, true)
+				register(t, hub, clients[username])
+			}
+			joinTestRoom(t, hub, clients["alice"], "dev")
+			joinTestRoom(t, hub, clients["bob"], "dev")
+			joinTestRoom(t, hub, clients["carol"], "ops")
+
+			for viewer, want := range map[string]string{"alice": tc.alice, "root": "alice,bob,carol,root"} {
+				// At /api/users
+				token, _ := GenerateToken(viewer)
+				w := callHandler(t, HandleUsers(hub), "GET", "/api/users", token, nil)
+				var page struct{ Users []string }
+				if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+					t.Fatal(err)
+				}
+				if got := strings.Join(page.Users, ","); got != want {
+					t.Errorf("%s sees %s at /api/users, want %s", viewer, got, want)
+				}
+
+				// And in the user list of chat messages
+				drain(clients[viewer])
+				hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: "hi " + viewer}
+				// The hub hands the same list to every viewer who sees everyone
+				list := append([]string(nil), receive(t, clients[viewer], PublicMessage).UserList...)
+				sort.Strings(list)
+				if got := strings.Join(list, ","); got != want {
+					t.Errorf("%s sees %s in the user list, want %s", viewer, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// DocumentStats are counts editors show about a document's content
+type DocumentStats struct {
+	Characters int `json:"characters"`
+	Words      int `json:"words"` // Runs of characters between whitespace
+	Lines      int `json:"lines"` // As an editor numbers them: an empty document has one line, and a trailing line break starts another
+}
+
+// documentStats counts the characters, words and lines of content in one
+// pass, without copying it. Invalid UTF-8 bytes count as one character
+// each.
+func documentStats(content string) *DocumentStats {
+	stats := &DocumentStats{Lines: 1}
+	inWord := false
+	for i := 0; i < len(content); {
+		r, size := rune(content[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRuneInString(content[i:])
+		}
+		i += size
+
+		stats.Characters++
+		if r == '\n' {
+			stats.Lines++
+		}
+		if unicode.IsSpace(r) {
+			inWord = false
+		} else if !inWord {
+			inWord = true
+			stats.Words++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocumentStats(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    DocumentStats
+	}{
+		{"empty", "", DocumentStats{0, 0, 1}},
+		{"one line", "hello world", DocumentStats{11, 2, 1}},
+		{"trailing line break", "hello\n", DocumentStats{6, 1, 2}},
+		{"several lines", "one two\nthree\n\nfour", DocumentStats{19, 4, 4}},
+		{"only line breaks", "\n\n", DocumentStats{2, 0, 3}},
+		{"windows line breaks", "a\r\nb\r\n", DocumentStats{6, 2, 3}},
+		{"runs of whitespace", "  spaced \t out  ", DocumentStats{16, 2, 1}},
+		{"multi-byte characters", "héllo wörld 日本語", DocumentStats{15, 3, 1}},
+		{"invalid UTF-8", "a\xffb c", DocumentStats{5, 2, 1}},
+	} {
+		if got := documentStats(tc.content); *got != tc.want {
+			t.Errorf("%s: documentStats(%q) = %+v, want %+v", tc.name, tc.content, *got, tc.want)
+		}
+	}
+
+	large := strings.Repeat("lorem ipsum dolor\n", 100000)
+	if got := documentStats(large); *got != (DocumentStats{1800000, 300000, 100001}) {
+		t.Errorf("a large document counts as %+v", *got)
+	}
+}
+
+func TestDocumentStatsAreSent(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	alice.expect(Session)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	if err := UpdateDocument(doc.ID, "first line\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	opened := alice.expect(DocContent)
+	if opened.Stats == nil || *opened.Stats != (DocumentStats{11, 2, 2}) {
+		t.Errorf("the document opened with stats %+v", opened.Stats)
+	}
+
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+	alice.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Revision: opened.Revision, Content: "first line\nsecond line"})
+	if ack := alice.expect(DocRevision); ack.Stats == nil || *ack.Stats != (DocumentStats{22, 4, 2}) {
+		t.Errorf("the save was acknowledged with stats %+v", ack.Stats)
+	}
+	if got := receive(t, bob, DocUpdate); got.Stats == nil || *got.Stats != (DocumentStats{22, 4, 2}) {
+		t.Errorf("the update was broadcast with stats %+v", got.Stats)
+	}
+}
@@ -2,7 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -16,9 +22,129 @@ type Document struct {
 	CreatedBy string    `json:"created_by"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Mode      string    `json:"mode"`               // Collaboration mode chosen by the owner
+	Frozen    bool      `json:"frozen"`             // The mode is ModeReadOnly, edits are refused
+	Archived  bool      `json:"archived,omitempty"` // The document was archived, edits are refused
 }
 
-// InitDocumentTables creates the documents table
+// DocumentSummary is a document without its content, as shown in document
+// lists
+type DocumentSummary struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Language  string    `json:"language"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ErrDocumentQuotaExceeded is returned by CreateDocument when the user
+// already owns as many documents as their quota allows
+var ErrDocumentQuotaExceeded = errors.New("document quota exceeded")
+
+// ErrLanguageQuotaExceeded is returned by CreateDocument when there are
+// already as many documents in a language as DOC_LANGUAGE_QUOTAS allows
+var ErrLanguageQuotaExceeded = errors.New("language quota exceeded")
+
+// ErrDocumentDeleted is returned by UpdateDocument when the document no
+// longer exists
+var ErrDocumentDeleted = errors.New("document was deleted")
+
+// ErrInvalidDocumentName is returned by CreateDocument and RenameDocument
+// for names that are empty, too long, contain path separators or control
+// characters, or whose extension isn't allowed
+var ErrInvalidDocumentName = errors.New("invalid document name")
+
+// maxDocumentNameLength is the longest document name accepted, in characters
+const maxDocumentNameLength = 255
+
+// Document list filters accepted on DocList requests
+const (
+	DocFilterAll        = ""
+	DocFilterMine       = "mine"       // Documents the caller created
+	DocFilterAccessible = "accessible" // Documents the caller created or that were shared with them
+	DocFilterArchived   = "archived"   // Documents the caller created and archived
+)
+
+// Fields document lists can be sorted by on DocList requests
+const (
+	DocSortName    = "name"
+	DocSortCreated = "created_at"
+	DocSortUpdated = "updated_at"
+)
+
+// Directions document lists can be sorted in
+const (
+	SortAscending  = "asc"
+	SortDescending = "desc"
+)
+
+// docSortColumns maps the accepted sort fields to the ORDER BY expressions
+// they stand for. Only these expressions ever reach the query.
+var docSortColumns = map[string]string{
+	DocSortName:    "name COLLATE NOCASE",
+	DocSortCreated: "created_at",
+	DocSortUpdated: "updated_at",
+}
+
+// DocumentSort is the order of a document list
+type DocumentSort struct {
+	Field string // DocSortName, DocSortCreated or DocSortUpdated
+	Order string // SortAscending or SortDescending
+}
+
+// parseDocumentSort checks the sort requested on a document list. Lists
+// are sorted by last update by default, names ascending and times newest
+// first unless an order is given.
+func parseDocumentSort(field, order string) (DocumentSort, error) {
+	if field == "" {
+		field = DocSortUpdated
+	}
+	if _, ok := docSortColumns[field]; !ok {
+		return DocumentSort{}, fmt.Errorf("documents can't be sorted by '%s', only by %s, %s or %s", field, DocSortName, DocSortCreated, DocSortUpdated)
+	}
+	switch order {
+	case "":
+		order = SortDescending
+		if field == DocSortName {
+			order = SortAscending
+		}
+	case SortAscending, SortDescending:
+	default:
+		return DocumentSort{}, fmt.Errorf("sort order must be %s or %s", SortAscending, SortDescending)
+	}
+	return DocumentSort{Field: field, Order: order}, nil
+}
+
+// orderBy returns the ORDER BY clause of the sort, with the ID breaking
+// ties so that lists are stable
+func (s DocumentSort) orderBy() string {
+	direction := "ASC"
+	if s.Order == SortDescending {
+		direction = "DESC"
+	}
+	return "ORDER BY " + docSortColumns[s.Field] + " " + direction + ", id"
+}
+
+// DocumentPage is a stretch of a document list
+type DocumentPage struct {
+	Documents []DocumentSummary
+	HasMore   bool // There are documents after these
+	Total     int  // How many documents the whole list holds
+}
+
+// normalizeDocumentLimit clamps a requested document list page size
+func normalizeDocumentLimit(limit int) int {
+	return clampLimit(limit, config.DocListPageSize, config.DocListMaxPageSize)
+}
+
+// Permissions that can be granted on a document to users other than its creator
+const (
+	PermissionRead = "read"
+	PermissionEdit = "edit"
+)
+
+// InitDocumentTables creates the documents and document_permissions tables
 func InitDocumentTables() error {
 	createDocumentsTable := `
 	CREATE TABLE IF NOT EXISTS documents (
@@ -28,15 +154,66 @@ func InitDocumentTables() error {
 		language TEXT DEFAULT 'plaintext',
 		created_by TEXT NOT NULL,
 		created_at DATETIME NOT NULL,
-		updated_at DATETIME NOT NULL
+		updated_at DATETIME NOT NULL,
+		archived_at DATETIME,
+		frozen_at DATETIME,
+		content_encoding TEXT NOT NULL DEFAULT '',
+		collab_mode TEXT NOT NULL DEFAULT 'open'
 	);`
 
-	_, err := db.Exec(createDocumentsTable)
-	return err
+	if _, err := db.Exec(createDocumentsTable); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "archived_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "frozen_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "content_encoding", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("documents", "collab_mode", "TEXT NOT NULL DEFAULT 'open'"); err != nil {
+		return err
+	}
+	// Documents frozen before collaboration modes existed become read-only
+	if _, err := db.Exec(`UPDATE documents SET collab_mode = ?, frozen_at = NULL WHERE frozen_at IS NOT NULL`, ModeReadOnly); err != nil {
+		return err
+	}
+
+	// link_token is the share link a permission was redeemed from, or ''
+	// for one granted by name. Revoking the link takes its grants back.
+	createPermissionsTable := `
+	CREATE TABLE IF NOT EXISTS document_permissions (
+		document_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		granted_at DATETIME NOT NULL,
+		link_token TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (document_id, username)
+	);`
+
+	if _, err := db.Exec(createPermissionsTable); err != nil {
+		return err
+	}
+	return addColumnIfMissing("document_permissions", "link_token", "TEXT NOT NULL DEFAULT ''")
+}
+
+// DocumentQuota returns how many documents a user may own, 0 meaning no limit
+func DocumentQuota(username string) int {
+	if quota, ok := config.DocQuotaOverrides[username]; ok {
+		return quota
+	}
+	return config.DocQuota
 }
 
 // CreateDocument creates a new document
 func CreateDocument(name, language, username string) (*Document, error) {
+	name, err := newDocumentName(name, username)
+	if err != nil {
+		return nil, err
+	}
+
 	doc := &Document{
 		ID:        uuid.New().String(),
 		Name:      name,
@@ -45,6 +222,7 @@ func CreateDocument(name, language, username string) (*Document, error) {
 		CreatedBy: username,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		Mode:      ModeOpen,
 	}
 
 	query := `
@@ -52,7 +230,26 @@ func CreateDocument(name, language, username string) (*Document, error) {
 		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err := db.Exec(query, doc.ID, doc.Name, doc.Content, doc.Language, doc.CreatedBy, doc.CreatedAt, doc.UpdatedAt)
+	// The quotas are checked in the transaction that adds the document, so
+	// that two creations at once can't both squeeze under them
+	err = retryBusy("creating a document", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := checkDocumentQuota(tx, username); err != nil {
+			return err
+		}
+		if err := checkLanguageQuota(tx, language); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, doc.ID, doc.Name, doc.Content, doc.Language, doc.CreatedBy, doc.CreatedAt, doc.UpdatedAt); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -60,12 +257,31 @@ func CreateDocument(name, language, username string) (*Document, error) {
 	return doc, nil
 }
 
+// checkDocumentQuota returns ErrDocumentQuotaExceeded if the user already
+// owns as many documents as their quota allows
+func checkDocumentQuota(q queryer, username string) error {
+	quota := DocumentQuota(username)
+	if quota <= 0 {
+		return nil
+	}
+	count, err := countDocumentsByCreator(q, username)
+	if err != nil {
+		return err
+	}
+	if count >= quota {
+		return fmt.Errorf("%w: you can own at most %d documents", ErrDocumentQuotaExceeded, quota)
+	}
+	return nil
+}
+
 // GetDocument retrieves a document by ID
 func GetDocument(docID string) (*Document, error) {
 	var doc Document
+	var content []byte
+	var encoding string
 
 	query := `
-		SELECT id, name, content, language, created_by, created_at, updated_at
+		SELECT id, name, COALESCE(content, ''), content_encoding, language, created_by, created_at, updated_at, collab_mode, archived_at IS NOT NULL
 		FROM documents
 		WHERE id = ?
 	`
@@ -73,11 +289,14 @@ func GetDocument(docID string) (*Document, error) {
 	err := db.QueryRow(query, docID).Scan(
 		&doc.ID,
 		&doc.Name,
-		&doc.Content,
+		&content,
+		&encoding,
 		&doc.Language,
 		&doc.CreatedBy,
 		&doc.CreatedAt,
 		&doc.UpdatedAt,
+		&doc.Mode,
+		&doc.Archived,
 	)
 
 	if err == sql.ErrNoRows {
@@ -87,30 +306,129 @@ func GetDocument(docID string) (*Document, error) {
 		return nil, err
 	}
 
+	doc.Frozen = doc.Mode == ModeReadOnly
+	doc.Content, err = decodeDocumentContent(content, encoding)
+	if err != nil {
+		return nil, fmt.Errorf("reading content of document %s: %w", docID, err)
+	}
 	return &doc, nil
 }
 
-// GetAllDocuments retrieves all documents
-func GetAllDocuments() ([]Document, error) {
+// GetDocumentSummaries retrieves a page of the documents that aren't
+// archived without their content, for list views
+func GetDocumentSummaries(sort DocumentSort, limit, offset int) (*DocumentPage, error) {
+	return getDocumentPage(`archived_at IS NULL`, nil, sort, limit, offset)
+}
+
+// GetDocumentSummariesByCreator retrieves a page of the documents created by
+// a user, without their content. Archived documents are only returned, and
+// then exclusively, when archived is set.
+func GetDocumentSummariesByCreator(username string, archived bool, sort DocumentSort, limit, offset int) (*DocumentPage, error) {
+	return getDocumentPage(`created_by = ? AND (archived_at IS NOT NULL) = ?`, []any{username, archived}, sort, limit, offset)
+}
+
+// queryer is what the quota checks need of a database or transaction
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// CountDocumentsByCreator returns how many documents a user created
+func CountDocumentsByCreator(username string) (int, error) {
+	return countDocumentsByCreator(db, username)
+}
+
+func countDocumentsByCreator(q queryer, username string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM documents WHERE created_by = ?`
+	err := q.QueryRow(query, username).Scan(&count)
+	return count, err
+}
+
+// GetDocumentCountsByLanguage counts the documents of each language,
+// archived ones included
+func GetDocumentCountsByLanguage() (map[string]int, error) {
+	rows, err := db.Query(`SELECT language, COUNT(*) FROM documents GROUP BY language`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var language string
+		var count int
+		if err := rows.Scan(&language, &count); err != nil {
+			return nil, err
+		}
+		counts[language] = count
+	}
+	return counts, rows.Err()
+}
+
+// CountDocumentsByLanguage counts the documents of one language
+func CountDocumentsByLanguage(language string) (int, error) {
+	return countDocumentsByLanguage(db, language)
+}
+
+func countDocumentsByLanguage(q queryer, language string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM documents WHERE language = ?`
+	err := q.QueryRow(query, language).Scan(&count)
+	return count, err
+}
+
+// GetAccessibleDocumentSummaries retrieves a page of the documents a user
+// created plus the ones that were shared with them, without their content or
+// the archived ones
+func GetAccessibleDocumentSummaries(username string, sort DocumentSort, limit, offset int) (*DocumentPage, error) {
+	return getDocumentPage(`
+		(created_by = ? OR id IN (SELECT document_id FROM document_permissions WHERE username = ?))
+		AND archived_at IS NULL
+	`, []any{username, username}, sort, limit, offset)
+}
+
+// getDocumentPage retrieves limit summaries of the documents matching where,
+// skipping the first offset of them in the given order, along with how many
+// match in all
+func getDocumentPage(where string, args []any, sort DocumentSort, limit, offset int) (*DocumentPage, error) {
+	page := &DocumentPage{}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM documents WHERE `+where, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	// Fetch one extra document to tell whether there are more
 	query := `
-		SELECT id, name, content, language, created_by, created_at, updated_at
+		SELECT id, name, language, created_by, created_at, updated_at
 		FROM documents
-		ORDER BY updated_at DESC
-	`
+		WHERE ` + where + `
+	` + sort.orderBy() + `
+		LIMIT ? OFFSET ?`
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, append(args, limit+1, offset)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var documents []Document
+	page.Documents, err = scanDocumentSummaries(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Documents) > limit {
+		page.Documents = page.Documents[:limit]
+		page.HasMore = true
+	}
+	return page, nil
+}
+
+// scanDocumentSummaries reads every row of a document summaries query
+func scanDocumentSummaries(rows *sql.Rows) ([]DocumentSummary, error) {
+	documents := []DocumentSummary{}
 	for rows.Next() {
-		var doc Document
+		var doc DocumentSummary
 		err := rows.Scan(
 			&doc.ID,
 			&doc.Name,
-			&doc.Content,
 			&doc.Language,
 			&doc.CreatedBy,
 			&doc.CreatedAt,
@@ -122,24 +440,191 @@ func GetAllDocuments() ([]Document, error) {
 		documents = append(documents, doc)
 	}
 
-	return documents, nil
+	return documents, rows.Err()
+}
+
+// GrantDocumentPermission shares a document with a user, replacing any
+// permission they already had on it. The grant lasts until it is changed,
+// even if the user first got access through a share link.
+func GrantDocumentPermission(docID, username, permission string) error {
+	return grantDocumentPermission(docID, username, permission, "")
 }
 
-// UpdateDocument updates document content
+// grantDocumentPermission grants a permission redeemed from the share link
+// with the given token, or granted by name when linkToken is ""
+func grantDocumentPermission(docID, username, permission, linkToken string) error {
+	query := `
+		INSERT INTO document_permissions (document_id, username, permission, granted_at, link_token)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (document_id, username) DO UPDATE SET permission = excluded.permission, granted_at = excluded.granted_at, link_token = excluded.link_token
+	`
+
+	return retryBusy("sharing a document", func() error {
+		_, err := db.Exec(query, docID, username, permission, time.Now(), linkToken)
+		return err
+	})
+}
+
+// GetDocumentPermission returns the permission granted to a user on a
+// document, or "" when none was granted
+func GetDocumentPermission(docID, username string) (string, error) {
+	var permission string
+	query := `SELECT permission FROM document_permissions WHERE document_id = ? AND username = ?`
+	err := db.QueryRow(query, docID, username).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return permission, err
+}
+
+// RenameDocument changes a document's name and language
+func RenameDocument(docID, name, language string) error {
+	name, err := sanitizeDocumentName(name)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE documents SET name = ?, language = ?, updated_at = ? WHERE id = ?`
+	return retryBusy("renaming a document", func() error {
+		_, err := db.Exec(query, name, language, time.Now(), docID)
+		return err
+	})
+}
+
+// UpdateDocument stores new content for a document, compressed if
+// DOC_COMPRESSION says so. Content that isn't valid UTF-8 or holds null
+// bytes is handled according to INVALID_CONTENT. It isn't retried while
+// the database is busy: the hub calls it from Run, and keeps the changes
+// unsaved for the next autosave to try again.
 func UpdateDocument(docID, content string) error {
+	content, err := cleanContent(content)
+	if err != nil {
+		return err
+	}
+	stored, encoding, err := encodeDocumentContent(content)
+	if err != nil {
+		return err
+	}
+
 	query := `
 		UPDATE documents
-		SET content = ?, updated_at = ?
+		SET content = ?, content_encoding = ?, updated_at = ?
 		WHERE id = ?
 	`
 
-	_, err := db.Exec(query, content, time.Now(), docID)
+	result, err := db.Exec(query, stored, encoding, time.Now(), docID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err == nil && updated == 0 {
+		return ErrDocumentDeleted
+	}
 	return err
 }
 
-// DeleteDocument deletes a document
+// execer is what deleteDocument needs of a database or transaction
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// DeleteDocument deletes a document along with the permissions granted on it,
+// its share links and its comments
 func DeleteDocument(docID string) error {
+	return deleteDocument(db, docID)
+}
+
+func deleteDocument(e execer, docID string) error {
+	if _, err := e.Exec(`DELETE FROM document_permissions WHERE document_id = ?`, docID); err != nil {
+		return err
+	}
+	if _, err := e.Exec(`DELETE FROM document_comments WHERE document_id = ?`, docID); err != nil {
+		return err
+	}
+	if _, err := e.Exec(`DELETE FROM document_share_links WHERE document_id = ?`, docID); err != nil {
+		return err
+	}
+	if _, err := e.Exec(`DELETE FROM document_snapshots WHERE document_id = ?`, docID); err != nil {
+		return err
+	}
+
 	query := `DELETE FROM documents WHERE id = ?`
-	_, err := db.Exec(query, docID)
+	_, err := e.Exec(query, docID)
 	return err
 }
+
+// newDocumentName checks the name of a document the user is creating. An
+// empty name is replaced by the next untitled name of the user when
+// DOC_UNTITLED_PREFIX is set.
+func newDocumentName(name, username string) (string, error) {
+	if strings.TrimSpace(name) == "" && config.DocUntitledPrefix != "" {
+		return untitledDocumentName(username)
+	}
+	return sanitizeDocumentName(name)
+}
+
+// untitledDocumentName returns DOC_UNTITLED_PREFIX followed by the lowest
+// number none of the user's documents is named with, plus the first allowed
+// extension if DOC_EXTENSIONS restricts them
+func untitledDocumentName(username string) (string, error) {
+	var ext string
+	if len(config.DocExtensions) > 0 {
+		ext = "." + strings.TrimPrefix(config.DocExtensions[0], ".")
+	}
+
+	rows, err := db.Query(`SELECT name FROM documents WHERE created_by = ?`, username)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		taken[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s-%d%s", config.DocUntitledPrefix, n, ext)
+		if !taken[strings.ToLower(name)] {
+			return sanitizeDocumentName(name)
+		}
+	}
+}
+
+// sanitizeDocumentName trims a document name and checks that it is a plain
+// file name with an allowed extension
+func sanitizeDocumentName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("%w: a name is required", ErrInvalidDocumentName)
+	}
+	if utf8.RuneCountInString(name) > maxDocumentNameLength {
+		return "", fmt.Errorf("%w: at most %d characters", ErrInvalidDocumentName, maxDocumentNameLength)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("%w: path separators are not allowed", ErrInvalidDocumentName)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 || !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: control characters are not allowed", ErrInvalidDocumentName)
+	}
+
+	if len(config.DocExtensions) > 0 {
+		ext := strings.TrimPrefix(filepath.Ext(name), ".")
+		allowed := false
+		for _, candidate := range config.DocExtensions {
+			allowed = allowed || strings.EqualFold(ext, strings.TrimPrefix(candidate, "."))
+		}
+		if !allowed {
+			return "", fmt.Errorf("%w: the extension must be one of %s", ErrInvalidDocumentName, strings.Join(config.DocExtensions, ", "))
+		}
+	}
+
+	return name, nil
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// createTestDocument creates a document owned by username
+func createTestDocument(t *testing.T, name, username string) *Document {
+	t.Helper()
+	doc, err := CreateDocument(name, "plaintext", username)
+	if err != nil {
+		t.Fatalf("CreateDocument %s: %v", name, err)
+	}
+	return doc
+}
+
+// Clients opening, editing, asking who edits and leaving a document all at
+// once only reach the editing sessions through the hub, which -race checks
+func TestDocumentUsers(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	doc := createTestDocument(t, "notes.txt", "alice")
+
+	// Opening and closing from the clients' own goroutines only goes
+	// through the hub's channels
+	alice := fakeClient("alice", false)
+	bob := fakeClient("bob", false)
+	register(t, hub, alice)
+	register(t, hub, bob)
+	var wg sync.WaitGroup
+	for _, client := range []*Client{alice, bob} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.handleDocumentOpen(doc.ID, "", hub)
+		}()
+	}
+	wg.Wait()
+	receive(t, alice, DocContent)
+	receive(t, bob, DocContent)
+
+	alice.handleDocumentUsers(doc.ID, hub)
+	editors := receive(t, alice, DocUsers).UserList
+	sort.Strings(editors)
+	if len(editors) != 2 || editors[0] != "alice" || editors[1] != "bob" {
+		t.Errorf("editors = %v, want alice and bob", editors)
+	}
+
+	hub.LeaveDocument <- bob
+	eventually(t, "bob to leave the document", func() bool { return len(hub.DocumentEditors(doc.ID)) == 1 })
+}
+
+func TestConcurrentDocumentSessions(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "notes.txt", "alice")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		client := fakeClient(fmt.Sprintf("user%d", i), false)
+		register(t, hub, client)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.handleDocumentOpen(doc.ID, "", hub)
+			for j := 0; j < 10; j++ {
+				hub.DocumentEdits <- documentEdit{Client: client, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: client.Username, Content: fmt.Sprintf("%s edit %d", client.Username, j)}}
+				hub.DocumentEditors(doc.ID)
+			}
+			if i%2 == 0 {
+				hub.LeaveDocument <- client
+			} else {
+				hub.Unregister <- client
+				for range client.Send {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	eventually(t, "everyone to leave the document", func() bool { return len(hub.DocumentEditors(doc.ID)) == 0 })
+}
+
+// openTestDocument registers a fake client for username and opens a
+// document with it
+func openTestDocument(t *testing.T, hub *Hub, username, docID string) *Client {
+	t.Helper()
+	client := fakeClient(username, false)
+	register(t, hub, client)
+	client.handleDocumentOpen(docID, "", hub)
+	receive(t, client, DocContent)
+	return client
+}
+
+func TestDocumentUsersOfMissingDocument(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", false)
+	register(t, hub, alice)
+
+	alice.handleDocumentUsers("no-such-document", hub)
+	if msg := receive(t, alice, ErrorMessage); msg.Content != "Document not found" {
+		t.Errorf("error = %q, want Document not found", msg.Content)
+	}
+	for _, msg := range drain(alice) {
+		if msg.Type == DocUsers {
+			t.Errorf("editors of a missing document were sent: %v", msg.UserList)
+		}
+	}
+}
+
+func TestEditDeletedDocument(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+
+	if _, err := bulkDocuments(hub, "alice", RoleUser, BulkDelete, []string{doc.ID}); err != nil {
+		t.Fatalf("bulkDocuments: %v", err)
+	}
+	if msg := receive(t, alice, DocClose); msg.Content != "This document was deleted" {
+		t.Errorf("document closed with %q", msg.Content)
+	}
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "lost"}}
+	receive(t, alice, ErrorMessage)
+	if editors := hub.DocumentEditors(doc.ID); len(editors) != 0 {
+		t.Errorf("the deleted document is still edited by %v", editors)
+	}
+}
+
+// A document deleted behind the hub's back, say by an account deletion,
+// ends its session when the hub next tries to save it
+func TestEditDocumentDeletedElsewhere(t *testing.T) {
+	setupTest(t)
+	config.DocAutosaveInterval = 1
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	if err := deleteDocument(db, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "lost"}}
+	for _, client := range []*Client{alice, bob} {
+		if msg := receive(t, client, DocClose); msg.Content != "This document was deleted" {
+			t.Errorf("%s's document closed with %q", client.Username, msg.Content)
+		}
+	}
+	if editors := hub.DocumentEditors(doc.ID); len(editors) != 0 {
+		t.Errorf("the deleted document is still edited by %v", editors)
+	}
+}
+
+func TestArchiveKeepsUnsavedEdits(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "draft"}}
+	if _, err := bulkDocuments(hub, "alice", RoleUser, BulkArchive, []string{doc.ID}); err != nil {
+		t.Fatalf("bulkDocuments: %v", err)
+	}
+	if msg := receive(t, alice, DocClose); msg.Content != "This document was archived" {
+		t.Errorf("document closed with %q", msg.Content)
+	}
+	stored, err := GetDocument(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Archived || stored.Content != "draft" {
+		t.Errorf("stored document is archived=%v with %q, want archived with the edit", stored.Archived, stored.Content)
+	}
+}
+
+func TestEditArchivedDocumentIsRefused(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	if _, err := BulkUpdateDocuments(BulkArchive, []string{doc.ID}, "alice", RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: "changed"}}
+	receive(t, alice, ErrorMessage)
+	stored, err := GetDocument(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Content != "" {
+		t.Errorf("the archived document was changed to %q", stored.Content)
+	}
+}
+
+func TestCreatorJoinsNewDocument(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", false)
+	register(t, hub, alice)
+
+	alice.handleDocumentCreate("plan.txt", "plaintext", hub)
+	doc := receive(t, alice, DocContent)
+	if doc.DocumentID == "" || doc.Name != "plan.txt" {
+		t.Fatalf("the creator was sent %+v, want the new document", doc)
+	}
+	if editors := hub.DocumentEditors(doc.DocumentID); len(editors) != 1 || editors[0] != "alice" {
+		t.Errorf("editors right after creation = %v, want alice", editors)
+	}
+
+	// Edits by others reach the creator without reopening the document
+	bob := fakeClient("bob", false)
+	register(t, hub, bob)
+	bob.handleDocumentOpen(doc.DocumentID, "", hub)
+	receive(t, alice, UserJoined)
+	hub.DocumentEdits <- documentEdit{Client: bob, Msg: Msg{Type: DocUpdate, DocumentID: doc.DocumentID, Username: "bob", Content: "step one"}}
+	if edit := receive(t, alice, DocUpdate); edit.Content != "step one" {
+		t.Errorf("the creator got edit %q", edit.Content)
+	}
+}
+
+// listDocuments sends a DocList request with a filter and returns the names
+// of the documents listed, by name
+func listDocuments(t *testing.T, client *Client, filter string) []string {
+	t.Helper()
+	client.handleDocumentList(filter, DocSortName, SortAscending, 0, 0)
+	list := receive(t, client, DocList)
+	names := []string{}
+	for _, doc := range list.Documents {
+		names = append(names, doc.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDocumentListFilters(t *testing.T) {
+	setupTest(t)
+	createTestDocument(t, "owned.txt", "alice")
+	shared := createTestDocument(t, "shared.txt", "bob")
+	createTestDocument(t, "unrelated.txt", "carol")
+	if err := GrantDocumentPermission(shared.ID, "alice", PermissionRead); err != nil {
+		t.Fatalf("GrantDocumentPermission: %v", err)
+	}
+
+	alice := fakeClient("alice", false)
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{DocFilterMine, []string{"owned.txt"}},
+		{DocFilterAccessible, []string{"owned.txt", "shared.txt"}},
+		{DocFilterAll, []string{"owned.txt", "shared.txt", "unrelated.txt"}},
+	}
+	for _, tt := range tests {
+		if got := listDocuments(t, alice, tt.filter); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q lists %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	dave := fakeClient("dave", false)
+	if got := listDocuments(t, dave, DocFilterMine); len(got) != 0 {
+		t.Errorf("dave's own documents are %v, want none", got)
+	}
+}
+
+func TestDocumentQuota(t *testing.T) {
+	setupTest(t)
+	config.DocQuota = 2
+	config.DocQuotaOverrides = map[string]int{"bob": 3}
+
+	first := createTestDocument(t, "one.txt", "alice")
+	createTestDocument(t, "two.txt", "alice")
+	if _, err := CreateDocument("three.txt", "plaintext", "alice"); !errors.Is(err, ErrDocumentQuotaExceeded) {
+		t.Fatalf("creating past the quota: %v, want ErrDocumentQuotaExceeded", err)
+	}
+	if count, err := CountDocumentsByCreator("alice"); err != nil || count != 2 {
+		t.Errorf("alice owns %d documents (%v), want 2", count, err)
+	}
+
+	if err := DeleteDocument(first.ID); err != nil {
+		t.Fatalf("DeleteDocument: %v", err)
+	}
+	createTestDocument(t, "three.txt", "alice")
+
+	// Overrides raise the quota of some users
+	for _, name := range []string{"one.txt", "two.txt", "three.txt"} {
+		createTestDocument(t, name, "bob")
+	}
+	if _, err := CreateDocument("four.txt", "plaintext", "bob"); !errors.Is(err, ErrDocumentQuotaExceeded) {
+		t.Errorf("creating past bob's quota: %v, want ErrDocumentQuotaExceeded", err)
+	}
+}
+
+func TestLargeDocumentIsStreamedInChunks(t *testing.T) {
+	setupTest(t)
+	config.DocChunkSize = 100
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "big.txt", "alice")
+	content := strings.Repeat("héllo wörld ", 50)
+	if err := UpdateDocument(doc.ID, content); err != nil {
+		t.Fatalf("UpdateDocument: %v", err)
+	}
+	alice := openTestDocumentChunked(t, hub, "alice", doc.ID)
+
+	// Edits made once bob has joined arrive after the whole stream
+	bob := fakeClient("bob", false)
+	register(t, hub, bob)
+	bob.handleDocumentOpen(doc.ID, "", hub)
+	eventually(t, "bob to join the document", func() bool { return len(hub.DocumentEditors(doc.ID)) == 2 })
+	hub.DocumentEdits <- documentEdit{Client: alice, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "alice", Content: content + "!"}}
+
+	var assembled strings.Builder
+	chunks := 0
+	for {
+		msg := receive(t, bob, "")
+		if msg.Type == DocUpdate {
+			if chunks == 0 {
+				t.Fatal("bob got an edit before the document")
+			}
+			break
+		}
+		if msg.Type != DocContentChunk {
+			continue
+		}
+		chunks++
+		if msg.Chunk != chunks {
+			t.Fatalf("chunk %d arrived in position %d", msg.Chunk, chunks)
+		}
+		if !utf8.ValidString(msg.Content) || len(msg.Content) > config.DocChunkSize {
+			t.Errorf("chunk %d is %d bytes of valid UTF-8: %v", msg.Chunk, len(msg.Content), utf8.ValidString(msg.Content))
+		}
+		assembled.WriteString(msg.Content)
+		if msg.Final != (msg.Chunk == msg.ChunkCount) {
+			t.Errorf("chunk %d of %d has final %v", msg.Chunk, msg.ChunkCount, msg.Final)
+		}
+	}
+	if chunks < 2 {
+		t.Errorf("the document came in %d chunks", chunks)
+	}
+	if assembled.String() != content {
+		t.Errorf("reassembled %d bytes, want %d", assembled.Len(), len(content))
+	}
+}
+
+// openTestDocumentChunked is openTestDocument for documents large enough to
+// be streamed, waiting for their final chunk
+func openTestDocumentChunked(t *testing.T, hub *Hub, username, docID string) *Client {
+	t.Helper()
+	client := fakeClient(username, false)
+	register(t, hub, client)
+	client.handleDocumentOpen(docID, "", hub)
+	for !receive(t, client, DocContentChunk).Final {
+	}
+	return client
+}
+
+func TestSanitizeDocumentName(t *testing.T) {
+	setupTest(t)
+	if name, err := sanitizeDocumentName("  notes.txt \t"); err != nil || name != "notes.txt" {
+		t.Errorf("sanitizeDocumentName trimmed to %q, %v", name, err)
+	}
+	for _, name := range []string{"", "   ", "..", "../etc/passwd", `docs\notes.txt`, "bell\a.txt", "tab\tinside.txt", "bad\xffname", strings.Repeat("a", 256)} {
+		if _, err := sanitizeDocumentName(name); !errors.Is(err, ErrInvalidDocumentName) {
+			t.Errorf("sanitizeDocumentName(%q) = %v, want ErrInvalidDocumentName", name, err)
+		}
+	}
+
+	config.DocExtensions = []string{"go", ".md"}
+	for _, name := range []string{"main.go", "README.MD"} {
+		if _, err := sanitizeDocumentName(name); err != nil {
+			t.Errorf("%q was refused with DOC_EXTENSIONS go,.md: %v", name, err)
+		}
+	}
+	for _, name := range []string{"notes.txt", "Makefile", "go"} {
+		if _, err := sanitizeDocumentName(name); !errors.Is(err, ErrInvalidDocumentName) {
+			t.Errorf("%q was accepted with DOC_EXTENSIONS go,.md", name)
+		}
+	}
+}
+
+func TestInvalidDocumentNamesAreRefused(t *testing.T) {
+	setupTest(t)
+	config.DocExtensions = []string{"txt"}
+	if _, err := CreateDocument("../secret.txt", "plaintext", "alice"); !errors.Is(err, ErrInvalidDocumentName) {
+		t.Errorf("CreateDocument with a path: %v, want ErrInvalidDocumentName", err)
+	}
+	doc := createTestDocument(t, " notes.txt ", "alice")
+	if doc.Name != "notes.txt" {
+		t.Errorf("the document was named %q", doc.Name)
+	}
+
+	if err := RenameDocument(doc.ID, "notes.exe", "plaintext"); !errors.Is(err, ErrInvalidDocumentName) {
+		t.Errorf("RenameDocument to notes.exe: %v, want ErrInvalidDocumentName", err)
+	}
+	if err := RenameDocument(doc.ID, "plans.txt", "plaintext"); err != nil {
+		t.Fatalf("RenameDocument: %v", err)
+	}
+	if stored, _ := GetDocument(doc.ID); stored.Name != "plans.txt" {
+		t.Errorf("the document is named %q after renaming", stored.Name)
+	}
+}
+
+func TestDocumentEditorCap(t *testing.T) {
+	setupTest(t)
+	config.DocMaxEditors = 2
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	openTestDocument(t, hub, "bob", doc.ID)
+
+	carol := fakeClient("carol", false)
+	register(t, hub, carol)
+	carol.handleDocumentOpen(doc.ID, "", hub)
+	if msg := receive(t, carol, ErrorMessage); msg.Content != "Document is at capacity, it allows at most 2 editors at a time" {
+		t.Errorf("the third editor was told %q", msg.Content)
+	}
+	if editors := hub.DocumentEditors(doc.ID); len(editors) != 2 {
+		t.Errorf("editors = %v, want alice and bob only", editors)
+	}
+
+	// With DOC_OVERFLOW_READ_ONLY, latecomers watch instead
+	config.DocOverflowReadOnly = true
+	carol.handleDocumentOpen(doc.ID, "", hub)
+	if content := receive(t, carol, DocContent); !content.ReadOnly {
+		t.Error("the third editor wasn't made read-only")
+	}
+	hub.DocumentEdits <- documentEdit{Client: carol, Msg: Msg{Type: DocUpdate, DocumentID: doc.ID, Username: "carol", Content: "mine now"}}
+	receive(t, carol, ErrorMessage)
+
+	// A seat freed by an editor is free again for the next one
+	hub.LeaveDocument <- alice
+	dave := openTestDocument(t, hub, "dave", doc.ID)
+	if dave.ReadOnly {
+		t.Error("dave was made read-only though alice left")
+	}
+}
+
+func TestDocumentListSkipsContent(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+
+	// Content that can't be decoded breaks whatever reads it
+	if _, err := db.Exec(`UPDATE documents SET content = ?, content_encoding = ? WHERE id = ?`, []byte("not gzip"), ContentGzip, doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetDocument(doc.ID); err == nil {
+		t.Fatal("GetDocument read the broken content")
+	}
+
+	if got := listDocuments(t, fakeClient("alice", false), DocFilterAll); len(got) != 1 || got[0] != "notes.txt" {
+		t.Errorf("the list is %v, want notes.txt", got)
+	}
+	page, err := GetDocumentSummaries(DocumentSort{Field: DocSortName, Order: SortAscending}, 10, 0)
+	if err != nil {
+		t.Fatalf("GetDocumentSummaries: %v", err)
+	}
+	data, err := json.Marshal(page.Documents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "content") {
+		t.Errorf("summaries carry content: %s", data)
+	}
+}
+
+func TestEditReachesTheSendersOtherConnections(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	laptop := dial(t, server, token, nil)
+	phone := dial(t, server, token, nil)
+	laptop.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	laptop.expect(DocContent)
+	phone.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	phone.expect(DocContent)
+
+	laptop.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "typed on the laptop"})
+	if edit := phone.expect(DocUpdate); edit.Content != "typed on the laptop" {
+		t.Errorf("the other connection got %q", edit.Content)
+	}
+	// The laptop's next update is the phone's, not an echo of its own
+	phone.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "typed on the phone"})
+	if edit := laptop.expect(DocUpdate); edit.Content != "typed on the phone" {
+		t.Errorf("the edit was echoed to the connection it came from: %q", edit.Content)
+	}
+}
+
+func TestDocumentListSorts(t *testing.T) {
+	setupTest(t)
+	base := time.Now().Add(-time.Hour)
+	for i, doc := range []struct {
+		name             string
+		created, updated int
+	}{
+		{"b.txt", 0, 3},
+		{"A.txt", 1, 2},
+		{"c.txt", 2, 1},
+	} {
+		created := createTestDocument(t, doc.name, "alice")
+		if _, err := db.Exec(`UPDATE documents SET created_at = ?, updated_at = ? WHERE id = ?`, base.Add(time.Duration(doc.created)*time.Minute), base.Add(time.Duration(doc.updated)*time.Minute), created.ID); err != nil {
+			t.Fatalf("dating document %d: %v", i, err)
+		}
+	}
+
+	alice := fakeClient("alice", false)
+	for _, tc := range []struct {
+		field, order       string
+		want               string
+		appliedF, appliedO string
+	}{
+		{"", "", "b.txt,A.txt,c.txt", DocSortUpdated, SortDescending},
+		{DocSortUpdated, SortAscending, "c.txt,A.txt,b.txt", DocSortUpdated, SortAscending},
+		{DocSortCreated, "", "c.txt,A.txt,b.txt", DocSortCreated, SortDescending},
+		{DocSortCreated, SortAscending, "b.txt,A.txt,c.txt", DocSortCreated, SortAscending},
+		// Names sort without regard to case
+		{DocSortName, "", "A.txt,b.txt,c.txt", DocSortName, SortAscending},
+		{DocSortName, SortDescending, "c.txt,b.txt,A.txt", DocSortName, SortDescending},
+	} {
+		alice.handleDocumentList(DocFilterAll, tc.field, tc.order, 0, 0)
+		list := receive(t, alice, DocList)
+		var names []string
+		for _, doc := range list.Documents {
+			names = append(names, doc.Name)
+		}
+		if got := strings.Join(names, ","); got != tc.want || list.Sort != tc.appliedF || list.Order != tc.appliedO {
+			t.Errorf("sorting by %q %q listed %s as %s %s, want %s as %s %s", tc.field, tc.order, got, list.Sort, list.Order, tc.want, tc.appliedF, tc.appliedO)
+		}
+	}
+
+	for _, bad := range [][2]string{{"id; DROP TABLE documents", ""}, {"content", ""}, {DocSortName, "sideways"}} {
+		alice.handleDocumentList(DocFilterAll, bad[0], bad[1], 0, 0)
+		if got := receive(t, alice, ""); got.Type != ErrorMessage {
+			t.Errorf("sorting by %q %q was answered with %s", bad[0], bad[1], got.Type)
+		}
+	}
+	if count := countDocuments(t); count != 3 {
+		t.Errorf("%d documents are left", count)
+	}
+}
+
+func TestDocumentListPaging(t *testing.T) {
+	setupTest(t)
+	config.DocListPageSize = 10
+	config.DocListMaxPageSize = 25
+	for i := 0; i < 57; i++ {
+		createTestDocument(t, fmt.Sprintf("doc-%02d.txt", i), "alice")
+	}
+	alice := fakeClient("alice", false)
+
+	// Paging through with the default page size sees every document once
+	var names []string
+	for offset := 0; ; offset += 10 {
+		alice.handleDocumentList(DocFilterAll, DocSortName, SortAscending, 0, offset)
+		page := receive(t, alice, DocList)
+		if page.Total != 57 || page.Limit != 10 || page.Offset != offset {
+			t.Fatalf("page at %d has total %d, limit %d, offset %d", offset, page.Total, page.Limit, page.Offset)
+		}
+		for _, doc := range page.Documents {
+			names = append(names, doc.Name)
+		}
+		if wantMore := offset+10 < 57; page.HasMore != wantMore {
+			t.Errorf("page at %d has hasMore %v, want %v", offset, page.HasMore, wantMore)
+		}
+		if !page.HasMore {
+			break
+		}
+	}
+	if len(names) != 57 || names[0] != "doc-00.txt" || names[56] != "doc-56.txt" || !sort.StringsAreSorted(names) {
+		t.Errorf("paging listed %d documents from %s", len(names), names[0])
+	}
+
+	// Page sizes are capped, and a page past the end is empty
+	alice.handleDocumentList(DocFilterAll, "", "", 1000, 0)
+	if page := receive(t, alice, DocList); len(page.Documents) != 25 || page.Limit != 25 || !page.HasMore {
+		t.Errorf("a page of 1000 held %d documents with limit %d", len(page.Documents), page.Limit)
+	}
+	alice.handleDocumentList(DocFilterAll, "", "", 0, 100)
+	if page := receive(t, alice, DocList); len(page.Documents) != 0 || page.HasMore || page.Total != 57 {
+		t.Errorf("the page past the end is %+v", page)
+	}
+	alice.handleDocumentList(DocFilterAll, "", "", 0, -1)
+	if got := receive(t, alice, ErrorMessage); got.Content != "offset can't be negative" {
+		t.Errorf("a negative offset was answered with %q", got.Content)
+	}
+
+	// The filtered lists page the same way
+	alice.handleDocumentList(DocFilterMine, DocSortName, SortAscending, 5, 55)
+	if page := receive(t, alice, DocList); len(page.Documents) != 2 || page.HasMore || page.Total != 57 {
+		t.Errorf("the last page of alice's documents holds %d with total %d", len(page.Documents), page.Total)
+	}
+}
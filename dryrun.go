@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// dryRunDocumentCreate tells the client whether it could create a document
+// with the given name and language, without creating it. Unlike a real
+// create, every check runs so that all the problems are reported at once.
+func (c *Client) dryRunDocumentCreate(name, language string) {
+	var problems []string
+	if !currentDocCreatePolicy().Allows(c.Role) {
+		problems = append(problems, "You are not allowed to create documents")
+	}
+
+	language, err := normalizeLanguage(language)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if checked, err := newDocumentName(name, c.Username); errors.Is(err, ErrInvalidDocumentName) {
+		problems = append(problems, err.Error())
+	} else if err != nil {
+		log.Printf("Error naming document of %s: %v", c.Username, err)
+		c.sendError("Failed to check the document")
+		return
+	} else {
+		name = checked
+	}
+
+	err = checkDocumentQuota(db, c.Username)
+	if errors.Is(err, ErrDocumentQuotaExceeded) {
+		problems = append(problems, err.Error())
+	} else if err != nil {
+		log.Printf("Error checking document quota of %s: %v", c.Username, err)
+		c.sendError("Failed to check the document")
+		return
+	}
+
+	if language != "" {
+		err = checkLanguageQuota(db, language)
+		if errors.Is(err, ErrLanguageQuotaExceeded) {
+			problems = append(problems, err.Error())
+		} else if err != nil {
+			log.Printf("Error checking language quota of %s: %v", language, err)
+			c.sendError("Failed to check the document")
+			return
+		}
+	}
+
+	c.reply(Msg{
+		Type:     DocCreate,
+		DryRun:   true,
+		Name:     name,
+		Language: language,
+		Errors:   problems,
+		Time:     time.Now(),
+	})
+}
+
+// dryRunDocumentRename tells the client whether it could rename a document
+// or change its language, without changing anything. Like
+// dryRunDocumentCreate it reports all the problems found.
+func (c *Client) dryRunDocumentRename(docID, name, language string) {
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		c.sendError("Failed to check the document")
+		return
+	}
+
+	response := Msg{
+		Type:       DocRename,
+		DryRun:     true,
+		DocumentID: docID,
+		Name:       name,
+		Language:   language,
+		Time:       time.Now(),
+	}
+	if doc == nil {
+		response.Errors = []string{"Document not found"}
+		c.reply(response)
+		return
+	}
+
+	if doc.CreatedBy != c.Username {
+		permission, err := GetDocumentPermission(docID, c.Username)
+		if err != nil {
+			log.Printf("Error getting permission on %s: %v", docID, err)
+			c.sendError("Failed to check the document")
+			return
+		}
+		if permission != PermissionEdit {
+			response.Errors = append(response.Errors, "You are not allowed to rename this document")
+		}
+	}
+
+	// Anything left out stays as it was
+	if name == "" {
+		name = doc.Name
+	}
+	if language == "" {
+		language = doc.Language
+	}
+	if sanitized, err := sanitizeDocumentName(name); err != nil {
+		response.Errors = append(response.Errors, err.Error())
+	} else {
+		name = sanitized
+	}
+	if normalized, err := normalizeLanguage(language); err != nil {
+		response.Errors = append(response.Errors, err.Error())
+	} else {
+		language = normalized
+		if language != doc.Language {
+			err := checkLanguageQuota(db, language)
+			if errors.Is(err, ErrLanguageQuotaExceeded) {
+				response.Errors = append(response.Errors, err.Error())
+			} else if err != nil {
+				log.Printf("Error checking language quota of %s: %v", language, err)
+				c.sendError("Failed to check the document")
+				return
+			}
+		}
+	}
+
+	response.Name = name
+	response.Language = language
+	c.reply(response)
+}
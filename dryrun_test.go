@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// countDocuments returns how many documents are stored
+func countDocuments(t *testing.T) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM documents`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestDryRunCreate(t *testing.T) {
+	setupTest(t)
+	config.DocQuota = 1
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	drain(alice)
+
+	alice.dryRunDocumentCreate("  notes.txt ", "")
+	if got := receive(t, alice, DocCreate); !got.DryRun || len(got.Errors) != 0 || got.Name != "notes.txt" || got.Language != config.DocDefaultLanguage {
+		t.Errorf("a valid creation was checked as %+v", got)
+	}
+	// All the problems are reported at once
+	alice.dryRunDocumentCreate("../notes.txt", "klingon")
+	if got := receive(t, alice, DocCreate); len(got.Errors) != 2 {
+		t.Errorf("a bad name and language were checked as %q", got.Errors)
+	}
+	if count := countDocuments(t); count != 0 {
+		t.Fatalf("dry runs stored %d documents", count)
+	}
+
+	// At the quota, the dry run and the real creation agree
+	createTestDocument(t, "first.txt", "alice")
+	alice.dryRunDocumentCreate("second.txt", "")
+	checked := receive(t, alice, DocCreate)
+	if len(checked.Errors) != 1 || !strings.HasPrefix(checked.Errors[0], ErrDocumentQuotaExceeded.Error()) {
+		t.Errorf("a creation over the quota was checked as %q", checked.Errors)
+	}
+	alice.handleDocumentCreate("second.txt", "", hub)
+	if got := receive(t, alice, ErrorMessage); got.Content != checked.Errors[0] {
+		t.Errorf("the creation failed with %q, the dry run said %q", got.Content, checked.Errors[0])
+	}
+	if count := countDocuments(t); count != 1 {
+		t.Errorf("%d documents are stored, want the first only", count)
+	}
+}
+
+func TestDryRunRename(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+
+	alice.dryRunDocumentRename(doc.ID, "plan.md", "markdown")
+	if got := receive(t, alice, DocRename); !got.DryRun || len(got.Errors) != 0 || got.Name != "plan.md" || got.Language != "markdown" {
+		t.Errorf("a valid rename was checked as %+v", got)
+	}
+	alice.dryRunDocumentRename(doc.ID, "a/b", "")
+	if got := receive(t, alice, DocRename); len(got.Errors) != 1 {
+		t.Errorf("a bad name was checked as %q", got.Errors)
+	}
+	bob.dryRunDocumentRename(doc.ID, "mine.txt", "")
+	if got := receive(t, bob, DocRename); len(got.Errors) != 1 || got.Errors[0] != "You are not allowed to rename this document" {
+		t.Errorf("a rename by another user was checked as %q", got.Errors)
+	}
+	alice.dryRunDocumentRename("missing", "plan.md", "")
+	if got := receive(t, alice, DocRename); len(got.Errors) != 1 || got.Errors[0] != "Document not found" {
+		t.Errorf("renaming a missing document was checked as %q", got.Errors)
+	}
+
+	if stored, _ := GetDocument(doc.ID); stored.Name != "notes.txt" || stored.Language != doc.Language {
+		t.Errorf("a dry run changed the document to %s (%s)", stored.Name, stored.Language)
+	}
+}
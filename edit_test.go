@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestEditSetsEditedAtAndKeepsCreatedAt(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	register(t, hub, alice)
+	register(t, hub, bob)
+	posted := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	id, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: "first draft", Time: posted})
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if history := lobbyHistory(t); len(history) != 1 || history[0].Edited || history[0].EditedAt != nil {
+		t.Fatalf("replayed %+v before the edit, want an unedited message", history)
+	}
+
+	alice.handleMessageEdit(id, "second draft", hub)
+	edit := receive(t, bob, MessageEdit)
+	if !edit.Edited || edit.EditedAt == nil || !edit.Time.Equal(posted) {
+		t.Errorf("delivered edit %+v, want edited with the posting time kept", edit)
+	}
+
+	history := lobbyHistory(t)
+	if len(history) != 1 {
+		t.Fatalf("replayed %d messages, want 1", len(history))
+	}
+	msg := history[0]
+	if !msg.Time.Equal(posted) {
+		t.Errorf("created at %v after the edit, want %v", msg.Time, posted)
+	}
+	if !msg.Edited || msg.EditedAt == nil || !msg.EditedAt.After(posted) {
+		t.Errorf("replayed edited = %v at %v, want edited after %v", msg.Edited, msg.EditedAt, posted)
+	}
+}
+
+// setupLegacyTest is setupTest on a database created before messages had
+// anything but a timestamp, holding one lobby message posted at posted
+func setupLegacyTest(t *testing.T, posted time.Time) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	old, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		username TEXT NOT NULL,
+		content TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		to_user TEXT,
+		from_user TEXT,
+		is_system BOOLEAN DEFAULT 0
+	)`)
+	if err == nil {
+		_, err = old.Exec(`INSERT INTO messages (type, username, content, timestamp) VALUES (?, 'alice', 'from before edits', ?)`, PublicMessage, posted)
+	}
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitDB(); err != nil {
+		t.Fatalf("InitDB on an old database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+func TestMessageTimesMigration(t *testing.T) {
+	posted := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	setupLegacyTest(t, posted)
+
+	history := lobbyHistory(t)
+	if len(history) != 1 || !history[0].Time.Equal(posted) || history[0].Edited {
+		t.Errorf("replayed %+v, want the old message created at %v and not edited", history, posted)
+	}
+}
+
+func TestMessageEditWindow(t *testing.T) {
+	setupTest(t)
+	config.MessageEditWindow = 15
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+
+	// post stores a message by a user, posted some time ago
+	post := func(username string, ago time.Duration) int64 {
+		t.Helper()
+		id, err := SaveMessage(Msg{Type: PublicMessage, Username: username, Content: "first draft", Time: time.Now().Add(-ago)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// edit has a user edit a message and returns the error they got, if any
+	edit := func(client *Client, id int64) string {
+		t.Helper()
+		drain(client)
+		client.handleMessageEdit(id, "second draft", hub)
+		for {
+			switch msg := receive(t, client, ""); msg.Type {
+			case ErrorMessage:
+				return msg.Content
+			case MessageEdit:
+				return ""
+			}
+		}
+	}
+	alice := fakeClient("alice", true)
+	root := fakeClient("root", true)
+	register(t, hub, alice)
+	register(t, hub, root)
+
+	if got := edit(alice, post("alice", 5*time.Minute)); got != "" {
+		t.Errorf("editing within the window was refused: %q", got)
+	}
+	late := post("alice", 20*time.Minute)
+	if got := edit(alice, late); got != "Messages can only be edited within 15 minutes of posting" {
+		t.Errorf("editing after the window was answered with %q", got)
+	}
+	if history := lobbyHistory(t); history[1].ID != late || history[1].Content != "first draft" {
+		t.Errorf("the late edit changed %+v", history[1])
+	}
+	if got := edit(root, post("root", time.Hour)); got != "" {
+		t.Errorf("an admin's late edit was refused: %q", got)
+	}
+
+	config.MessageEditWindow = 0
+	if got := edit(alice, late); got != "" {
+		t.Errorf("editing with no window was refused: %q", got)
+	}
+}
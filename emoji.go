@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// defaultEmojiShortcodes are the shortcodes expanded when EMOJI_SHORTCODES is
+// on, unless EMOJI_SHORTCODES_FILE replaces or adds to them. The names follow
+// the ones common chat apps use.
+var defaultEmojiShortcodes = map[string]string{
+	"smile":            "😄",
+	"smiley":           "😃",
+	"grin":             "😁",
+	"laughing":         "😆",
+	"joy":              "😂",
+	"rofl":             "🤣",
+	"wink":             "😉",
+	"blush":            "😊",
+	"slightly_smiling": "🙂",
+	"upside_down":      "🙃",
+	"heart_eyes":       "😍",
+	"kissing_heart":    "😘",
+	"thinking":         "🤔",
+	"neutral_face":     "😐",
+	"expressionless":   "😑",
+	"unamused":         "😒",
+	"roll_eyes":        "🙄",
+	"grimacing":        "😬",
+	"relieved":         "😌",
+	"sleeping":         "😴",
+	"sweat_smile":      "😅",
+	"sunglasses":       "😎",
+	"confused":         "😕",
+	"worried":          "😟",
+	"open_mouth":       "😮",
+	"astonished":       "😲",
+	"cry":              "😢",
+	"sob":              "😭",
+	"angry":            "😠",
+	"rage":             "😡",
+	"scream":           "😱",
+	"skull":            "💀",
+	"poop":             "💩",
+	"wave":             "👋",
+	"ok_hand":          "👌",
+	"+1":               "👍",
+	"thumbsup":         "👍",
+	"-1":               "👎",
+	"thumbsdown":       "👎",
+	"clap":             "👏",
+	"pray":             "🙏",
+	"raised_hands":     "🙌",
+	"muscle":           "💪",
+	"eyes":             "👀",
+	"heart":            "❤️",
+	"broken_heart":     "💔",
+	"fire":             "🔥",
+	"sparkles":         "✨",
+	"star":             "⭐",
+	"tada":             "🎉",
+	"rocket":           "🚀",
+	"100":              "💯",
+	"check":            "✅",
+	"white_check_mark": "✅",
+	"x":                "❌",
+	"warning":          "⚠️",
+	"question":         "❓",
+	"exclamation":      "❗",
+	"bulb":             "💡",
+	"bug":              "🐛",
+	"coffee":           "☕",
+	"beer":             "🍺",
+	"pizza":            "🍕",
+	"cake":             "🍰",
+	"sun":              "☀️",
+	"rainbow":          "🌈",
+	"zap":              "⚡",
+	"lock":             "🔒",
+	"key":              "🔑",
+	"memo":             "📝",
+	"calendar":         "📅",
+	"hourglass":        "⌛",
+	"see_no_evil":      "🙈",
+	"shrug":            "🤷",
+	"facepalm":         "🤦",
+}
+
+// emojiShortcodes maps shortcode names, without their colons, to the emoji
+// they expand to. main sets it from EMOJI_SHORTCODES_FILE.
+var emojiShortcodes = defaultEmojiShortcodes
+
+// shortcodeName matches the name of a shortcode, such as smile or +1
+var shortcodeName = regexp.MustCompile(`^[a-z0-9_+-]+$`)
+
+// loadEmojiShortcodes reads EMOJI_SHORTCODES_FILE, a JSON object mapping
+// shortcode names to emoji, e.g. {"shipit": "🐿️"}. Its entries are added to
+// the built-in ones, replacing those with the same name; an empty emoji
+// removes a built-in shortcode.
+func loadEmojiShortcodes() error {
+	if config.EmojiShortcodesFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(config.EmojiShortcodesFile)
+	if err != nil {
+		return err
+	}
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", config.EmojiShortcodesFile, err)
+	}
+
+	shortcodes := make(map[string]string, len(defaultEmojiShortcodes)+len(entries))
+	for name, emoji := range defaultEmojiShortcodes {
+		shortcodes[name] = emoji
+	}
+	for name, emoji := range entries {
+		name = strings.Trim(strings.ToLower(name), ":")
+		if !shortcodeName.MatchString(name) {
+			return fmt.Errorf("invalid shortcode name %q, use lowercase letters, digits, _, + and -", name)
+		}
+		if emoji == "" {
+			delete(shortcodes, name)
+			continue
+		}
+		shortcodes[name] = emoji
+	}
+	emojiShortcodes = shortcodes
+	return nil
+}
+
+// expandShortcodes replaces known emoji shortcodes in the content of a chat
+// message with their emoji when EMOJI_SHORTCODES is on. Code messages are
+// left alone, as are `code spans` and ``` fenced blocks in other messages.
+// Unknown shortcodes stay as they were written.
+func expandShortcodes(content, format string) string {
+	if !config.EmojiShortcodes || format == FormatCode || !strings.Contains(content, ":") {
+		return content
+	}
+
+	var b strings.Builder
+	for content != "" {
+		// Text up to the next run of backticks is expanded
+		start := strings.IndexByte(content, '`')
+		if start < 0 {
+			b.WriteString(expandText(content))
+			break
+		}
+		b.WriteString(expandText(content[:start]))
+		content = content[start:]
+
+		// Code runs up to a run of as many backticks. A run that is never
+		// closed is no code, only backticks.
+		fence := len(content) - len(strings.TrimLeft(content, "`"))
+		end := closingFence(content[fence:], fence)
+		if end < 0 {
+			b.WriteString(content[:fence])
+			content = content[fence:]
+			continue
+		}
+		end += 2 * fence
+		b.WriteString(content[:end])
+		content = content[end:]
+	}
+	return b.String()
+}
+
+// closingFence finds the first run of exactly fence backticks in s and
+// returns where it starts, or -1 if there is none
+func closingFence(s string, fence int) int {
+	for i := 0; i < len(s); {
+		if s[i] != '`' {
+			i++
+			continue
+		}
+		run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+		if run == fence {
+			return i
+		}
+		i += run
+	}
+	return -1
+}
+
+// expandText replaces the known shortcodes in text outside code. The colon
+// closing an unknown one may open the next, as in 10:30:smile:.
+func expandText(text string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(text, ':')
+		if start < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		b.WriteString(text[:start])
+		text = text[start:]
+
+		end := strings.IndexByte(text[1:], ':')
+		if end < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		name := text[1 : end+1]
+		if emoji, ok := emojiShortcodes[name]; ok {
+			b.WriteString(emoji)
+			text = text[end+2:]
+			continue
+		}
+		b.WriteByte(':')
+		text = text[1:]
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandShortcodes(t *testing.T) {
+	setupTest(t)
+	config.EmojiShortcodes = true
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"one", "hello :smile:", "hello 😄"},
+		{"several", ":tada::+1: shipped", "🎉👍 shipped"},
+		{"unknown", "this is :not_an_emoji:", "this is :not_an_emoji:"},
+		{"times", "meet at 10:30:smile:", "meet at 10:30😄"},
+		{"lone colon", "note: :smile", "note: :smile"},
+		{"code span", "run `a:smile:b` then :smile:", "run `a:smile:b` then 😄"},
+		{"fenced block", "```\nx := m[:smile:]\n```\n:tada:", "```\nx := m[:smile:]\n```\n🎉"},
+		{"double backticks", "``a `:smile:` b`` :smile:", "``a `:smile:` b`` 😄"},
+		{"unclosed backtick", "it`s :smile:", "it`s 😄"},
+	} {
+		if got := expandShortcodes(tc.in, FormatMarkdown); got != tc.want {
+			t.Errorf("%s: expandShortcodes(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+
+	if got := expandShortcodes("x = y[:smile:]", FormatCode); got != "x = y[:smile:]" {
+		t.Errorf("a code message was expanded to %q", got)
+	}
+	config.EmojiShortcodes = false
+	if got := expandShortcodes("hello :smile:", FormatPlain); got != "hello :smile:" {
+		t.Errorf("with EMOJI_SHORTCODES off, expanded to %q", got)
+	}
+}
+
+func TestEmojiShortcodesFile(t *testing.T) {
+	setupTest(t)
+	t.Cleanup(func() { emojiShortcodes = defaultEmojiShortcodes })
+	config.EmojiShortcodes = true
+	config.EmojiShortcodesFile = filepath.Join(t.TempDir(), "emoji.json")
+	if err := os.WriteFile(config.EmojiShortcodesFile, []byte(`{":shipit:": "🐿️", "Smile": "🙂", "tada": ""}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadEmojiShortcodes(); err != nil {
+		t.Fatalf("loadEmojiShortcodes: %v", err)
+	}
+	if got := expandShortcodes(":shipit: :smile: :tada: :+1:", FormatPlain); got != "🐿️ 🙂 :tada: 👍" {
+		t.Errorf("expanded to %q", got)
+	}
+	if defaultEmojiShortcodes["tada"] != "🎉" {
+		t.Error("the file changed the built-in shortcodes")
+	}
+
+	if err := os.WriteFile(config.EmojiShortcodesFile, []byte(`{"no spaces": "x"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadEmojiShortcodes(); err == nil {
+		t.Error("an invalid shortcode name was accepted")
+	}
+}
+
+func TestShortcodesAreExpandedBeforeStoring(t *testing.T) {
+	setupTest(t)
+	config.EmojiShortcodes = true
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	conn.send(Msg{Type: PublicMessage, Content: "shipped :tada: see `:tada:`"})
+	got := conn.expect(PublicMessage)
+	if got.Content != "shipped 🎉 see `:tada:`" {
+		t.Errorf("the message was broadcast as %q", got.Content)
+	}
+	if stored, err := GetMessage(got.ID); err != nil || stored.Content != got.Content {
+		t.Errorf("the message was stored as %+v, %v", stored, err)
+	}
+
+	conn.send(Msg{Type: PublicMessage, Format: FormatCode, Content: "m[:tada:]"})
+	if got := conn.expect(PublicMessage); got.Content != "m[:tada:]" {
+		t.Errorf("the code message was broadcast as %q", got.Content)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Invalid UTF-8 and a null byte, as a client could smuggle them in
+const badContent = "caf\xe9 \x00menu"
+
+func TestInvalidContentIsSanitized(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+
+	id, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: badContent})
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	if msg, err := GetMessage(id); err != nil || msg.Content != "caf� menu" {
+		t.Errorf("the message was stored as %q, %v", msg.Content, err)
+	}
+	if _, err := UpdateMessage(id, "\x00edited"); err != nil {
+		t.Fatalf("UpdateMessage: %v", err)
+	}
+	if msg, _ := GetMessage(id); msg.Content != "edited" {
+		t.Errorf("the edit was stored as %q", msg.Content)
+	}
+
+	if err := UpdateDocument(doc.ID, badContent); err != nil {
+		t.Fatalf("UpdateDocument: %v", err)
+	}
+	if stored, _ := GetDocument(doc.ID); stored.Content != "caf� menu" {
+		t.Errorf("the document was stored as %q", stored.Content)
+	}
+}
+
+func TestInvalidContentIsRejected(t *testing.T) {
+	setupTest(t)
+	config.InvalidContent = InvalidContentReject
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+
+	for _, content := range []string{"caf\xe9", "nul\x00"} {
+		if _, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: content}); !errors.Is(err, ErrInvalidContent) {
+			t.Errorf("SaveMessage(%q) = %v, want ErrInvalidContent", content, err)
+		}
+		if err := UpdateDocument(doc.ID, content); !errors.Is(err, ErrInvalidContent) {
+			t.Errorf("UpdateDocument(%q) = %v, want ErrInvalidContent", content, err)
+		}
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&stored); err != nil || stored != 0 {
+		t.Errorf("%d messages were stored, %v", stored, err)
+	}
+	if _, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: "café"}); err != nil {
+		t.Errorf("valid UTF-8 was refused: %v", err)
+	}
+}
+
+// Null bytes survive JSON decoding as \u0000, so the hub must catch them on
+// what clients send
+func TestNullBytesFromClients(t *testing.T) {
+	setupTest(t)
+	config.InvalidContent = InvalidContentReject
+	hub := newTestHub(t)
+	createTestUser(t, "bob")
+	doc := createTestDocument(t, "notes.txt", "bob")
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+
+	conn.send(Msg{Type: PublicMessage, Content: "nul\x00"})
+	if got := conn.expect(ErrorMessage); got.Content != "Message not sent: "+ErrInvalidContent.Error() {
+		t.Errorf("a message with a null byte was answered with %q", got.Content)
+	}
+
+	conn.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	conn.expect(DocContent)
+	conn.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "nul\x00"})
+	if got := conn.expect(ErrorMessage); got.Content != "Edit refused: "+ErrInvalidContent.Error() {
+		t.Errorf("an edit with a null byte was answered with %q", got.Content)
+	}
+}
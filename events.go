@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Operations recorded in the document event log
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventShare  = "share"
+	EventRename = "rename"
+	EventUndo   = "undo"
+	EventRedo   = "redo"
+
+	EventMode     = "mode"
+	EventTruncate = "truncate"
+)
+
+// DocumentEvent is one entry of a document's append-only edit log
+type DocumentEvent struct {
+	ID         int64     `json:"id,omitempty"` // Unset on events streamed before they are saved
+	DocumentID string    `json:"document_id"`
+	Username   string    `json:"username"`
+	Operation  string    `json:"operation"`
+	Detail     string    `json:"detail,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// documentEvents buffers events for the background writer so that logging
+// never blocks the edit path
+var documentEvents = make(chan DocumentEvent, 1024)
+
+// InitDocumentEventTables creates the document_events table
+func InitDocumentEventTables() error {
+	createEventsTable := `
+	CREATE TABLE IF NOT EXISTS document_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		detail TEXT DEFAULT '',
+		timestamp DATETIME NOT NULL
+	);`
+
+	_, err := db.Exec(createEventsTable)
+	return err
+}
+
+// RecordDocumentEvent queues an event for the log and streams it at /events.
+// If the writer has fallen behind, the event is dropped rather than stalling
+// the caller.
+func RecordDocumentEvent(docID, username, operation, detail string) {
+	event := DocumentEvent{
+		DocumentID: docID,
+		Username:   username,
+		Operation:  operation,
+		Detail:     detail,
+		Time:       time.Now(),
+	}
+	publishEvent(StreamDocument+"."+operation, event)
+
+	select {
+	case documentEvents <- event:
+	default:
+		log.Printf("Document event queue full, dropping %s event for %s", operation, docID)
+	}
+}
+
+// RunDocumentEventWriter persists queued events to store. It runs in its own
+// goroutine until stop is closed, then saves what is still queued and
+// returns. The server never stops it and passes a nil stop.
+func RunDocumentEventWriter(store *sql.DB, stop <-chan struct{}) {
+	save := func(event DocumentEvent) {
+		if err := SaveDocumentEvent(store, event); err != nil {
+			log.Printf("Failed to save document event: %v", err)
+		}
+	}
+	for {
+		select {
+		case event := <-documentEvents:
+			save(event)
+		case <-stop:
+			for {
+				select {
+				case event := <-documentEvents:
+					save(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// SaveDocumentEvent appends an event to the log in store
+func SaveDocumentEvent(store *sql.DB, event DocumentEvent) error {
+	query := `
+		INSERT INTO document_events (document_id, username, operation, detail, timestamp)
+		VALUES (?, ?, ?, ?, ?)
+	`
+	return retryBusy("saving a document event", func() error {
+		_, err := store.Exec(query, event.DocumentID, event.Username, event.Operation, event.Detail, event.Time)
+		return err
+	})
+}
+
+// GetDocumentEvents retrieves the last N events of a document in
+// chronological order
+func GetDocumentEvents(docID string, limit int) ([]DocumentEvent, error) {
+	query := `
+		SELECT id, document_id, username, operation, detail, timestamp
+		FROM document_events
+		WHERE document_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, docID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []DocumentEvent{}
+	for rows.Next() {
+		var event DocumentEvent
+		err := rows.Scan(&event.ID, &event.DocumentID, &event.Username, &event.Operation, &event.Detail, &event.Time)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Reverse the slice to get chronological order
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
+
+// sizeDetail describes the size of a document's content for the event log
+func sizeDetail(content string) string {
+	return fmt.Sprintf("%d bytes", len(content))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDocumentEventLog(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	createTestUser(t, "alice")
+	bobToken := createTestUser(t, "bob")
+	alice := fakeClient("alice", false)
+	register(t, hub, alice)
+	alice.handleDocumentCreate("plan.txt", "plaintext", hub)
+	doc := receive(t, alice, DocContent)
+
+	bob := dial(t, server, bobToken, url.Values{"mode": {"editor"}})
+	bob.send(Msg{Type: DocOpen, DocumentID: doc.DocumentID})
+	bob.expect(DocContent)
+	bob.send(Msg{Type: DocUpdate, DocumentID: doc.DocumentID, Content: "step one"})
+	receive(t, alice, DocUpdate)
+	flushBackgroundWriters(t)
+
+	alice.handleDocumentHistory(doc.DocumentID)
+	events := receive(t, alice, DocHistory).Events
+	if len(events) != 2 {
+		t.Fatalf("the log has %d events, want 2: %+v", len(events), events)
+	}
+	if events[0].Operation != EventCreate || events[0].Username != "alice" || events[0].Detail != "plan.txt" {
+		t.Errorf("first event = %+v, want alice creating plan.txt", events[0])
+	}
+	if events[1].Operation != EventUpdate || events[1].Username != "bob" {
+		t.Errorf("second event = %+v, want bob's update", events[1])
+	}
+}
+
+func TestGetDocumentEvents(t *testing.T) {
+	setupTest(t)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		for _, docID := range []string{"doc-1", "doc-2"} {
+			event := DocumentEvent{DocumentID: docID, Username: "alice", Operation: EventUpdate, Detail: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Second)}
+			if err := SaveDocumentEvent(db, event); err != nil {
+				t.Fatalf("SaveDocumentEvent: %v", err)
+			}
+		}
+	}
+
+	// The last events of the document only, oldest first
+	events, err := GetDocumentEvents("doc-1", 3)
+	if err != nil {
+		t.Fatalf("GetDocumentEvents: %v", err)
+	}
+	var details string
+	for _, event := range events {
+		if event.DocumentID != "doc-1" {
+			t.Errorf("got an event of %s", event.DocumentID)
+		}
+		details += event.Detail
+	}
+	if details != "234" {
+		t.Errorf("events %q were returned, want 2, 3 and 4", details)
+	}
+
+	if events, err := GetDocumentEvents("doc-3", 3); err != nil || len(events) != 0 {
+		t.Errorf("a document without events has %v, %v", events, err)
+	}
+}
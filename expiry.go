@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// checkMessageTTL reports negative expiry, dedupe or edit window settings
+func (c *Config) checkMessageTTL(p *configProblems) {
+	if c.MessageMaxTTL < 0 {
+		p.add("MESSAGE_MAX_TTL can't be negative, got %d", c.MessageMaxTTL)
+	}
+	if c.MessagePruneInterval <= 0 {
+		p.add("MESSAGE_PRUNE_INTERVAL must be positive, got %d", c.MessagePruneInterval)
+	}
+	if c.MessageDedupeWindow < 0 {
+		p.add("MESSAGE_DEDUPE_WINDOW can't be negative, got %d", c.MessageDedupeWindow)
+	}
+	if c.MessageEditWindow < 0 {
+		p.add("MESSAGE_EDIT_WINDOW can't be negative, got %d", c.MessageEditWindow)
+	}
+}
+
+// checkTTL validates the time to live a client asked for on a chat message
+// and sets when the message expires, telling the client when the TTL isn't
+// allowed
+func (c *Client) checkTTL(msg *Msg) bool {
+	if msg.TTL == 0 {
+		return true
+	}
+	if config.MessageMaxTTL == 0 {
+		c.sendError("Expiring messages are disabled")
+		return false
+	}
+	if msg.TTL < 0 || msg.TTL > config.MessageMaxTTL {
+		c.sendError(fmt.Sprintf("Message TTL must be between 1 and %d seconds", config.MessageMaxTTL))
+		return false
+	}
+
+	expiresAt := msg.Time.Add(time.Duration(msg.TTL) * time.Second)
+	msg.ExpiresAt = &expiresAt
+	return true
+}
+
+// DeleteExpiredMessages removes the messages whose time to live ran out,
+// with their reactions, and returns them so that clients can be told
+func DeleteExpiredMessages(now time.Time) ([]Msg, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT id, COALESCE(to_user, ''), COALESCE(from_user, ''), room, conversation_id
+		FROM messages
+		WHERE expires_at IS NOT NULL AND expires_at <= ?
+	`
+	rows, err := tx.Query(query, now)
+	if err != nil {
+		return nil, err
+	}
+	var expired []Msg
+	for rows.Next() {
+		var msg Msg
+		if err := rows.Scan(&msg.ID, &msg.To, &msg.From, &msg.Room, &msg.ConversationID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, msg := range expired {
+		if err := deleteMessage(tx, msg.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, tx.Commit()
+}
+
+// pruneMessages deletes expired messages and tells the connected clients
+// that could see them to remove them
+func (h *Hub) pruneMessages() {
+	expired, err := DeleteExpiredMessages(time.Now())
+	if err != nil {
+		log.Printf("Failed to prune expired messages: %v", err)
+		return
+	}
+	if len(expired) > 0 {
+		log.Printf("Pruned %d expired messages", len(expired))
+	}
+
+	ids := make([]int64, len(expired))
+	for i, msg := range expired {
+		ids[i] = msg.ID
+	}
+	h.forgetMessages(ids...)
+
+	for _, msg := range expired {
+		notice := Msg{
+			Type:           MessageExpired,
+			MessageID:      msg.ID,
+			To:             msg.To,
+			From:           msg.From,
+			Room:           msg.Room,
+			ConversationID: msg.ConversationID,
+			Time:           time.Now(),
+		}
+		if msg.ConversationID != "" {
+			conv, err := GetConversation(msg.ConversationID)
+			if err != nil || conv == nil {
+				log.Printf("Error getting conversation %s: %v", msg.ConversationID, err)
+				continue
+			}
+			notice.Participants = conv.Members
+		}
+		h.deliverUpdate(notice)
+	}
+}
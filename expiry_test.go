@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiredMessagesAreHiddenAndDeleted(t *testing.T) {
+	setupTest(t)
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	expired, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: "gone rollout", Time: time.Now().Add(-2 * time.Minute), ExpiresAt: &past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: "soon rollout", Time: time.Now(), ExpiresAt: &future})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := saveTestMessage(t, "alice", "kept rollout")
+
+	history := lobbyHistory(t)
+	if len(history) != 2 || history[0].ID != expiring || history[1].ID != kept {
+		t.Errorf("replayed %+v, want the messages that haven't expired", history)
+	}
+	if ids := searchIDs(t, "rollout"); len(ids) != 2 {
+		t.Errorf("search found %v, want the 2 messages that haven't expired", ids)
+	}
+
+	deleted, err := DeleteExpiredMessages(time.Now())
+	if err != nil || len(deleted) != 1 || deleted[0].ID != expired {
+		t.Fatalf("DeleteExpiredMessages = %+v, %v, want message %d", deleted, err, expired)
+	}
+	var left int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&left); err != nil || left != 2 {
+		t.Errorf("%d messages left, %v, want 2", left, err)
+	}
+}
+
+func TestExpiringMessageIsRemovedFromClients(t *testing.T) {
+	setupTest(t)
+	config.MessageMaxTTL = 60
+	config.MessagePruneInterval = 1
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	alice := dial(t, server, createTestUser(t, "alice"), nil)
+	bobToken := createTestUser(t, "bob")
+	bob := dial(t, server, bobToken, nil)
+	bob.expect(LastRead)
+
+	alice.send(Msg{Type: PublicMessage, Content: "this will self-destruct", TTL: 1})
+	msg := bob.expect(PublicMessage)
+	for msg.Content != "this will self-destruct" {
+		msg = bob.expect(PublicMessage)
+	}
+	if msg.ExpiresAt == nil || msg.ID == 0 {
+		t.Fatalf("delivered %+v, want an ID and an expiry", msg)
+	}
+	if notice := bob.expect(MessageExpired); notice.MessageID != msg.ID {
+		t.Errorf("told to remove message %d, want %d", notice.MessageID, msg.ID)
+	}
+
+	again := dial(t, server, bobToken, nil)
+	for {
+		replayed, err := again.read()
+		if err != nil {
+			t.Fatalf("reading the replay: %v", err)
+		}
+		if replayed.Type == LastRead {
+			break
+		}
+		if replayed.ID == msg.ID {
+			t.Error("the expired message was replayed")
+		}
+	}
+}
+
+func TestMessageTTLLimits(t *testing.T) {
+	setupTest(t)
+	for _, tt := range []struct {
+		maxTTL, ttl int
+		want        string
+	}{
+		{0, 10, "Expiring messages are disabled"},
+		{60, 61, "Message TTL must be between 1 and 60 seconds"},
+		{60, -1, "Message TTL must be between 1 and 60 seconds"},
+	} {
+		config.MessageMaxTTL = tt.maxTTL
+		client := fakeClient("alice", true)
+		msg := Msg{Type: PublicMessage, Content: "hi", TTL: tt.ttl, Time: time.Now()}
+		if client.checkTTL(&msg) {
+			t.Errorf("TTL %d was accepted with MESSAGE_MAX_TTL=%d", tt.ttl, tt.maxTTL)
+			continue
+		}
+		if got := receive(t, client, ErrorMessage); got.Content != tt.want {
+			t.Errorf("TTL %d with MESSAGE_MAX_TTL=%d was refused with %q", tt.ttl, tt.maxTTL, got.Content)
+		}
+	}
+
+	config.MessageMaxTTL = 60
+	sent := time.Now()
+	msg := Msg{Type: PublicMessage, Content: "hi", TTL: 30, Time: sent}
+	if !fakeClient("alice", true).checkTTL(&msg) || msg.ExpiresAt == nil || !msg.ExpiresAt.Equal(sent.Add(30*time.Second)) {
+		t.Errorf("a TTL of 30s set the expiry to %v", msg.ExpiresAt)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats messages can be exported in
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// exportCSVHeader names the columns of a CSV export
+var exportCSVHeader = []string{"id", "time", "type", "username", "to", "room", "conversation_id", "format", "content", "edited_at"}
+
+// ExportMessages calls fn with every message viewer is allowed to see, as
+// visibleTo selects them with the rooms they are in, oldest first. from and
+// to, when not zero, limit the export to messages created in that range. Rows are read
+// one at a time so the history is never held in memory as a whole.
+func ExportMessages(viewer string, rooms []string, from, to time.Time, fn func(Msg) error) error {
+	visible, args := visibleTo("", viewer, rooms)
+	query := `
+		SELECT ` + messageColumns("") + `
+		FROM messages
+		WHERE ` + visible + `
+	`
+	if !from.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, to)
+	}
+	query += ` ORDER BY id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var stored StoredMessage
+		if err := rows.Scan(stored.fields()...); err != nil {
+			return err
+		}
+		if err := fn(stored.Msg()); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// parseExportTime reads a bound of the export range, either an RFC 3339
+// time or a date. A date used as the end of the range includes that day.
+func parseExportTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is not a date or an RFC 3339 time", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// exportCSVRecord lays out a message as a row of a CSV export
+func exportCSVRecord(msg Msg) []string {
+	var editedAt string
+	if msg.EditedAt != nil {
+		editedAt = msg.EditedAt.Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatInt(msg.ID, 10),
+		msg.Time.Format(time.RFC3339),
+		string(msg.Type),
+		msg.Username,
+		msg.To,
+		msg.Room,
+		msg.ConversationID,
+		msg.Format,
+		msg.Content,
+		editedAt,
+	}
+}
+
+// HandleExport streams the messages the user whose token is in the
+// Authorization header can see, as a JSON array or as CSV (?format=csv).
+// ?from= and ?to= limit the export to a date range. Rooms aren't stored,
+// they only last as long as the connections in them: as for search, room
+// messages are exported from the rooms the user is in on any connection
+// open now, and from none while they are offline.
+func HandleExport(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, err := ValidateToken(r.Header.Get("Authorization"))
+		if err != nil {
+			http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !config.ChatPersistence {
+			http.Error(w, historyOffMessage, http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		format := strings.ToLower(query.Get("format"))
+		if format == "" {
+			format = ExportJSON
+		}
+		if format != ExportJSON && format != ExportCSV {
+			http.Error(w, "Invalid request: format must be json or csv", http.StatusBadRequest)
+			return
+		}
+		from, err := parseExportTime(query.Get("from"), false)
+		if err != nil {
+			http.Error(w, "Invalid request: from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseExportTime(query.Get("to"), true)
+		if err != nil {
+			http.Error(w, "Invalid request: to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		username := claims.Username
+		rooms := hub.RoomsOf(username)
+		filename := fmt.Sprintf("messages-%s-%s.%s", username, time.Now().Format("20060102"), format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		count := 0
+		if format == ExportCSV {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			out := csv.NewWriter(w)
+			out.Write(exportCSVHeader)
+			err = ExportMessages(username, rooms, from, to, func(msg Msg) error {
+				count++
+				return out.Write(exportCSVRecord(msg))
+			})
+			out.Flush()
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			encoder := json.NewEncoder(w)
+			fmt.Fprint(w, "[")
+			err = ExportMessages(username, rooms, from, to, func(msg Msg) error {
+				if count > 0 {
+					fmt.Fprint(w, ",")
+				}
+				count++
+				return encoder.Encode(msg)
+			})
+			fmt.Fprint(w, "]\n")
+		}
+
+		// The response has started, so a failure can only be logged
+		if err != nil {
+			log.Printf("Error exporting messages of %s: %v", username, err)
+			return
+		}
+		log.Printf("Exported %d messages for %s as %s", count, username, format)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedExportHistory stores messages alice may and may not see, and returns
+// the contents of the ones alice may see from the dev room
+func seedExportHistory(t *testing.T) []string {
+	t.Helper()
+	for _, username := range []string{"alice", "bob", "carol"} {
+		createTestUser(t, username)
+	}
+	ours, err := CreateConversation("ours", "bob", []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := CreateConversation("theirs", "bob", []string{"carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := []struct {
+		msg     Msg
+		visible bool
+	}{
+		{Msg{Type: PublicMessage, Username: "bob", Content: "lobby"}, true},
+		{Msg{Type: PublicMessage, Username: "alice", Room: "dev", Content: "alice in dev"}, true},
+		{Msg{Type: PublicMessage, Username: "bob", Room: "dev", Content: "bob in dev"}, true},
+		{Msg{Type: PublicMessage, Username: "bob", Room: "ops", Content: "bob in ops"}, false},
+		{Msg{Type: PrivateMessage, Username: "bob", From: "bob", To: "alice", Content: "bob to alice"}, true},
+		{Msg{Type: PrivateMessage, Username: "bob", From: "bob", To: "carol", Content: "bob to carol"}, false},
+		{Msg{Type: GroupMessage, Username: "bob", ConversationID: ours.ID, Content: "our group"}, true},
+		{Msg{Type: GroupMessage, Username: "bob", ConversationID: theirs.ID, Content: "their group"}, false},
+	}
+	var visible []string
+	for _, s := range seed {
+		if _, err := SaveMessage(s.msg); err != nil {
+			t.Fatalf("SaveMessage %q: %v", s.msg.Content, err)
+		}
+		if s.visible {
+			visible = append(visible, s.msg.Content)
+		}
+	}
+	return visible
+}
+
+// export calls HandleExport for alice
+func export(t *testing.T, hub *Hub, query string) string {
+	t.Helper()
+	token, err := GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := callHandler(t, HandleExport(hub), "GET", "/export?"+query, token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status %d: %s", w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+// exportedContents returns the contents of the messages in a JSON export
+func exportedContents(t *testing.T, body string) []string {
+	t.Helper()
+	var msgs []Msg
+	if err := json.Unmarshal([]byte(body), &msgs); err != nil {
+		t.Fatalf("export isn't a JSON array: %v", err)
+	}
+	var contents []string
+	for _, msg := range msgs {
+		contents = append(contents, msg.Content)
+	}
+	sort.Strings(contents)
+	return contents
+}
+
+func TestExportScoping(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	want := seedExportHistory(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	joinTestRoom(t, hub, alice, "dev")
+
+	sort.Strings(want)
+	if got := exportedContents(t, export(t, hub, "")); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("exported %q, want %q", got, want)
+	}
+
+	// Like search, the export covers the rooms alice is in now, on any of
+	// her connections: a second tab outside dev still exports it
+	tab := fakeClient("alice", true)
+	register(t, hub, tab)
+	if got := exportedContents(t, export(t, hub, "")); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("with a second tab outside dev, exported %q, want %q", got, want)
+	}
+
+	// Room membership only lasts as long as the connections, so an export
+	// made while alice is offline leaves the rooms out
+	unregister(t, hub, alice)
+	unregister(t, hub, tab)
+	for _, content := range exportedContents(t, export(t, hub, "")) {
+		if strings.HasSuffix(content, " in dev") {
+			t.Errorf("exported %q while alice is offline", content)
+		}
+	}
+}
+
+func TestExportCSVAndRange(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	seedExportHistory(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	joinTestRoom(t, hub, alice, "dev")
+
+	records, err := csv.NewReader(strings.NewReader(export(t, hub, "format=csv"))).ReadAll()
+	if err != nil {
+		t.Fatalf("export isn't CSV: %v", err)
+	}
+	if len(records) != 6 || strings.Join(records[0], ",") != strings.Join(exportCSVHeader, ",") {
+		t.Errorf("CSV export has %d rows starting with %v, want the header and 5 messages", len(records), records[0])
+	}
+
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
+	if body := export(t, hub, "from="+tomorrow); strings.TrimSpace(body) != "[]" {
+		t.Errorf("export from tomorrow = %s, want nothing", body)
+	}
+}
+
+func TestExportRequests(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	token := createTestUser(t, "alice")
+	saveTestMessage(t, "alice", "hello")
+
+	w := callHandler(t, HandleExport(hub), "GET", "/export?format=CSV", token, nil)
+	if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != "text/csv; charset=utf-8" {
+		t.Errorf("CSV export = %d with type %q", w.Code, got)
+	}
+	if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, `attachment; filename="messages-alice-`) || !strings.HasSuffix(got, `.csv"`) {
+		t.Errorf("CSV export is sent as %q", got)
+	}
+	// The range ends with the whole day given
+	today := time.Now().Format(time.DateOnly)
+	if body := export(t, hub, "to="+today); !strings.Contains(body, "hello") {
+		t.Errorf("export to today = %s, want today's message", body)
+	}
+
+	for _, tc := range []struct {
+		method, target, token string
+		status                int
+	}{
+		{"POST", "/export", token, http.StatusMethodNotAllowed},
+		{"GET", "/export", "", http.StatusUnauthorized},
+		{"GET", "/export?format=xml", token, http.StatusBadRequest},
+		{"GET", "/export?from=yesterday", token, http.StatusBadRequest},
+		{"GET", "/export?to=2024-13-01", token, http.StatusBadRequest},
+	} {
+		if w := callHandler(t, HandleExport(hub), tc.method, tc.target, tc.token, nil); w.Code != tc.status {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.target, w.Code, tc.status)
+		}
+	}
+}
+
+func TestExportWithoutPersistence(t *testing.T) {
+	setupTest(t)
+	config.ChatPersistence = false
+	// Refused before the hub is asked anything
+	if w := callHandler(t, HandleExport(nil), "GET", "/export", createTestUser(t, "alice"), nil); w.Code != http.StatusNotFound {
+		t.Errorf("export with CHAT_PERSISTENCE off = %d, want 404", w.Code)
+	}
+}
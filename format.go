@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rendering hints chat messages can carry in their format field. The server
+// stores and replays them. The only change it makes to the content is
+// expanding emoji shortcodes, and never in code.
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+	FormatCode     = "code" // Rendered as a code block, highlighted for Language when set
+)
+
+var messageFormats = []string{FormatPlain, FormatMarkdown, FormatCode}
+
+// normalizeFormat checks the rendering hint of a chat message and brings it
+// to its canonical form. Messages without one are plain text and keep the
+// field empty. Only code messages may name a language.
+func normalizeFormat(msg *Msg) error {
+	msg.Format = strings.ToLower(strings.TrimSpace(msg.Format))
+	if msg.Format == FormatPlain {
+		msg.Format = ""
+	}
+	if msg.Format != "" && !contains(messageFormats, msg.Format) {
+		return fmt.Errorf("unknown format '%s', expected one of %s", msg.Format, strings.Join(messageFormats, ", "))
+	}
+
+	if msg.Language == "" {
+		return nil
+	}
+	if msg.Format != FormatCode {
+		return fmt.Errorf("only code messages can have a language")
+	}
+	language, err := normalizeLanguage(msg.Language)
+	if err != nil {
+		return err
+	}
+	msg.Language = language
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeFormat(t *testing.T) {
+	tests := []struct {
+		format, language         string
+		wantFormat, wantLanguage string
+		wantErr                  string
+	}{
+		{"", "", "", "", ""},
+		{"plain", "", "", "", ""},
+		{" Markdown ", "", FormatMarkdown, "", ""},
+		{"code", "", FormatCode, "", ""},
+		{"code", "Go", FormatCode, "go", ""},
+		{"html", "", "", "", "unknown format 'html', expected one of plain, markdown, code"},
+		{"markdown", "go", "", "", "only code messages can have a language"},
+		{"code", "cobol", "", "", "unsupported language 'cobol'"},
+	}
+	for _, tt := range tests {
+		msg := Msg{Format: tt.format, Language: tt.language}
+		err := normalizeFormat(&msg)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("normalizeFormat(%q, %q) error = %v, want %q", tt.format, tt.language, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || msg.Format != tt.wantFormat || msg.Language != tt.wantLanguage {
+			t.Errorf("normalizeFormat(%q, %q) = %q, %q, %v", tt.format, tt.language, msg.Format, msg.Language, err)
+		}
+	}
+}
+
+func TestFormatIsPersistedAndReplayed(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	alice := dial(t, server, createTestUser(t, "alice"), nil)
+
+	sent := []Msg{
+		{Type: PublicMessage, Content: "**shipping** today", Format: FormatMarkdown},
+		{Type: PublicMessage, Content: "x := <-ch // :smile:", Format: FormatCode, Language: "go"},
+		{Type: PublicMessage, Content: "just text"},
+	}
+	for _, msg := range sent {
+		alice.send(msg)
+		if got := alice.expect(PublicMessage); got.Content != msg.Content || got.Format != msg.Format || got.Language != msg.Language {
+			t.Errorf("delivered %q as %q/%q, want it untouched as %q/%q", got.Content, got.Format, got.Language, msg.Format, msg.Language)
+		}
+	}
+	alice.send(Msg{Type: PublicMessage, Content: "<b>hi</b>", Format: "html"})
+	if got := alice.expect(ErrorMessage); got.Content != "Invalid format: unknown format 'html', expected one of plain, markdown, code" {
+		t.Errorf("an unknown format was answered with %q", got.Content)
+	}
+
+	bob := dial(t, server, createTestUser(t, "bob"), nil)
+	var replayed []Msg
+	for {
+		msg, err := bob.read()
+		if err != nil {
+			t.Fatalf("reading the replay: %v", err)
+		}
+		if msg.Type == LastRead {
+			break
+		}
+		if msg.Type == PublicMessage && !msg.IsSystem {
+			replayed = append(replayed, msg)
+		}
+	}
+	if len(replayed) != len(sent) {
+		t.Fatalf("replayed %d messages, want %d", len(replayed), len(sent))
+	}
+	for i, msg := range replayed {
+		if msg.Content != sent[i].Content || msg.Format != sent[i].Format || msg.Language != sent[i].Language {
+			t.Errorf("replayed %q as %q/%q, want %q/%q", msg.Content, msg.Format, msg.Language, sent[i].Format, sent[i].Language)
+		}
+	}
+}
+
+func TestFormatMigration(t *testing.T) {
+	setupLegacyTest(t, time.Now())
+	history := lobbyHistory(t)
+	if len(history) != 1 || history[0].Format != "" || history[0].Language != "" {
+		t.Errorf("an old message replayed as %+v, want plain text", history)
+	}
+
+	if _, err := SaveMessage(Msg{Type: PublicMessage, Username: "alice", Content: "# notes", Format: FormatMarkdown}); err != nil {
+		t.Fatalf("SaveMessage into a migrated table: %v", err)
+	}
+	if history := lobbyHistory(t); len(history) != 2 || history[1].Format != FormatMarkdown {
+		t.Errorf("replayed %+v, want the markdown message", history)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestFrozenDocumentRefusesEdits(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	owner := dial(t, server, createTestUser(t, "alice"), nil)
+	editor := dial(t, server, createTestUser(t, "bob"), nil)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	for _, conn := range []*testConn{owner, editor} {
+		conn.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+		if got := conn.expect(DocContent); got.Frozen {
+			t.Fatal("a new document opened frozen")
+		}
+	}
+
+	editor.send(Msg{Type: DocFreeze, DocumentID: doc.ID})
+	if got := editor.expect(ErrorMessage); got.Content != "Only the owner can change how this document is edited" {
+		t.Errorf("another user freezing the document was answered with %q", got.Content)
+	}
+
+	owner.send(Msg{Type: DocFreeze, DocumentID: doc.ID})
+	for _, conn := range []*testConn{owner, editor} {
+		if got := conn.expect(DocMode); !got.Frozen || got.Mode != ModeReadOnly {
+			t.Errorf("freezing was announced as %+v", got)
+		}
+	}
+	for _, conn := range []*testConn{owner, editor} {
+		conn.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "too late"})
+		if got := conn.expect(ErrorMessage); got.Content != "This document is frozen, it can't be edited" {
+			t.Errorf("an edit to the frozen document was answered with %q", got.Content)
+		}
+	}
+
+	// The flag is stored, and reopening the document shows it
+	editor.send(Msg{Type: DocClose, DocumentID: doc.ID})
+	editor.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	if got := editor.expect(DocContent); !got.Frozen || got.Content == "too late" {
+		t.Errorf("the frozen document reopened as %+v", got)
+	}
+	if stored, err := GetDocument(doc.ID); err != nil || !stored.Frozen {
+		t.Errorf("GetDocument = %+v, %v, want it frozen", stored, err)
+	}
+
+	owner.send(Msg{Type: DocUnfreeze, DocumentID: doc.ID})
+	if got := editor.expect(DocMode); got.Frozen || got.Mode != ModeOpen {
+		t.Errorf("unfreezing was announced as %+v", got)
+	}
+	editor.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "thawed"})
+	if got := owner.expect(DocUpdate); got.Content != "thawed" {
+		t.Errorf("the edit after unfreezing came through as %q", got.Content)
+	}
+}
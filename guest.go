@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RoleGuest is the token role of unregistered users
+const RoleGuest = "guest"
+
+// guestPrefix starts every guest username. Names with it can't be registered.
+const guestPrefix = "guest-"
+
+// CloseGuestLimit is the WebSocket close code sent when a guest connection
+// reaches GUEST_SESSION_LIFETIME or GUEST_ACTION_LIMIT. Clients should not
+// reconnect on their own: the guest has to come in again, or register.
+const CloseGuestLimit = 4004
+
+// Capabilities that can be granted to guests with GUEST_PERMISSIONS. Without
+// any, guests can only read the public chat.
+const (
+	GuestPost      = "post"      // Post and edit public and room messages, comment on documents
+	GuestPrivate   = "private"   // Send private messages and use group conversations
+	GuestReact     = "react"     // React to messages
+	GuestRooms     = "rooms"     // Join and leave rooms
+	GuestSearch    = "search"    // Search messages
+	GuestDocuments = "documents" // List and view documents
+	GuestEdit      = "edit"      // Create, edit, rename and share documents
+)
+
+var guestCapabilities = []string{GuestPost, GuestPrivate, GuestReact, GuestRooms, GuestSearch, GuestDocuments, GuestEdit}
+
+// guestCapabilityOf maps message types to the capability guests need to
+// send them. Types not listed here are open to guests.
+var guestCapabilityOf = map[MsgType]string{
+	PublicMessage:  GuestPost,
+	PrivateMessage: GuestPrivate,
+	MessageEdit:    GuestPost,
+	MessageDelete:  GuestPost,
+	DocComment:     GuestPost,
+	GroupCreate:    GuestPrivate,
+	GroupMessage:   GuestPrivate,
+	Reaction:       GuestReact,
+	RoomJoin:       GuestRooms,
+	RoomLeave:      GuestRooms,
+	RoomMembers:    GuestRooms,
+	Search:         GuestSearch,
+	DocList:        GuestDocuments,
+	DocOpen:        GuestDocuments,
+	DocUsers:       GuestDocuments,
+	DocHistory:     GuestDocuments,
+	DocSnapshot:    GuestDocuments,
+	DocCreate:      GuestEdit,
+	DocUpdate:      GuestEdit,
+	DocUndo:        GuestEdit,
+	DocRedo:        GuestEdit,
+	DocRename:      GuestEdit,
+	DocShare:       GuestEdit,
+	DocBulk:        GuestEdit,
+	DocFreeze:      GuestEdit,
+	DocUnfreeze:    GuestEdit,
+	DocMode:        GuestEdit,
+	DocTurn:        GuestEdit,
+}
+
+// checkGuest reports unknown guest capabilities
+func (c *Config) checkGuest(p *configProblems) {
+	for _, capability := range c.GuestPermissions {
+		if !contains(guestCapabilities, capability) {
+			p.add("Unknown GUEST_PERMISSIONS entry %q, expected one of %s", capability, strings.Join(guestCapabilities, ", "))
+		}
+	}
+	if c.GuestTokenTTL <= 0 {
+		p.add("GUEST_TOKEN_TTL must be positive, got %d", c.GuestTokenTTL)
+	}
+	if c.GuestSessionLifetime < 0 {
+		p.add("GUEST_SESSION_LIFETIME can't be negative, got %d", c.GuestSessionLifetime)
+	}
+	if c.GuestActionLimit < 0 {
+		p.add("GUEST_ACTION_LIMIT can't be negative, got %d", c.GuestActionLimit)
+	}
+}
+
+// guestSessionEnd fires when a guest connection has been open for
+// GUEST_SESSION_LIFETIME. It never fires for registered users, or when no
+// lifetime is set.
+func (c *Client) guestSessionEnd() (<-chan time.Time, func()) {
+	if !c.Guest || config.GuestSessionLifetime <= 0 {
+		return nil, func() {}
+	}
+	lifetime := time.Duration(config.GuestSessionLifetime) * time.Minute
+	timer := time.NewTimer(time.Until(c.Connected.Add(lifetime)))
+	return timer.C, func() { timer.Stop() }
+}
+
+// countGuestAction counts a message from a guest against GUEST_ACTION_LIMIT
+// and reports whether the guest was still within it. Pongs are answers to
+// the server's own pings and don't count.
+func (c *Client) countGuestAction(msgType MsgType) bool {
+	if !c.Guest || config.GuestActionLimit <= 0 || msgType == Pong {
+		return true
+	}
+	c.guestActions++
+	return c.guestActions <= config.GuestActionLimit
+}
+
+// guestCan reports whether guests were granted a capability
+func guestCan(capability string) bool {
+	return contains(config.GuestPermissions, capability)
+}
+
+// guestMaySend reports whether guests may send messages of the given type
+func guestMaySend(msgType MsgType) bool {
+	capability, ok := guestCapabilityOf[msgType]
+	if !ok {
+		if _, known := messageRules[msgType]; known {
+			return true
+		}
+		// Unknown types are handled as public messages
+		capability = GuestPost
+	}
+	return guestCan(capability)
+}
+
+// IsGuestUsername reports whether a name belongs to the guest namespace
+func IsGuestUsername(username string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(username)), guestPrefix)
+}
+
+// newGuestUsername returns a unique guest username
+func newGuestUsername() string {
+	return guestPrefix + strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+}
+
+// HandleGuest issues a short-lived guest token under a fresh username
+func HandleGuest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !config.GuestAccess {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success: false,
+			Message: "Guest access is disabled",
+		})
+		return
+	}
+
+	username := newGuestUsername()
+	ttl := time.Duration(config.GuestTokenTTL) * time.Minute
+	token, err := signToken(username, RoleGuest, ttl)
+	if err != nil {
+		log.Printf("Error generating guest token: %v", err)
+		json.NewEncoder(w).Encode(AuthResponse{
+			Success: false,
+			Message: "Failed to generate token",
+		})
+		return
+	}
+
+	log.Printf("Issued guest token for %s", username)
+	setAuthCookie(w, token, ttl)
+	json.NewEncoder(w).Encode(AuthResponse{
+		Success:  true,
+		Message:  "Guest access granted",
+		Token:    token,
+		Username: username,
+	})
+}
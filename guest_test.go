@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleGuest(t *testing.T) {
+	setupTest(t)
+	if w := callHandler(t, HandleGuest, "POST", "/guest", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("POST /guest with guest access off = %d, want 403", w.Code)
+	}
+
+	config.GuestAccess = true
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		w := callHandler(t, HandleGuest, "POST", "/guest", "", nil)
+		var resp AuthResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.Success {
+			t.Fatalf("POST /guest = %d %+v, %v", w.Code, resp, err)
+		}
+		claims, err := ValidateToken(resp.Token)
+		if err != nil {
+			t.Fatalf("the guest token doesn't verify: %v", err)
+		}
+		if claims.Role != RoleGuest || !IsGuestUsername(claims.Username) || seen[claims.Username] {
+			t.Errorf("guest token for %q with role %q", claims.Username, claims.Role)
+		}
+		seen[claims.Username] = true
+		if ttl := time.Until(claims.ExpiresAt.Time); ttl > time.Hour || ttl < 59*time.Minute {
+			t.Errorf("the guest token lasts %v, want GUEST_TOKEN_TTL", ttl)
+		}
+	}
+
+	if !IsReservedUsername("Guest-1234") {
+		t.Error("guest names can be registered")
+	}
+}
+
+func TestGuestRestrictions(t *testing.T) {
+	setupTest(t)
+	config.GuestAccess = true
+	config.GuestPermissions = []string{GuestDocuments}
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	guest := dial(t, server, guestTestToken(t, newGuestUsername()), url.Values{"role": {RoleGuest}})
+
+	for _, msg := range []Msg{
+		{Type: PublicMessage, Content: "hi"},
+		{Type: PrivateMessage, To: "alice", Content: "hi"},
+		{Type: RoomJoin, Room: "dev"},
+		{Type: DocCreate, Name: "mine.txt"},
+		{Type: DocUpdate, DocumentID: doc.ID, Content: "vandalism"},
+	} {
+		guest.send(msg)
+		if got := guest.expect(ErrorMessage); got.Content != "Guests are not allowed to do this, please register" {
+			t.Errorf("a guest's %s was answered with %q", msg.Type, got.Content)
+		}
+	}
+
+	// Guests read the chat and, with the documents capability, watch documents
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "alice", Content: "welcome"}
+	if got := guest.expect(PublicMessage); got.Content != "welcome" {
+		t.Errorf("the guest read %q", got.Content)
+	}
+	guest.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	if got := guest.expect(DocContent); !got.ReadOnly {
+		t.Error("the guest opened the document for editing without the edit capability")
+	}
+}
+
+func TestGuestPermissionsGrantCapabilities(t *testing.T) {
+	setupTest(t)
+	config.GuestAccess = true
+	config.GuestPermissions = []string{GuestPost}
+	hub := newTestHub(t)
+	guest := dial(t, newTestServer(t, hub), guestTestToken(t, newGuestUsername()), url.Values{"role": {RoleGuest}})
+
+	guest.send(Msg{Type: PublicMessage, Content: "hello from a guest"})
+	if got := guest.expect(PublicMessage); got.Content != "hello from a guest" {
+		t.Errorf("the guest's post came back as %q", got.Content)
+	}
+}
+
+func TestGuestActionLimitClosesConnection(t *testing.T) {
+	setupTest(t)
+	config.GuestAccess = true
+	config.GuestActionLimit = 2
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	conn := dial(t, server, guestTestToken(t, newGuestUsername()), nil)
+	conn.expect(Session)
+
+	for i := 0; i < 3; i++ {
+		conn.send(Msg{Type: UserListRequest})
+	}
+	// Invalid and forbidden messages after the limit must be ignored, not
+	// answered on a connection that is going away
+	conn.send(Msg{Type: "bogus"})
+	conn.send(Msg{Type: PublicMessage, Content: "hello"})
+
+	closeErr, msgs := conn.expectClose()
+	if closeErr.Code != CloseGuestLimit {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseGuestLimit)
+	}
+	answered := 0
+	for _, msg := range msgs {
+		if msg.Type == UserListRequest {
+			answered++
+		}
+	}
+	if answered != 2 {
+		t.Errorf("%d requests were answered, want the 2 within the limit", answered)
+	}
+	eventually(t, "the guest to leave the hub", func() bool { return len(hub.ConnectedClients()) == 0 })
+}
+
+func TestGuestActionLimitSparesRegisteredUsers(t *testing.T) {
+	setupTest(t)
+	config.GuestActionLimit = 2
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	conn := dial(t, server, createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	for i := 0; i < 5; i++ {
+		conn.send(Msg{Type: UserListRequest})
+		conn.expect(UserListRequest)
+	}
+}
+
+func TestGuestSessionLifetimeClosesConnection(t *testing.T) {
+	setupTest(t)
+	config.GuestSessionLifetime = 1
+
+	// A guest who connected longer ago than the lifetime is closed at once.
+	// There is no hub here to close Send once the connection is gone.
+	client := fakeClient(newGuestUsername(), true)
+	client.Guest = true
+	client.Connected = time.Now().Add(-2 * time.Minute)
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		client.Conn = conn
+		go func() {
+			defer close(done)
+			client.writeMessages()
+		}()
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	closeErr, _ := (&testConn{t: t, conn: ws}).expectClose()
+	if closeErr.Code != CloseGuestLimit {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseGuestLimit)
+	}
+	close(client.Send)
+	<-done
+}
+
+func TestGuestSessionEnd(t *testing.T) {
+	setupTest(t)
+	config.GuestSessionLifetime = 30
+
+	guest := fakeClient("guest-1", true)
+	guest.Guest = true
+	if end, stop := guest.guestSessionEnd(); end == nil {
+		t.Error("a guest connection has no end with GUEST_SESSION_LIFETIME set")
+	} else {
+		stop()
+	}
+
+	if end, _ := fakeClient("alice", true).guestSessionEnd(); end != nil {
+		t.Error("a registered user's connection has an end")
+	}
+
+	config.GuestSessionLifetime = 0
+	if end, _ := guest.guestSessionEnd(); end != nil {
+		t.Error("a guest connection has an end without GUEST_SESSION_LIFETIME")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReloadOnHangup starts reloading the files operators may edit while the
+// server runs, in a goroutine of its own, whenever the process gets SIGHUP:
+// the message of the day from motdFile and, when policyFile is set, the
+// document creation policy. A file that can't be loaded keeps what was
+// loaded from it before.
+func ReloadOnHangup(motdFile, policyFile string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := LoadMessageOfTheDay(motdFile); err != nil {
+				log.Printf("Failed to reload MOTD file %s: %v", motdFile, err)
+			} else {
+				log.Printf("Reloaded MOTD file %s", motdFile)
+			}
+
+			if policyFile == "" {
+				continue
+			}
+			if err := loadDocCreatePolicyFile(policyFile); err != nil {
+				log.Printf("Failed to reload document creation policy file %s, keeping the last good policy: %v", policyFile, err)
+			} else {
+				log.Printf("Reloaded document creation policy from %s", policyFile)
+			}
+		}
+	}()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTimeout bounds how long a test waits for the hub or a connection
+const testTimeout = 5 * time.Second
+
+// TestMain keeps the server's logging out of the test output, unless the
+// tests run with -v
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// setupTest gives a test the default configuration and a fresh database in
+// a temporary directory, both restored when it ends, with the log writers
+// running on that database. Tests change config afterwards to try other
+// settings.
+func setupTest(t *testing.T) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	saved := config
+	config = DefaultConfig()
+	t.Cleanup(func() { config = saved })
+	if err := loadDocCreatePolicy(); err != nil {
+		t.Fatalf("loadDocCreatePolicy: %v", err)
+	}
+	if err := LoadMessageOfTheDay(config.MOTDFile); err != nil {
+		t.Fatalf("LoadMessageOfTheDay: %v", err)
+	}
+
+	if err := InitDB(); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	startBackgroundWriters(t)
+}
+
+// startBackgroundWriters runs the writers of the document event and access
+// logs on the test's database. When the test ends they save what is still
+// queued and have returned before the database is closed, so that nothing
+// is left reading the configuration or the database of the next test.
+func startBackgroundWriters(t *testing.T) {
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		RunDocumentEventWriter(db, stop)
+	}()
+	go func() {
+		defer writers.Done()
+		RunAccessLogWriter(db, stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		writers.Wait()
+	})
+}
+
+// eventStreams starts the dispatcher of /events once for the whole test
+// run. The streams a test opens go away with it.
+var eventStreams sync.Once
+
+// newTestHub starts a hub for a test. When the test ends, the hub waits for
+// its connections to go away and stops.
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	eventStreams.Do(func() { go RunEventStreams() })
+	hub := NewHub()
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	return hub
+}
+
+// settle waits until the hub is done with what it was last handed on an
+// unbuffered channel, by asking it a question
+func settle(hub *Hub) {
+	hub.DocumentEditors("")
+}
+
+// flushBackgroundWriters waits until the log writers have written what was
+// handed to them, by handing them one more entry each and waiting for it.
+// Each call has its own marker, so that a test can flush more than once.
+func flushBackgroundWriters(t *testing.T) {
+	t.Helper()
+	marker := fmt.Sprintf("flush-%s-%d", t.Name(), time.Now().UnixNano())
+	documentEvents <- DocumentEvent{DocumentID: marker, Operation: "flush", Time: time.Now()}
+	documentAccesses <- DocumentAccess{DocumentID: marker, Action: "flush", Time: time.Now()}
+	eventually(t, "the log writers to catch up", func() bool {
+		var written int
+		err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM document_events WHERE document_id = ?1) + (SELECT COUNT(*) FROM access_log WHERE document_id = ?1)`, marker).Scan(&written)
+		return err == nil && written == 2
+	})
+}
+
+// createTestUser registers a user and returns a token for them
+func createTestUser(t *testing.T, username string) string {
+	t.Helper()
+	if err := CreateUser(username, "secret1"); err != nil {
+		t.Fatalf("CreateUser %s: %v", username, err)
+	}
+	token, err := GenerateToken(username)
+	if err != nil {
+		t.Fatalf("GenerateToken %s: %v", username, err)
+	}
+	return token
+}
+
+// guestTestToken returns a guest token for the given guest name
+func guestTestToken(t *testing.T, username string) string {
+	t.Helper()
+	token, err := signToken(username, RoleGuest, time.Hour)
+	if err != nil {
+		t.Fatalf("signToken %s: %v", username, err)
+	}
+	return token
+}
+
+// saveTestMessage stores a lobby message and returns its ID
+func saveTestMessage(t *testing.T, username, content string) int64 {
+	t.Helper()
+	id, err := SaveMessage(Msg{Type: PublicMessage, Username: username, Content: content})
+	if err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	return id
+}
+
+// searchIDs returns the IDs of the messages a search by alice finds
+func searchIDs(t *testing.T, query string) []int64 {
+	t.Helper()
+	results, err := SearchMessages(query, "alice", nil, 0, 50)
+	if err != nil {
+		t.Fatalf("SearchMessages %q: %v", query, err)
+	}
+	var ids []int64
+	for _, result := range results {
+		ids = append(ids, result.Message.ID)
+	}
+	return ids
+}
+
+// lobbyHistory returns the lobby messages alice would be replayed
+func lobbyHistory(t *testing.T) []Msg {
+	t.Helper()
+	page, err := GetRoomHistory("", 0, 50, "alice")
+	if err != nil {
+		t.Fatalf("GetRoomHistory: %v", err)
+	}
+	return page.Messages
+}
+
+// callHandler serves one request to an HTTP handler, with the token in the
+// Authorization header and body encoded as JSON unless it is nil
+func callHandler(t *testing.T, handler http.HandlerFunc, method, target, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// fakeClient is a client of the hub without a connection. What the hub
+// sends it piles up in Send, for the test to read.
+func fakeClient(username string, inChat bool) *Client {
+	return &Client{
+		ID:       username + "-" + time.Now().Format("150405.000000000"),
+		Username: username,
+		Send:     make(chan Msg, 256),
+		Closing:  make(chan *closeFrame, 1),
+		InChat:   inChat,
+		Role:     roleOf(username, false),
+	}
+}
+
+// register adds a fake client to the hub and waits until it is in
+func register(t *testing.T, hub *Hub, client *Client) {
+	t.Helper()
+	done := make(chan struct{})
+	hub.Register <- registration{Client: client, Done: done}
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("registering %s timed out", client.Username)
+	}
+}
+
+// unregister removes a fake client from the hub and waits until it is out,
+// returning what was still sent to it. The hub closes Send before it is
+// done with the client, saving its document for one; a round trip through
+// Run waits for the rest.
+func unregister(t *testing.T, hub *Hub, client *Client) []Msg {
+	t.Helper()
+	hub.Unregister <- client
+	var msgs []Msg
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-client.Send:
+			if !ok {
+				hub.ConnectedClients()
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		case <-deadline:
+			t.Fatalf("unregistering %s timed out", client.Username)
+		}
+	}
+}
+
+// receive returns the next message of the given type sent to a fake
+// client, skipping the others, or the next message of any type if msgType
+// is empty
+func receive(t *testing.T, client *Client, msgType MsgType) Msg {
+	t.Helper()
+	deadline := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-client.Send:
+			if !ok {
+				t.Fatalf("%s was disconnected while waiting for %s", client.Username, msgType)
+			}
+			if msgType == "" || msg.Type == msgType {
+				return msg
+			}
+		case <-deadline:
+			t.Fatalf("%s got no %s message", client.Username, msgType)
+		}
+	}
+}
+
+// drain discards what was sent to a fake client so far, waiting a little
+// for the hub to finish what it was doing
+func drain(client *Client) []Msg {
+	var msgs []Msg
+	for {
+		select {
+		case msg, ok := <-client.Send:
+			if !ok {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		case <-time.After(100 * time.Millisecond):
+			return msgs
+		}
+	}
+}
+
+// newTestServer serves the WebSocket endpoint of a hub, behind the same
+// authentication as the real server
+func newTestServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	}))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testConn is a WebSocket client of a test server
+type testConn struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// dial connects to a test server with a token and extra query parameters
+func dial(t *testing.T, server *httptest.Server, token string, query url.Values) *testConn {
+	t.Helper()
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("token", token)
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?" + query.Encode()
+	conn, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dialing %s: %v (status %d)", u, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn}
+}
+
+// send writes a message to the server
+func (c *testConn) send(msg Msg) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("sending %s: %v", msg.Type, err)
+	}
+}
+
+// read returns the next message from the server, or the error that ended
+// the connection
+func (c *testConn) read() (Msg, error) {
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var msg Msg
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+// expect returns the next message of the given type, skipping the others
+func (c *testConn) expect(msgType MsgType) Msg {
+	c.t.Helper()
+	for {
+		msg, err := c.read()
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// expectClose reads until the server closes the connection, and returns
+// the close frame it sent along with the messages that came before it
+func (c *testConn) expectClose() (*websocket.CloseError, []Msg) {
+	c.t.Helper()
+	var msgs []Msg
+	for {
+		msg, err := c.read()
+		if err == nil {
+			msgs = append(msgs, msg)
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			c.t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return closeErr, msgs
+	}
+}
+
+// eventually waits for a condition the hub reaches on its own time
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
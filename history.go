@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// historyOffMessage answers requests for stored messages when
+// CHAT_PERSISTENCE is off
+const historyOffMessage = "Chat history is turned off on this server"
+
+// HistoryPage is a stretch of a room's history, oldest message first
+type HistoryPage struct {
+	Messages []Msg
+	HasMore  bool  // There are older messages than Messages
+	OldestID int64 // ID of the first message, 0 if there are none
+	NewestID int64 // ID of the last message, 0 if there are none
+	Total    int   // How many messages of the room the viewer can see
+}
+
+// historyInfo describes a history page without its messages, sent after
+// the messages of a replay so clients know whether they can load more
+func historyInfo(room string, page *HistoryPage) Msg {
+	return Msg{
+		Type:     History,
+		Room:     room,
+		HasMore:  page.HasMore,
+		OldestID: page.OldestID,
+		NewestID: page.NewestID,
+		Total:    page.Total,
+		Time:     time.Now(),
+	}
+}
+
+// normalizeHistoryLimit clamps a requested page size
+func normalizeHistoryLimit(limit int) int {
+	return clampLimit(limit, config.HistoryPageSize, config.HistoryMaxPageSize)
+}
+
+// handleHistory sends the client a page of older messages of the lobby or
+// of one of its rooms
+func (c *Client) handleHistory(room string, before int64, limit int, hub *Hub) {
+	if !config.ChatPersistence {
+		c.sendError(historyOffMessage)
+		return
+	}
+	if room != "" {
+		if _, ok := hub.RoomMembers(c, room); !ok {
+			c.sendError("You are not a member of this room")
+			return
+		}
+	}
+	limit = normalizeHistoryLimit(limit)
+
+	page, err := GetRoomHistory(room, before, limit, c.Username)
+	if err != nil {
+		log.Printf("Error getting history of room %q for %s: %v", room, c.Username, err)
+		c.sendError("Failed to load history")
+		return
+	}
+
+	response := historyInfo(room, page)
+	response.Messages = page.Messages
+	response.Before = before
+	response.Limit = limit
+	c.reply(response)
+}
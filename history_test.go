@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestHistoryPagination(t *testing.T) {
+	setupTest(t)
+	var ids []int64
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		ids = append(ids, saveTestMessage(t, "alice", content))
+	}
+	// Not visible to alice, so not counted either
+	if _, err := SaveMessage(Msg{Type: PrivateMessage, Username: "bob", To: "carol", Content: "psst"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		before  int64
+		want    []int64
+		hasMore bool
+	}{
+		{0, ids[3:], true},
+		{ids[3], ids[1:3], true},
+		// Exactly the last page: nothing older is left
+		{ids[2], ids[:2], false},
+		{ids[1], ids[:1], false},
+	} {
+		page, err := GetRoomHistory("", tc.before, 2, "alice")
+		if err != nil {
+			t.Fatalf("GetRoomHistory before %d: %v", tc.before, err)
+		}
+		var got []int64
+		for _, msg := range page.Messages {
+			got = append(got, msg.ID)
+		}
+		if len(got) != len(tc.want) || got[0] != tc.want[0] || got[len(got)-1] != tc.want[len(tc.want)-1] {
+			t.Errorf("before %d: got messages %v, want %v", tc.before, got, tc.want)
+		}
+		if page.HasMore != tc.hasMore || page.OldestID != got[0] || page.NewestID != got[len(got)-1] || page.Total != 5 {
+			t.Errorf("before %d: hasMore %v oldest %d newest %d total %d, want hasMore %v and total 5", tc.before, page.HasMore, page.OldestID, page.NewestID, page.Total, tc.hasMore)
+		}
+	}
+}
+
+func TestHistoryRequestCarriesPagination(t *testing.T) {
+	setupTest(t)
+	config.HistoryPageSize = 2
+	for _, content := range []string{"one", "two", "three"} {
+		saveTestMessage(t, "bob", content)
+	}
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	// The replay on connecting ends with the page's metadata
+	replay := conn.expect(History)
+	if !replay.HasMore || replay.Total != 3 || replay.OldestID == 0 {
+		t.Fatalf("the replay ended with %+v, want more to load", replay)
+	}
+
+	conn.send(Msg{Type: History, Before: replay.OldestID})
+	older := conn.expect(History)
+	if len(older.Messages) != 1 || older.Messages[0].Content != "one" || older.HasMore || older.Limit != 2 {
+		t.Errorf("the older page is %+v, want the first message and nothing more", older)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitDBSaysWhichStepFailed(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// A comments table from some other program, missing the column the
+	// comments index needs
+	other, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Exec(`CREATE TABLE document_comments (id INTEGER PRIMARY KEY, body TEXT)`)
+	other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = InitDB()
+	if err == nil {
+		db.Close()
+		t.Fatal("InitDB succeeded with a broken document_comments table")
+	}
+	if !strings.HasPrefix(err.Error(), "creating document comments table: ") || !strings.Contains(err.Error(), "document_id") {
+		t.Errorf("InitDB error = %q, want it to name the step and the cause", err)
+	}
+	if db != nil {
+		t.Error("the database handle was left open after InitDB failed")
+	}
+}
+
+func TestInitDBSaysWhenTheDatabaseCantBeOpened(t *testing.T) {
+	t.Chdir(t.TempDir())
+	// A directory where the database file should be
+	if err := os.Mkdir(dbPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := InitDB()
+	if err == nil {
+		db.Close()
+		t.Fatal("InitDB succeeded with a directory for a database")
+	}
+	if !strings.HasPrefix(err.Error(), "connecting to database "+dbPath+": ") {
+		t.Errorf("InitDB error = %q, want it to say connecting failed", err)
+	}
+	if db != nil {
+		t.Error("the database handle was left open after InitDB failed")
+	}
+}
+
+func TestIndexesExistAfterInit(t *testing.T) {
+	setupTest(t)
+	for _, index := range []string{
+		"idx_messages_room",
+		"idx_messages_private",
+		"idx_messages_conversation",
+		"idx_messages_username",
+		"idx_documents_created_by",
+		"idx_documents_updated_at",
+		"idx_document_permissions_username",
+		"idx_document_events_document",
+	} {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = ?)`, index).Scan(&exists); err != nil || !exists {
+			t.Errorf("index %s missing after InitDB (%v)", index, err)
+		}
+	}
+
+	// The hot queries use them rather than scanning
+	for query, index := range map[string]string{
+		`SELECT id FROM messages WHERE from_user = 'alice' AND to_user = 'bob'`: "idx_messages_private",
+		`SELECT id FROM documents WHERE created_by = 'alice'`:                   "idx_documents_created_by",
+		`SELECT id FROM documents ORDER BY updated_at DESC`:                     "idx_documents_updated_at",
+	} {
+		rows, err := db.Query("EXPLAIN QUERY PLAN " + query)
+		if err != nil {
+			t.Fatalf("explaining %q: %v", query, err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, notUsed int
+			var detail string
+			if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+				t.Fatal(err)
+			}
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if !strings.Contains(strings.Join(plan, "\n"), index) {
+			t.Errorf("%q runs as %q, not using %s", query, plan, index)
+		}
+	}
+}
+
+func TestInitDropsStoredDocumentListRefreshes(t *testing.T) {
+	setupTest(t)
+	kept := saveTestMessage(t, "alice", "hello")
+	if _, err := db.Exec(`INSERT INTO messages (type, username, content, timestamp, created_at) VALUES (?, '', '', ?, ?)`, DocList, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initMessageTables(); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	rows, err := db.Query(`SELECT id FROM messages`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != 1 || ids[0] != kept {
+		t.Errorf("messages left: %v, want only %d", ids, kept)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// quietLeave is a leave notice held back under JOIN_LEAVE_WINDOW
+type quietLeave struct {
+	Due   time.Time
+	Rooms []string // The rooms the user was in, to be told
+}
+
+// inChat reports whether the user has a chat connection open other than
+// except, or one that dropped within RECONNECT_GRACE
+func (h *Hub) inChat(username string, except *Client) bool {
+	for client := range h.Clients {
+		if client != except && client.InChat && client.Username == username {
+			return true
+		}
+	}
+	for _, pending := range h.Pending[username] {
+		if pending.InChat {
+			return true
+		}
+	}
+	return false
+}
+
+// announceJoined tells the rooms the user is in, or the lobby when they are
+// in none yet, that the user joined. Under JOIN_LEAVE_WINDOW
+// only the user's first chat connection is announced, and not even that one
+// when it makes up for a leave still held back: to the chat, the user never
+// left.
+func (h *Hub) announceJoined(client *Client) {
+	if config.JoinLeaveWindow > 0 {
+		if _, held := h.QuietLeaves[client.Username]; held {
+			delete(h.QuietLeaves, client.Username)
+			log.Printf("%s rejoined within JOIN_LEAVE_WINDOW, not announcing", client.Username)
+			return
+		}
+		if h.inChat(client.Username, client) {
+			return
+		}
+	}
+
+	welcomeMsg := newSystemMessage(client.Username + " joined the chat")
+	h.notifyRooms(welcomeMsg, h.userRooms(client.Username))
+	EmitWebhookEvent(WebhookUserJoined, webhookUser{Username: client.Username})
+	publishEvent(WebhookUserJoined, webhookUser{Username: client.Username})
+}
+
+// holdLeave puts off the leave notice of a user whose last chat connection
+// is gone for JOIN_LEAVE_WINDOW seconds. Connections the user still has
+// keep them in the chat, and nothing is held.
+func (h *Hub) holdLeave(username string, rooms []string) {
+	if h.inChat(username, nil) {
+		return
+	}
+	leave, held := h.QuietLeaves[username]
+	if !held {
+		leave.Due = time.Now().Add(time.Duration(config.JoinLeaveWindow) * time.Second)
+	}
+	for _, room := range rooms {
+		if !contains(leave.Rooms, room) {
+			leave.Rooms = append(leave.Rooms, room)
+		}
+	}
+	h.QuietLeaves[username] = leave
+}
+
+// sendQuietLeaves announces the leaves held back for JOIN_LEAVE_WINDOW
+// whose users didn't come back in time
+func (h *Hub) sendQuietLeaves(now time.Time) {
+	for username, leave := range h.QuietLeaves {
+		if now.Before(leave.Due) {
+			continue
+		}
+		delete(h.QuietLeaves, username)
+		h.sendLeft(username, leave.Rooms)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notices returns the contents of the system notices among msgs
+func notices(msgs []Msg) []string {
+	var contents []string
+	for _, msg := range msgs {
+		if msg.Type == SystemMessage {
+			contents = append(contents, msg.Content)
+		}
+	}
+	return contents
+}
+
+func TestEditorOnlyClientsGetNoChatNotices(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	editor := fakeClient("alice", false)
+	watcher := fakeClient("carol", true)
+	register(t, hub, editor)
+	register(t, hub, watcher)
+	drain(editor)
+	drain(watcher)
+
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	unregister(t, hub, bob)
+
+	if got := notices(drain(editor)); len(got) != 0 {
+		t.Errorf("the editor-only client got chat notices %q", got)
+	}
+	got := strings.Join(notices(drain(watcher)), "|")
+	if got != "bob joined the chat|bob left the chat" {
+		t.Errorf("the chat client got %q, want bob's join and leave", got)
+	}
+}
+
+func TestEditorOnlyConnectionsAreNotAnnounced(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	watcher := fakeClient("carol", true)
+	register(t, hub, watcher)
+	drain(watcher)
+
+	editor := fakeClient("bob", false)
+	register(t, hub, editor)
+	unregister(t, hub, editor)
+	if got := notices(drain(watcher)); len(got) != 0 {
+		t.Errorf("an editor-only connection was announced: %q", got)
+	}
+}
+
+func TestJoinLeaveNoticesAreNotStored(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	unregister(t, hub, bob)
+
+	watcher := fakeClient("carol", true)
+	register(t, hub, watcher)
+	for _, msg := range drain(watcher) {
+		if strings.Contains(msg.Content, "bob") {
+			t.Errorf("a notice about bob was replayed: %q", msg.Content)
+		}
+	}
+	var stored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Errorf("%d notices were stored", stored)
+	}
+}
+
+func TestJoinLeaveNoticesStayInTheUsersRooms(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	carol := fakeClient("carol", true)
+	for _, client := range []*Client{alice, bob, carol} {
+		register(t, hub, client)
+	}
+	joinTestRoom(t, hub, alice, "dev")
+	joinTestRoom(t, hub, carol, "dev")
+	joinTestRoom(t, hub, bob, "ops")
+	drain(bob)
+	drain(carol)
+
+	// A second tab of alice, who is in dev, and its leave are news to dev
+	// only, not to bob in another room
+	tab := fakeClient("alice", true)
+	register(t, hub, tab)
+	unregister(t, hub, alice)
+	if got := strings.Join(notices(drain(carol)), "|"); got != "alice joined the chat|alice left the chat" {
+		t.Errorf("carol in the same room got %q", got)
+	}
+	if got := notices(drain(bob)); len(got) != 0 {
+		t.Errorf("bob in another room got %q", got)
+	}
+
+	// A user only in the lobby is announced to the lobby
+	dave := fakeClient("dave", true)
+	register(t, hub, dave)
+	unregister(t, hub, dave)
+	for name, client := range map[string]*Client{"bob": bob, "carol": carol} {
+		if got := strings.Join(notices(drain(client)), "|"); got != "dave joined the chat|dave left the chat" {
+			t.Errorf("%s got %q, want dave's join and leave", name, got)
+		}
+	}
+}
+
+// A connection that asks for a room is announced to that room only, as if
+// it had been in it all along
+func TestAutoJoinedConnectionIsAnnouncedToItsRoom(t *testing.T) {
+	setupTest(t)
+	config.AutoJoinSource = AutoJoinQuery
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	bob := fakeClient("bob", true)
+	carol := fakeClient("carol", true)
+	for _, client := range []*Client{bob, carol} {
+		register(t, hub, client)
+	}
+	joinTestRoom(t, hub, bob, "other")
+	joinTestRoom(t, hub, carol, "support")
+	drain(bob)
+	drain(carol)
+
+	alice := dial(t, server, createTestUser(t, "alice"), url.Values{"room": {"support"}})
+	alice.expect(Session)
+	eventually(t, "alice to join support", func() bool { return len(hub.RoomsOf("alice")) == 1 })
+	if got := strings.Join(notices(drain(carol)), "|"); got != "alice joined the chat" {
+		t.Errorf("carol in support got %q", got)
+	}
+	if got := notices(drain(bob)); len(got) != 0 {
+		t.Errorf("bob in another room got %q", got)
+	}
+}
+
+func TestSystemMessagesUseConfiguredIdentity(t *testing.T) {
+	setupTest(t)
+	config.SystemName = "Concierge"
+	config.SystemColor = "#336699"
+	hub := newTestHub(t)
+	watcher := fakeClient("carol", true)
+	register(t, hub, watcher)
+	drain(watcher)
+
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	unregister(t, hub, bob)
+
+	var seen int
+	for _, msg := range drain(watcher) {
+		if msg.Type != SystemMessage {
+			continue
+		}
+		seen++
+		if msg.Username != "Concierge" || msg.Color != "#336699" || !msg.IsSystem {
+			t.Errorf("%q came from %q in %q", msg.Content, msg.Username, msg.Color)
+		}
+	}
+	if seen != 2 {
+		t.Errorf("%d system messages were sent, want the join and the leave", seen)
+	}
+
+	for _, name := range []string{"Concierge", "concierge ", "System"} {
+		if !IsReservedUsername(name) {
+			t.Errorf("%q can be registered", name)
+		}
+	}
+}
+
+func TestQuickReconnectIsNotAnnounced(t *testing.T) {
+	setupTest(t)
+	config.JoinLeaveWindow = 1
+	hub := newTestHub(t)
+	watcher := fakeClient("carol", true)
+	register(t, hub, watcher)
+	drain(watcher)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	if got := strings.Join(notices(drain(watcher)), "|"); got != "bob joined the chat" {
+		t.Fatalf("the first connection was announced as %q", got)
+	}
+
+	// A refresh: the connection drops and comes right back
+	unregister(t, hub, bob)
+	bob = fakeClient("bob", true)
+	register(t, hub, bob)
+	// A second tab of a user already in the chat
+	tab := fakeClient("bob", true)
+	register(t, hub, tab)
+	unregister(t, hub, tab)
+	if got := notices(drain(watcher)); len(got) != 0 {
+		t.Errorf("the reconnect was announced: %q", got)
+	}
+
+	// Well past the window, the held leave doesn't come out after all
+	time.Sleep(1500 * time.Millisecond)
+	if got := notices(drain(watcher)); len(got) != 0 {
+		t.Errorf("bob is still connected, but the chat was told %q", got)
+	}
+}
+
+func TestHeldLeaveIsAnnouncedAfterTheWindow(t *testing.T) {
+	setupTest(t)
+	config.JoinLeaveWindow = 1
+	hub := newTestHub(t)
+	watcher := fakeClient("carol", true)
+	register(t, hub, watcher)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	drain(watcher)
+
+	unregister(t, hub, bob)
+	if got := notices(drain(watcher)); len(got) != 0 {
+		t.Errorf("the leave wasn't held back: %q", got)
+	}
+	if got := receive(t, watcher, SystemMessage); got.Content != "bob left the chat" {
+		t.Errorf("the chat was told %q, want bob's leave", got.Content)
+	}
+
+	// Once the leave is out, coming back is news again
+	register(t, hub, fakeClient("bob", true))
+	if got := receive(t, watcher, SystemMessage); got.Content != "bob joined the chat" {
+		t.Errorf("the chat was told %q, want bob's join", got.Content)
+	}
+
+	c := DefaultConfig()
+	c.JoinLeaveWindow = -1
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "JOIN_LEAVE_WINDOW") {
+		t.Errorf("Validate = %v, want JOIN_LEAVE_WINDOW reported", err)
+	}
+}
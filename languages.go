@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultDocLanguages are the canonical language names accepted for
+// documents unless DOC_LANGUAGES says otherwise. They match the language IDs
+// of the Monaco editor.
+var defaultDocLanguages = []string{
+	"plaintext", "c", "cpp", "csharp", "css", "go", "html", "java", "javascript",
+	"json", "markdown", "php", "python", "ruby", "rust", "shell", "sql",
+	"typescript", "xml", "yaml",
+}
+
+// languageAliases maps common alternative spellings to canonical names
+var languageAliases = map[string]string{
+	"text":       "plaintext",
+	"txt":        "plaintext",
+	"c++":        "cpp",
+	"c#":         "csharp",
+	"cs":         "csharp",
+	"golang":     "go",
+	"ecmascript": "javascript",
+	"js":         "javascript",
+	"node":       "javascript",
+	"md":         "markdown",
+	"py":         "python",
+	"python3":    "python",
+	"rb":         "ruby",
+	"rs":         "rust",
+	"bash":       "shell",
+	"sh":         "shell",
+	"ts":         "typescript",
+	"yml":        "yaml",
+}
+
+// supportedLanguages returns the canonical names of the languages documents
+// may use
+func (c *Config) supportedLanguages() []string {
+	if len(c.DocLanguages) > 0 {
+		return c.DocLanguages
+	}
+	return defaultDocLanguages
+}
+
+// normalizeLanguage maps a requested document language to its canonical
+// name. An empty language falls back to DOC_DEFAULT_LANGUAGE; anything not
+// in the allowlist is an error.
+func normalizeLanguage(language string) (string, error) {
+	return config.normalizeLanguage(language)
+}
+
+func (c *Config) normalizeLanguage(language string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(language))
+	if name == "" {
+		name = c.DocDefaultLanguage
+	}
+	if canonical, ok := languageAliases[name]; ok {
+		name = canonical
+	}
+
+	for _, supported := range c.supportedLanguages() {
+		if name == supported {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported language '%s'", language)
+}
+
+// checkLanguage lowercases the language settings and reports a default
+// language missing from the allowlist, since documents created without a
+// language would be rejected
+func (c *Config) checkLanguage(p *configProblems) {
+	for i, language := range c.DocLanguages {
+		c.DocLanguages[i] = strings.ToLower(language)
+	}
+	c.DocDefaultLanguage = strings.ToLower(c.DocDefaultLanguage)
+
+	if _, err := c.normalizeLanguage(c.DocDefaultLanguage); err != nil {
+		p.add("DOC_DEFAULT_LANGUAGE %q is not in the supported languages", c.DocDefaultLanguage)
+	}
+
+	// Quotas are kept under canonical names, which documents are stored with
+	quotas := make(map[string]int, len(c.DocLanguageQuotas))
+	for language, quota := range c.DocLanguageQuotas {
+		canonical, err := c.normalizeLanguage(language)
+		if err != nil || language == "" {
+			p.add("DOC_LANGUAGE_QUOTAS names %q, which is not a supported language", language)
+			continue
+		}
+		if quota < 0 {
+			p.add("DOC_LANGUAGE_QUOTAS for %s must not be negative", language)
+		}
+		quotas[canonical] = quota
+	}
+	c.DocLanguageQuotas = quotas
+}
+
+// LanguageCount is the number of documents in one language, with the quota
+// of the language if it has one
+type LanguageCount struct {
+	Language string `json:"language"`
+	Count    int    `json:"count"`
+	Quota    int    `json:"quota,omitempty"`
+}
+
+// LanguageStatsResponse answers GET /documents/languages
+type LanguageStatsResponse struct {
+	Languages []LanguageCount `json:"languages"`
+	Total     int             `json:"total"`
+}
+
+// checkLanguageQuota returns ErrLanguageQuotaExceeded if there are already as
+// many documents in a language as DOC_LANGUAGE_QUOTAS allows
+func checkLanguageQuota(q queryer, language string) error {
+	quota := config.DocLanguageQuotas[language]
+	if quota <= 0 {
+		return nil
+	}
+	count, err := countDocumentsByLanguage(q, language)
+	if err != nil {
+		return err
+	}
+	if count >= quota {
+		return fmt.Errorf("%w: there can be at most %d %s documents", ErrLanguageQuotaExceeded, quota, language)
+	}
+	return nil
+}
+
+// languageStats breaks the documents down by language, the most used first.
+// Languages with a quota are listed even when no document uses them yet.
+func languageStats() (*LanguageStatsResponse, error) {
+	counts, err := GetDocumentCountsByLanguage()
+	if err != nil {
+		return nil, err
+	}
+	for language := range config.DocLanguageQuotas {
+		if _, ok := counts[language]; !ok {
+			counts[language] = 0
+		}
+	}
+
+	stats := &LanguageStatsResponse{Languages: make([]LanguageCount, 0, len(counts))}
+	for language, count := range counts {
+		stats.Languages = append(stats.Languages, LanguageCount{
+			Language: language,
+			Count:    count,
+			Quota:    config.DocLanguageQuotas[language],
+		})
+		stats.Total += count
+	}
+	sort.Slice(stats.Languages, func(i, j int) bool {
+		a, b := stats.Languages[i], stats.Languages[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Language < b.Language
+	})
+	return stats, nil
+}
+
+// HandleLanguageStats returns how many documents there are in each language
+func HandleLanguageStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := ValidateToken(r.Header.Get("Authorization")); err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	stats, err := languageStats()
+	if err != nil {
+		log.Printf("Error counting documents by language: %v", err)
+		http.Error(w, "Failed to count documents", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	setupTest(t)
+	tests := []struct{ in, want string }{
+		{"go", "go"},
+		{" Go ", "go"},
+		{"golang", "go"},
+		{"PY", "python"},
+		{"c++", "cpp"},
+		{"", "plaintext"},
+	}
+	for _, tt := range tests {
+		if got, err := normalizeLanguage(tt.in); err != nil || got != tt.want {
+			t.Errorf("normalizeLanguage(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := normalizeLanguage("cobol"); err == nil {
+		t.Error("cobol was accepted")
+	}
+
+	// DOC_LANGUAGES narrows the list, aliases included
+	config.DocLanguages = []string{"go", "plaintext"}
+	if got, err := normalizeLanguage("golang"); err != nil || got != "go" {
+		t.Errorf("golang with DOC_LANGUAGES = %q, %v", got, err)
+	}
+	if _, err := normalizeLanguage("py"); err == nil {
+		t.Error("py was accepted though python isn't in DOC_LANGUAGES")
+	}
+}
+
+func TestDocumentLanguagesOnCreateAndRename(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	alice := fakeClient("alice", false)
+	register(t, hub, alice)
+
+	alice.handleDocumentCreate("old.cob", "cobol", hub)
+	if msg := receive(t, alice, ErrorMessage); msg.Content != "unsupported language 'cobol'" {
+		t.Errorf("creating a cobol document: %q", msg.Content)
+	}
+
+	alice.handleDocumentCreate("main.go", "Golang", hub)
+	doc := receive(t, alice, DocContent)
+	if doc.Language != "go" {
+		t.Errorf("the document was created in %q, want go", doc.Language)
+	}
+
+	alice.handleDocumentRename(doc.DocumentID, "", "JS", hub)
+	receive(t, alice, DocList)
+	if stored, err := GetDocument(doc.DocumentID); err != nil || stored.Language != "javascript" {
+		t.Errorf("renamed to %+v (%v), want javascript", stored, err)
+	}
+	alice.handleDocumentRename(doc.DocumentID, "", "cobol", hub)
+	if msg := receive(t, alice, ErrorMessage); msg.Content != "unsupported language 'cobol'" {
+		t.Errorf("renaming to cobol: %q", msg.Content)
+	}
+}
+
+func TestSupportedLanguagesRequest(t *testing.T) {
+	setupTest(t)
+	config.DocLanguages = []string{"go", "plaintext"}
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+
+	conn.send(Msg{Type: DocLanguages})
+	if got := conn.expect(DocLanguages).Languages; len(got) != 2 || got[0] != "go" || got[1] != "plaintext" {
+		t.Errorf("the supported languages are %v, want go and plaintext", got)
+	}
+}
+
+// createDocumentIn creates a document of alice's in a language
+func createDocumentIn(t *testing.T, name, language string) *Document {
+	t.Helper()
+	doc, err := CreateDocument(name, language, "alice")
+	if err != nil {
+		t.Fatalf("CreateDocument %s: %v", name, err)
+	}
+	return doc
+}
+
+func TestDocumentCountsByLanguage(t *testing.T) {
+	setupTest(t)
+	if counts, err := GetDocumentCountsByLanguage(); err != nil || len(counts) != 0 {
+		t.Errorf("counts without documents = %v, %v", counts, err)
+	}
+
+	for i, language := range []string{"go", "python", "go", "markdown", "go", "python"} {
+		createDocumentIn(t, fmt.Sprintf("doc%d", i), language)
+	}
+	counts, err := GetDocumentCountsByLanguage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"go": 3, "python": 2, "markdown": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("GetDocumentCountsByLanguage = %v, want %v", counts, want)
+	}
+	if count, err := CountDocumentsByLanguage("python"); err != nil || count != 2 {
+		t.Errorf("CountDocumentsByLanguage(python) = %d, %v", count, err)
+	}
+}
+
+func TestLanguageQuotas(t *testing.T) {
+	setupTest(t)
+	config.DocLanguageQuotas = map[string]int{"go": 2}
+	createDocumentIn(t, "one.go", "go")
+	createDocumentIn(t, "two.go", "go")
+	if _, err := CreateDocument("three.go", "go", "alice"); !errors.Is(err, ErrLanguageQuotaExceeded) {
+		t.Errorf("a third go document = %v, want ErrLanguageQuotaExceeded", err)
+	}
+	createDocumentIn(t, "notes.txt", "plaintext")
+
+	// Quotas are checked under canonical names
+	c := DefaultConfig()
+	c.DocLanguageQuotas = map[string]int{"golang": 1, "cobol": 1, "py": -1}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), `"cobol"`) || !strings.Contains(err.Error(), "py must not be negative") {
+		t.Errorf("Validate = %v", err)
+	}
+	if c.DocLanguageQuotas["go"] != 1 {
+		t.Errorf("quotas were kept as %v", c.DocLanguageQuotas)
+	}
+}
+
+func TestHandleLanguageStats(t *testing.T) {
+	setupTest(t)
+	config.DocLanguageQuotas = map[string]int{"go": 5, "rust": 3}
+	token := createTestUser(t, "alice")
+	for i, language := range []string{"python", "go", "python", "markdown"} {
+		createDocumentIn(t, fmt.Sprintf("doc%d", i), language)
+	}
+
+	if w := callHandler(t, HandleLanguageStats, "GET", "/documents/languages", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a token = %d, want 401", w.Code)
+	}
+	w := callHandler(t, HandleLanguageStats, "GET", "/documents/languages", token, nil)
+	var stats LanguageStatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("GET /documents/languages = %d, %v", w.Code, err)
+	}
+	want := []LanguageCount{
+		{Language: "python", Count: 2},
+		{Language: "go", Count: 1, Quota: 5},
+		{Language: "markdown", Count: 1},
+		{Language: "rust", Count: 0, Quota: 3},
+	}
+	if stats.Total != 4 || !reflect.DeepEqual(stats.Languages, want) {
+		t.Errorf("the breakdown is %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// sendPing sends the client an application-level ping, which it answers
+// with a pong carrying the same pingSent, and reports whether the
+// connection is still usable. Unlike WebSocket control frames, the round
+// trip also covers the client's own message handling.
+func (c *Client) sendPing() bool {
+	now := time.Now()
+	c.pingSent.Store(now.UnixNano())
+	return c.writeMessage(Msg{
+		Type:     Ping,
+		PingSent: now.UnixMilli(),
+		Time:     now,
+	})
+}
+
+// handlePong records the round-trip time of the ping a pong answers. Pongs
+// that don't answer the latest ping are ignored.
+func (c *Client) handlePong(pingSent int64) {
+	sent := c.pingSent.Load()
+	if sent == 0 || pingSent != time.Unix(0, sent).UnixMilli() {
+		log.Printf("Ignoring stale pong from %s", c.Username)
+		return
+	}
+	c.latency.Store(int64(time.Since(time.Unix(0, sent))))
+}
+
+// Latency returns the round-trip time of the client's latest answered ping,
+// or 0 if it hasn't answered any. It is safe to call from any goroutine.
+func (c *Client) Latency() time.Duration {
+	return time.Duration(c.latency.Load())
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlePong(t *testing.T) {
+	setupTest(t)
+	client := fakeClient("alice", true)
+	if client.Latency() != 0 {
+		t.Fatalf("latency before any ping = %v", client.Latency())
+	}
+	sent := time.Now().Add(-80 * time.Millisecond)
+	client.pingSent.Store(sent.UnixNano())
+
+	// A pong for an older ping is ignored
+	client.handlePong(sent.Add(-time.Second).UnixMilli())
+	if client.Latency() != 0 {
+		t.Errorf("a stale pong set the latency to %v", client.Latency())
+	}
+	client.handlePong(sent.UnixMilli())
+	if got := client.Latency(); got < 80*time.Millisecond || got > time.Second {
+		t.Errorf("latency = %v, want about 80ms", got)
+	}
+}
+
+func TestLatencyOfConnectedClient(t *testing.T) {
+	setupTest(t)
+	config.PingInterval = 1
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+
+	ping := conn.expect(Ping)
+	if ping.PingSent == 0 {
+		t.Fatal("the ping carries no send time")
+	}
+	// The client takes its time to answer
+	time.Sleep(100 * time.Millisecond)
+	conn.send(Msg{Type: Pong, PingSent: ping.PingSent})
+
+	eventually(t, "the latency to be measured", func() bool {
+		clients := hub.ConnectedClients()
+		return len(clients) == 1 && clients[0].LatencyMs >= 100
+	})
+	if latency := hub.ConnectedClients()[0].LatencyMs; latency > 1000 {
+		t.Errorf("latency = %vms, want about 100ms", latency)
+	}
+}
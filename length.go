@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"unicode/utf8"
+)
+
+// Ways of handling chat messages longer than MESSAGE_MAX_LENGTH, set with
+// MESSAGE_LENGTH_POLICY
+const (
+	LengthReject   = "reject"   // Refuse the message with an error
+	LengthTruncate = "truncate" // Cut the message to the limit and tell the sender
+)
+
+// checkLength reports a negative MESSAGE_MAX_LENGTH or an unknown
+// MESSAGE_LENGTH_POLICY
+func (c *Config) checkLength(p *configProblems) {
+	if c.MessageMaxLength < 0 {
+		p.add("MESSAGE_MAX_LENGTH must not be negative, got %d", c.MessageMaxLength)
+	}
+	if c.MessageLengthPolicy != LengthReject && c.MessageLengthPolicy != LengthTruncate {
+		p.add("Invalid MESSAGE_LENGTH_POLICY %q, expected %s or %s", c.MessageLengthPolicy, LengthReject, LengthTruncate)
+	}
+}
+
+// truncateRunes returns the first limit characters of s. The cut falls
+// between characters, so a valid UTF-8 string stays valid.
+func truncateRunes(s string, limit int) string {
+	count := 0
+	for i := range s {
+		if count == limit {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// checkLength enforces MESSAGE_MAX_LENGTH on the content of a chat message
+// or message edit, refusing it or cutting it short as MESSAGE_LENGTH_POLICY
+// says. A cut message goes out with a notice telling the sender so.
+// Documents and comments have limits of their own.
+func (c *Client) checkLength(msg *Msg) bool {
+	if config.MessageMaxLength == 0 {
+		return true
+	}
+	length := utf8.RuneCountInString(msg.Content)
+	if length <= config.MessageMaxLength {
+		return true
+	}
+
+	if config.MessageLengthPolicy == LengthReject {
+		c.sendError(fmt.Sprintf("Messages can be at most %d characters long, this one has %d", config.MessageMaxLength, length))
+		return false
+	}
+
+	log.Printf("Truncating %s message from %s from %d to %d characters", msg.Type, c.Username, length, config.MessageMaxLength)
+	msg.Content = truncateRunes(msg.Content, config.MessageMaxLength)
+	notice := newSystemMessage(fmt.Sprintf("Your message had %d characters and was cut to the first %d", length, config.MessageMaxLength))
+	notice.Type = MessageTruncated
+	notice.MessageID = msg.MessageID
+	notice.ClientKey = msg.ClientKey
+	c.reply(notice)
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		limit int
+		want  string
+	}{
+		{"hello", 3, "hel"},
+		{"hello", 5, "hello"},
+		{"hello", 10, "hello"},
+		{"héllo wörld", 4, "héll"},
+		{"日本語のテキスト", 3, "日本語"},
+		{"👩‍💻👍", 1, "👩"},
+		{"", 2, ""},
+	} {
+		got := truncateRunes(tc.in, tc.limit)
+		if got != tc.want || !utf8.ValidString(got) {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", tc.in, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestLongMessageIsTruncated(t *testing.T) {
+	setupTest(t)
+	config.MessageMaxLength = 5
+	config.MessageLengthPolicy = LengthTruncate
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	conn.send(Msg{Type: PublicMessage, Content: "héllo wörld", ClientKey: "key-1"})
+	notice := conn.expect(MessageTruncated)
+	if notice.ClientKey != "key-1" || !strings.Contains(notice.Content, "11 characters") {
+		t.Errorf("the notice was %+v", notice)
+	}
+	posted := conn.expect(PublicMessage)
+	if posted.Content != "héllo" {
+		t.Errorf("the message was posted as %q, want its first 5 characters", posted.Content)
+	}
+	if stored, err := GetMessage(posted.ID); err != nil || stored.Content != "héllo" {
+		t.Errorf("the message was stored as %+v, %v", stored, err)
+	}
+
+	// Messages within the limit go through untouched, without a notice
+	conn.send(Msg{Type: PublicMessage, Content: "short"})
+	for {
+		msg, err := conn.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == MessageTruncated {
+			t.Fatal("a message within the limit was reported as truncated")
+		}
+		if msg.Type == PublicMessage {
+			if msg.Content != "short" {
+				t.Errorf("the message was posted as %q", msg.Content)
+			}
+			break
+		}
+	}
+}
+
+func TestLongMessageIsRejected(t *testing.T) {
+	setupTest(t)
+	config.MessageMaxLength = 5
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	conn.send(Msg{Type: PublicMessage, Content: "hello world"})
+	if got := conn.expect(ErrorMessage); got.Content != "Messages can be at most 5 characters long, this one has 11" {
+		t.Errorf("the error was %q", got.Content)
+	}
+	if stored := lobbyHistory(t); len(stored) != 0 {
+		t.Errorf("the message was stored as %+v", stored)
+	}
+}
+
+func TestDocumentsIgnoreMessageLength(t *testing.T) {
+	setupTest(t)
+	config.MessageMaxLength = 5
+	config.MessageLengthPolicy = LengthTruncate
+	hub := newTestHub(t)
+	alice := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	alice.expect(Session)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	alice.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	alice.expect(DocContent)
+	alice.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "a document longer than five characters"})
+	if got := receive(t, bob, DocUpdate); got.Content != "a document longer than five characters" {
+		t.Errorf("bob got the document as %q", got.Content)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestRoomLimit(t *testing.T) {
+	setupTest(t)
+	config.MaxRoomsPerUser = 2
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	phone := fakeClient("alice", true)
+	register(t, hub, alice)
+	register(t, hub, phone)
+
+	joinTestRoom(t, hub, alice, "dev")
+	// The limit counts rooms across the user's connections
+	joinTestRoom(t, hub, phone, "ops")
+	hub.JoinRoom <- roomRequest{Client: alice, Room: "random"}
+	if msg := receive(t, alice, ErrorMessage); msg.Content != "You can be in at most 2 rooms at a time, leave one first" {
+		t.Errorf("joining a third room was answered with %q", msg.Content)
+	}
+	// A room the user is already in doesn't count again
+	joinTestRoom(t, hub, alice, "ops")
+
+	hub.LeaveRoom <- roomRequest{Client: alice, Room: "dev"}
+	joinTestRoom(t, hub, alice, "random")
+	if rooms := hub.RoomsOf("alice"); len(rooms) != 2 {
+		t.Errorf("alice is in %v, want 2 rooms", rooms)
+	}
+}
+
+func TestOpenDocumentLimit(t *testing.T) {
+	setupTest(t)
+	config.MaxOpenDocuments = 2
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	first := createTestDocument(t, "first.txt", "alice")
+	second := createTestDocument(t, "second.txt", "alice")
+	third := createTestDocument(t, "third.txt", "alice")
+	openTestDocument(t, hub, "alice", first.ID)
+	openTestDocument(t, hub, "alice", second.ID)
+
+	tab := fakeClient("alice", false)
+	register(t, hub, tab)
+	tab.handleDocumentOpen(third.ID, "", hub)
+	if msg := receive(t, tab, ErrorMessage); msg.Content != "You can have at most 2 documents open at a time, close one first" {
+		t.Errorf("opening a third document was answered with %q", msg.Content)
+	}
+	// Another view of a document that is already open is fine
+	tab.handleDocumentOpen(first.ID, "", hub)
+	if msg := receive(t, tab, DocContent); msg.DocumentID != first.ID {
+		t.Errorf("reopening an open document gave %+v", msg)
+	}
+
+	// Others have limits of their own
+	openTestDocument(t, hub, "bob", third.ID)
+}
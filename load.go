@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ChannelDepth is how many items are queued in one of the hub's channels
+type ChannelDepth struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// ConnectionStats counts the open WebSocket connections
+type ConnectionStats struct {
+	Total      int64 `json:"total"`
+	Compressed int64 `json:"compressed"` // Connections that negotiated permessage-deflate
+}
+
+// LoadStatus reports the hub's backlog. While Degraded, the hub sheds
+// optional work such as history replay.
+type LoadStatus struct {
+	Degraded    bool                    `json:"degraded"`
+	Channels    map[string]ChannelDepth `json:"channels"`
+	Connections ConnectionStats         `json:"connections"`
+}
+
+// checkLoad reports thresholds and timeouts that can't work
+func (c *Config) checkLoad(p *configProblems) {
+	if c.LoadWarnPercent <= 0 || c.LoadWarnPercent > 100 {
+		p.add("LOAD_WARN_PERCENT must be between 1 and 100, got %d", c.LoadWarnPercent)
+	}
+	if c.LoadRecoverPercent < 0 || c.LoadRecoverPercent >= c.LoadWarnPercent {
+		p.add("LOAD_RECOVER_PERCENT must be below LOAD_WARN_PERCENT, got %d", c.LoadRecoverPercent)
+	}
+	if c.WSWriteTimeout <= 0 {
+		p.add("WS_WRITE_TIMEOUT must be positive, got %d", c.WSWriteTimeout)
+	}
+	if c.PingInterval < 0 {
+		p.add("PING_INTERVAL can't be negative, got %d", c.PingInterval)
+	}
+	if c.ReconnectGrace < 0 {
+		p.add("RECONNECT_GRACE can't be negative, got %d", c.ReconnectGrace)
+	}
+	if c.JoinLeaveWindow < 0 {
+		p.add("JOIN_LEAVE_WINDOW can't be negative, got %d", c.JoinLeaveWindow)
+	}
+}
+
+// ChannelDepths returns the backlog of each buffered hub channel. It is
+// safe to call from any goroutine.
+func (h *Hub) ChannelDepths() map[string]ChannelDepth {
+	depths := make(map[string]ChannelDepth)
+	add := func(name string, length, capacity int) {
+		if capacity == 0 {
+			return
+		}
+		depths[name] = ChannelDepth{Depth: length, Capacity: capacity}
+	}
+
+	add("broadcast", len(h.BroadCast), cap(h.BroadCast))
+	add("private", len(h.Private), cap(h.Private))
+	add("register", len(h.Register), cap(h.Register))
+	add("unregister", len(h.Unregister), cap(h.Unregister))
+	add("document_edits", len(h.DocumentEdits), cap(h.DocumentEdits))
+	add("join_document", len(h.JoinDocument), cap(h.JoinDocument))
+	add("leave_document", len(h.LeaveDocument), cap(h.LeaveDocument))
+	add("document_undo", len(h.DocumentUndo), cap(h.DocumentUndo))
+	add("document_comments", len(h.DocumentComment), cap(h.DocumentComment))
+	add("documents_removed", len(h.DocumentsRemoved), cap(h.DocumentsRemoved))
+	add("document_lists", len(h.DocumentLists), cap(h.DocumentLists))
+	add("message_updates", len(h.MessageUpdates), cap(h.MessageUpdates))
+	add("join_room", len(h.JoinRoom), cap(h.JoinRoom))
+	add("leave_room", len(h.LeaveRoom), cap(h.LeaveRoom))
+	add("groups", len(h.Groups), cap(h.Groups))
+	add("role_messages", len(h.RoleMessages), cap(h.RoleMessages))
+	add("notifications", len(h.Notifications), cap(h.Notifications))
+	return depths
+}
+
+// LoadStatus returns the hub's current backlog. It is safe to call from any
+// goroutine.
+func (h *Hub) LoadStatus() LoadStatus {
+	return LoadStatus{
+		Degraded: h.degraded.Load(),
+		Channels: h.ChannelDepths(),
+		Connections: ConnectionStats{
+			Total:      h.connections.Load(),
+			Compressed: h.compressedConnections.Load(),
+		},
+	}
+}
+
+// checkLoad is called by Run before handling each event. Once a channel
+// fills past LOAD_WARN_PERCENT the hub becomes degraded and warns chat
+// users; it recovers when every channel is back under LOAD_RECOVER_PERCENT.
+func (h *Hub) checkLoad() {
+	highest := 0
+	for _, channel := range h.ChannelDepths() {
+		if percent := channel.Depth * 100 / channel.Capacity; percent > highest {
+			highest = percent
+		}
+	}
+
+	switch {
+	case !h.degraded.Load() && highest >= config.LoadWarnPercent:
+		h.degraded.Store(true)
+		log.Printf("Hub channels at %d%% of capacity, shedding load", highest)
+		h.notifyChat(newSystemMessage("The server is under heavy load, some messages may be delayed"))
+
+	case h.degraded.Load() && highest <= config.LoadRecoverPercent:
+		h.degraded.Store(false)
+		log.Printf("Hub channels back to %d%% of capacity", highest)
+		h.notifyChat(newSystemMessage("Server load is back to normal"))
+	}
+}
+
+// HandleLoad reports the hub's channel depths, whether it is degraded and
+// how many connections are open
+func HandleLoad(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.LoadStatus())
+	}
+}
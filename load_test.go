@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// fillBroadcast queues count chat messages on the hub's broadcast channel
+func fillBroadcast(hub *Hub, count int) {
+	for i := 0; i < count; i++ {
+		hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: "spike"}
+	}
+}
+
+func TestFullChannelWarnsChat(t *testing.T) {
+	setupTest(t)
+	// Run isn't started, so the channel stays as full as the test makes it
+	hub := NewHub()
+	alice := fakeClient("alice", true)
+	editor := fakeClient("carol", false)
+	hub.Clients[alice] = true
+	hub.Clients[editor] = true
+
+	fillBroadcast(hub, 205)
+	hub.checkLoad()
+	if !hub.degraded.Load() {
+		t.Fatal("the hub isn't degraded with its broadcast channel at 80%")
+	}
+	if got := notices(drain(alice)); len(got) != 1 || got[0] != "The server is under heavy load, some messages may be delayed" {
+		t.Errorf("alice was warned with %q", got)
+	}
+	if got := notices(drain(editor)); len(got) != 0 {
+		t.Errorf("the editor-only client got %q", got)
+	}
+
+	w := callHandler(t, HandleLoad(hub), "GET", "/load", "", nil)
+	var status LoadStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /load = %d, %v", w.Code, err)
+	}
+	if !status.Degraded || status.Channels["broadcast"] != (ChannelDepth{Depth: 205, Capacity: 256}) {
+		t.Errorf("GET /load reported %+v", status)
+	}
+
+	// Still above LOAD_RECOVER_PERCENT, nothing changes
+	for len(hub.BroadCast) > 140 {
+		<-hub.BroadCast
+	}
+	hub.checkLoad()
+	if !hub.degraded.Load() || len(drain(alice)) != 0 {
+		t.Error("the hub recovered above LOAD_RECOVER_PERCENT")
+	}
+
+	for len(hub.BroadCast) > 128 {
+		<-hub.BroadCast
+	}
+	hub.checkLoad()
+	if hub.degraded.Load() {
+		t.Error("the hub is still degraded at 50%")
+	}
+	if got := notices(drain(alice)); len(got) != 1 || got[0] != "Server load is back to normal" {
+		t.Errorf("alice was told %q on recovery", got)
+	}
+}
+
+func TestDegradedHubSkipsHistoryReplay(t *testing.T) {
+	setupTest(t)
+	config.LoadWarnPercent = 20
+	config.LoadRecoverPercent = 5
+	saveTestMessage(t, "bob", "before the spike")
+
+	hub := NewHub()
+	fillBroadcast(hub, 60)
+	alice := fakeClient("alice", true)
+	done := make(chan struct{})
+	hub.Register <- registration{Client: alice, Done: done}
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	<-done
+
+	// alice connected while the hub was degraded, and recovery is announced
+	// once the backlog is gone
+	for {
+		msg := receive(t, alice, "")
+		if msg.Content == "before the spike" {
+			t.Fatal("history was replayed while degraded")
+		}
+		if msg.Type == SystemMessage && msg.Content == "Server load is back to normal" {
+			break
+		}
+	}
+}
@@ -1,228 +1,727 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type MsgType string
 
 const (
-	PublicMessage  MsgType = "public"
-	PrivateMessage MsgType = "Private"
-	SystemMessage  MsgType = "system"
-	DocList        MsgType = "doc-list"
-	DocOpen        MsgType = "doc-open"
-	DocCreate      MsgType = "doc-create"
-	DocContent     MsgType = "doc-content"
-	DocUpdate      MsgType = "doc-update"
-	UserJoined     MsgType = "user-joined"
-	UserLeft       MsgType = "user-left"
+	PublicMessage    MsgType = "public"
+	PrivateMessage   MsgType = "private"
+	SystemMessage    MsgType = "system"
+	DocList          MsgType = "doc-list"
+	DocOpen          MsgType = "doc-open"
+	DocCreate        MsgType = "doc-create"
+	DocContent       MsgType = "doc-content"
+	DocContentChunk  MsgType = "doc-content-chunk"
+	DocUpdate        MsgType = "doc-update"
+	DocClose         MsgType = "doc-close"
+	DocUsers         MsgType = "doc-users"
+	DocShare         MsgType = "doc-share"
+	DocHistory       MsgType = "doc-history"
+	DocUndo          MsgType = "doc-undo"
+	DocRedo          MsgType = "doc-redo"
+	DocRename        MsgType = "doc-rename"
+	DocLanguages     MsgType = "doc-languages"
+	DocComment       MsgType = "doc-comment"
+	DocComments      MsgType = "doc-comments"
+	DocBulk          MsgType = "doc-bulk"
+	DocFreeze        MsgType = "doc-freeze"
+	DocUnfreeze      MsgType = "doc-unfreeze"
+	DocMode          MsgType = "doc-mode"
+	DocTurn          MsgType = "doc-turn"
+	DocTruncated     MsgType = "doc-truncated"
+	DocSnapshot      MsgType = "doc-snapshot"
+	DocConflict      MsgType = "doc-conflict"
+	DocRevision      MsgType = "doc-revision"
+	UserJoined       MsgType = "user-joined"
+	UserLeft         MsgType = "user-left"
+	ErrorMessage     MsgType = "error"
+	Reaction         MsgType = "reaction"
+	ReactionSet      MsgType = "reaction-set"
+	MessageEdit      MsgType = "message-edit"
+	MessageExpired   MsgType = "message-expired"
+	MessageDelete    MsgType = "message-delete"
+	RoomJoin         MsgType = "room-join"
+	RoomLeave        MsgType = "room-leave"
+	RoomMembers      MsgType = "room-members"
+	GroupCreate      MsgType = "group-create"
+	GroupMessage     MsgType = "group"
+	Search           MsgType = "search"
+	MarkRead         MsgType = "mark-read"
+	LastRead         MsgType = "last-read"
+	AuthRefresh      MsgType = "auth-refresh"
+	PresenceSnapshot MsgType = "presence-snapshot"
+	PresenceJoin     MsgType = "presence-join"
+	PresenceLeave    MsgType = "presence-leave"
+	UserListRequest  MsgType = "user-list"
+	History          MsgType = "history"
+	RoleMessage      MsgType = "role-message"
+	Ping             MsgType = "ping"
+	Pong             MsgType = "pong"
+	Notification     MsgType = "notification"
+	Session          MsgType = "session"
+	Thread           MsgType = "thread"
+	MessageTruncated MsgType = "message-truncated"
 )
 
+// legacyPrivateMessage is the type private messages had before types were
+// all lowercase. Clients may still send it; it is taken as PrivateMessage.
+const legacyPrivateMessage MsgType = "Private"
+
 type Msg struct {
-	Type     MsgType   `json:"type"`
-	Username string    `json:"username"`
-	Content  string    `json:"content"`
-	Time     time.Time `json:"time"`
-	UserList []string  `json:"user_list"`
-	IsSystem bool      `json:"is_system"`
-	To       string    `json:"to,omitempty"`
-	From     string    `json:"from,omitempty"`
+	ID        int64      `json:"id,omitempty"` // Set once the message is stored
+	Type      MsgType    `json:"type"`
+	Username  string     `json:"username"`
+	Content   string     `json:"content"`
+	Time      time.Time  `json:"time"`
+	UserList  []string   `json:"user_list"`
+	IsSystem  bool       `json:"is_system"`
+	To        string     `json:"to,omitempty"`
+	From      string     `json:"from,omitempty"`
+	Room      string     `json:"room,omitempty"`      // Chat room of a public message; empty for the lobby
+	Edited    bool       `json:"edited,omitempty"`    // The content was changed after posting
+	EditedAt  *time.Time `json:"editedAt,omitempty"`  // When the content was last changed
+	Format    string     `json:"format,omitempty"`    // How to render the content: empty (plain), markdown or code
+	TTL       int        `json:"ttl,omitempty"`       // Seconds until the message expires and is deleted; 0 keeps it
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"` // When the message is deleted
+	Role      string     `json:"role,omitempty"`      // RoleMessage: the role the message is addressed to
+	ClientKey string     `json:"clientKey,omitempty"` // Chosen by the sender so that resending doesn't post the message twice
+	Duplicate bool       `json:"duplicate,omitempty"` // The message was resent and is already stored under ID
+	Delivery  string     `json:"delivery,omitempty"`  // Private: DeliveryDelivered, DeliveryQueued or DeliveryFailed, on the sender's copy
+
+	Token string `json:"token,omitempty"` // AuthRefresh: a refreshed token for the connection; DocOpen: a share link token
+
+	SessionID string `json:"sessionID,omitempty"` // Session: the connection's own ID; on messages from clients, the connection they came from
+
+	PingSent int64 `json:"pingSent,omitempty"` // Ping, Pong: when the server sent the ping, in Unix milliseconds
+
+	Notification string `json:"notification,omitempty"` // Notification: the event, NotifyMention, NotifyPrivate or NotifyShare
+
+	// Room-related fields
+	Members []RoomMember `json:"members,omitempty"` // RoomMembers: the room's roster; UserListRequest: the online users
+
+	// Read position fields
+	ReadPositions []ReadPosition `json:"readPositions,omitempty"` // LastRead: where the user stopped reading
+
+	// Search fields
+	Results []SearchResult `json:"results,omitempty"` // Search: matching messages, newest first
+	Before  int64          `json:"before,omitempty"`  // Search, History: only older messages; in search replies, the cursor of the next page
+	Limit   int            `json:"limit,omitempty"`   // Search, History, DocList: page size
+	Offset  int            `json:"offset,omitempty"`  // DocList: how many documents of the list to skip
+
+	// History fields
+	Messages []Msg `json:"messages,omitempty"` // History: the page's messages, oldest first; Thread: the thread's messages, oldest first
+	HasMore  bool  `json:"hasMore,omitempty"`  // History: there are older messages to load; DocList: there are more documents; Thread: the thread is longer than sent
+	OldestID int64 `json:"oldestID,omitempty"` // History: ID of the oldest message sent, the cursor of the next page
+	NewestID int64 `json:"newestID,omitempty"` // History: ID of the newest message sent
+	Total    int   `json:"total,omitempty"`    // History: how many messages of the room the client can see; DocList: how many documents the list holds
+
+	// Group conversation fields
+	ConversationID string   `json:"conversationID,omitempty"`
+	Participants   []string `json:"participants,omitempty"` // Users taking part in the conversation
+
+	// Thread fields
+	ParentID   int64 `json:"parentID,omitempty"`   // Public: the message this one replies to
+	ThreadID   int64 `json:"threadID,omitempty"`   // Public replies: the message the thread started with; Thread: the thread fetched
+	Depth      int   `json:"depth,omitempty"`      // Public replies: how deeply the reply is nested, 1 for a reply to a top-level message
+	ReplyCount int   `json:"replyCount,omitempty"` // Replayed messages: how many direct replies the message has, for collapsing them
+
+	// Reaction-related fields
+	Reactions []ReactionCount `json:"reactions,omitempty"` // Aggregated reactions on a replayed message
+	MessageID int64           `json:"messageID,omitempty"` // Reaction, MessageEdit, MessageDelete, Thread: the message reacted to, edited, deleted or whose thread to fetch
+	Emoji     string          `json:"emoji,omitempty"`     // Reaction: the emoji toggled, or a custom reaction's name in colons
+	Removed   bool            `json:"removed,omitempty"`   // Reaction: the reaction was taken back
+
+	// ReactionSet: the custom reactions and REACTION_POLICY
+	CustomReactions []CustomReaction `json:"customReactions,omitempty"`
+	ReactionPolicy  string           `json:"reactionPolicy,omitempty"`
 
 	// Document-related fields
-	DocumentID string      `json:"documentID,omitempty"`
-	Documents  []Document  `json:"documents,omitempty"`
-	Document   *Document   `json:"document,omitempty"`
-	Name       string      `json:"name,omitempty"`
-	Language   string      `json:"language,omitempty"`
-	Color      string      `json:"color,omitempty"`
+	DocumentID string            `json:"documentID,omitempty"`
+	Documents  []DocumentSummary `json:"documents,omitempty"`
+	Document   *Document         `json:"document,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Language   string            `json:"language,omitempty"`
+	Color      string            `json:"color,omitempty"`
+	Filter     string            `json:"filter,omitempty"`     // DocList: which documents to list
+	Sort       string            `json:"sort,omitempty"`       // DocList: the field documents are sorted by
+	Order      string            `json:"order,omitempty"`      // DocList: SortAscending or SortDescending
+	Permission string            `json:"permission,omitempty"` // DocShare: permission to grant
+	Events     []DocumentEvent   `json:"events,omitempty"`     // DocHistory: the document's edit log
+	Chunk      int               `json:"chunk,omitempty"`      // DocContentChunk: 1-based position of this chunk
+	ChunkCount int               `json:"chunkCount,omitempty"` // DocContentChunk: number of chunks in the stream
+	Final      bool              `json:"final,omitempty"`      // DocContentChunk: set on the last chunk
+	Languages  []string          `json:"languages,omitempty"`  // DocLanguages: the supported document languages
+	ReadOnly   bool              `json:"readOnly,omitempty"`   // DocContent: the client was admitted as a viewer only
+	Frozen     bool              `json:"frozen,omitempty"`     // DocContent, DocMode: the document accepts no edits
+	Mode       string            `json:"mode,omitempty"`       // DocContent, DocMode: the document's collaboration mode
+	Holder     string            `json:"holder,omitempty"`     // DocContent, DocTurn: who holds the turn in ModeTurns; empty while it is free
+	Owner      string            `json:"owner,omitempty"`      // DocContent: the document's creator, the only editor in ModeOwnerOnly
+	Line       int               `json:"line,omitempty"`       // DocComment: the line a new comment is anchored to
+	Comment    *DocumentComment  `json:"comment,omitempty"`    // DocComment: the comment posted
+	Comments   []DocumentComment `json:"comments,omitempty"`   // DocComments: the document's discussion so far
+	SnapshotID int64             `json:"snapshotID,omitempty"` // DocTruncated, DocSnapshot: the copy of the content before it was cut
+	Revision   int               `json:"revision,omitempty"`   // DocContent, DocUpdate, DocRevision, DocConflict: the revision of the content; on edits from clients, the one the edit was made against
+	Stats      *DocumentStats    `json:"stats,omitempty"`      // DocContent, the final DocContentChunk, DocUpdate, DocRevision, DocConflict: counts of the content's characters, words and lines
+
+	// Dry run fields
+	DryRun bool     `json:"dryRun,omitempty"` // DocCreate, DocRename: only check whether the operation would succeed
+	Errors []string `json:"errors,omitempty"` // DocCreate, DocRename dry runs: why the operation would fail
+
+	// Bulk document fields
+	Action          string           `json:"action,omitempty"`          // DocBulk: BulkDelete or BulkArchive
+	DocumentIDs     []string         `json:"documentIDs,omitempty"`     // DocBulk: the documents to act on
+	DocumentResults []DocumentResult `json:"documentResults,omitempty"` // DocBulk: the outcome for each document
 }
 
 type Client struct {
-	Username           string
-	Conn               *websocket.Conn
-	Send               chan Msg
-	CurrentDocumentID  string // Track which document the user is editing
+	ID                string // Unique to this connection; a user may have several
+	Username          string
+	Conn              *websocket.Conn
+	Send              chan Msg
+	CurrentDocumentID string           // Track which document the user is editing (only touched by Hub.Run)
+	ReadOnly          bool             // The client may view but not edit its current document (only touched by Hub.Run)
+	DocumentJoined    time.Time        // When the client opened its current document (only touched by Hub.Run)
+	InChat            bool             // False for editor-only connections that never join the chat
+	Compressed        bool             // permessage-deflate was negotiated for this connection
+	Batched           bool             // Connected with batch=1 while WS_BATCH_INTERVAL is set: messages may come as arrays
+	Guest             bool             // Connected with a guest token, limited to GUEST_PERMISSIONS
+	Role              string           // RoleGuest, or the user's role when they connected
+	TokenExpiry       time.Time        // When the token the client connected with lapses; zero if never
+	Reauth            chan time.Time   // Expiries of refreshed tokens, picked up by writeMessages
+	Closing           chan *closeFrame // Close frames to end the connection with once what is queued is written (see requestClose)
+	Presence          string           // PresenceFull or PresenceDiff
+	Connected         time.Time        // When the connection was accepted
+
+	guestActions int // Messages counted against GUEST_ACTION_LIMIT (only touched by readMessages)
+
+	reactionsWarned time.Time // Until when throttled reactions are dropped without another warning (only touched by readMessages)
+
+	pingSent atomic.Int64 // When the latest ping was sent, in Unix nanoseconds
+	latency  atomic.Int64 // Round-trip time of the latest answered ping
+	closing  atomic.Bool  // Set once a close was asked for: readMessages ignores what the client still sends
 }
 
 type Hub struct {
-	Clients         map[*Client]bool
-	BroadCast       chan Msg
-	Private         chan Msg
-	Register        chan *Client
-	Unregister      chan *Client
+	Clients    map[*Client]bool
+	BroadCast  chan Msg
+	Private    chan Msg
+	Register   chan registration
+	Unregister chan *Client
+
+	// Document editing sessions. DocumentClients is owned by Run; client
+	// handlers change or inspect it only through the channels below.
+	DocumentClients  map[string]map[*Client]bool // documentID -> set of clients
+	DocumentEdits    chan documentEdit           // Channel for document edit broadcasts
+	JoinDocument     chan documentJoin           // Clients opening (or creating) a document
+	LeaveDocument    chan *Client                // Clients closing their current document
+	DocumentRoster   chan rosterRequest          // Lookups of who is editing a document
+	DocumentUndo     chan undoRequest            // Undo and redo requests from editors
+	DocumentComment  chan documentEdit           // Comments to store and deliver to a document's session
+	DocumentsRemoved chan documentRemoval        // Deleted or archived documents whose sessions must end
+	DocumentMode     chan documentMode           // Collaboration modes changed by a document's owner
+	DocumentTurn     chan turnRequest            // Editors taking or giving up the turn
+	DocumentLists    chan struct{}               // Changes that leave every client's document list out of date
+
+	// Operation log of each open document, for undo and redo. Its content is
+	// the live one, saved to the database by autosaveDocuments. Sessions are
+	// kept for DOC_IDLE_TIMEOUT after the last client leaves.
+	DocumentHistories map[string]*documentHistory
+	DocumentDirty     map[string]time.Time // Documents with changes not saved yet, and when they last changed
+	DocumentActivity  map[string]time.Time // Last join, leave or change in each session
+	FlushDocuments    chan chan struct{}   // Requests to save every document now, answered once done
+
+	MessageUpdates chan Msg // Reactions, edits and deletions to deliver to everyone who can see the message
+
+	// Client keys of recently stored messages, by sender. Owned by Run.
+	SentKeys map[string]sentKey
+
+	// Sessions of dropped connections awaiting a reconnect, by username,
+	// oldest first. Owned by Run.
+	Pending map[string][]pendingDisconnect
+
+	// When the held-back leave notice of each user who left the chat goes
+	// out, under JOIN_LEAVE_WINDOW. Owned by Run.
+	QuietLeaves map[string]quietLeave
+
+	// Chat rooms. Like DocumentClients, Rooms is owned by Run.
+	Rooms      map[string]map[*Client]bool // room name -> set of member clients
+	JoinRoom   chan roomRequest            // Clients entering a room
+	LeaveRoom  chan roomRequest            // Clients leaving a room
+	RoomRoster chan roomRosterRequest      // Lookups of a room's members
+	UserRooms  chan userRoomsRequest       // Lookups of the rooms a user is in
+
+	Groups        chan Msg // Group conversation messages, delivered to their Participants
+	RoleMessages  chan Msg // Messages delivered only to the users holding their Role
+	Notifications chan Msg // Notifications to deliver to their recipient, if they want them
+
+	Admin      chan adminCommand      // Operations requested by admin tooling
+	Directory  chan directoryRequest  // Lookups of the online users someone may see
+	UserRoster chan userRosterRequest // Lookups of the online users a client may see, with their status
+
+	stop chan chan struct{} // Requests to end Run, answered once it has (see Stop)
+
+	degraded atomic.Bool // Set by Run while its channels are close to full
+
+	running sync.WaitGroup // The reading and writing goroutines of the connections
+
+	// Connection counts, readable from any goroutine
+	connections           atomic.Int64
+	compressedConnections atomic.Int64
+}
+
+// documentJoin asks the hub to add a client to a document's editing session
+type documentJoin struct {
+	Client   *Client
+	Document *Document
+	Comments []DocumentComment // Sent to the client along with the content
+	ViewOnly bool              // Admit the client as a viewer only, e.g. through a read link
+}
+
+// documentEdit carries a client's new content for the document it is
+// editing
+type documentEdit struct {
+	Client *Client
+	Msg    Msg
+}
+
+// undoRequest asks the hub to undo (or redo) the client's last change to a
+// document
+type undoRequest struct {
+	Client     *Client
+	DocumentID string
+	Redo       bool
+}
 
-	// Document editing sessions
-	DocumentClients map[string]map[*Client]bool // documentID -> set of clients
-	DocumentEdits   chan Msg                     // Channel for document edit broadcasts
+// registration adds a client to the hub. Done is closed once the client is
+// in Clients, from which point an Unregister for it is no longer lost.
+type registration struct {
+	Client *Client
+	Done   chan struct{}
+	Room   string // A room to put the client in before its join is announced
+}
+
+// rosterRequest asks the hub for the users editing a document. The answer
+// is sent on Reply.
+type rosterRequest struct {
+	DocumentID string
+	Reply      chan []string
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		Clients:         make(map[*Client]bool),
-		BroadCast:       make(chan Msg, 256),
-		Private:         make(chan Msg, 256),
-		Register:        make(chan *Client, 256),
-		Unregister:      make(chan *Client, 256),
-		DocumentClients: make(map[string]map[*Client]bool),
-		DocumentEdits:   make(chan Msg, 256),
+		Clients:          make(map[*Client]bool),
+		BroadCast:        make(chan Msg, 256),
+		Private:          make(chan Msg, 256),
+		Register:         make(chan registration, 256),
+		Unregister:       make(chan *Client, 256),
+		DocumentClients:  make(map[string]map[*Client]bool),
+		DocumentEdits:    make(chan documentEdit, 256),
+		JoinDocument:     make(chan documentJoin, 256),
+		LeaveDocument:    make(chan *Client, 256),
+		DocumentRoster:   make(chan rosterRequest),
+		DocumentUndo:     make(chan undoRequest, 256),
+		DocumentComment:  make(chan documentEdit, 256),
+		DocumentsRemoved: make(chan documentRemoval, 256),
+		DocumentMode:     make(chan documentMode, 256),
+		DocumentTurn:     make(chan turnRequest, 256),
+		DocumentLists:    make(chan struct{}, 256),
+		MessageUpdates:   make(chan Msg, 256),
+
+		SentKeys:    make(map[string]sentKey),
+		Pending:     make(map[string][]pendingDisconnect),
+		QuietLeaves: make(map[string]quietLeave),
+
+		DocumentHistories: make(map[string]*documentHistory),
+		DocumentDirty:     make(map[string]time.Time),
+		DocumentActivity:  make(map[string]time.Time),
+		FlushDocuments:    make(chan chan struct{}),
+
+		Rooms:      make(map[string]map[*Client]bool),
+		JoinRoom:   make(chan roomRequest, 256),
+		LeaveRoom:  make(chan roomRequest, 256),
+		RoomRoster: make(chan roomRosterRequest),
+		UserRooms:  make(chan userRoomsRequest),
+
+		Groups:        make(chan Msg, 256),
+		RoleMessages:  make(chan Msg, 256),
+		Notifications: make(chan Msg, 256),
+
+		Admin:      make(chan adminCommand),
+		Directory:  make(chan directoryRequest),
+		UserRoster: make(chan userRosterRequest),
+
+		stop: make(chan chan struct{}),
 	}
 }
 
+// Stop waits for the goroutines of the connections to return, then ends Run
+// and waits until it has. The connections must be closing already. The
+// server's hub runs for as long as the process does; hubs that don't, like
+// those of tests, are stopped once their clients are gone.
+func (h *Hub) Stop() {
+	h.running.Wait()
+	done := make(chan struct{})
+	h.stop <- done
+	<-done
+}
+
 func (h *Hub) Run() {
+	autosave := time.NewTicker(time.Duration(config.DocAutosaveInterval) * time.Second)
+	defer autosave.Stop()
+	prune := time.NewTicker(time.Duration(config.MessagePruneInterval) * time.Second)
+	defer prune.Stop()
+	// Housekeeping that needs to happen within a second of being due
+	seconds := time.NewTicker(time.Second)
+	defer seconds.Stop()
+
 	for {
+		h.checkLoad()
+
 		select {
-		case client := <-h.Register:
+		case <-autosave.C:
+			h.autosaveDocuments()
+
+		case <-prune.C:
+			h.pruneMessages()
+			h.forgetSentKeys()
+
+		case done := <-h.stop:
+			close(done)
+			return
+
+		case reg := <-h.Register:
+			client := reg.Client
+			if !h.userOnline(client.Username) {
+				h.sendPresenceDiff(PresenceJoin, client.Username)
+			}
+			pending, resumed := h.takePending(client)
 			h.Clients[client] = true
-			log.Printf("Client %s connected. Total Clients %d", client.Username, len(h.Clients))
+			h.connections.Add(1)
+			if client.Compressed {
+				h.compressedConnections.Add(1)
+			}
+			log.Printf("Client %s connected (connection %s). Total Clients %d", client.Username, client.ID, len(h.Clients))
+			close(reg.Done)
+			h.sendSession(client)
+
+			// Editor-only clients don't take part in the chat, so they get
+			// neither the history nor a join notice
+			if !client.InChat {
+				if resumed {
+					h.restoreSession(client, pending)
+				}
+				continue
+			}
+			if client.Presence == PresenceDiff {
+				h.sendPresenceSnapshot(client)
+			}
 
-			// Send recent message history to new client
-			history, err := GetRecentMessages(50)
-			if err != nil {
+			// Send recent message history to new client, unless the hub is
+			// too busy for it
+			if !config.ChatPersistence {
+				// Messages aren't stored, there is no history to replay
+			} else if h.degraded.Load() {
+				log.Printf("Skipping history replay for %s while degraded", client.Username)
+			} else if history, err := GetRoomHistory("", 0, config.HistoryPageSize, client.Username); err != nil {
 				log.Printf("Failed to get message history: %v", err)
 			} else {
-				for _, msg := range history {
-					msg.UserList = h.GetUserNames()
+				directory := h.userDirectory(h.GetUserNames())
+				for _, msg := range history.Messages {
 					select {
-					case client.Send <- msg:
+					case client.Send <- client.withUserList(msg, directory):
 					default:
 						log.Printf("Failed to send history message to %s", client.Username)
 					}
 				}
+				select {
+				case client.Send <- historyInfo("", history):
+				default:
+					log.Printf("Failed to send history info to %s", client.Username)
+				}
+			}
+
+			// Tell the client where the user stopped reading
+			if positions, err := GetLastReadPositions(client.Username); err != nil {
+				log.Printf("Failed to get read positions of %s: %v", client.Username, err)
+			} else {
+				select {
+				case client.Send <- Msg{Type: LastRead, ReadPositions: positions, Time: time.Now()}:
+				default:
+					log.Printf("Failed to send read positions to %s", client.Username)
+				}
 			}
 
-			welcomeMsg := Msg{
-				Type:     SystemMessage,
-				Username: "System",
-				Content:  client.Username + " joined the chat",
-				Time:     time.Now(),
-				IsSystem: true,
-				UserList: h.GetUserNames(),
+			// Greet the new client with the message of the day, if any
+			if text := MessageOfTheDay(client.Username); text != "" {
+				motdMsg := newSystemMessage(text)
+				select {
+				case client.Send <- client.withUserList(motdMsg, h.userDirectory(h.GetUserNames())):
+				default:
+					log.Printf("Failed to send MOTD to %s", client.Username)
+				}
+			}
+
+			// The room asked for when connecting is joined first, so that
+			// the join is announced to that room rather than the lobby
+			if reg.Room != "" {
+				h.joinRoom(client, reg.Room)
+			}
+
+			// A quick reconnect picks up where the dropped connection
+			// left off, and the chat never heard that the user had left
+			if resumed {
+				h.restoreSession(client, pending)
+				continue
 			}
-			h.BroadCast <- welcomeMsg
+			h.announceJoined(client)
 
 		case client := <-h.Unregister:
 			if _, ok := h.Clients[client]; ok {
-				delete(h.Clients, client)
-				close(client.Send)
-				log.Printf("Client %s disconnected. Total Clients %d", client.Username, len(h.Clients))
-
-				// Remove from document editing session
-				if client.CurrentDocumentID != "" {
-					if clients, ok := h.DocumentClients[client.CurrentDocumentID]; ok {
-						delete(clients, client)
-
-						// Notify other users in the document
-						leaveMsg := Msg{
-							Type:       UserLeft,
-							DocumentID: client.CurrentDocumentID,
-							Username:   client.Username,
-						}
-						for c := range clients {
-							select {
-							case c.Send <- leaveMsg:
-							default:
-							}
-						}
-					}
+				if config.ReconnectGrace > 0 {
+					h.holdClient(client)
+				} else {
+					h.disconnectClient(client)
 				}
+			}
 
-				goodbyeMsg := Msg{
-					Type:     SystemMessage,
-					Username: "System",
-					Content:  client.Username + " left the chat",
-					Time:     time.Now(),
-					IsSystem: true,
-					UserList: h.GetUserNames(),
-				}
-				h.BroadCast <- goodbyeMsg
+		case now := <-seconds.C:
+			h.expireDisconnects(now)
+			h.sendQuietLeaves(now)
+			h.saveQuietDocuments(now)
+			h.expireTurns(now)
+
+		case done := <-h.FlushDocuments:
+			for docID := range h.DocumentDirty {
+				h.saveDocument(docID)
 			}
+			close(done)
+
+		case cmd := <-h.Admin:
+			cmd.Reply <- h.runAdminCommand(cmd)
 
 		case message := <-h.BroadCast:
 			log.Printf("Broadcasting message from %s: %s", message.Username, message.Content)
 
 			// Save message to database
-			if err := SaveMessage(message); err != nil {
-				log.Printf("Failed to save message: %v", err)
+			if !h.saveMessage(&message) {
+				continue
+			}
+
+			if message.Type == PublicMessage {
+				posted := webhookMessage{
+					ID:       message.ID,
+					Username: message.Username,
+					Content:  message.Content,
+					Room:     message.Room,
+					Time:     message.Time,
+				}
+				EmitWebhookEvent(WebhookMessagePosted, posted)
+				publishEvent(WebhookMessagePosted, posted)
 			}
 
 			// Always update user list for all messages
-			message.UserList = h.GetUserNames()
+			directory := h.userDirectory(h.GetUserNames())
 
-			// Send to ALL connected clients
-			for client := range h.Clients {
+			// Send to ALL connected clients, or to the members of the room
+			recipients := h.Clients
+			if message.Room != "" {
+				recipients = h.Rooms[message.Room]
+			}
+			for client := range recipients {
 				select {
-				case client.Send <- message:
+				case client.Send <- client.withUserList(message, directory):
 					log.Printf("Message sent to %s", client.Username)
 				default:
-					log.Printf("Failed to send to %s, closing connection", client.Username)
-					close(client.Send)
-					delete(h.Clients, client)
+					if client.requestClose(recoverableClose(websocket.CloseTryAgainLater, HintOverloaded, overloadedRetryAfter)) {
+						log.Printf("Failed to send to %s, closing connection", client.Username)
+					}
 				}
 			}
+			if message.Type == PublicMessage {
+				h.notifyMentions(message)
+			}
 
 		case privateMsg := <-h.Private:
 			log.Printf("Sending private messages from %s to %s", privateMsg.From, privateMsg.To)
+			h.deliverPrivate(privateMsg)
+
+		case update := <-h.MessageUpdates:
+			if update.Type == MessageDelete {
+				h.forgetMessages(update.MessageID)
+			}
+			h.deliverUpdate(update)
 
-			// Save private message to database
-			if err := SaveMessage(privateMsg); err != nil {
-				log.Printf("Failed to save private message: %v", err)
+		case groupMsg := <-h.Groups:
+			// Group messages are stored; creation notices are not
+			if groupMsg.Type == GroupMessage && !h.saveMessage(&groupMsg) {
+				continue
 			}
 
-			var sender, recipient *Client
 			for client := range h.Clients {
-				if client.Username == privateMsg.From {
-					sender = client
-				}
-				if client.Username == privateMsg.To {
-					recipient = client
+				if !client.InChat || !contains(groupMsg.Participants, client.Username) {
+					continue
 				}
-			}
-			if sender != nil {
 				select {
-				case sender.Send <- privateMsg:
-					log.Printf("Private message sent to sender %s", sender.Username)
+				case client.Send <- groupMsg:
 				default:
-					log.Printf("Failed to send private message to sender %s", sender.Username)
+					log.Printf("Failed to send group message to %s", client.Username)
 				}
 			}
 
-			if recipient != nil {
-				select {
-				case recipient.Send <- privateMsg:
-					log.Printf("Private message sent to recipient %s", recipient.Username)
-				default:
-					log.Printf("Failed to send private message to recipient %s", recipient.Username)
-				}
+		case roleMsg := <-h.RoleMessages:
+			h.sendToRole(roleMsg)
+
+		case note := <-h.Notifications:
+			h.notify(note)
+
+		case join := <-h.JoinDocument:
+			h.joinDocument(join.Client, join.Document, join.Comments, join.ViewOnly)
+
+		case client := <-h.LeaveDocument:
+			h.leaveDocument(client)
+
+		case req := <-h.DocumentRoster:
+			var usernames []string
+			for client := range h.DocumentClients[req.DocumentID] {
+				usernames = append(usernames, client.Username)
+			}
+			req.Reply <- usernames
+
+		case req := <-h.DocumentUndo:
+			h.undoDocument(req)
+
+		case comment := <-h.DocumentComment:
+			h.commentDocument(comment.Client, comment.Msg)
+
+		case removal := <-h.DocumentsRemoved:
+			h.removeDocuments(removal)
+
+		case req := <-h.DocumentMode:
+			h.setDocumentMode(req)
+
+		case req := <-h.DocumentTurn:
+			h.takeTurn(req)
+
+		case <-h.DocumentLists:
+			h.refreshDocumentLists()
+
+		case req := <-h.JoinRoom:
+			h.joinRoom(req.Client, req.Room)
+
+		case req := <-h.LeaveRoom:
+			h.leaveRoom(req.Client, req.Room)
+			select {
+			case req.Client.Send <- Msg{Type: RoomLeave, Room: req.Room, Time: time.Now()}:
+			default:
+			}
+			if req.Client.Presence == PresenceDiff && config.UserDirectoryPolicy == DirectoryRooms {
+				h.sendPresenceSnapshot(req.Client)
+			}
+
+		case req := <-h.Directory:
+			req.Reply <- h.userDirectory(h.onlineUsers()).visibleTo(req.Username, req.Admin)
+
+		case req := <-h.UserRoster:
+			req.Reply <- h.userRoster(req.Client)
+
+		case req := <-h.UserRooms:
+			req.Reply <- h.userRooms(req.Username)
+
+		case req := <-h.RoomRoster:
+			if h.Rooms[req.Room][req.Client] {
+				req.Reply <- h.roomMembers(req.Room)
 			} else {
-				// Recipient not found, send error message to sender
-				if sender != nil {
-					errorMsg := Msg{
-						Type:     SystemMessage,
-						Username: "System",
-						Content:  "User '" + privateMsg.To + "' is not online",
-						Time:     time.Now(),
-						IsSystem: true,
-					}
-					select {
-					case sender.Send <- errorMsg:
-					default:
-					}
+				req.Reply <- nil
+			}
+
+		case edit := <-h.DocumentEdits:
+			editMsg := edit.Msg
+
+			// Only clients editing the document may change it, as far as its
+			// collaboration mode allows
+			history, ok := h.DocumentHistories[editMsg.DocumentID]
+			if !ok || edit.Client.CurrentDocumentID != editMsg.DocumentID {
+				h.sendError(edit.Client, "You can't edit this document")
+				continue
+			}
+			if reason := h.editRefusal(edit.Client, editMsg.DocumentID, history); reason != "" {
+				h.sendError(edit.Client, reason)
+				continue
+			}
+
+			content, err := cleanContent(editMsg.Content)
+			if err != nil {
+				h.sendError(edit.Client, "Edit refused: "+err.Error())
+				continue
+			}
+			editMsg.Content = content
+
+			// Edits made against an older revision go through
+			// DOC_CONFLICT_STRATEGY. Clients that don't track revisions
+			// send none, and their edits always apply.
+			merged := false
+			if editMsg.Revision != 0 && editMsg.Revision != history.Revision() {
+				if content, ok = h.resolveStaleEdit(edit.Client, history, editMsg); !ok {
+					continue
 				}
+				merged = content != editMsg.Content
+				editMsg.Content = content
 			}
+			RecordDocumentEvent(editMsg.DocumentID, editMsg.Username, EventUpdate, sizeDetail(editMsg.Content))
+			RecordDocumentAccess(editMsg.DocumentID, editMsg.Username, AccessEdit)
 
-		case editMsg := <-h.DocumentEdits:
 			// Broadcast document edit to all users editing the same document
 			log.Printf("Broadcasting edit for document %s from %s", editMsg.DocumentID, editMsg.Username)
 
+			before := history.Content
+			history.Record(editMsg.Username, editMsg.Content)
+			if isTruncation(before, editMsg.Content) {
+				h.warnTruncation(editMsg.DocumentID, editMsg.Username, before, editMsg.Content)
+			}
+			editMsg.Revision = history.Revision()
+			editMsg.Stats = documentStats(editMsg.Content)
+			h.touchDocument(editMsg.DocumentID, true)
+
+			// Tell a sender that tracks revisions which one its edit made,
+			// with the content when a merge changed it
+			if edit.Msg.Revision != 0 {
+				ack := Msg{Type: DocRevision, DocumentID: editMsg.DocumentID, Revision: editMsg.Revision, Stats: editMsg.Stats, Time: time.Now()}
+				if merged {
+					ack.Content = editMsg.Content
+				}
+				select {
+				case edit.Client.Send <- ack:
+				default:
+					log.Printf("Failed to send revision to %s", edit.Client.Username)
+				}
+			}
+
 			if clients, ok := h.DocumentClients[editMsg.DocumentID]; ok {
 				for client := range clients {
-					// Don't send back to the sender
-					if client.Username != editMsg.Username {
+					// Don't send back to the connection the edit came from.
+					// The user's other connections still need it.
+					if client.ID != edit.Client.ID {
 						select {
 						case client.Send <- editMsg:
 							log.Printf("Edit sent to %s", client.Username)
@@ -236,253 +735,1719 @@ func (h *Hub) Run() {
 	}
 }
 
-func (h *Hub) GetUserNames() []string {
-	var usernames []string
+// deliverUpdate sends a change to a message to everyone who can see the
+// message. Changes to a private message only go to its two participants, and
+// those to a room or group message to its members.
+func (h *Hub) deliverUpdate(update Msg) {
 	for client := range h.Clients {
-		usernames = append(usernames, client.Username)
+		if !client.InChat {
+			continue
+		}
+		if update.To != "" && client.Username != update.To && client.Username != update.From {
+			continue
+		}
+		if update.Room != "" && !h.Rooms[update.Room][client] {
+			continue
+		}
+		if update.ConversationID != "" && !contains(update.Participants, client.Username) {
+			continue
+		}
+		select {
+		case client.Send <- update:
+		default:
+			log.Printf("Failed to send message update to %s", client.Username)
+		}
 	}
-	return usernames
 }
 
-// Generate a consistent color for each user based on their username
-func generateUserColor(username string) string {
-	colors := []string{
-		"#FF6B6B", "#4ECDC4", "#45B7D1", "#FFA07A",
-		"#98D8C8", "#F7DC6F", "#BB8FCE", "#85C1E2",
-		"#F8B739", "#52B788", "#E76F51", "#8E44AD",
+// removeClient takes a client out of the hub, its document editing session
+// and its rooms, and closes its Send channel
+func (h *Hub) removeClient(client *Client) {
+	delete(h.Clients, client)
+	close(client.Send)
+	h.connections.Add(-1)
+	if client.Compressed {
+		h.compressedConnections.Add(-1)
 	}
 
-	// Simple hash to pick a color consistently for each username
-	hash := 0
-	for _, char := range username {
-		hash += int(char)
+	h.leaveDocument(client)
+	h.leaveAllRooms(client)
+
+	if !h.userOnline(client.Username) {
+		h.sendPresenceDiff(PresenceLeave, client.Username)
 	}
-	return colors[hash%len(colors)]
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+// disconnectClient removes a client from the hub and tells the rooms it was
+// in that the user left
+func (h *Hub) disconnectClient(client *Client) {
+	rooms := h.roomsOf(client)
+	h.removeClient(client)
+	log.Printf("Client %s disconnected. Total Clients %d", client.Username, len(h.Clients))
 
-func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		log.Printf("WebSocket connection attempt without username")
-		http.Error(w, "Username required", http.StatusBadRequest)
-		return
+	if client.InChat {
+		h.announceLeft(client.Username, rooms)
 	}
+}
 
-	log.Printf("WebSocket upgrade request from %s", username)
-
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade error for %s: %s", username, err)
+// announceLeft tells the rooms a chat connection of a user was in that it
+// is gone, or holds the notice back under JOIN_LEAVE_WINDOW
+func (h *Hub) announceLeft(username string, rooms []string) {
+	if config.JoinLeaveWindow > 0 {
+		h.holdLeave(username, rooms)
 		return
 	}
+	h.sendLeft(username, rooms)
+}
 
-	log.Printf("WebSocket connection established for %s", username)
+// sendLeft tells the rooms a user was in, or the lobby, that they left
+func (h *Hub) sendLeft(username string, rooms []string) {
+	goodbyeMsg := newSystemMessage(username + " left the chat")
+	h.notifyRooms(goodbyeMsg, rooms)
+	EmitWebhookEvent(WebhookUserLeft, webhookUser{Username: username})
+	publishEvent(WebhookUserLeft, webhookUser{Username: username})
+}
 
-	client := &Client{
-		Username: username,
-		Conn:     conn,
-		Send:     make(chan Msg, 256),
+// newSystemMessage builds a message sent under the server's configured
+// system identity
+func newSystemMessage(content string) Msg {
+	return Msg{
+		Type:     SystemMessage,
+		Username: config.SystemName,
+		Content:  content,
+		Time:     time.Now(),
+		IsSystem: true,
+		Color:    config.SystemColor,
 	}
-
-	log.Printf("Starting goroutines for %s", username)
-	go client.readMessages(hub)
-	go client.writeMessages()
-
-	log.Printf("Registering client %s", username)
-	// Move registration after starting goroutines to prevent blocking
-	hub.Register <- client
 }
 
-func (c *Client) readMessages(hub *Hub) {
-	defer func() {
-		log.Printf("readMessages defer called for %s", c.Username)
-		hub.Unregister <- c
-		c.Conn.Close()
-	}()
-
-	log.Printf("Starting to read messages for %s", c.Username)
-
-	for {
-		var msg Msg
-		err := c.Conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Read error for %s: %v", c.Username, err)
-			break
-		}
-		log.Printf("Received message from %s, type: %s", c.Username, msg.Type)
-		msg.Username = c.Username
-		msg.Time = time.Now()
-
-		// Handle different message types
-		switch msg.Type {
-		case DocList:
-			// Client requests list of documents
-			c.handleDocumentList()
-
-		case DocOpen:
-			// Client wants to open a document
-			c.handleDocumentOpen(msg.DocumentID, hub)
-
-		case DocCreate:
-			// Client wants to create a new document
-			c.handleDocumentCreate(msg.Name, msg.Language, hub)
-
-		case DocUpdate:
-			// Client updated document content - broadcast to other users
-			msg.Username = c.Username
-			hub.DocumentEdits <- msg
-
-		case PrivateMessage:
-			if msg.To != "" {
-				msg.From = c.Username
-				log.Printf("Received private message from %s to %s: %s", c.Username, msg.To, msg.Content)
-				hub.Private <- msg
-			}
+// notifyChat delivers a transient system notice to chat clients only.
+// Notices are not persisted, so they never show up in history replay.
+func (h *Hub) notifyChat(msg Msg) {
+	h.notifyRooms(msg, nil)
+}
 
+// refreshDocumentLists tells every client, chat and editor alike, to reload
+// its document list. Unlike a broadcast, the refresh isn't stored.
+func (h *Hub) refreshDocumentLists() {
+	directory := h.userDirectory(h.GetUserNames())
+	refresh := Msg{Type: DocList, Time: time.Now()}
+	for client := range h.Clients {
+		select {
+		case client.Send <- client.withUserList(refresh, directory):
 		default:
-			// Public message
-			msg.Type = PublicMessage
-			msg.IsSystem = false
-			log.Printf("Received public message from %s: %s", c.Username, msg.Content)
-			hub.BroadCast <- msg
+			log.Printf("Failed to send document list refresh to %s", client.Username)
 		}
 	}
 }
 
-func (c *Client) writeMessages() {
-	defer func() {
-		log.Printf("writeMessages defer called for %s", c.Username)
-		c.Conn.Close()
-	}()
-
-	log.Printf("Starting to write messages for %s", c.Username)
-
-	for {
+// notifyRooms delivers a transient system notice to the chat clients in any
+// of rooms, or to every chat client when rooms is empty. Notices about a
+// user go to the rooms they are in, or to the lobby when they are in none.
+func (h *Hub) notifyRooms(msg Msg, rooms []string) {
+	directory := h.userDirectory(h.GetUserNames())
+	for client := range h.Clients {
+		if !client.InChat || (len(rooms) > 0 && !h.inAnyRoom(client, rooms)) {
+			continue
+		}
 		select {
-		case message, ok := <-c.Send:
-			if !ok {
-				log.Printf("Send channel closed for %s", c.Username)
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			log.Printf("Writing message to %s: %s", c.Username, message.Content)
-			if err := c.Conn.WriteJSON(message); err != nil {
-				log.Printf("Write error for %s: %v", c.Username, err)
-				return
-			}
+		case client.Send <- client.withUserList(msg, directory):
+		default:
+			log.Printf("Failed to send notice to %s", client.Username)
 		}
 	}
 }
 
-// Document operation handlers
-
-func (c *Client) handleDocumentList() {
-	documents, err := GetAllDocuments()
-	if err != nil {
-		log.Printf("Error getting documents: %v", err)
+// joinDocument makes the client an active editor of doc: it leaves the
+// document it was editing before, is added to the document's editing
+// session, receives the content and comments and is announced to the other
+// editors.
+func (h *Hub) joinDocument(client *Client, doc *Document, comments []DocumentComment, viewOnly bool) {
+	// The client may have disconnected while the document was loading
+	if !h.Clients[client] {
+		log.Printf("Ignoring document join from disconnected client %s", client.Username)
 		return
 	}
 
-	response := Msg{
-		Type:      DocList,
-		Documents: documents,
-	}
-
-	c.Conn.WriteJSON(response)
-}
+	if client.CurrentDocumentID != doc.ID {
+		// Users may only have so many documents open at once, across their
+		// connections. Switching this connection's document doesn't count.
+		if config.MaxOpenDocuments > 0 && !h.hasDocumentOpen(client.Username, doc.ID) && len(h.openDocuments(client)) >= config.MaxOpenDocuments {
+			h.sendError(client, fmt.Sprintf("You can have at most %d documents open at a time, close one first", config.MaxOpenDocuments))
+			return
+		}
 
-func (c *Client) handleDocumentOpen(docID string, hub *Hub) {
-	doc, err := GetDocument(docID)
-	if err != nil {
-		log.Printf("Error getting document %s: %v", docID, err)
-		return
-	}
+		h.leaveDocument(client)
 
-	if doc == nil {
-		log.Printf("Document %s not found", docID)
-		return
+		// Guests without the edit capability only get to watch, and so do
+		// newcomers past DOC_MAX_EDITORS unless they are refused outright
+		viewOnly = viewOnly || (client.Guest && !guestCan(GuestEdit))
+		atCapacity := !viewOnly && config.DocMaxEditors > 0 && h.countEditors(doc.ID) >= config.DocMaxEditors
+		if atCapacity && !config.DocOverflowReadOnly {
+			h.sendError(client, fmt.Sprintf("Document is at capacity, it allows at most %d editors at a time", config.DocMaxEditors))
+			return
+		}
+		client.ReadOnly = viewOnly || atCapacity
+		client.DocumentJoined = time.Now()
+		if client.ReadOnly {
+			RecordDocumentAccess(doc.ID, client.Username, AccessView)
+		} else {
+			RecordDocumentAccess(doc.ID, client.Username, AccessOpen)
+		}
 	}
 
 	// Update client's current document
-	c.CurrentDocumentID = docID
+	client.CurrentDocumentID = doc.ID
 
 	// Add client to document's editing session
-	if hub.DocumentClients[docID] == nil {
-		hub.DocumentClients[docID] = make(map[*Client]bool)
+	if h.DocumentClients[doc.ID] == nil {
+		h.DocumentClients[doc.ID] = make(map[*Client]bool)
 	}
-	hub.DocumentClients[docID][c] = true
-
-	log.Printf("%s opened document %s", c.Username, doc.Name)
+	h.DocumentClients[doc.ID][client] = true
+	if history, ok := h.DocumentHistories[doc.ID]; ok {
+		// The session's content and mode may be ahead of the database
+		doc.Content = history.Content
+		doc.Mode = history.Mode
+		doc.Frozen = history.Mode == ModeReadOnly
+	} else {
+		history = newDocumentHistory(doc.Content)
+		history.Mode = doc.Mode
+		history.Owner = doc.CreatedBy
+		history.Archived = doc.Archived
+		h.DocumentHistories[doc.ID] = history
+	}
+	h.touchDocument(doc.ID, false)
 
 	// Send document content to the client
-	response := Msg{
-		Type:       DocContent,
-		DocumentID: doc.ID,
-		Name:       doc.Name,
-		Content:    doc.Content,
-		Language:   doc.Language,
+	h.sendDocumentContent(client, doc)
+	select {
+	case client.Send <- Msg{Type: DocComments, DocumentID: doc.ID, Comments: comments}:
+	default:
+		log.Printf("Failed to send comments on %s to %s", doc.ID, client.Username)
 	}
-	c.Conn.WriteJSON(response)
 
 	// Notify other users editing this document
 	joinMsg := Msg{
 		Type:       UserJoined,
-		DocumentID: docID,
-		Username:   c.Username,
-		Color:      generateUserColor(c.Username),
+		DocumentID: doc.ID,
+		Username:   client.Username,
+		SessionID:  client.ID,
+		Color:      generateUserColor(client.Username),
 	}
 
-	for client := range hub.DocumentClients[docID] {
-		if client != c {
-			client.Send <- joinMsg
+	for c := range h.DocumentClients[doc.ID] {
+		if c != client {
+			select {
+			case c.Send <- joinMsg:
+			default:
+			}
 		}
 	}
 }
 
-func (c *Client) handleDocumentCreate(name, language string, hub *Hub) {
-	doc, err := CreateDocument(name, language, c.Username)
-	if err != nil {
-		log.Printf("Error creating document: %v", err)
-		return
+// sendDocumentContent sends a document to a client, as a single DocContent
+// message or, above the DOC_CHUNK_SIZE threshold, as a series of ordered
+// DocContentChunk messages whose last one is marked Final. All chunks are
+// queued in one go from Run, so edits broadcast afterwards always reach the
+// client after the final chunk.
+func (h *Hub) sendDocumentContent(client *Client, doc *Document) {
+	var revision int
+	var holder string
+	if history, ok := h.DocumentHistories[doc.ID]; ok {
+		revision = history.Revision()
+		holder = history.Turn
 	}
 
-	log.Printf("Document created: %s by %s", doc.Name, c.Username)
-
-	// Send the new document back to the creator
-	response := Msg{
-		Type:       DocContent,
-		DocumentID: doc.ID,
-		Name:       doc.Name,
-		Content:    doc.Content,
-		Language:   doc.Language,
+	if config.DocChunkSize <= 0 || len(doc.Content) <= config.DocChunkSize {
+		response := Msg{
+			Type:       DocContent,
+			DocumentID: doc.ID,
+			Name:       doc.Name,
+			Content:    doc.Content,
+			Language:   doc.Language,
+			ReadOnly:   client.ReadOnly,
+			Frozen:     doc.Frozen,
+			Mode:       doc.Mode,
+			Holder:     holder,
+			Owner:      doc.CreatedBy,
+			Revision:   revision,
+			Stats:      documentStats(doc.Content),
+		}
+		select {
+		case client.Send <- response:
+		default:
+			log.Printf("Failed to send document %s to %s", doc.ID, client.Username)
+		}
+		return
 	}
-	c.Conn.WriteJSON(response)
 
-	// Notify all clients about the new document
-	listMsg := Msg{
-		Type: DocList,
+	chunks := splitContent(doc.Content, config.DocChunkSize)
+
+	// A partially delivered document is useless, so don't start unless the
+	// whole stream fits in the client's buffer
+	if cap(client.Send)-len(client.Send) < len(chunks) {
+		log.Printf("Not enough buffer to stream document %s to %s", doc.ID, client.Username)
+		select {
+		case client.Send <- Msg{Type: ErrorMessage, Content: "Document is too large to open right now, please retry", Time: time.Now()}:
+		default:
+		}
+		return
+	}
+
+	for i, chunk := range chunks {
+		msg := Msg{
+			Type:       DocContentChunk,
+			DocumentID: doc.ID,
+			Name:       doc.Name,
+			Content:    chunk,
+			Language:   doc.Language,
+			Chunk:      i + 1,
+			ChunkCount: len(chunks),
+			Final:      i == len(chunks)-1,
+			ReadOnly:   client.ReadOnly,
+			Frozen:     doc.Frozen,
+			Mode:       doc.Mode,
+			Holder:     holder,
+			Owner:      doc.CreatedBy,
+			Revision:   revision,
+		}
+		if msg.Final {
+			msg.Stats = documentStats(doc.Content)
+		}
+		select {
+		case client.Send <- msg:
+		default:
+			log.Printf("Failed to send chunk %d of document %s to %s", i+1, doc.ID, client.Username)
+			return
+		}
+	}
+}
+
+// splitContent cuts content into chunks of at most size bytes without
+// splitting a UTF-8 sequence
+func splitContent(content string, size int) []string {
+	var chunks []string
+	for len(content) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(content[end]) {
+			end--
+		}
+		if end == 0 {
+			end = size
+		}
+		chunks = append(chunks, content[:end])
+		content = content[end:]
+	}
+	return append(chunks, content)
+}
+
+// leaveDocument removes the client from the editing session of its current
+// document, if any, and tells the remaining editors.
+func (h *Hub) leaveDocument(client *Client) {
+	docID := client.CurrentDocumentID
+	if docID == "" {
+		return
+	}
+	client.CurrentDocumentID = ""
+
+	clients, ok := h.DocumentClients[docID]
+	if !ok {
+		return
+	}
+	delete(clients, client)
+	client.ReadOnly = false
+	h.touchDocument(docID, false)
+	if history, ok := h.DocumentHistories[docID]; ok && history.Turn == client.Username && !h.hasDocumentOpen(client.Username, docID) {
+		h.giveTurn(docID, history, "")
+	}
+	if len(clients) == 0 {
+		delete(h.DocumentClients, docID)
+		// Nobody is left to make further changes
+		h.saveDocument(docID)
+	}
+
+	// Notify other users in the document
+	leaveMsg := Msg{
+		Type:       UserLeft,
+		DocumentID: docID,
+		Username:   client.Username,
+		SessionID:  client.ID,
+	}
+	for c := range clients {
+		select {
+		case c.Send <- leaveMsg:
+		default:
+		}
+	}
+}
+
+// undoDocument reverts (or reapplies) the requesting client's last change to
+// the document they are editing and sends the resulting content to every
+// editor, the requester included.
+func (h *Hub) undoDocument(req undoRequest) {
+	client := req.Client
+	history, ok := h.DocumentHistories[req.DocumentID]
+	if !ok || client.CurrentDocumentID != req.DocumentID {
+		h.sendError(client, "Open the document before undoing changes")
+		return
+	}
+	if reason := h.editRefusal(client, req.DocumentID, history); reason != "" {
+		h.sendError(client, reason)
+		return
+	}
+
+	op, event := history.Undo, EventUndo
+	if req.Redo {
+		op, event = history.Redo, EventRedo
+	}
+	content, err := op(client.Username)
+	if err != nil {
+		h.sendError(client, "Cannot "+event+": "+err.Error())
+		return
+	}
+	RecordDocumentEvent(req.DocumentID, client.Username, event, sizeDetail(content))
+	h.touchDocument(req.DocumentID, true)
+
+	update := Msg{
+		Type:       DocUpdate,
+		DocumentID: req.DocumentID,
+		Username:   client.Username,
+		Content:    content,
+		Revision:   history.Revision(),
+		Stats:      documentStats(content),
+		Time:       time.Now(),
+	}
+	for c := range h.DocumentClients[req.DocumentID] {
+		select {
+		case c.Send <- update:
+		default:
+			log.Printf("Failed to send %s of document %s to %s", event, req.DocumentID, c.Username)
+		}
+	}
+}
+
+// commentDocument stores a comment from a client on the document it has
+// open and delivers it to everyone in the document's session, viewers
+// included
+func (h *Hub) commentDocument(client *Client, msg Msg) {
+	if client.CurrentDocumentID != msg.DocumentID {
+		h.sendError(client, "Open the document to comment on it")
+		return
+	}
+
+	comment, err := AddDocumentComment(msg.DocumentID, client.Username, msg.Content, msg.Line)
+	if err != nil {
+		log.Printf("Error saving comment on %s: %v", msg.DocumentID, err)
+		return
+	}
+
+	commentMsg := Msg{
+		Type:       DocComment,
+		DocumentID: msg.DocumentID,
+		Username:   client.Username,
+		Time:       comment.Time,
+		Comment:    comment,
+	}
+	for c := range h.DocumentClients[msg.DocumentID] {
+		select {
+		case c.Send <- commentMsg:
+		default:
+			log.Printf("Failed to send comment to %s", c.Username)
+		}
+	}
+}
+
+// countEditors returns how many clients edit a document in read-write mode
+func (h *Hub) countEditors(docID string) int {
+	count := 0
+	for client := range h.DocumentClients[docID] {
+		if !client.ReadOnly {
+			count++
+		}
+	}
+	return count
+}
+
+// openDocuments returns the documents the user of a client has open on
+// their other connections
+func (h *Hub) openDocuments(client *Client) map[string]bool {
+	docIDs := make(map[string]bool)
+	for c := range h.Clients {
+		if c != client && c.Username == client.Username && c.CurrentDocumentID != "" {
+			docIDs[c.CurrentDocumentID] = true
+		}
+	}
+	return docIDs
+}
+
+// hasDocumentOpen reports whether any of the user's connections is editing
+// or viewing a document
+func (h *Hub) hasDocumentOpen(username, docID string) bool {
+	for client := range h.DocumentClients[docID] {
+		if client.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// clientBySession returns the connection with the given session ID, or nil
+// if it is gone
+func (h *Hub) clientBySession(sessionID string) *Client {
+	for client := range h.Clients {
+		if client.ID == sessionID {
+			return client
+		}
+	}
+	return nil
+}
+
+// sendSession tells a new connection its session ID, so that a user with
+// several connections can recognize its own among them
+func (h *Hub) sendSession(client *Client) {
+	select {
+	case client.Send <- Msg{Type: Session, Username: client.Username, SessionID: client.ID, Time: time.Now()}:
+	default:
+		log.Printf("Failed to send session ID to %s", client.Username)
+	}
+}
+
+// sendError reports a failed request to a client from within Run, where
+// blocking on a full Send buffer is not an option
+func (h *Hub) sendError(client *Client, content string) {
+	select {
+	case client.Send <- Msg{Type: ErrorMessage, Content: content, Time: time.Now()}:
+	default:
+		log.Printf("Failed to send error to %s", client.Username)
+	}
+}
+
+// sendUserError reports a failed request to all chat connections of a user,
+// for requests that don't say which connection they came from
+func (h *Hub) sendUserError(username, content string) {
+	for client := range h.Clients {
+		if client.InChat && client.Username == username {
+			h.sendError(client, content)
+		}
+	}
+}
+
+// DocumentEditors returns the usernames currently editing a document. It is
+// safe to call from outside Run.
+func (h *Hub) DocumentEditors(docID string) []string {
+	reply := make(chan []string, 1)
+	h.DocumentRoster <- rosterRequest{DocumentID: docID, Reply: reply}
+	return <-reply
+}
+
+func (h *Hub) GetUserNames() []string {
+	var usernames []string
+	for client := range h.Clients {
+		usernames = append(usernames, client.Username)
+	}
+	// Users who may be about to reconnect are still listed
+	for username := range h.Pending {
+		if !contains(usernames, username) {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// contains reports whether s holds value
+func contains(s []string, value string) bool {
+	for _, v := range s {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate a consistent color for each user based on their username
+func generateUserColor(username string) string {
+	colors := []string{
+		"#FF6B6B", "#4ECDC4", "#45B7D1", "#FFA07A",
+		"#98D8C8", "#F7DC6F", "#BB8FCE", "#85C1E2",
+		"#F8B739", "#52B788", "#E76F51", "#8E44AD",
+	}
+
+	// Simple hash to pick a color consistently for each username
+	hash := 0
+	for _, char := range username {
+		hash += int(char)
+	}
+	return colors[hash%len(colors)]
+}
+
+// upgrader accepts WebSocket connections. main turns on compression when
+// WS_COMPRESSION asks for it.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// offersCompression reports whether the upgrade request offers the
+// permessage-deflate extension. With compression enabled on the upgrader,
+// that is exactly when it gets negotiated.
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func handleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		log.Printf("WebSocket connection attempt without username")
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("WebSocket upgrade request from %s", username)
+	guest := r.URL.Query().Get("role") == RoleGuest
+	role := roleOf(username, guest)
+	// The editor connects with mode=editor; anything else is a chat client
+	inChat := r.URL.Query().Get("mode") != "editor"
+
+	// Chat clients may be put in a room right away, if guests may join rooms
+	var room string
+	if inChat && (!guest || guestMaySend(RoomJoin)) {
+		var err error
+		if room, err = autoJoinRoom(r); err != nil {
+			log.Printf("Refusing connection of %s: %v", username, err)
+			http.Error(w, "Invalid room name", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error for %s: %s", username, err)
+		return
+	}
+
+	log.Printf("WebSocket connection established for %s", username)
+
+	client := &Client{
+		ID:         uuid.New().String(),
+		Username:   username,
+		Conn:       conn,
+		Send:       make(chan Msg, 256),
+		Closing:    make(chan *closeFrame, 1),
+		InChat:     inChat,
+		Compressed: upgrader.EnableCompression && offersCompression(r),
+		Guest:      guest,
+		Role:       role,
+		Reauth:     make(chan time.Time, 1),
+		Presence:   PresenceFull,
+		Connected:  time.Now(),
+	}
+	if r.URL.Query().Get("presence") == PresenceDiff {
+		client.Presence = PresenceDiff
+	}
+	if config.WSBatchInterval > 0 && r.URL.Query().Get("batch") == "1" {
+		client.Batched = true
+	}
+	if expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64); err == nil {
+		client.TokenExpiry = time.Unix(expires, 0)
+	}
+
+	// Register before reading, so that a connection dropped right away
+	// can't be unregistered before the hub knows about it and linger on
+	log.Printf("Registering client %s", username)
+	registered := make(chan struct{})
+	hub.Register <- registration{Client: client, Done: registered, Room: room}
+	<-registered
+
+	log.Printf("Starting goroutines for %s", username)
+	hub.running.Add(2)
+	go func() {
+		defer hub.running.Done()
+		client.readMessages(hub)
+	}()
+	go func() {
+		defer hub.running.Done()
+		client.writeMessages()
+	}()
+}
+
+func (c *Client) readMessages(hub *Hub) {
+	// Run closes Send once the client is unregistered, and writeMessages
+	// then writes what is left and closes the connection
+	defer func() {
+		log.Printf("readMessages defer called for %s", c.Username)
+		hub.Unregister <- c
+	}()
+
+	log.Printf("Starting to read messages for %s", c.Username)
+
+	for {
+		var msg Msg
+		err := c.Conn.ReadJSON(&msg)
+		if err != nil {
+			log.Printf("Read error for %s: %v", c.Username, err)
+			break
+		}
+		if c.closing.Load() {
+			continue
+		}
+		log.Printf("Received message from %s, type: %s", c.Username, msg.Type)
+		if msg.Type == legacyPrivateMessage {
+			msg.Type = PrivateMessage
+		}
+
+		if config.MessageValidation != ValidationOff {
+			if err := validateMessage(msg); err != nil {
+				log.Printf("Invalid message from %s: %v", c.Username, err)
+				if config.MessageValidation == ValidationStrict {
+					c.sendError("Invalid message: " + err.Error())
+					continue
+				}
+			}
+		}
+
+		if c.Guest && !guestMaySend(msg.Type) {
+			c.sendError("Guests are not allowed to do this, please register")
+			continue
+		}
+		if !c.countGuestAction(msg.Type) {
+			// The connection is closed once what was already sent to it is
+			// written. Nothing more from the guest is handled or answered:
+			// the reader only waits for the close handshake from now on.
+			log.Printf("Guest %s reached GUEST_ACTION_LIMIT, closing connection", c.Username)
+			c.requestClose(permanentClose(CloseGuestLimit, "guest action limit reached"))
+			continue
+		}
+
+		msg.ID = 0 // Assigned once the message is stored
+		msg.Username = c.Username
+		msg.SessionID = c.ID
+		msg.Time = time.Now()
+
+		// Handle different message types
+		switch msg.Type {
+		case DocList:
+			// Client requests list of documents
+			c.handleDocumentList(msg.Filter, msg.Sort, msg.Order, msg.Limit, msg.Offset)
+
+		case DocOpen:
+			// Client wants to open a document, by ID or through a share link
+			c.handleDocumentOpen(msg.DocumentID, msg.Token, hub)
+
+		case DocCreate:
+			// Client wants to create a new document, or to know whether it could
+			if msg.DryRun {
+				c.dryRunDocumentCreate(msg.Name, msg.Language)
+			} else {
+				c.handleDocumentCreate(msg.Name, msg.Language, hub)
+			}
+
+		case DocClose:
+			// Client stops editing its current document
+			hub.LeaveDocument <- c
+
+		case DocUsers:
+			// Client asks who is editing a document
+			c.handleDocumentUsers(msg.DocumentID, hub)
+
+		case DocShare:
+			// Document owner shares the document with another user
+			c.handleDocumentShare(msg.DocumentID, msg.To, msg.Permission, hub)
+
+		case DocRename:
+			// Client renames a document or changes its language, or asks
+			// whether it could
+			if msg.DryRun {
+				c.dryRunDocumentRename(msg.DocumentID, msg.Name, msg.Language)
+			} else {
+				c.handleDocumentRename(msg.DocumentID, msg.Name, msg.Language, hub)
+			}
+
+		case DocMode:
+			// Document owner changes how the document may be edited
+			c.handleDocumentMode(msg.DocumentID, msg.Mode, hub)
+
+		case DocFreeze, DocUnfreeze:
+			// Shorthands for switching to read-only and back to open
+			mode := ModeReadOnly
+			if msg.Type == DocUnfreeze {
+				mode = ModeOpen
+			}
+			c.handleDocumentMode(msg.DocumentID, mode, hub)
+
+		case DocTurn:
+			// Editor takes or gives up the turn on a turn-based document
+			hub.DocumentTurn <- turnRequest{Client: c, DocumentID: msg.DocumentID, Take: msg.Action == TurnTake}
+
+		case DocBulk:
+			// Client deletes or archives several documents at once
+			c.handleDocumentBulk(msg.Action, msg.DocumentIDs, hub)
+
+		case DocComment:
+			// Client comments on the document it has open
+			content := strings.TrimSpace(msg.Content)
+			if content == "" || utf8.RuneCountInString(content) > maxCommentLength || msg.Line < 0 {
+				c.sendError(fmt.Sprintf("Comments must have between 1 and %d characters", maxCommentLength))
+				continue
+			}
+			msg.Content = content
+			hub.DocumentComment <- documentEdit{Client: c, Msg: msg}
+
+		case DocLanguages:
+			// Client asks which languages documents can use
+			c.reply(Msg{
+				Type:      DocLanguages,
+				Languages: config.supportedLanguages(),
+			})
+
+		case DocHistory:
+			// Client requests the edit log of a document
+			c.handleDocumentHistory(msg.DocumentID)
+
+		case DocSnapshot:
+			// Client fetches content saved before an edit cut most of it
+			c.handleDocumentSnapshot(msg.DocumentID, msg.SnapshotID)
+
+		case DocUpdate:
+			// Client updated document content - broadcast to other users
+			msg.Username = c.Username
+			hub.DocumentEdits <- documentEdit{Client: c, Msg: msg}
+
+		case DocUndo, DocRedo:
+			// Client undoes or redoes its own last change to the document
+			hub.DocumentUndo <- undoRequest{Client: c, DocumentID: msg.DocumentID, Redo: msg.Type == DocRedo}
+
+		case Reaction:
+			// Client toggles a reaction on a message
+			c.handleReaction(msg.MessageID, msg.Emoji, hub)
+
+		case ReactionSet:
+			// Client asks which reactions it can use
+			c.reply(Msg{
+				Type:            ReactionSet,
+				Time:            time.Now(),
+				CustomReactions: customReactions,
+				ReactionPolicy:  config.ReactionPolicy,
+			})
+
+		case MessageEdit:
+			// Client changes the content of one of its messages
+			if !c.checkLength(&msg) {
+				continue
+			}
+			c.handleMessageEdit(msg.MessageID, msg.Content, hub)
+
+		case MessageDelete:
+			// Client removes a message, as MESSAGE_DELETE allows
+			c.handleMessageDelete(msg.MessageID, hub)
+
+		case AuthRefresh:
+			// Client swaps in a refreshed token before the old one lapses
+			c.handleAuthRefresh(msg.Token)
+
+		case Pong:
+			// Client answers a ping, telling us its latency
+			c.handlePong(msg.PingSent)
+
+		case RoomJoin:
+			// Client enters a chat room, creating it if needed
+			if !c.InChat || !validRoomName(msg.Room) {
+				c.sendError("Invalid room name")
+				continue
+			}
+			hub.JoinRoom <- roomRequest{Client: c, Room: msg.Room}
+
+		case RoomLeave:
+			hub.LeaveRoom <- roomRequest{Client: c, Room: msg.Room}
+
+		case RoomMembers:
+			// Client asks who is in one of its rooms
+			members, ok := hub.RoomMembers(c, msg.Room)
+			if !ok {
+				c.sendError("You are not a member of this room")
+				continue
+			}
+			c.reply(Msg{
+				Type:    RoomMembers,
+				Room:    msg.Room,
+				Members: members,
+				Time:    time.Now(),
+			})
+
+		case UserListRequest:
+			// Client asks who is online, e.g. after being quiet for a while
+			c.reply(Msg{
+				Type:    UserListRequest,
+				Members: hub.OnlineUsers(c),
+				Time:    time.Now(),
+			})
+
+		case MarkRead:
+			// Client reports having read up to a message
+			c.handleMarkRead(msg.Room, msg.ConversationID, msg.MessageID, hub)
+
+		case History:
+			// Client loads older messages of the lobby or one of its rooms
+			c.handleHistory(msg.Room, msg.Before, msg.Limit, hub)
+
+		case Thread:
+			// Client expands a thread
+			c.handleThread(msg.MessageID, hub)
+
+		case Search:
+			// Client searches the messages it can see
+			c.handleSearch(msg.Content, msg.Before, msg.Limit, hub)
+
+		case GroupCreate:
+			// Client starts a group conversation
+			c.handleGroupCreate(msg.Name, msg.Participants, hub)
+
+		case GroupMessage:
+			// Client posts to one of its group conversations
+			if !c.checkFormat(&msg) || !c.checkLength(&msg) || !c.checkTTL(&msg) || !c.checkClientKey(&msg) {
+				continue
+			}
+			c.handleGroupMessage(msg, hub)
+
+		case RoleMessage:
+			// Admin addresses the users holding a role
+			if !c.checkFormat(&msg) || !c.checkLength(&msg) {
+				continue
+			}
+			c.handleRoleMessage(msg, hub)
+
+		case PrivateMessage:
+			if !c.checkFormat(&msg) || !c.checkLength(&msg) || !c.checkTTL(&msg) || !c.checkClientKey(&msg) {
+				continue
+			}
+			if msg.To != "" {
+				msg.From = c.Username
+				if !c.checkRecipient(msg) {
+					continue
+				}
+				log.Printf("Received private message from %s to %s: %s", c.Username, msg.To, msg.Content)
+				hub.Private <- msg
+			}
+
+		default:
+			// Public message
+			msg.Type = PublicMessage
+			msg.IsSystem = false
+			if !c.checkFormat(&msg) || !c.checkLength(&msg) || !c.checkTTL(&msg) || !c.checkClientKey(&msg) {
+				continue
+			}
+			if msg.Room != "" {
+				if _, ok := hub.RoomMembers(c, msg.Room); !ok {
+					c.sendError("You are not a member of this room")
+					continue
+				}
+			}
+			if !c.checkThread(&msg) {
+				continue
+			}
+			log.Printf("Received public message from %s: %s", c.Username, msg.Content)
+			hub.BroadCast <- msg
+		}
+	}
+}
+
+// checkFormat validates the rendering hint of a chat message, telling the
+// client when it is invalid
+func (c *Client) checkFormat(msg *Msg) bool {
+	if err := normalizeFormat(msg); err != nil {
+		c.sendError("Invalid format: " + err.Error())
+		return false
+	}
+	return true
+}
+
+func (c *Client) writeMessages() {
+	// However the writer ends, it keeps taking what is sent to the client
+	// until Run closes Send, like awaitClose: readMessages may be in the
+	// middle of a reply, and would block forever on a full Send nobody
+	// reads. Closing the connection ends readMessages, which unregisters
+	// the client, after which Send is closed.
+	defer func() {
+		log.Printf("writeMessages defer called for %s", c.Username)
+		c.Conn.Close()
+		for range c.Send {
+		}
+	}()
+
+	log.Printf("Starting to write messages for %s", c.Username)
+
+	// The connection is closed when the token lapses, unless the client
+	// refreshes it in time
+	expiry := time.NewTimer(time.Until(c.TokenExpiry))
+	if c.TokenExpiry.IsZero() {
+		expiry.Stop()
+	}
+	defer expiry.Stop()
+
+	// Guests are sent on their way after GUEST_SESSION_LIFETIME
+	sessionEnd, stopSessionEnd := c.guestSessionEnd()
+	defer stopSessionEnd()
+
+	// Pings measure the client's latency
+	var pings <-chan time.Time
+	if config.PingInterval > 0 {
+		ticker := time.NewTicker(time.Duration(config.PingInterval) * time.Second)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	// Messages to batched clients may wait a little to share a frame
+	var batch outboundBatch
+	defer batch.stop()
+
+	for {
+		select {
+		case <-batch.due():
+			if !c.flushBatch(&batch) {
+				return
+			}
+
+		case <-pings:
+			if !c.sendPing() {
+				return
+			}
+
+		case expiresAt := <-c.Reauth:
+			expiry.Stop()
+			if !expiresAt.IsZero() {
+				expiry.Reset(time.Until(expiresAt))
+			}
+
+		case <-expiry.C:
+			log.Printf("Token of %s expired, closing connection", c.Username)
+			if c.flushBatch(&batch) {
+				c.writeClose(permanentClose(CloseTokenExpired, "token expired"))
+				c.awaitClose()
+			}
+			return
+
+		case <-sessionEnd:
+			log.Printf("Guest session of %s reached GUEST_SESSION_LIFETIME, closing connection", c.Username)
+			if c.flushBatch(&batch) {
+				c.writeClose(permanentClose(CloseGuestLimit, "guest session lifetime reached"))
+				c.awaitClose()
+			}
+			return
+
+		case frame := <-c.Closing:
+			// Write what was queued before the close was asked for
+			for queued := true; queued; {
+				select {
+				case message, ok := <-c.Send:
+					if ok && !c.queueMessage(&batch, message) {
+						return
+					}
+					queued = ok
+				default:
+					queued = false
+				}
+			}
+			if c.flushBatch(&batch) {
+				c.writeClose(frame)
+				c.awaitClose()
+			}
+			return
+
+		case message, ok := <-c.Send:
+			if !ok {
+				log.Printf("Send channel closed for %s", c.Username)
+				var frame *closeFrame
+				select {
+				case frame = <-c.Closing:
+				default:
+				}
+				if c.flushBatch(&batch) {
+					c.writeClose(frame)
+				}
+				return
+			}
+			if !c.queueMessage(&batch, message) {
+				return
+			}
+		}
+	}
+}
+
+// queueMessage writes a message to the client, or adds it to the batch of a
+// batched client, and reports whether the connection is still usable
+func (c *Client) queueMessage(batch *outboundBatch, message Msg) bool {
+	log.Printf("Writing message to %s: %s", c.Username, message.Content)
+	if c.Batched {
+		return batch.add(message) || c.flushBatch(batch)
+	}
+	return c.writeMessage(message)
+}
+
+// writeMessage sends one message to the client within WS_WRITE_TIMEOUT and
+// reports whether the connection is still usable. A message that can't be
+// encoded is dropped without harming the connection. Any failed write is
+// fatal, though: part of the frame may already be on the wire, so the
+// connection can't be written to again and is dropped.
+func (c *Client) writeMessage(message Msg) bool {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to encode %s message for %s, dropping it: %v", message.Type, c.Username, err)
+		return true
+	}
+	return c.writeFrame(data)
+}
+
+// writeFrame writes one encoded text frame to the client, with the same
+// rules as writeMessage
+func (c *Client) writeFrame(data []byte) bool {
+	// Small messages aren't worth deflating
+	if c.Compressed {
+		c.Conn.EnableWriteCompression(len(data) >= config.WSCompressionThreshold)
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(config.WSWriteTimeout) * time.Second))
+	err := c.Conn.WriteMessage(websocket.TextMessage, data)
+	if err == nil {
+		return true
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		log.Printf("Write to %s timed out after %ds, closing connection", c.Username, config.WSWriteTimeout)
+	case errors.Is(err, websocket.ErrCloseSent), errors.Is(err, net.ErrClosed), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET):
+		log.Printf("Connection to %s is already closed", c.Username)
+	default:
+		log.Printf("Write error for %s: %v", c.Username, err)
+	}
+	return false
+}
+
+// Document operation handlers
+
+func (c *Client) handleDocumentList(filter, sortField, sortOrder string, limit, offset int) {
+	sort, err := parseDocumentSort(sortField, sortOrder)
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+	if offset < 0 {
+		c.sendError("offset can't be negative")
+		return
+	}
+	limit = normalizeDocumentLimit(limit)
+
+	var page *DocumentPage
+	switch filter {
+	case DocFilterMine:
+		page, err = GetDocumentSummariesByCreator(c.Username, false, sort, limit, offset)
+	case DocFilterArchived:
+		page, err = GetDocumentSummariesByCreator(c.Username, true, sort, limit, offset)
+	case DocFilterAccessible:
+		page, err = GetAccessibleDocumentSummaries(c.Username, sort, limit, offset)
+	default:
+		page, err = GetDocumentSummaries(sort, limit, offset)
+	}
+	if err != nil {
+		log.Printf("Error getting documents: %v", err)
+		return
+	}
+
+	response := Msg{
+		Type:      DocList,
+		Documents: page.Documents,
+		Filter:    filter,
+		Sort:      sort.Field,
+		Order:     sort.Order,
+		Limit:     limit,
+		Offset:    offset,
+		HasMore:   page.HasMore,
+		Total:     page.Total,
+	}
+
+	c.reply(response)
+}
+
+func (c *Client) handleDocumentOpen(docID, shareToken string, hub *Hub) {
+	viewOnly := false
+	if shareToken != "" {
+		link, err := GetShareLink(shareToken)
+		if err != nil {
+			log.Printf("Error getting share link: %v", err)
+			return
+		}
+		if link == nil || (docID != "" && docID != link.DocumentID) {
+			c.sendError("This share link is invalid or has expired")
+			return
+		}
+		docID = link.DocumentID
+
+		// Registered users keep the access the link gave them, so the
+		// document shows up among the ones shared with them
+		permission := link.Permission
+		if !c.Guest && link.CreatedBy != c.Username {
+			if permission, err = RedeemShareLink(link, c.Username); err != nil {
+				log.Printf("Error redeeming share link on %s: %v", docID, err)
+				return
+			}
+		}
+		viewOnly = permission == PermissionRead
+	}
+
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		return
+	}
+
+	if doc == nil {
+		log.Printf("Document %s not found", docID)
+		return
+	}
+
+	// Users the document was shared with to read only stay readers,
+	// however they open it
+	if shareToken == "" && doc.CreatedBy != c.Username {
+		permission, err := GetDocumentPermission(docID, c.Username)
+		if err != nil {
+			log.Printf("Error getting permission of %s on %s: %v", c.Username, docID, err)
+			return
+		}
+		viewOnly = permission == PermissionRead
+	}
+
+	comments, err := GetDocumentComments(docID)
+	if err != nil {
+		log.Printf("Error getting comments on %s: %v", docID, err)
+		return
+	}
+
+	hub.JoinDocument <- documentJoin{Client: c, Document: doc, Comments: comments, ViewOnly: viewOnly}
+
+	log.Printf("%s opened document %s", c.Username, doc.Name)
+}
+
+// handleDocumentUsers tells the client who is editing a document. Like
+// opening it, this needs the document to exist; guests also need the
+// documents capability, which readMessages checked already.
+func (c *Client) handleDocumentUsers(docID string, hub *Hub) {
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		return
+	}
+	if doc == nil {
+		c.sendError("Document not found")
+		return
+	}
+
+	c.reply(Msg{
+		Type:       DocUsers,
+		DocumentID: docID,
+		UserList:   hub.DocumentEditors(docID),
+	})
+}
+
+func (c *Client) handleDocumentCreate(name, language string, hub *Hub) {
+	if !currentDocCreatePolicy().Allows(c.Role) {
+		c.sendError("You are not allowed to create documents")
+		return
+	}
+
+	language, err := normalizeLanguage(language)
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+
+	doc, err := CreateDocument(name, language, c.Username)
+	if errors.Is(err, ErrDocumentQuotaExceeded) || errors.Is(err, ErrLanguageQuotaExceeded) || errors.Is(err, ErrInvalidDocumentName) {
+		c.sendError(err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating document: %v", err)
+		return
+	}
+
+	log.Printf("Document created: %s by %s", doc.Name, c.Username)
+	RecordDocumentEvent(doc.ID, c.Username, EventCreate, doc.Name)
+	EmitWebhookEvent(WebhookDocumentCreated, doc)
+
+	// The creator starts editing the new document right away, which also
+	// sends the new document back to them
+	hub.JoinDocument <- documentJoin{Client: c, Document: doc}
+
+	// Notify all clients about the new document
+	hub.DocumentLists <- struct{}{}
+}
+
+func (c *Client) handleDocumentBulk(action string, docIDs []string, hub *Hub) {
+	results, err := bulkDocuments(hub, c.Username, c.Role, action, docIDs)
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+
+	c.reply(Msg{
+		Type:            DocBulk,
+		Action:          action,
+		DocumentResults: results,
+		Time:            time.Now(),
+	})
+}
+
+func (c *Client) handleDocumentRename(docID, name, language string, hub *Hub) {
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		return
+	}
+
+	if doc == nil {
+		c.sendError("Document not found")
+		return
+	}
+
+	// The owner and users allowed to edit may rename
+	if doc.CreatedBy != c.Username {
+		permission, err := GetDocumentPermission(docID, c.Username)
+		if err != nil {
+			log.Printf("Error getting permission on %s: %v", docID, err)
+			return
+		}
+		if permission != PermissionEdit {
+			c.sendError("You are not allowed to rename this document")
+			return
+		}
+	}
+
+	// Anything left out stays as it was
+	if name == "" {
+		name = doc.Name
+	}
+	if language == "" {
+		language = doc.Language
+	}
+	language, err = normalizeLanguage(language)
+	if err != nil {
+		c.sendError(err.Error())
+		return
+	}
+	if language != doc.Language {
+		err := checkLanguageQuota(db, language)
+		if errors.Is(err, ErrLanguageQuotaExceeded) {
+			c.sendError(err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking language quota of %s: %v", language, err)
+			return
+		}
+	}
+
+	err = RenameDocument(docID, name, language)
+	if errors.Is(err, ErrInvalidDocumentName) {
+		c.sendError(err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error renaming document %s: %v", docID, err)
+		return
+	}
+	RecordDocumentEvent(docID, c.Username, EventRename, name+":"+language)
+
+	// Refresh everyone's document list
+	hub.DocumentLists <- struct{}{}
+}
+
+func (c *Client) handleDocumentShare(docID, username, permission string, hub *Hub) {
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		return
+	}
+
+	if doc == nil {
+		c.sendError("Document not found")
+		return
+	}
+
+	// Only the creator decides who the document is shared with
+	if doc.CreatedBy != c.Username {
+		c.sendError("Only the owner can share this document")
+		return
+	}
+
+	if permission == "" {
+		permission = PermissionEdit
+	}
+	if permission != PermissionRead && permission != PermissionEdit {
+		c.sendError("Unknown permission '" + permission + "'")
+		return
+	}
+
+	exists, err := UserExists(username)
+	if err != nil {
+		log.Printf("Error checking user existence: %v", err)
+		return
+	}
+	if !exists || username == c.Username {
+		c.sendError("Cannot share with user '" + username + "'")
+		return
+	}
+
+	if err := GrantDocumentPermission(docID, username, permission); err != nil {
+		log.Printf("Error sharing document %s: %v", docID, err)
+		return
+	}
+
+	log.Printf("%s shared document %s with %s (%s)", c.Username, doc.Name, username, permission)
+	RecordDocumentEvent(docID, c.Username, EventShare, username+":"+permission)
+
+	note := newNotification(NotifyShare, username, c.Username, fmt.Sprintf("%s shared %s with you", c.Username, doc.Name))
+	note.DocumentID = docID
+	note.Permission = permission
+	hub.Notify(note)
+}
+
+func (c *Client) handleDocumentHistory(docID string) {
+	events, err := GetDocumentEvents(docID, 100)
+	if err != nil {
+		log.Printf("Error getting events for document %s: %v", docID, err)
+		return
+	}
+
+	c.reply(Msg{
+		Type:       DocHistory,
+		DocumentID: docID,
+		Events:     events,
+	})
+}
+
+func (c *Client) handleReaction(messageID int64, emoji string, hub *Hub) {
+	if emoji == "" {
+		c.sendError("Reaction emoji is required")
+		return
+	}
+	if !c.allowReaction(time.Now()) {
+		return
+	}
+
+	// Only react to messages the user can see
+	target, participants := c.findVisibleMessage(messageID, hub)
+	if target == nil {
+		return
+	}
+
+	// A reaction that isn't allowed any more can still be taken back
+	var added bool
+	var err error
+	if problem := checkReaction(emoji); problem != "" {
+		removed, err := RemoveReaction(messageID, c.Username, emoji)
+		if err != nil {
+			log.Printf("Error removing reaction from message %d: %v", messageID, err)
+			return
+		}
+		if !removed {
+			c.sendError(problem)
+			return
+		}
+	} else {
+		added, err = ToggleReaction(messageID, c.Username, emoji)
+		if err != nil {
+			log.Printf("Error toggling reaction on message %d: %v", messageID, err)
+			return
+		}
+	}
+
+	hub.MessageUpdates <- Msg{
+		Type:      Reaction,
+		Username:  c.Username,
+		Time:      time.Now(),
+		MessageID: messageID,
+		Emoji:     emoji,
+		Removed:   !added,
+		To:        target.To,
+		From:      target.From,
+		Room:      target.Room,
+
+		ConversationID: target.ConversationID,
+		Participants:   participants,
+	}
+}
+
+// handleAuthRefresh checks a refreshed token for the same user and moves
+// the connection's expiry to the new token's
+func (c *Client) handleAuthRefresh(token string) {
+	claims, err := ValidateToken(token)
+	if err != nil || claims.Username != c.Username || (claims.Role == RoleGuest) != c.Guest {
+		c.sendError("Invalid token")
+		return
+	}
+
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	// Only this goroutine sends on Reauth, so after dropping an expiry the
+	// writer hasn't picked up yet there is room for the new one
+	select {
+	case c.Reauth <- expiresAt:
+	default:
+		<-c.Reauth
+		c.Reauth <- expiresAt
+	}
+
+	c.reply(Msg{Type: AuthRefresh, Time: time.Now()})
+}
+
+// handleMessageEdit replaces the content of one of the client's own messages
+// and tells everyone who can see the message
+func (c *Client) handleMessageEdit(messageID int64, content string, hub *Hub) {
+	if strings.TrimSpace(content) == "" {
+		c.sendError("Message content is required")
+		return
+	}
+
+	target, participants := c.findVisibleMessage(messageID, hub)
+	if target == nil {
+		return
+	}
+	if target.IsSystem || target.Username != c.Username {
+		c.sendError("You can only edit your own messages")
+		return
+	}
+	if config.MessageEditWindow > 0 && c.Role != RoleAdmin && time.Since(target.Time) > time.Duration(config.MessageEditWindow)*time.Minute {
+		c.sendError(fmt.Sprintf("Messages can only be edited within %d minutes of posting", config.MessageEditWindow))
+		return
+	}
+
+	content, err := cleanContent(content)
+	if err != nil {
+		c.sendError("Message not edited: " + err.Error())
+		return
+	}
+	content = expandShortcodes(sanitizeControls(content), target.Format)
+	editedAt, err := UpdateMessage(messageID, content)
+	if errors.Is(err, errMessageGone) {
+		c.sendError("Message not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error editing message %d: %v", messageID, err)
+		return
+	}
+
+	hub.MessageUpdates <- Msg{
+		Type:      MessageEdit,
+		Username:  c.Username,
+		Content:   content,
+		Time:      target.Time,
+		MessageID: messageID,
+		Edited:    true,
+		EditedAt:  &editedAt,
+		Format:    target.Format,
+		Language:  target.Language,
+		To:        target.To,
+		From:      target.From,
+		Room:      target.Room,
+
+		ConversationID: target.ConversationID,
+		Participants:   participants,
+	}
+}
+
+// findVisibleMessage loads a message the client is allowed to see, with the
+// members of its group conversation if it belongs to one. Otherwise it
+// reports the message as not found and returns nil.
+func (c *Client) findVisibleMessage(messageID int64, hub *Hub) (*Msg, []string) {
+	target, err := GetMessage(messageID)
+	if err != nil {
+		log.Printf("Error getting message %d: %v", messageID, err)
+		return nil, nil
+	}
+
+	if target == nil || (target.To != "" && target.To != c.Username && target.From != c.Username) {
+		c.sendError("Message not found")
+		return nil, nil
+	}
+	if target.Room != "" {
+		if _, ok := hub.RoomMembers(c, target.Room); !ok {
+			c.sendError("Message not found")
+			return nil, nil
+		}
+	}
+	var participants []string
+	if target.ConversationID != "" {
+		conv, err := GetConversation(target.ConversationID)
+		if err != nil {
+			log.Printf("Error getting conversation %s: %v", target.ConversationID, err)
+			return nil, nil
+		}
+		if conv == nil || !conv.IsMember(c.Username) {
+			c.sendError("Message not found")
+			return nil, nil
+		}
+		participants = conv.Members
+	}
+	return target, participants
+}
+
+func (c *Client) handleGroupCreate(name string, participants []string, hub *Hub) {
+	if name != "" && !validRoomName(name) {
+		c.sendError("Invalid conversation name")
+		return
+	}
+
+	for _, username := range participants {
+		exists, err := UserExists(username)
+		if err != nil {
+			log.Printf("Error checking user %s: %v", username, err)
+			return
+		}
+		if !exists {
+			c.sendError("User '" + username + "' does not exist")
+			return
+		}
+	}
+
+	conv, err := CreateConversation(name, c.Username, participants)
+	if errors.Is(err, ErrConversationTooSmall) || errors.Is(err, ErrConversationTooLarge) {
+		c.sendError(err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating conversation: %v", err)
+		return
+	}
+
+	// Tell every participant about the new conversation
+	hub.Groups <- Msg{
+		Type:           GroupCreate,
+		Username:       c.Username,
+		Time:           conv.CreatedAt,
+		Name:           conv.Name,
+		ConversationID: conv.ID,
+		Participants:   conv.Members,
+	}
+}
+
+func (c *Client) handleGroupMessage(msg Msg, hub *Hub) {
+	conv, err := GetConversation(msg.ConversationID)
+	if err != nil {
+		log.Printf("Error getting conversation %s: %v", msg.ConversationID, err)
+		return
+	}
+
+	// Only members may post, and non-members can't tell the conversation exists
+	if conv == nil || !conv.IsMember(c.Username) {
+		c.sendError("You are not a member of this conversation")
+		return
+	}
+
+	msg.Participants = conv.Members
+	msg.To = ""
+	msg.From = ""
+	msg.Room = ""
+	hub.Groups <- msg
+}
+
+func (c *Client) handleMarkRead(room, conversationID string, messageID int64, hub *Hub) {
+	if messageID <= 0 {
+		c.sendError("Message ID is required")
+		return
+	}
+
+	// Only track positions in scopes the user can see
+	if room != "" {
+		if _, ok := hub.RoomMembers(c, room); !ok {
+			c.sendError("You are not a member of this room")
+			return
+		}
+	}
+	if conversationID != "" {
+		conv, err := GetConversation(conversationID)
+		if err != nil {
+			log.Printf("Error getting conversation %s: %v", conversationID, err)
+			return
+		}
+		if conv == nil || !conv.IsMember(c.Username) {
+			c.sendError("You are not a member of this conversation")
+			return
+		}
+	}
+
+	if err := SetLastRead(c.Username, room, conversationID, messageID); err != nil {
+		log.Printf("Error saving read position of %s: %v", c.Username, err)
 	}
-	hub.BroadCast <- listMsg
 }
 
-func (c *Client) handleDocumentUpdate(docID, content string, hub *Hub) {
-	err := UpdateDocument(docID, content)
+func (c *Client) handleSearch(query string, before int64, limit int, hub *Hub) {
+	if !config.ChatPersistence {
+		c.sendError(historyOffMessage)
+		return
+	}
+	if !validSearchQuery(query) {
+		c.sendError("Invalid search query")
+		return
+	}
+	limit = normalizeSearchLimit(limit)
+
+	// Fetch one extra result to tell whether there is a next page
+	results, err := SearchMessages(query, c.Username, hub.RoomsOf(c.Username), before, limit+1)
 	if err != nil {
-		log.Printf("Error updating document %s: %v", docID, err)
+		log.Printf("Error searching messages for %s: %v", c.Username, err)
+		c.sendError("Search failed")
 		return
 	}
 
-	log.Printf("Document %s updated by %s", docID, c.Username)
+	response := Msg{
+		Type:    Search,
+		Content: query,
+		Time:    time.Now(),
+		Limit:   limit,
+	}
+	if len(results) > limit {
+		results = results[:limit]
+		response.Before = results[limit-1].Message.ID
+	}
+	response.Results = results
+	c.reply(response)
+}
+
+// reply sends a message to the client from its readMessages. Replies are
+// dropped once the connection is closing, and a client too far behind to
+// take one is closed as overloaded, as the hub does: a blocking send could
+// wait forever on a writer that has stopped.
+func (c *Client) reply(msg Msg) {
+	if c.closing.Load() {
+		return
+	}
+	select {
+	case c.Send <- msg:
+	default:
+		if c.requestClose(recoverableClose(websocket.CloseTryAgainLater, HintOverloaded, overloadedRetryAfter)) {
+			log.Printf("Failed to reply to %s, closing connection", c.Username)
+		}
+	}
+}
 
-	// Broadcast the update to other users editing the same document
-	// TODO: We'll implement proper real-time sync with Yjs in next step
+// sendError reports a failed request back to the client
+func (c *Client) sendError(content string) {
+	c.reply(Msg{
+		Type:    ErrorMessage,
+		Content: content,
+		Time:    time.Now(),
+	})
 }
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -494,7 +2459,7 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	http.ServeFile(w, r, "index.html")
+	serveStaticFile(w, r, "index.html")
 }
 
 func serveEditor(w http.ResponseWriter, r *http.Request) {
@@ -502,29 +2467,144 @@ func serveEditor(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	http.ServeFile(w, r, "editor.html")
+	serveStaticFile(w, r, "editor.html")
+}
+
+// staticFiles lists the pages served from STATIC_DIR
+var staticFiles = []string{"index.html", "editor.html"}
+
+// checkStaticFiles warns at startup about pages missing from STATIC_DIR, so
+// a broken deployment shows up in the logs before the first request
+func checkStaticFiles() {
+	for _, name := range staticFiles {
+		path := filepath.Join(config.StaticDir, name)
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("Warning: static file %s not found (%v); requests for it will fail", path, err)
+		}
+	}
+}
+
+// serveStaticFile serves a page from STATIC_DIR. A missing file is a server
+// misconfiguration, so it gets an explicit 500 rather than a bare 404.
+func serveStaticFile(w http.ResponseWriter, r *http.Request, name string) {
+	path := filepath.Join(config.StaticDir, name)
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("Static file %s unavailable: %v", path, err)
+		http.Error(w, name+" is missing on the server. Check that STATIC_DIR points to the directory containing the frontend files.", http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, path)
 }
 
 func main() {
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = cfg
+	upgrader.EnableCompression = config.WSCompression
+
+	// Load the JWT signing keys
+	if config.JWTKeySpec != "" {
+		keys, err := ParseJWTKeySet(config.JWTKeySpec, config.JWTCurrentKID)
+		if err != nil {
+			log.Fatal("Invalid JWT_KEYS:", err)
+		}
+		jwtKeys = keys
+	}
+
+	// Load the webhooks
+	if config.WebhookSpec != "" {
+		hooks, err := ParseWebhooks(config.WebhookSpec)
+		if err != nil {
+			log.Fatal("Invalid WEBHOOKS:", err)
+		}
+		webhooks = hooks
+	}
+
+	// Load the reverse proxies, the document creation policy, the custom
+	// reactions and the emoji shortcodes
+	if trustedProxyNets, err = ParseTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	if err := loadDocCreatePolicy(); err != nil {
+		log.Fatal("Invalid DOC_CREATE_POLICY:", err)
+	}
+	if err := loadCustomReactions(); err != nil {
+		log.Fatalf("Failed to load custom reactions: %v", err)
+	}
+	if err := loadEmojiShortcodes(); err != nil {
+		log.Fatal("Invalid EMOJI_SHORTCODES_FILE: ", err)
+	}
+
+	// Load the message of the day, and reload it and the document creation
+	// policy file on SIGHUP
+	if err := LoadMessageOfTheDay(config.MOTDFile); err != nil {
+		log.Printf("Failed to read MOTD file %s: %v", config.MOTDFile, err)
+	}
+	ReloadOnHangup(config.MOTDFile, config.DocCreatePolicyFile)
+
 	// Initialize database
 	if err := InitDB(); err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
+	go RunDocumentEventWriter(db, nil)
+	go RunAccessLogWriter(db, nil)
+	go RunWebhookDispatcher()
+	go RunEventStreams()
+
+	checkStaticFiles()
+
 	hub := NewHub()
 	go hub.Run()
+	go RunDBMaintenance(hub)
+
+	// Save the documents being edited before stopping
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, saving documents before shutting down", sig)
+		hub.SaveAllDocuments()
+		count := hub.CloseConnections()
+		log.Printf("Told %d clients to reconnect later", count)
+		os.Exit(0)
+	}()
 
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/editor", serveEditor)
 	http.HandleFunc("/register", HandleRegister)
 	http.HandleFunc("/login", HandleLogin)
-	http.HandleFunc("/ws", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/guest", HandleGuest)
+	http.HandleFunc("/refresh", HandleRefresh)
+	http.HandleFunc("/logout", HandleLogout)
+	http.HandleFunc("/version", HandleVersion)
+	http.HandleFunc("/load", HandleLoad(hub))
+	http.HandleFunc("/stats", HandleStats)
+	http.HandleFunc("/export", HandleExport(hub))
+	http.HandleFunc("/api/preferences", HandlePreferences)
+	http.HandleFunc("/api/users", HandleUsers(hub))
+	http.HandleFunc("/api/account", HandleAccount(hub))
+	http.HandleFunc("/admin/clients", HandleAdminClients(hub))
+	http.HandleFunc("/admin/documents", HandleAdminDocuments(hub))
+	http.HandleFunc("/admin/disconnect", HandleAdminDisconnect(hub))
+	http.HandleFunc("/admin/announce", HandleAdminAnnounce(hub))
+	http.HandleFunc("/admin/maintenance", HandleAdminMaintenance)
+	http.HandleFunc("/admin/users/rename", HandleAdminRename(hub))
+	http.HandleFunc("/admin/users/merge", HandleAdminMerge(hub))
+	http.HandleFunc("/documents/bulk", HandleDocumentsBulk(hub))
+	http.HandleFunc("/documents/links", HandleShareLinks)
+	http.HandleFunc("/documents/languages", HandleLanguageStats)
+	http.HandleFunc("/documents/access", HandleDocumentAccess)
+	http.HandleFunc("/events", HandleEventStream)
+	http.HandleFunc("/ws", RateLimitUpgrades(AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		handleWebSocket(hub, w, r)
-	}))
+	})))
 
-	log.Println("Server starting on :8080")
-	log.Println("Chat: http://localhost:8080")
-	log.Println("Editor: http://localhost:8080/editor")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Println("Server starting on " + config.ListenAddr)
+	log.Println("Chat: " + serverURL())
+	log.Println("Editor: " + serverURL() + "/editor")
+	log.Fatal(serve(http.DefaultServeMux))
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How the database is tidied up, set with DB_MAINTENANCE_MODE
+const (
+	MaintenanceCheckpoint = "checkpoint" // Fold the write-ahead log into the database and truncate it
+	MaintenanceVacuum     = "vacuum"     // Also rebuild the database, giving the space of deleted rows back
+)
+
+// maintenanceRetry is how long scheduled maintenance waits when the server
+// is too busy before trying again
+const maintenanceRetry = time.Minute
+
+// errMaintenanceRunning is returned when maintenance is asked for while it
+// is already under way
+var errMaintenanceRunning = errors.New("database maintenance is already running")
+
+// maintenanceMu keeps maintenance runs from overlapping
+var maintenanceMu sync.Mutex
+
+// MaintenanceResult describes a maintenance run. Sizes are in bytes.
+type MaintenanceResult struct {
+	Mode       string  `json:"mode"`
+	Seconds    float64 `json:"seconds"`
+	SizeBefore int64   `json:"sizeBefore"` // The database file and its write-ahead log
+	SizeAfter  int64   `json:"sizeAfter"`
+}
+
+// checkMaintenance reports an unknown DB_MAINTENANCE_MODE and schedules
+// that can't work
+func (c *Config) checkMaintenance(p *configProblems) {
+	if !validMaintenanceMode(c.DBMaintenanceMode) {
+		p.add("Invalid DB_MAINTENANCE_MODE %q, expected %s or %s", c.DBMaintenanceMode, MaintenanceCheckpoint, MaintenanceVacuum)
+	}
+	if c.DBMaintenanceInterval < 0 {
+		p.add("DB_MAINTENANCE_INTERVAL can't be negative, got %d", c.DBMaintenanceInterval)
+	}
+	if c.DBMaintenanceMaxConnections < 0 {
+		p.add("DB_MAINTENANCE_MAX_CONNECTIONS can't be negative, got %d", c.DBMaintenanceMaxConnections)
+	}
+}
+
+func validMaintenanceMode(mode string) bool {
+	return mode == MaintenanceCheckpoint || mode == MaintenanceVacuum
+}
+
+// databaseSize returns the size of the database file and its write-ahead
+// log
+func databaseSize() int64 {
+	var size int64
+	for _, path := range []string{dbPath, dbPath + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// MaintainDatabase checkpoints the write-ahead log and truncates it and, in
+// vacuum mode, first rebuilds the database to free the pages of deleted
+// messages and documents. Writers wait while it runs, up to their busy
+// timeout, so it is meant for quiet times. Only one run happens at a time;
+// another one asked for meanwhile gets errMaintenanceRunning.
+func MaintainDatabase(mode string) (*MaintenanceResult, error) {
+	if !maintenanceMu.TryLock() {
+		return nil, errMaintenanceRunning
+	}
+	defer maintenanceMu.Unlock()
+
+	result := &MaintenanceResult{Mode: mode, SizeBefore: databaseSize()}
+	start := time.Now()
+
+	if mode == MaintenanceVacuum {
+		err := retryBusy("vacuuming the database", func() error {
+			_, err := db.Exec(`VACUUM`)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// VACUUM goes through the log like any write, so the checkpoint comes
+	// after it
+	var busy, logged, checkpointed int
+	err := retryBusy("checkpointing the database", func() error {
+		return db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logged, &checkpointed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if busy != 0 {
+		log.Printf("Database checkpoint was blocked by readers, %d of %d pages copied", checkpointed, logged)
+	}
+
+	result.Seconds = time.Since(start).Seconds()
+	result.SizeAfter = databaseSize()
+	log.Printf("Database maintenance (%s) took %.2fs, %d bytes before, %d after",
+		mode, result.Seconds, result.SizeBefore, result.SizeAfter)
+	return result, nil
+}
+
+// quietEnough reports whether the server is idle enough for scheduled
+// maintenance: the hub isn't shedding load and no more than
+// DB_MAINTENANCE_MAX_CONNECTIONS clients are connected (0 for any number)
+func quietEnough(hub *Hub) bool {
+	status := hub.LoadStatus()
+	if status.Degraded {
+		return false
+	}
+	return config.DBMaintenanceMaxConnections == 0 || status.Connections.Total <= int64(config.DBMaintenanceMaxConnections)
+}
+
+// RunDBMaintenance maintains the database every DB_MAINTENANCE_INTERVAL
+// minutes, putting it off while the server is busy. It runs in its own
+// goroutine.
+func RunDBMaintenance(hub *Hub) {
+	if config.DBMaintenanceInterval <= 0 {
+		return
+	}
+	interval := time.Duration(config.DBMaintenanceInterval) * time.Minute
+	timer := time.NewTimer(interval)
+	for range timer.C {
+		if !quietEnough(hub) {
+			log.Printf("Server busy, putting database maintenance off for %s", maintenanceRetry)
+			timer.Reset(maintenanceRetry)
+			continue
+		}
+		if _, err := MaintainDatabase(config.DBMaintenanceMode); err != nil {
+			log.Printf("Database maintenance failed: %v", err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// HandleAdminMaintenance runs database maintenance right away (POST), busy
+// or not. The optional mode query parameter overrides DB_MAINTENANCE_MODE.
+func HandleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = config.DBMaintenanceMode
+	}
+	if !validMaintenanceMode(mode) {
+		http.Error(w, "Invalid mode, expected checkpoint or vacuum", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("%s started database maintenance (%s)", claims.Username, mode)
+	result, err := MaintainDatabase(mode)
+	if errors.Is(err, errMaintenanceRunning) {
+		http.Error(w, "Database maintenance is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Database maintenance failed: %v", err)
+		http.Error(w, "Database maintenance failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fillAndDeleteMessages stores messages and deletes them again, leaving the
+// database with free pages and a write-ahead log to tidy up
+func fillAndDeleteMessages(t *testing.T) {
+	t.Helper()
+	content := strings.Repeat("lorem ipsum ", 400)
+	for i := 0; i < 200; i++ {
+		saveTestMessage(t, "alice", content)
+	}
+	if _, err := db.Exec(`DELETE FROM messages`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pragma reads an integer PRAGMA of the database
+func pragma(t *testing.T, name string) int {
+	t.Helper()
+	var value int
+	if err := db.QueryRow(`PRAGMA ` + name).Scan(&value); err != nil {
+		t.Fatalf("PRAGMA %s: %v", name, err)
+	}
+	return value
+}
+
+func TestMaintainDatabaseCheckpoint(t *testing.T) {
+	setupTest(t)
+	fillAndDeleteMessages(t)
+	if info, err := os.Stat(dbPath + "-wal"); err != nil || info.Size() == 0 {
+		t.Fatalf("the write-ahead log is %v, %v", info, err)
+	}
+
+	result, err := MaintainDatabase(MaintenanceCheckpoint)
+	if err != nil {
+		t.Fatalf("MaintainDatabase: %v", err)
+	}
+	if info, err := os.Stat(dbPath + "-wal"); err != nil || info.Size() != 0 {
+		t.Errorf("after a checkpoint the write-ahead log is %v, %v, want it truncated", info, err)
+	}
+	if result.Mode != MaintenanceCheckpoint || result.SizeAfter >= result.SizeBefore || result.SizeAfter != databaseSize() {
+		t.Errorf("the checkpoint reported %+v", result)
+	}
+	if pragma(t, "freelist_count") == 0 {
+		t.Error("a checkpoint alone gave the free pages back")
+	}
+}
+
+func TestMaintainDatabaseVacuum(t *testing.T) {
+	setupTest(t)
+	fillAndDeleteMessages(t)
+	if _, err := MaintainDatabase(MaintenanceCheckpoint); err != nil {
+		t.Fatal(err)
+	}
+	pages := pragma(t, "page_count")
+	free := pragma(t, "freelist_count")
+	if free == 0 {
+		t.Fatal("deleting the messages left no free pages")
+	}
+
+	result, err := MaintainDatabase(MaintenanceVacuum)
+	if err != nil {
+		t.Fatalf("MaintainDatabase: %v", err)
+	}
+	if got := pragma(t, "freelist_count"); got != 0 {
+		t.Errorf("%d pages are still free after a vacuum", got)
+	}
+	if got := pragma(t, "page_count"); got > pages-free {
+		t.Errorf("the database has %d pages after a vacuum, want at most %d", got, pages-free)
+	}
+	if result.SizeAfter >= result.SizeBefore {
+		t.Errorf("the vacuum reported %+v", result)
+	}
+	if info, err := os.Stat(dbPath + "-wal"); err != nil || info.Size() != 0 {
+		t.Errorf("after a vacuum the write-ahead log is %v, %v, want it truncated", info, err)
+	}
+
+	// What was kept is still there
+	kept := saveTestMessage(t, "alice", "still here")
+	if _, err := MaintainDatabase(MaintenanceVacuum); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := GetMessage(kept); err != nil || msg.Content != "still here" {
+		t.Errorf("after a vacuum the message is %+v, %v", msg, err)
+	}
+}
+
+func TestMaintenanceWaitsForQuiet(t *testing.T) {
+	setupTest(t)
+	config.DBMaintenanceMaxConnections = 1
+	hub := newTestHub(t)
+	if !quietEnough(hub) {
+		t.Error("an idle server is too busy for maintenance")
+	}
+	register(t, hub, fakeClient("alice", true))
+	register(t, hub, fakeClient("bob", true))
+	if quietEnough(hub) {
+		t.Error("two connections are quiet enough with DB_MAINTENANCE_MAX_CONNECTIONS 1")
+	}
+	config.DBMaintenanceMaxConnections = 0
+	if !quietEnough(hub) {
+		t.Error("DB_MAINTENANCE_MAX_CONNECTIONS 0 doesn't allow any number of connections")
+	}
+}
+
+func TestHandleAdminMaintenance(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	aliceToken := createTestUser(t, "alice")
+	rootToken := createTestUser(t, "root")
+	fillAndDeleteMessages(t)
+
+	if w := callHandler(t, HandleAdminMaintenance, "POST", "/admin/maintenance", aliceToken, nil); w.Code != http.StatusForbidden {
+		t.Errorf("a user's request = %d, want 403", w.Code)
+	}
+	if w := callHandler(t, HandleAdminMaintenance, "POST", "/admin/maintenance?mode=defrag", rootToken, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown mode = %d, want 400", w.Code)
+	}
+
+	w := callHandler(t, HandleAdminMaintenance, "POST", "/admin/maintenance?mode=vacuum", rootToken, nil)
+	var result MaintenanceResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusOK || result.Mode != MaintenanceVacuum || pragma(t, "freelist_count") != 0 {
+		t.Errorf("the vacuum answered %d with %+v", w.Code, result)
+	}
+
+	// Runs don't overlap
+	maintenanceMu.Lock()
+	w = callHandler(t, HandleAdminMaintenance, "POST", "/admin/maintenance", rootToken, nil)
+	maintenanceMu.Unlock()
+	if w.Code != http.StatusConflict {
+		t.Errorf("a request during maintenance = %d, want 409", w.Code)
+	}
+}
+
+func TestMaintenanceConfigIsValidated(t *testing.T) {
+	c := DefaultConfig()
+	c.DBMaintenanceMode = "defrag"
+	c.DBMaintenanceInterval = -1
+	c.DBMaintenanceMaxConnections = -1
+	err := c.Validate()
+	for _, want := range []string{"Invalid DB_MAINTENANCE_MODE", "DB_MAINTENANCE_INTERVAL", "DB_MAINTENANCE_MAX_CONNECTIONS"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, want %s reported", err, want)
+		}
+	}
+}
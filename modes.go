@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Collaboration modes of a document, chosen by its owner
+const (
+	ModeOpen      = "open"      // Everyone allowed to edit may do so at any time
+	ModeTurns     = "turns"     // One user edits at a time, whoever holds the turn
+	ModeOwnerOnly = "owner"     // Only the owner edits, everyone else reads
+	ModeReadOnly  = "read-only" // Nobody edits; freezing a document sets this mode
+)
+
+// collabModes lists the modes in the order they are offered
+var collabModes = []string{ModeOpen, ModeTurns, ModeOwnerOnly, ModeReadOnly}
+
+// Actions of a doc-turn request
+const (
+	TurnTake    = "take"
+	TurnRelease = "release"
+)
+
+// documentMode asks the hub to switch the editing session of a document to
+// another collaboration mode
+type documentMode struct {
+	DocumentID string
+	Username   string // Who changed the mode
+	Mode       string
+}
+
+// turnRequest asks the hub to give a client the turn on the document it is
+// editing, or to take the turn back
+type turnRequest struct {
+	Client     *Client
+	DocumentID string
+	Take       bool
+}
+
+// SetDocumentMode stores the collaboration mode of a document. Freezes from
+// before modes existed are cleared along the way, the mode replaces them.
+func SetDocumentMode(docID, mode string) error {
+	_, err := db.Exec(`UPDATE documents SET collab_mode = ?, frozen_at = NULL WHERE id = ?`, mode, docID)
+	return err
+}
+
+// handleDocumentMode lets the owner of a document change its collaboration
+// mode. Freezing and unfreezing are the same as switching to ModeReadOnly
+// and back to ModeOpen.
+func (c *Client) handleDocumentMode(docID, mode string, hub *Hub) {
+	if !contains(collabModes, mode) {
+		c.sendError(fmt.Sprintf("Unknown collaboration mode '%s'", mode))
+		return
+	}
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		return
+	}
+	if doc == nil {
+		c.sendError("Document not found")
+		return
+	}
+	if doc.CreatedBy != c.Username {
+		c.sendError("Only the owner can change how this document is edited")
+		return
+	}
+
+	if err := SetDocumentMode(docID, mode); err != nil {
+		log.Printf("Error setting mode of document %s: %v", docID, err)
+		return
+	}
+	RecordDocumentEvent(docID, c.Username, EventMode, mode)
+
+	hub.DocumentMode <- documentMode{DocumentID: docID, Username: c.Username, Mode: mode}
+}
+
+// setDocumentMode applies a mode to the document's editing session, if it
+// is open, and tells its clients so they can adapt their editors. Any turn
+// held ends with the old mode.
+func (h *Hub) setDocumentMode(req documentMode) {
+	history, ok := h.DocumentHistories[req.DocumentID]
+	if !ok {
+		return
+	}
+	history.Mode = req.Mode
+	history.Turn = ""
+
+	notice := Msg{
+		Type:       DocMode,
+		DocumentID: req.DocumentID,
+		Username:   req.Username,
+		Mode:       req.Mode,
+		Frozen:     req.Mode == ModeReadOnly,
+		Time:       time.Now(),
+	}
+	for client := range h.DocumentClients[req.DocumentID] {
+		select {
+		case client.Send <- notice:
+		default:
+			log.Printf("Failed to send mode of %s to %s", req.DocumentID, client.Username)
+		}
+	}
+}
+
+// editRefusal returns why a client may not change the document of an
+// editing session, or "" if it may. In turn-based mode, a client editing
+// while nobody holds the turn takes it.
+func (h *Hub) editRefusal(client *Client, docID string, history *documentHistory) string {
+	if client.ReadOnly {
+		return "You can't edit this document"
+	}
+	if history.Archived {
+		// Documents archived while open had their sessions ended when the
+		// hub was told (see removeDocuments), so this one was archived
+		// already when it was opened
+		return "This document was archived, please close it"
+	}
+	switch history.Mode {
+	case ModeReadOnly:
+		return "This document is frozen, it can't be edited"
+	case ModeOwnerOnly:
+		if client.Username != history.Owner {
+			return "Only the owner can edit this document"
+		}
+	case ModeTurns:
+		if history.Turn == "" {
+			h.giveTurn(docID, history, client.Username)
+		}
+		if history.Turn != client.Username {
+			return fmt.Sprintf("%s is editing this document, wait for your turn", history.Turn)
+		}
+		history.TurnActive = time.Now()
+	}
+	return ""
+}
+
+// takeTurn gives a client the turn on its document, if it is free, or
+// gives up the turn the client's user holds
+func (h *Hub) takeTurn(req turnRequest) {
+	client := req.Client
+	history, ok := h.DocumentHistories[req.DocumentID]
+	if !ok || client.CurrentDocumentID != req.DocumentID {
+		h.sendError(client, "Open the document before taking a turn")
+		return
+	}
+	if history.Mode != ModeTurns {
+		h.sendError(client, "This document isn't edited in turns")
+		return
+	}
+
+	if !req.Take {
+		if history.Turn == client.Username {
+			h.giveTurn(req.DocumentID, history, "")
+		}
+		return
+	}
+	if client.ReadOnly {
+		h.sendError(client, "You can't edit this document")
+		return
+	}
+	if history.Turn != "" && history.Turn != client.Username {
+		h.sendError(client, fmt.Sprintf("%s is editing this document, wait for your turn", history.Turn))
+		return
+	}
+	h.giveTurn(req.DocumentID, history, client.Username)
+}
+
+// giveTurn hands the turn on a document to a user, or frees it when
+// username is empty, and tells everyone in the session
+func (h *Hub) giveTurn(docID string, history *documentHistory, username string) {
+	history.Turn = username
+	history.TurnActive = time.Now()
+
+	notice := Msg{
+		Type:       DocTurn,
+		DocumentID: docID,
+		Holder:     username,
+		Time:       time.Now(),
+	}
+	for client := range h.DocumentClients[docID] {
+		select {
+		case client.Send <- notice:
+		default:
+			log.Printf("Failed to send turn on %s to %s", docID, client.Username)
+		}
+	}
+}
+
+// expireTurns frees the turns of users who haven't edited for
+// DOC_TURN_IDLE seconds
+func (h *Hub) expireTurns(now time.Time) {
+	if config.DocTurnIdle <= 0 {
+		return
+	}
+	for docID, history := range h.DocumentHistories {
+		if history.Turn != "" && now.Sub(history.TurnActive) >= time.Duration(config.DocTurnIdle)*time.Second {
+			log.Printf("Turn of %s on document %s expired", history.Turn, docID)
+			h.giveTurn(docID, history, "")
+		}
+	}
+}
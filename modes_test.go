@@ -0,0 +1,139 @@
+package main
+
+import "testing"
+
+// openModeTest opens a document of alice's on a connection of alice and one
+// of bob
+func openModeTest(t *testing.T) (doc *Document, alice, bob *testConn) {
+	t.Helper()
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	alice = dial(t, server, createTestUser(t, "alice"), nil)
+	bob = dial(t, server, createTestUser(t, "bob"), nil)
+	doc = createTestDocument(t, "notes.txt", "alice")
+	for _, conn := range []*testConn{alice, bob} {
+		conn.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+		if got := conn.expect(DocContent); got.Mode != ModeOpen {
+			t.Fatalf("a new document opened in mode %q", got.Mode)
+		}
+	}
+	return doc, alice, bob
+}
+
+// setMode has alice switch the document's mode and waits until both
+// connections are told
+func setMode(t *testing.T, doc *Document, alice, bob *testConn, mode string) {
+	t.Helper()
+	alice.send(Msg{Type: DocMode, DocumentID: doc.ID, Mode: mode})
+	for _, conn := range []*testConn{alice, bob} {
+		if got := conn.expect(DocMode); got.Mode != mode {
+			t.Fatalf("switching to %s was announced as %q", mode, got.Mode)
+		}
+	}
+}
+
+// expectRefusal checks that an edit is refused with the given error
+func expectRefusal(t *testing.T, conn *testConn, doc *Document, want string) {
+	t.Helper()
+	conn.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "refused"})
+	if got := conn.expect(ErrorMessage); got.Content != want {
+		t.Errorf("the edit was answered with %q, want %q", got.Content, want)
+	}
+}
+
+func TestModeChangesAreOwnerOnly(t *testing.T) {
+	setupTest(t)
+	doc, alice, bob := openModeTest(t)
+
+	bob.send(Msg{Type: DocMode, DocumentID: doc.ID, Mode: ModeOwnerOnly})
+	if got := bob.expect(ErrorMessage); got.Content != "Only the owner can change how this document is edited" {
+		t.Errorf("another user changing the mode was answered with %q", got.Content)
+	}
+	alice.send(Msg{Type: DocMode, DocumentID: doc.ID, Mode: "chaos"})
+	if got := alice.expect(ErrorMessage); got.Content != "Unknown collaboration mode 'chaos'" {
+		t.Errorf("an unknown mode was answered with %q", got.Content)
+	}
+
+	// The mode is stored and comes with the content
+	setMode(t, doc, alice, bob, ModeTurns)
+	bob.send(Msg{Type: DocClose, DocumentID: doc.ID})
+	bob.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+	if got := bob.expect(DocContent); got.Mode != ModeTurns {
+		t.Errorf("the document reopened in mode %q", got.Mode)
+	}
+	if stored, _ := GetDocument(doc.ID); stored.Mode != ModeTurns {
+		t.Errorf("the stored mode is %q", stored.Mode)
+	}
+}
+
+func TestOwnerOnlyMode(t *testing.T) {
+	setupTest(t)
+	doc, alice, bob := openModeTest(t)
+	setMode(t, doc, alice, bob, ModeOwnerOnly)
+
+	expectRefusal(t, bob, doc, "Only the owner can edit this document")
+	alice.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "mine"})
+	if got := bob.expect(DocUpdate); got.Content != "mine" {
+		t.Errorf("bob saw the owner's edit as %q", got.Content)
+	}
+
+	// Back to open, everyone edits again
+	setMode(t, doc, alice, bob, ModeOpen)
+	bob.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "ours"})
+	if got := alice.expect(DocUpdate); got.Content != "ours" {
+		t.Errorf("alice saw bob's edit as %q", got.Content)
+	}
+}
+
+func TestTurnsMode(t *testing.T) {
+	setupTest(t)
+	doc, alice, bob := openModeTest(t)
+	setMode(t, doc, alice, bob, ModeTurns)
+
+	// Editing while nobody holds the turn takes it
+	bob.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "bob's turn"})
+	for _, conn := range []*testConn{alice, bob} {
+		if got := conn.expect(DocTurn); got.Holder != "bob" {
+			t.Errorf("the turn went to %q", got.Holder)
+		}
+	}
+	if got := alice.expect(DocUpdate); got.Content != "bob's turn" {
+		t.Errorf("alice saw bob's edit as %q", got.Content)
+	}
+	expectRefusal(t, alice, doc, "bob is editing this document, wait for your turn")
+	alice.send(Msg{Type: DocTurn, DocumentID: doc.ID, Action: TurnTake})
+	if got := alice.expect(ErrorMessage); got.Content != "bob is editing this document, wait for your turn" {
+		t.Errorf("taking a held turn was answered with %q", got.Content)
+	}
+
+	bob.send(Msg{Type: DocTurn, DocumentID: doc.ID, Action: TurnRelease})
+	for _, conn := range []*testConn{alice, bob} {
+		if got := conn.expect(DocTurn); got.Holder != "" {
+			t.Errorf("after the release the turn is %q's", got.Holder)
+		}
+	}
+	alice.send(Msg{Type: DocTurn, DocumentID: doc.ID, Action: TurnTake})
+	if got := bob.expect(DocTurn); got.Holder != "alice" {
+		t.Errorf("the taken turn went to %q", got.Holder)
+	}
+	expectRefusal(t, bob, doc, "alice is editing this document, wait for your turn")
+}
+
+func TestIdleTurnIsFreed(t *testing.T) {
+	setupTest(t)
+	config.DocTurnIdle = 1
+	doc, alice, bob := openModeTest(t)
+	setMode(t, doc, alice, bob, ModeTurns)
+
+	alice.send(Msg{Type: DocTurn, DocumentID: doc.ID, Action: TurnTake})
+	if got := bob.expect(DocTurn); got.Holder != "alice" {
+		t.Errorf("the taken turn went to %q", got.Holder)
+	}
+	if got := bob.expect(DocTurn); got.Holder != "" {
+		t.Errorf("after DOC_TURN_IDLE the turn is %q's", got.Holder)
+	}
+	bob.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "bob's turn"})
+	if got := alice.expect(DocUpdate); got.Content != "bob's turn" {
+		t.Errorf("alice saw bob's edit as %q", got.Content)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// motd holds the message-of-the-day template. It is read from MOTD_FILE at
+// startup and again on SIGHUP, so operators can edit it without a restart
+// while the hub never waits on the file.
+var motd struct {
+	mu   sync.RWMutex
+	text string
+}
+
+// LoadMessageOfTheDay reads the template from file, and clears it when file
+// is "". When the file can't be read, the previous template is kept.
+func LoadMessageOfTheDay(file string) error {
+	text := ""
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimSpace(string(data))
+	}
+
+	motd.mu.Lock()
+	motd.text = text
+	motd.mu.Unlock()
+	return nil
+}
+
+// MessageOfTheDay returns the greeting for a user, with every {username} in
+// the template replaced by their name. It returns "" when no MOTD is
+// configured.
+func MessageOfTheDay(username string) string {
+	motd.mu.RLock()
+	defer motd.mu.RUnlock()
+	return strings.ReplaceAll(motd.text, "{username}", username)
+}
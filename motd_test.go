@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// motdsIn returns the greetings among messages sent to a client
+func motdsIn(msgs []Msg) []string {
+	var greetings []string
+	for _, msg := range msgs {
+		if msg.Type == SystemMessage && strings.HasPrefix(msg.Content, "Welcome") {
+			greetings = append(greetings, msg.Content)
+		}
+	}
+	return greetings
+}
+
+func TestMessageOfTheDayGoesToNewClientOnly(t *testing.T) {
+	setupTest(t)
+	if err := os.WriteFile("motd.txt", []byte("Welcome, {username}!\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMessageOfTheDay("motd.txt"); err != nil {
+		t.Fatal(err)
+	}
+	hub := newTestHub(t)
+
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	if got := motdsIn(drain(alice)); len(got) != 1 || got[0] != "Welcome, alice!" {
+		t.Errorf("alice was greeted with %q", got)
+	}
+
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	if got := motdsIn(drain(bob)); len(got) != 1 || got[0] != "Welcome, bob!" {
+		t.Errorf("bob was greeted with %q", got)
+	}
+	if got := motdsIn(drain(alice)); len(got) != 0 {
+		t.Errorf("alice also got %q when bob connected", got)
+	}
+}
+
+func TestMessageOfTheDayReloads(t *testing.T) {
+	setupTest(t)
+	if err := LoadMessageOfTheDay("motd.txt"); err == nil {
+		t.Error("a missing MOTD file was loaded")
+	}
+	if got := MessageOfTheDay("alice"); got != "" {
+		t.Errorf("a missing MOTD file gave %q", got)
+	}
+
+	if err := os.WriteFile("motd.txt", []byte("Welcome {username}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMessageOfTheDay("motd.txt"); err != nil {
+		t.Fatalf("LoadMessageOfTheDay: %v", err)
+	}
+	if got := MessageOfTheDay("alice"); got != "Welcome alice" {
+		t.Errorf("MOTD = %q", got)
+	}
+
+	// Editing the file changes nothing until the server gets SIGHUP
+	if err := os.WriteFile("motd.txt", []byte("Welcome back {username}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := MessageOfTheDay("alice"); got != "Welcome alice" {
+		t.Errorf("MOTD before a reload = %q", got)
+	}
+	ReloadOnHangup("motd.txt", "")
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("sending SIGHUP: %v", err)
+	}
+	eventually(t, "the MOTD to be reloaded", func() bool { return MessageOfTheDay("alice") == "Welcome back alice" })
+
+	// A file that went missing keeps the last greeting
+	if err := os.Remove("motd.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMessageOfTheDay("motd.txt"); err == nil || MessageOfTheDay("alice") != "Welcome back alice" {
+		t.Errorf("after the file went missing, MOTD = %q, %v", MessageOfTheDay("alice"), err)
+	}
+
+	if err := LoadMessageOfTheDay(""); err != nil || MessageOfTheDay("alice") != "" {
+		t.Errorf("MOTD without MOTD_FILE = %q, %v", MessageOfTheDay("alice"), err)
+	}
+}
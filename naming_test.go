@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// createUntitled creates a document without a name and returns the name it
+// was given
+func createUntitled(t *testing.T, username string) string {
+	t.Helper()
+	doc, err := CreateDocument("  ", "", username)
+	if err != nil {
+		t.Fatalf("CreateDocument without a name: %v", err)
+	}
+	return doc.Name
+}
+
+func TestUntitledDocumentsAreNumbered(t *testing.T) {
+	setupTest(t)
+	config.DocUntitledPrefix = "Untitled"
+
+	for _, want := range []string{"Untitled-1", "Untitled-2"} {
+		if got := createUntitled(t, "alice"); got != want {
+			t.Errorf("untitled document named %q, want %q", got, want)
+		}
+	}
+	// Numbers are counted per creator
+	if got := createUntitled(t, "bob"); got != "Untitled-1" {
+		t.Errorf("bob's first untitled document named %q", got)
+	}
+
+	// A name taken by hand, in any case, is skipped, and a freed number is
+	// used again
+	if _, err := CreateDocument("untitled-3", "", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := createUntitled(t, "alice"); got != "Untitled-4" {
+		t.Errorf("untitled document named %q, want Untitled-4 past the taken name", got)
+	}
+	if _, err := db.Exec(`DELETE FROM documents WHERE created_by = 'alice' AND name = 'Untitled-2'`); err != nil {
+		t.Fatal(err)
+	}
+	if got := createUntitled(t, "alice"); got != "Untitled-2" {
+		t.Errorf("untitled document named %q, want the freed Untitled-2", got)
+	}
+
+	config.DocExtensions = []string{"md", "txt"}
+	if got := createUntitled(t, "carol"); got != "Untitled-1.md" {
+		t.Errorf("untitled document named %q, want the first allowed extension", got)
+	}
+}
+
+func TestEmptyNameIsRefusedWithoutPrefix(t *testing.T) {
+	setupTest(t)
+	if _, err := CreateDocument("", "", "alice"); !errors.Is(err, ErrInvalidDocumentName) {
+		t.Errorf("CreateDocument without a name = %v, want ErrInvalidDocumentName", err)
+	}
+	if count := countDocuments(t); count != 0 {
+		t.Errorf("%d documents were stored", count)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Events users can be notified of
+const (
+	NotifyMention = "mention" // Someone wrote @username in a message they can see
+	NotifyPrivate = "private" // Someone sent them a private message
+	NotifyShare   = "share"   // Someone shared a document with them
+)
+
+// mentionPattern finds @username mentions in message content
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9_.-]+)`)
+
+// NotificationPreferences are the events a user wants to be notified of
+type NotificationPreferences struct {
+	Mentions        bool `json:"mentions"`
+	PrivateMessages bool `json:"privateMessages"`
+	DocumentShares  bool `json:"documentShares"`
+}
+
+// defaultNotificationPreferences apply to users who never set theirs
+var defaultNotificationPreferences = NotificationPreferences{
+	Mentions:        true,
+	PrivateMessages: true,
+	DocumentShares:  true,
+}
+
+// Allows reports whether the preferences let through notifications of event
+func (p NotificationPreferences) Allows(event string) bool {
+	switch event {
+	case NotifyMention:
+		return p.Mentions
+	case NotifyPrivate:
+		return p.PrivateMessages
+	case NotifyShare:
+		return p.DocumentShares
+	}
+	return false
+}
+
+// InitPreferenceTables creates the notification_preferences table
+func InitPreferenceTables() error {
+	createPreferencesTable := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		username TEXT PRIMARY KEY,
+		mentions BOOLEAN NOT NULL,
+		private_messages BOOLEAN NOT NULL,
+		document_shares BOOLEAN NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`
+
+	_, err := db.Exec(createPreferencesTable)
+	return err
+}
+
+// GetNotificationPreferences retrieves a user's notification preferences,
+// or the defaults if they never set any
+func GetNotificationPreferences(username string) (NotificationPreferences, error) {
+	var prefs NotificationPreferences
+	err := db.QueryRow(`
+		SELECT mentions, private_messages, document_shares
+		FROM notification_preferences
+		WHERE username = ?
+	`, username).Scan(&prefs.Mentions, &prefs.PrivateMessages, &prefs.DocumentShares)
+	if err == sql.ErrNoRows {
+		return defaultNotificationPreferences, nil
+	}
+	return prefs, err
+}
+
+// SetNotificationPreferences stores a user's notification preferences
+func SetNotificationPreferences(username string, prefs NotificationPreferences) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_preferences (username, mentions, private_messages, document_shares, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET
+			mentions = excluded.mentions,
+			private_messages = excluded.private_messages,
+			document_shares = excluded.document_shares,
+			updated_at = excluded.updated_at
+	`, username, prefs.Mentions, prefs.PrivateMessages, prefs.DocumentShares, time.Now())
+	return err
+}
+
+// mentionedUsers returns the users mentioned in content, each once
+func mentionedUsers(content string) []string {
+	var usernames []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		username := strings.TrimRight(match[1], ".")
+		if username != "" && !contains(usernames, username) {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// newNotification builds the notice of event sent to a user. Its Username
+// is whoever caused it.
+func newNotification(event, to, from, content string) Msg {
+	return Msg{
+		Type:         Notification,
+		Notification: event,
+		To:           to,
+		Username:     from,
+		Content:      content,
+		Time:         time.Now(),
+	}
+}
+
+// notify hands a notification to the chat connections of its recipient,
+// unless they are offline or turned notifications of its kind off.
+// Notifications aren't stored, so users only get them while connected.
+func (h *Hub) notify(note Msg) {
+	if note.To == note.Username || !h.userOnline(note.To) {
+		return
+	}
+	if !IsGuestUsername(note.To) {
+		prefs, err := GetNotificationPreferences(note.To)
+		if err != nil {
+			log.Printf("Error getting notification preferences of %s: %v", note.To, err)
+			return
+		}
+		if !prefs.Allows(note.Notification) {
+			return
+		}
+	}
+	h.sendToUser(note.To, note)
+}
+
+// notifyMentions notifies the users mentioned in a lobby or room message
+// who can see it
+func (h *Hub) notifyMentions(msg Msg) {
+	for _, username := range mentionedUsers(msg.Content) {
+		if msg.Room != "" && !h.inRoom(username, msg.Room) {
+			continue
+		}
+		note := newNotification(NotifyMention, username, msg.Username, fmt.Sprintf("%s mentioned you", msg.Username))
+		note.MessageID = msg.ID
+		note.Room = msg.Room
+		h.notify(note)
+	}
+}
+
+// Notify asks the hub to deliver a notification. It is safe to call from
+// outside Run.
+func (h *Hub) Notify(note Msg) {
+	h.Notifications <- note
+}
+
+// HandlePreferences returns (GET) or replaces (PUT) the notification
+// preferences of the user whose token is in the Authorization header
+func HandlePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if claims.Role == RoleGuest {
+		http.Error(w, "Guests are not allowed to do this, please register", http.StatusForbidden)
+		return
+	}
+
+	prefs, err := GetNotificationPreferences(claims.Username)
+	if err != nil {
+		log.Printf("Error getting notification preferences of %s: %v", claims.Username, err)
+		http.Error(w, "Failed to load preferences", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "PUT" {
+		// Events left out of the body keep their current setting
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := SetNotificationPreferences(claims.Username, prefs); err != nil {
+			log.Printf("Error saving notification preferences of %s: %v", claims.Username, err)
+			http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s changed their notification preferences", claims.Username)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// notifications returns the events of the notifications among msgs
+func notifications(msgs []Msg) []string {
+	var events []string
+	for _, msg := range msgs {
+		if msg.Type == Notification {
+			events = append(events, msg.Notification)
+		}
+	}
+	return events
+}
+
+func TestHandlePreferences(t *testing.T) {
+	setupTest(t)
+	token := createTestUser(t, "bob")
+
+	w := callHandler(t, HandlePreferences, "GET", "/api/preferences", token, nil)
+	var prefs NotificationPreferences
+	if err := json.NewDecoder(w.Body).Decode(&prefs); err != nil || prefs != defaultNotificationPreferences {
+		t.Errorf("a new user's preferences = %d %+v, %v, want the defaults", w.Code, prefs, err)
+	}
+
+	// Events left out keep their setting
+	callHandler(t, HandlePreferences, "PUT", "/api/preferences", token, map[string]bool{"mentions": false})
+	w = callHandler(t, HandlePreferences, "GET", "/api/preferences", token, nil)
+	prefs = NotificationPreferences{}
+	if err := json.NewDecoder(w.Body).Decode(&prefs); err != nil || prefs != (NotificationPreferences{PrivateMessages: true, DocumentShares: true}) {
+		t.Errorf("after turning mentions off, preferences = %+v, %v", prefs, err)
+	}
+
+	for _, tc := range []struct {
+		method, token string
+		status        int
+	}{
+		{"DELETE", token, http.StatusMethodNotAllowed},
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", guestTestToken(t, "guest-1"), http.StatusForbidden},
+	} {
+		if w := callHandler(t, HandlePreferences, tc.method, "/api/preferences", tc.token, nil); w.Code != tc.status {
+			t.Errorf("%s /api/preferences = %d, want %d", tc.method, w.Code, tc.status)
+		}
+	}
+	if w := callHandler(t, HandlePreferences, "PUT", "/api/preferences", token, "not an object"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a bad body = %d, want 400", w.Code)
+	}
+}
+
+func TestDisabledNotificationsAreSuppressed(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		createTestUser(t, username)
+	}
+	if err := SetNotificationPreferences("bob", NotificationPreferences{PrivateMessages: true}); err != nil {
+		t.Fatal(err)
+	}
+	bob := fakeClient("bob", true)
+	carol := fakeClient("carol", true)
+	register(t, hub, bob)
+	register(t, hub, carol)
+	drain(bob)
+	drain(carol)
+
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "alice", Content: "@bob and @carol, lunch?"}
+	if got := receive(t, carol, Notification); got.Notification != NotifyMention || got.Username != "alice" {
+		t.Errorf("carol was notified with %+v", got)
+	}
+	hub.Private <- Msg{Type: PrivateMessage, Username: "alice", From: "alice", To: "bob", Content: "psst"}
+	hub.Notify(newNotification(NotifyShare, "bob", "alice", "alice shared notes.txt with you"))
+
+	// Only the private message gets through to bob
+	if events := notifications(drain(bob)); len(events) != 1 || events[0] != NotifyPrivate {
+		t.Errorf("bob was notified of %v, want only the private message", events)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// checkOnboarding reports an onboarding document whose language isn't
+// supported, and brings the language to its canonical name
+func (c *Config) checkOnboarding(p *configProblems) {
+	if c.OnboardingDocTemplate == "" {
+		return
+	}
+	if strings.TrimSpace(c.OnboardingDocName) == "" && c.DocUntitledPrefix == "" {
+		p.add("ONBOARDING_DOC_NAME is required unless DOC_UNTITLED_PREFIX is set")
+	}
+	language, err := c.normalizeLanguage(c.OnboardingDocLanguage)
+	if err != nil {
+		p.add("ONBOARDING_DOC_LANGUAGE %q is not in the supported languages", c.OnboardingDocLanguage)
+		return
+	}
+	c.OnboardingDocLanguage = language
+}
+
+// createOnboardingDocument gives a user who just registered their own copy
+// of ONBOARDING_DOC_TEMPLATE, with every {username} replaced by their name.
+// The template is read each time, so it can be edited without a restart.
+// Failures are only logged: the account is there either way.
+func createOnboardingDocument(username string) {
+	if config.OnboardingDocTemplate == "" {
+		return
+	}
+
+	template, err := os.ReadFile(config.OnboardingDocTemplate)
+	if err != nil {
+		log.Printf("Failed to read onboarding template %s: %v", config.OnboardingDocTemplate, err)
+		return
+	}
+	content := strings.ReplaceAll(string(template), "{username}", username)
+
+	doc, err := CreateDocument(config.OnboardingDocName, config.OnboardingDocLanguage, username)
+	if err != nil {
+		log.Printf("Failed to create onboarding document for %s: %v", username, err)
+		return
+	}
+	RecordDocumentEvent(doc.ID, username, EventCreate, doc.Name)
+
+	err = retryBusy("filling an onboarding document", func() error {
+		return UpdateDocument(doc.ID, content)
+	})
+	if err != nil {
+		log.Printf("Failed to fill onboarding document %s of %s: %v", doc.ID, username, err)
+		return
+	}
+	RecordDocumentEvent(doc.ID, username, EventUpdate, sizeDetail(content))
+	log.Printf("Created onboarding document %s for %s", doc.Name, username)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// registerWithOnboarding signs a user up through the register endpoint and
+// returns the documents they own afterwards
+func registerWithOnboarding(t *testing.T, username string) []DocumentSummary {
+	t.Helper()
+	w := callHandler(t, HandleRegister, "POST", "/register", "", RegisterRequest{Username: username, Password: "secret1"})
+	var resp AuthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Success || resp.Token == "" {
+		t.Fatalf("registering %s failed: %+v", username, resp)
+	}
+	page, err := GetDocumentSummariesByCreator(username, false, DocumentSort{Field: DocSortName, Order: SortAscending}, 10, 0)
+	if err != nil {
+		t.Fatalf("GetDocumentSummariesByCreator: %v", err)
+	}
+	return page.Documents
+}
+
+// writeOnboardingTemplate points ONBOARDING_DOC_TEMPLATE at a new file
+func writeOnboardingTemplate(t *testing.T, content string) {
+	t.Helper()
+	config.OnboardingDocTemplate = filepath.Join(t.TempDir(), "welcome.md")
+	if err := os.WriteFile(config.OnboardingDocTemplate, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisteringCreatesTheOnboardingDocument(t *testing.T) {
+	setupTest(t)
+	writeOnboardingTemplate(t, "# Welcome, {username}\n\nThis is your scratch space, {username}.\n")
+
+	docs := registerWithOnboarding(t, "alice")
+	if len(docs) != 1 || docs[0].Name != "Welcome.md" || docs[0].Language != "markdown" {
+		t.Fatalf("alice owns %+v, want the onboarding document", docs)
+	}
+	doc, err := GetDocument(docs[0].ID)
+	if err != nil {
+		t.Fatalf("GetDocument: %v", err)
+	}
+	if want := "# Welcome, alice\n\nThis is your scratch space, alice.\n"; doc.Content != want {
+		t.Errorf("the onboarding document holds %q, want %q", doc.Content, want)
+	}
+
+	// The template is read at each registration
+	writeOnboardingTemplate(t, "Hi {username}")
+	docs = registerWithOnboarding(t, "bob")
+	if len(docs) != 1 {
+		t.Fatalf("bob owns %+v", docs)
+	}
+	if doc, err := GetDocument(docs[0].ID); err != nil || doc.Content != "Hi bob" {
+		t.Errorf("bob's onboarding document is %+v, %v", doc, err)
+	}
+}
+
+func TestOnboardingIsOptIn(t *testing.T) {
+	setupTest(t)
+	if docs := registerWithOnboarding(t, "alice"); len(docs) != 0 {
+		t.Errorf("without ONBOARDING_DOC_TEMPLATE, alice owns %+v", docs)
+	}
+}
+
+func TestOnboardingFailuresDontFailRegistration(t *testing.T) {
+	setupTest(t)
+	config.OnboardingDocTemplate = filepath.Join(t.TempDir(), "missing.md")
+	if docs := registerWithOnboarding(t, "alice"); len(docs) != 0 {
+		t.Errorf("with a missing template, alice owns %+v", docs)
+	}
+
+	writeOnboardingTemplate(t, "Hi {username}")
+	config.DocLanguageQuotas = map[string]int{"markdown": 1}
+	createDocumentIn(t, "notes.md", "markdown")
+	if docs := registerWithOnboarding(t, "bob"); len(docs) != 0 {
+		t.Errorf("over the markdown quota, bob owns %+v", docs)
+	}
+}
+
+func TestOnboardingConfigIsValidated(t *testing.T) {
+	c := DefaultConfig()
+	c.OnboardingDocTemplate = "welcome.md"
+	c.OnboardingDocName = " "
+	c.OnboardingDocLanguage = "klingon"
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "ONBOARDING_DOC_NAME is required") || !strings.Contains(err.Error(), "ONBOARDING_DOC_LANGUAGE") {
+		t.Errorf("Validate = %v, want both settings reported", err)
+	}
+
+	// The name may be left to DOC_UNTITLED_PREFIX
+	c = DefaultConfig()
+	c.OnboardingDocTemplate = "welcome.md"
+	c.OnboardingDocName = ""
+	c.DocUntitledPrefix = "Untitled"
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate = %v", err)
+	}
+}
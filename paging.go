@@ -0,0 +1,33 @@
+package main
+
+// clampLimit returns the page size to use for a requested limit: pageSize
+// when the client gave none, or a zero or negative one, and at most
+// maxPageSize, so that no request can read an unbounded number of rows
+func clampLimit(limit, pageSize, maxPageSize int) int {
+	if limit <= 0 {
+		return pageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
+
+// checkPageSizes reports a page size setting that can't work
+func checkPageSizes(p *configProblems, name string, pageSize, maxPageSize int) {
+	if pageSize <= 0 {
+		p.add("%s_PAGE_SIZE must be positive, got %d", name, pageSize)
+	}
+	if maxPageSize < pageSize {
+		p.add("%s_MAX_PAGE_SIZE (%d) can't be below %s_PAGE_SIZE (%d)", name, maxPageSize, name, pageSize)
+	}
+}
+
+// checkPaging reports page sizes of history, search, document list or user
+// list requests that can't work
+func (c *Config) checkPaging(p *configProblems) {
+	checkPageSizes(p, "HISTORY", c.HistoryPageSize, c.HistoryMaxPageSize)
+	checkPageSizes(p, "SEARCH", c.SearchPageSize, c.SearchMaxPageSize)
+	checkPageSizes(p, "DOC_LIST", c.DocListPageSize, c.DocListMaxPageSize)
+	checkPageSizes(p, "USER_LIST", c.UserListPageSize, c.UserListMaxPageSize)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClampLimit(t *testing.T) {
+	for _, tc := range []struct{ limit, want int }{
+		{0, 50},
+		{-1, 50},
+		{-1000000, 50},
+		{1, 1},
+		{80, 80},
+		{100, 100},
+		{101, 100},
+		{10000000, 100},
+	} {
+		if got := clampLimit(tc.limit, 50, 100); got != tc.want {
+			t.Errorf("clampLimit(%d, 50, 100) = %d, want %d", tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestPageSizesAreValidated(t *testing.T) {
+	c := DefaultConfig()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("the defaults don't validate: %v", err)
+	}
+
+	c.HistoryPageSize = 0
+	c.SearchMaxPageSize = c.SearchPageSize - 1
+	c.UserListPageSize = -5
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("impossible page sizes validated")
+	}
+	for _, want := range []string{"HISTORY_PAGE_SIZE must be positive", "SEARCH_MAX_PAGE_SIZE", "USER_LIST_PAGE_SIZE must be positive"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't report %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "DOC_LIST") {
+		t.Errorf("%q reports the valid document list sizes", err)
+	}
+}
+
+func TestOversizedLimitsAreClamped(t *testing.T) {
+	setupTest(t)
+	config.HistoryPageSize, config.HistoryMaxPageSize = 2, 3
+	config.SearchPageSize, config.SearchMaxPageSize = 2, 3
+	config.DocListPageSize, config.DocListMaxPageSize = 2, 3
+	for i := 0; i < 5; i++ {
+		saveTestMessage(t, "bob", fmt.Sprintf("message %d", i))
+		createTestDocument(t, fmt.Sprintf("doc%d.txt", i), "bob")
+	}
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+	conn.expect(History)
+
+	for _, tc := range []struct {
+		limit, want int
+	}{
+		{1000000, 3},
+		{0, 2},
+		{-7, 2},
+	} {
+		conn.send(Msg{Type: History, Limit: tc.limit})
+		if got := conn.expect(History); got.Limit != tc.want || len(got.Messages) != tc.want {
+			t.Errorf("history with limit %d gave %d messages with limit %d, want %d", tc.limit, len(got.Messages), got.Limit, tc.want)
+		}
+
+		conn.send(Msg{Type: Search, Content: "message", Limit: tc.limit})
+		if got := conn.expect(Search); got.Limit != tc.want || len(got.Results) != tc.want {
+			t.Errorf("search with limit %d gave %d results with limit %d, want %d", tc.limit, len(got.Results), got.Limit, tc.want)
+		}
+
+		conn.send(Msg{Type: DocList, Limit: tc.limit})
+		if got := conn.expect(DocList); got.Limit != tc.want || len(got.Documents) != tc.want {
+			t.Errorf("the document list with limit %d gave %d documents with limit %d, want %d", tc.limit, len(got.Documents), got.Limit, tc.want)
+		}
+	}
+}
+
+func TestUserListLimitIsClamped(t *testing.T) {
+	setupTest(t)
+	config.UserDirectoryPolicy = DirectoryAll
+	config.UserListPageSize, config.UserListMaxPageSize = 2, 3
+	hub := newTestHub(t)
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		register(t, hub, fakeClient(username, true))
+	}
+	token := createTestUser(t, "alice")
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"?limit=1000000", 3},
+		{"?limit=0", 2},
+		{"?limit=-3", 2},
+		{"", 2},
+		{"?limit=1", 1},
+	} {
+		w := callHandler(t, HandleUsers(hub), "GET", "/api/users"+tc.query, token, nil)
+		var page struct {
+			Users   []string
+			Total   int
+			HasMore bool
+		}
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != tc.want || page.Total != 5 || !page.HasMore {
+			t.Errorf("/api/users%s gave %+v, want %d users", tc.query, page, tc.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPersistenceCombinations(t *testing.T) {
+	for _, chat := range []bool{true, false} {
+		for _, docs := range []bool{true, false} {
+			t.Run(fmt.Sprintf("chat=%v/docs=%v", chat, docs), func(t *testing.T) {
+				setupTest(t)
+				config.ChatPersistence = chat
+				config.DocPersistence = docs
+				saveTestMessage(t, "bob", "from before")
+				hub := newTestHub(t)
+				token := createTestUser(t, "alice")
+				doc := createTestDocument(t, "notes.txt", "alice")
+				conn := dial(t, newTestServer(t, hub), token, nil)
+				conn.expect(Session)
+
+				// Messages are delivered live either way, and only stored and
+				// replayed with chat persistence
+				conn.send(Msg{Type: PublicMessage, Content: "live"})
+				var replayed []Msg
+				for {
+					msg := conn.expect(PublicMessage)
+					if msg.Content == "live" {
+						break
+					}
+					replayed = append(replayed, msg)
+				}
+				if got := countContent(replayed, "from before"); got != countOf(chat) {
+					t.Errorf("the message from before was replayed %d times", got)
+				}
+				if got := countContent(lobbyHistory(t), "live"); got != countOf(chat) {
+					t.Errorf("the live message was stored %d times", got)
+				}
+
+				conn.send(Msg{Type: History, Before: 1 << 40})
+				conn.send(Msg{Type: Search, Content: "before"})
+				for _, msgType := range []MsgType{History, Search} {
+					msg, err := conn.read()
+					for err == nil && msg.Type != msgType && msg.Type != ErrorMessage {
+						msg, err = conn.read()
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					if refused := msg.Type == ErrorMessage && msg.Content == historyOffMessage; refused == chat {
+						t.Errorf("with chat persistence %v, the %s request was answered with %s %q", chat, msgType, msg.Type, msg.Content)
+					}
+				}
+
+				// Document edits reach the database once the last editor
+				// leaves, only with document persistence
+				bob := openTestDocument(t, hub, "bob", doc.ID)
+				conn.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+				conn.expect(DocContent)
+				conn.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: "edited"})
+				receive(t, bob, DocUpdate)
+				conn.conn.Close()
+				eventually(t, "alice to leave the hub", func() bool { return len(hub.ConnectedClients()) == 1 })
+				unregister(t, hub, bob)
+				want := ""
+				if docs {
+					want = "edited"
+				}
+				if got := storedContent(t, doc.ID); got != want {
+					t.Errorf("with document persistence %v, the document was stored as %q", docs, got)
+				}
+			})
+		}
+	}
+}
+
+// countOf is how many times something is expected to be found when it
+// should be there once or not at all
+func countOf(present bool) int {
+	if present {
+		return 1
+	}
+	return 0
+}
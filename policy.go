@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// docCreatePolicy decides which roles may create documents
+type docCreatePolicy struct {
+	All   bool     // Anyone may create documents
+	Roles []string // Otherwise, the roles that may
+}
+
+// ParseDocCreatePolicy parses a document creation policy: "all", "admins",
+// or "roles:" followed by comma-separated roles, e.g. "roles:admin,editor"
+func ParseDocCreatePolicy(spec string) (docCreatePolicy, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	switch {
+	case spec == "" || spec == "all":
+		return docCreatePolicy{All: true}, nil
+	case spec == "admins":
+		return docCreatePolicy{Roles: []string{RoleAdmin}}, nil
+	case strings.HasPrefix(spec, "roles:"):
+		var policy docCreatePolicy
+		for _, role := range strings.Split(strings.TrimPrefix(spec, "roles:"), ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				policy.Roles = append(policy.Roles, role)
+			}
+		}
+		if len(policy.Roles) == 0 {
+			return docCreatePolicy{}, fmt.Errorf("no roles given in %q", spec)
+		}
+		return policy, nil
+	}
+	return docCreatePolicy{}, fmt.Errorf("unknown policy %q, expected all, admins or roles:<role>,...", spec)
+}
+
+// Allows reports whether users of the given role may create documents
+func (p docCreatePolicy) Allows(role string) bool {
+	return p.All || contains(p.Roles, role)
+}
+
+// docCreation holds the policy in effect. It is read from
+// DOC_CREATE_POLICY_FILE at startup and again on SIGHUP, so operators can
+// change the policy without a restart.
+var docCreation struct {
+	mu     sync.RWMutex
+	policy docCreatePolicy
+}
+
+// checkDocCreatePolicy reports an invalid DOC_CREATE_POLICY
+func (c *Config) checkDocCreatePolicy(p *configProblems) {
+	if _, err := ParseDocCreatePolicy(c.DocCreatePolicySpec); err != nil {
+		p.add("Invalid DOC_CREATE_POLICY: %v", err)
+	}
+}
+
+// loadDocCreatePolicy sets up the policy of DOC_CREATE_POLICY and loads the
+// policy file, if any. A policy file that can't be loaded is logged, and
+// DOC_CREATE_POLICY applies until it is fixed and reloaded.
+func loadDocCreatePolicy() error {
+	policy, err := ParseDocCreatePolicy(config.DocCreatePolicySpec)
+	if err != nil {
+		return err
+	}
+	docCreation.mu.Lock()
+	docCreation.policy = policy
+	docCreation.mu.Unlock()
+
+	if config.DocCreatePolicyFile != "" {
+		if err := loadDocCreatePolicyFile(config.DocCreatePolicyFile); err != nil {
+			log.Printf("Failed to load document creation policy file %s: %v", config.DocCreatePolicyFile, err)
+		}
+	}
+	return nil
+}
+
+// loadDocCreatePolicyFile reads the policy from file. When the file can't be
+// read or holds an invalid policy, the policy in effect is kept.
+func loadDocCreatePolicyFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	policy, err := ParseDocCreatePolicy(string(data))
+	if err != nil {
+		return err
+	}
+
+	docCreation.mu.Lock()
+	docCreation.policy = policy
+	docCreation.mu.Unlock()
+	return nil
+}
+
+// currentDocCreatePolicy returns the policy in effect
+func currentDocCreatePolicy() docCreatePolicy {
+	docCreation.mu.RLock()
+	defer docCreation.mu.RUnlock()
+	return docCreation.policy
+}
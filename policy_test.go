@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseDocCreatePolicy(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    docCreatePolicy
+		wantErr bool
+	}{
+		{"", docCreatePolicy{All: true}, false},
+		{"All", docCreatePolicy{All: true}, false},
+		{"admins", docCreatePolicy{Roles: []string{RoleAdmin}}, false},
+		{"roles: admin, Editor ,", docCreatePolicy{Roles: []string{"admin", "editor"}}, false},
+		{"roles:", docCreatePolicy{}, true},
+		{"nobody", docCreatePolicy{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDocCreatePolicy(tt.spec)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseDocCreatePolicy(%q) = %+v, %v", tt.spec, got, err)
+		}
+	}
+}
+
+// tryCreateDocument has a client create a document and reports whether it
+// was let
+func tryCreateDocument(t *testing.T, hub *Hub, client *Client, name string) bool {
+	t.Helper()
+	drain(client)
+	client.handleDocumentCreate(name, "plaintext", hub)
+	switch msg := receive(t, client, ""); msg.Type {
+	case DocContent:
+		return true
+	case ErrorMessage:
+		if msg.Content != "You are not allowed to create documents" {
+			t.Errorf("%s's document was refused with %q", client.Username, msg.Content)
+		}
+		return false
+	default:
+		t.Fatalf("%s creating a document got %+v", client.Username, msg)
+		return false
+	}
+}
+
+func TestDocCreatePolicies(t *testing.T) {
+	tests := []struct {
+		spec  string
+		allow map[string]bool
+	}{
+		{"all", map[string]bool{"alice": true, "erin": true, "root": true}},
+		{"admins", map[string]bool{"alice": false, "erin": false, "root": true}},
+		{"roles:editor", map[string]bool{"alice": false, "erin": true, "root": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			setupTest(t)
+			config.DocCreatePolicySpec = tt.spec
+			config.AdminUsers = []string{"root"}
+			if err := loadDocCreatePolicy(); err != nil {
+				t.Fatal(err)
+			}
+			hub := newTestHub(t)
+			for _, username := range []string{"alice", "erin", "root"} {
+				createTestUser(t, username)
+			}
+			if _, err := db.Exec(`UPDATE users SET role = 'editor' WHERE username = 'erin'`); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, username := range []string{"alice", "erin", "root"} {
+				client := fakeClient(username, false)
+				register(t, hub, client)
+				if got := tryCreateDocument(t, hub, client, username+".txt"); got != tt.allow[username] {
+					t.Errorf("%s may create documents = %v, want %v", username, got, tt.allow[username])
+				}
+			}
+		})
+	}
+}
+
+func TestDocCreatePolicyFileReloadsOnHangup(t *testing.T) {
+	setupTest(t)
+	path := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(path, []byte("admins\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.DocCreatePolicyFile = path
+	if err := loadDocCreatePolicy(); err != nil {
+		t.Fatal(err)
+	}
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	alice := fakeClient("alice", false)
+	register(t, hub, alice)
+	if tryCreateDocument(t, hub, alice, "one.txt") {
+		t.Error("a user created a document under the admins policy")
+	}
+
+	// Editing the file changes nothing until the server gets SIGHUP
+	if err := os.WriteFile(path, []byte("all"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if tryCreateDocument(t, hub, alice, "two.txt") {
+		t.Error("the policy file was used before a reload")
+	}
+	ReloadOnHangup("", path)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("sending SIGHUP: %v", err)
+	}
+	eventually(t, "the policy to be reloaded", func() bool { return currentDocCreatePolicy().All })
+	if !tryCreateDocument(t, hub, alice, "three.txt") {
+		t.Error("the policy file was changed to all and reloaded, but alice is still refused")
+	}
+
+	// An invalid policy keeps the last good one
+	if err := os.WriteFile(path, []byte("nobody at all"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDocCreatePolicyFile(path); err == nil {
+		t.Error("an invalid policy file was loaded")
+	}
+	if !tryCreateDocument(t, hub, alice, "four.txt") {
+		t.Error("an invalid policy file replaced the last good policy")
+	}
+}
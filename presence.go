@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// Presence modes a chat client can pick with the presence query parameter
+// when connecting
+const (
+	PresenceFull = "full" // Every chat message carries the whole user list (the default)
+	PresenceDiff = "diff" // A PresenceSnapshot on connect, then PresenceJoin and PresenceLeave
+)
+
+// userRosterRequest asks the hub for the online users Client may see
+type userRosterRequest struct {
+	Client *Client
+	Reply  chan []RoomMember
+}
+
+// onlineUsers returns the names of the connected users, each listed once.
+// Users whose connection dropped within RECONNECT_GRACE count as online.
+func (h *Hub) onlineUsers() []string {
+	seen := make(map[string]bool)
+	var usernames []string
+	for client := range h.Clients {
+		if !seen[client.Username] {
+			seen[client.Username] = true
+			usernames = append(usernames, client.Username)
+		}
+	}
+	for username := range h.Pending {
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// userRoster describes the online users a client may see, sorted by name.
+// Users whose connection dropped within RECONNECT_GRACE are away.
+func (h *Hub) userRoster(client *Client) []RoomMember {
+	status := make(map[string]string)
+	for c := range h.Clients {
+		if c.CurrentDocumentID != "" {
+			status[c.Username] = StatusEditing
+		} else if status[c.Username] == "" {
+			status[c.Username] = StatusOnline
+		}
+	}
+
+	users := h.userDirectory(h.onlineUsers()).visibleToClient(client)
+	roster := make([]RoomMember, 0, len(users))
+	for _, username := range users {
+		member := RoomMember{Username: username, Color: generateUserColor(username), Status: status[username]}
+		if member.Status == "" {
+			member.Status = StatusAway
+		}
+		roster = append(roster, member)
+	}
+	return roster
+}
+
+// OnlineUsers returns the roster of the online users client may see. It is
+// safe to call from outside Run.
+func (h *Hub) OnlineUsers(client *Client) []RoomMember {
+	reply := make(chan []RoomMember, 1)
+	h.UserRoster <- userRosterRequest{Client: client, Reply: reply}
+	return <-reply
+}
+
+// userOnline reports whether the user has any connection open, or one that
+// dropped within RECONNECT_GRACE
+func (h *Hub) userOnline(username string) bool {
+	if len(h.Pending[username]) > 0 {
+		return true
+	}
+	for client := range h.Clients {
+		if client.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// sendPresenceSnapshot gives a client following presence diffs the roster
+// to apply them to
+func (h *Hub) sendPresenceSnapshot(client *Client) {
+	select {
+	case client.Send <- Msg{Type: PresenceSnapshot, UserList: h.userDirectory(h.onlineUsers()).visibleToClient(client), Time: time.Now()}:
+	default:
+		log.Printf("Failed to send presence snapshot to %s", client.Username)
+	}
+}
+
+// sendPresenceDiff tells the chat clients following presence diffs that a
+// user came online (PresenceJoin) or went offline (PresenceLeave), if
+// USER_DIRECTORY lets them see the user
+func (h *Hub) sendPresenceDiff(msgType MsgType, username string) {
+	diff := Msg{Type: msgType, Username: username, Time: time.Now()}
+	directory := h.userDirectory(nil)
+	for client := range h.Clients {
+		if !client.InChat || client.Presence != PresenceDiff || !directory.sees(client.Username, client.Role == RoleAdmin, username) {
+			continue
+		}
+		select {
+		case client.Send <- diff:
+		default:
+			log.Printf("Failed to send presence to %s", client.Username)
+		}
+	}
+}
+
+// withUserList attaches the part of the user list the client may see to a
+// chat message, for clients in full presence mode; clients following diffs
+// don't need it
+func (c *Client) withUserList(msg Msg, directory *userDirectory) Msg {
+	if c.Presence == PresenceDiff {
+		msg.UserList = nil
+	} else {
+		msg.UserList = directory.visibleToClient(c)
+	}
+	return msg
+}
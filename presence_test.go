@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// applyPresence updates a roster with the presence messages a client in
+// diff mode was sent
+func applyPresence(roster map[string]bool, msgs []Msg) {
+	for _, msg := range msgs {
+		switch msg.Type {
+		case PresenceSnapshot:
+			clear(roster)
+			for _, username := range msg.UserList {
+				roster[username] = true
+			}
+		case PresenceJoin:
+			roster[msg.Username] = true
+		case PresenceLeave:
+			delete(roster, msg.Username)
+		}
+	}
+}
+
+func TestRosterFromPresenceDiffs(t *testing.T) {
+	setupTest(t)
+	config.UserDirectoryPolicy = DirectoryAll
+	hub := newTestHub(t)
+	dave := fakeClient("dave", true)
+	register(t, hub, dave)
+
+	alice := fakeClient("alice", true)
+	alice.Presence = PresenceDiff
+	register(t, hub, alice)
+	roster := map[string]bool{}
+	applyPresence(roster, []Msg{receive(t, alice, PresenceSnapshot)})
+
+	bob := fakeClient("bob", true)
+	bobAgain := fakeClient("bob", true)
+	carol := fakeClient("carol", true)
+	for _, client := range []*Client{bob, bobAgain, carol} {
+		register(t, hub, client)
+	}
+	unregister(t, hub, bob)
+	unregister(t, hub, carol)
+
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "dave", Content: "who's here?"}
+	full := receive(t, bobAgain, PublicMessage)
+	msgs := drain(alice)
+	applyPresence(roster, msgs)
+
+	var got []string
+	for username := range roster {
+		got = append(got, username)
+	}
+	sort.Strings(got)
+	want := append([]string(nil), full.UserList...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("roster from the snapshot and diffs = %v, the full list is %v", got, want)
+	}
+	if !reflect.DeepEqual(want, []string{"alice", "bob", "dave"}) {
+		t.Errorf("full user list = %v", want)
+	}
+
+	// The second connection kept bob online, so bob never left
+	leaves := 0
+	for _, msg := range msgs {
+		if msg.Type == PresenceLeave && msg.Username == "bob" {
+			leaves++
+		}
+		if msg.Type == PublicMessage && msg.UserList != nil {
+			t.Errorf("a client following diffs got the user list %v", msg.UserList)
+		}
+	}
+	if leaves != 0 {
+		t.Errorf("bob left %d times while still connected", leaves)
+	}
+}
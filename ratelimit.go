@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedProxyNets are the networks of the reverse proxies allowed to set
+// X-Forwarded-For, parsed from TRUSTED_PROXIES at startup
+var trustedProxyNets []*net.IPNet
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR ranges
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether ip belongs to a trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, ipNet := range trustedProxyNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from. When it arrives
+// through trusted proxies, the X-Forwarded-For chain is walked from the
+// right and the first address not belonging to a proxy is used, so clients
+// can't pick their own address by sending the header themselves.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// tokenBucket is the token bucket of one client address or user
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter throttles operations per key with a token bucket each,
+// refilled at a rate per minute and holding at most a burst of operations
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// upgrades throttles WebSocket upgrade attempts per client address, at
+// WS_UPGRADE_RATE with bursts of WS_UPGRADE_BURST
+var upgrades = newRateLimiter()
+
+// Allow takes a token from the bucket of key, refilled at perMinute tokens
+// a minute up to burst. When it is empty, it returns false with how long
+// until the next token.
+func (l *rateLimiter) Allow(key string, now time.Time, perMinute, burst int) (bool, time.Duration) {
+	perSecond := float64(perMinute) / 60
+	capacity := float64(burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget keys whose bucket has refilled completely
+	if now.Sub(l.lastSweep) > time.Minute {
+		for key, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond >= capacity {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// checkRateLimit reports invalid limits or proxies
+func (c *Config) checkRateLimit(p *configProblems) {
+	if c.WSUpgradeRate < 0 {
+		p.add("WS_UPGRADE_RATE can't be negative, got %d", c.WSUpgradeRate)
+	}
+	if c.WSUpgradeRate > 0 && c.WSUpgradeBurst < 1 {
+		p.add("WS_UPGRADE_BURST must be at least 1, got %d", c.WSUpgradeBurst)
+	}
+	if c.ReactionRate < 0 {
+		p.add("REACTION_RATE can't be negative, got %d", c.ReactionRate)
+	}
+	if c.ReactionRate > 0 && c.ReactionBurst < 1 {
+		p.add("REACTION_BURST must be at least 1, got %d", c.ReactionBurst)
+	}
+	if _, err := ParseTrustedProxies(c.TrustedProxies); err != nil {
+		p.add("Invalid TRUSTED_PROXIES: %v", err)
+	}
+}
+
+// RateLimitUpgrades rejects WebSocket upgrade attempts with 429 once their
+// address exceeds WS_UPGRADE_RATE. It runs before authentication, so that
+// floods are turned away as cheaply as possible.
+func RateLimitUpgrades(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.WSUpgradeRate > 0 {
+			ip := clientIP(r)
+			if ok, wait := upgrades.Allow(ip, time.Now(), config.WSUpgradeRate, config.WSUpgradeBurst); !ok {
+				log.Printf("Throttling WebSocket upgrades from %s", ip)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many connection attempts", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// reactionLimits throttles reactions per user, across all of their
+// connections, at REACTION_RATE with bursts of REACTION_BURST
+var reactionLimits = newRateLimiter()
+
+// allowReaction reports whether the user may react again. A throttled user
+// is warned once, and further reactions until the next one is allowed are
+// dropped quietly.
+func (c *Client) allowReaction(now time.Time) bool {
+	if config.ReactionRate <= 0 {
+		return true
+	}
+	ok, wait := reactionLimits.Allow(c.Username, now, config.ReactionRate, config.ReactionBurst)
+	if ok {
+		return true
+	}
+	if now.After(c.reactionsWarned) {
+		log.Printf("Throttling reactions from %s", c.Username)
+		c.sendError(fmt.Sprintf("You are reacting too fast, try again in %v", time.Duration(math.Ceil(wait.Seconds()))*time.Second))
+		c.reactionsWarned = now.Add(wait)
+	}
+	return false
+}
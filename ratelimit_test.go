@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newThrottledServer serves the WebSocket endpoint of a hub behind the
+// upgrade limiter, as the real server does, with a limiter of its own
+func newThrottledServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+	saved := upgrades
+	upgrades = newRateLimiter()
+	t.Cleanup(func() { upgrades = saved })
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", RateLimitUpgrades(AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	})))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// upgradeStatus attempts an upgrade and returns the HTTP status it got,
+// closing the connection if there was one
+func upgradeStatus(t *testing.T, server *httptest.Server, token, forwardedFor string) *http.Response {
+	t.Helper()
+	header := http.Header{}
+	if forwardedFor != "" {
+		header.Set("X-Forwarded-For", forwardedFor)
+	}
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + token
+	conn, resp, err := websocket.DefaultDialer.Dial(u, header)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dialing %s: %v", u, err)
+	}
+	return resp
+}
+
+func TestUpgradeFloodIsThrottled(t *testing.T) {
+	setupTest(t)
+	config.WSUpgradeRate = 1
+	config.WSUpgradeBurst = 3
+	hub := newTestHub(t)
+	server := newThrottledServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	for i := 0; i < 3; i++ {
+		if resp := upgradeStatus(t, server, token, ""); resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("attempt %d within the burst got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp := upgradeStatus(t, server, token, "")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("attempt past the burst got %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("the 429 has no Retry-After")
+	}
+
+	// Throttling comes before authentication, so bad tokens count as well
+	// and don't get to see a 401
+	if resp := upgradeStatus(t, server, "not-a-token", ""); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("an unauthenticated attempt past the burst got %d, want 429", resp.StatusCode)
+	}
+	eventually(t, "the connections to leave the hub", func() bool { return hub.LoadStatus().Connections.Total == 0 })
+}
+
+func TestUpgradeThrottlingIsOff(t *testing.T) {
+	setupTest(t)
+	config.WSUpgradeRate = 0
+	config.WSUpgradeBurst = 1
+	hub := newTestHub(t)
+	server := newThrottledServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	for i := 0; i < 5; i++ {
+		if resp := upgradeStatus(t, server, token, ""); resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("attempt %d with WS_UPGRADE_RATE=0 got %d", i+1, resp.StatusCode)
+		}
+	}
+	eventually(t, "the connections to leave the hub", func() bool { return hub.LoadStatus().Connections.Total == 0 })
+}
+
+func TestUpgradeThrottlingBehindProxy(t *testing.T) {
+	setupTest(t)
+	config.WSUpgradeRate = 1
+	config.WSUpgradeBurst = 1
+	saved := trustedProxyNets
+	t.Cleanup(func() { trustedProxyNets = saved })
+	var err error
+	if trustedProxyNets, err = ParseTrustedProxies([]string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	hub := newTestHub(t)
+	server := newThrottledServer(t, hub)
+	token := createTestUser(t, "alice")
+
+	// Each client behind the proxy has a bucket of its own
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+		if resp := upgradeStatus(t, server, token, ip); resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("the first attempt from %s got %d", ip, resp.StatusCode)
+		}
+	}
+	if resp := upgradeStatus(t, server, token, "203.0.113.1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("the second attempt from 203.0.113.1 got %d, want 429", resp.StatusCode)
+	}
+	// A client prepending its own address doesn't escape its bucket
+	if resp := upgradeStatus(t, server, token, "198.51.100.7, 203.0.113.2"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("a spoofed X-Forwarded-For got %d, want 429", resp.StatusCode)
+	}
+	eventually(t, "the connections to leave the hub", func() bool { return hub.LoadStatus().Connections.Total == 0 })
+}
+
+func TestClientIP(t *testing.T) {
+	saved := trustedProxyNets
+	t.Cleanup(func() { trustedProxyNets = saved })
+	trustedProxyNets = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+	tests := []struct {
+		remote, forwardedFor, want string
+	}{
+		{"192.0.2.1:5000", "", "192.0.2.1"},
+		{"192.0.2.1:5000", "198.51.100.7", "192.0.2.1"},
+		{"10.0.0.2:5000", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.2:5000", "198.51.100.7, 10.0.0.3", "198.51.100.7"},
+		{"10.0.0.2:5000", "6.6.6.6, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.2:5000", "", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP from %s with X-Forwarded-For %q = %s, want %s", tt.remote, tt.forwardedFor, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a", now, 60, 2); !ok {
+			t.Fatalf("operation %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("a", now, 60, 2)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("past the burst: allowed %v, wait %v, want refused for up to 1s", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b", now, 60, 2); !ok {
+		t.Error("another key was refused")
+	}
+	if ok, _ := limiter.Allow("a", now.Add(time.Second), 60, 2); !ok {
+		t.Error("refused after a token was refilled")
+	}
+}
+
+// useFreshReactionLimits gives the test a reaction limiter of its own
+func useFreshReactionLimits(t *testing.T) {
+	saved := reactionLimits
+	reactionLimits = newRateLimiter()
+	t.Cleanup(func() { reactionLimits = saved })
+}
+
+// countReplies sorts what a client got into reactions and errors
+func countReplies(msgs []Msg) (reactions, errors int) {
+	for _, msg := range msgs {
+		switch msg.Type {
+		case Reaction:
+			reactions++
+		case ErrorMessage:
+			errors++
+		}
+	}
+	return reactions, errors
+}
+
+func TestRapidReactionsAreThrottled(t *testing.T) {
+	setupTest(t)
+	useFreshReactionLimits(t)
+	config.ReactionRate = 6
+	config.ReactionBurst = 3
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	drain(alice)
+	id := saveTestMessage(t, "carol", "vote here")
+
+	for i := 0; i < 10; i++ {
+		alice.handleReaction(id, "👍", hub)
+	}
+	replies := drain(alice)
+	reactions, errors := countReplies(replies)
+	if reactions != 3 || errors != 1 {
+		t.Errorf("10 rapid toggles made %d reactions and %d warnings, want 3 and 1", reactions, errors)
+	}
+	for _, msg := range replies {
+		if msg.Type == ErrorMessage && !strings.Contains(msg.Content, "reacting too fast") {
+			t.Errorf("the warning says %q", msg.Content)
+		}
+	}
+
+	// The limit is the user's, across connections, and nobody else's
+	other := fakeClient("alice", true)
+	register(t, hub, other)
+	drain(other)
+	other.handleReaction(id, "🎉", hub)
+	if _, errors := countReplies(drain(other)); errors != 1 {
+		t.Error("another connection of alice's wasn't throttled")
+	}
+	bob.handleReaction(id, "🎉", hub)
+	receive(t, bob, Reaction)
+
+	// Once a token is back, alice may react again
+	if !alice.allowReaction(time.Now().Add(11 * time.Second)) {
+		t.Error("a reaction after the bucket refilled was refused")
+	}
+}
+
+func TestReactionThrottlingIsOff(t *testing.T) {
+	setupTest(t)
+	useFreshReactionLimits(t)
+	config.ReactionRate = 0
+	config.ReactionBurst = 1
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	drain(alice)
+	id := saveTestMessage(t, "bob", "vote here")
+
+	for i := 0; i < 20; i++ {
+		alice.handleReaction(id, "👍", hub)
+	}
+	if reactions, errors := countReplies(drain(alice)); reactions != 20 || errors != 0 {
+		t.Errorf("with REACTION_RATE=0, 20 toggles made %d reactions and %d warnings", reactions, errors)
+	}
+
+	c := DefaultConfig()
+	c.ReactionRate = 10
+	c.ReactionBurst = 0
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "REACTION_BURST") {
+		t.Errorf("Validate = %v, want REACTION_BURST reported", err)
+	}
+}
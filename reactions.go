@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// ReactionCount aggregates the reactions with one emoji on a message
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Mine  bool   `json:"mine,omitempty"` // The receiving user is one of the reactors
+}
+
+// InitReactionTables creates the message_reactions table. Its primary key
+// starts with message_id, so it also serves the per-message lookups.
+func InitReactionTables() error {
+	createReactionsTable := `
+	CREATE TABLE IF NOT EXISTS message_reactions (
+		message_id INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		emoji TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (message_id, username, emoji)
+	);`
+
+	_, err := db.Exec(createReactionsTable)
+	return err
+}
+
+// ToggleReaction adds the user's reaction to a message, or removes it if it
+// was already there. It reports whether the reaction was added.
+func ToggleReaction(messageID int64, username, emoji string) (bool, error) {
+	if removed, err := RemoveReaction(messageID, username, emoji); err != nil || removed {
+		return false, err
+	}
+
+	query := `INSERT INTO message_reactions (message_id, username, emoji, created_at) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(query, messageID, username, emoji, time.Now())
+	return err == nil, err
+}
+
+// RemoveReaction takes the user's reaction off a message and reports
+// whether it was there
+func RemoveReaction(messageID int64, username, emoji string) (bool, error) {
+	result, err := db.Exec(`DELETE FROM message_reactions WHERE message_id = ? AND username = ? AND emoji = ?`,
+		messageID, username, emoji)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+// GetReactionCounts aggregates the reactions on the given messages in a
+// single query, flagging the ones made by viewer
+func GetReactionCounts(messageIDs []int64, viewer string) (map[int64][]ReactionCount, error) {
+	counts := make(map[int64][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	args := []interface{}{viewer}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	query := `
+		SELECT message_id, emoji, COUNT(*), MAX(username = ?)
+		FROM message_reactions
+		WHERE message_id IN (?` + strings.Repeat(", ?", len(messageIDs)-1) + `)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at)
+	`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int64
+		var reaction ReactionCount
+		if err := rows.Scan(&messageID, &reaction.Emoji, &reaction.Count, &reaction.Mine); err != nil {
+			return nil, err
+		}
+		counts[messageID] = append(counts[messageID], reaction)
+	}
+
+	return counts, rows.Err()
+}
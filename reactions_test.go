@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestReplayedHistoryCarriesReactions(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	liked := saveTestMessage(t, "alice", "lunch at noon?")
+	plain := saveTestMessage(t, "alice", "or one")
+	for _, reaction := range []struct{ username, emoji string }{
+		{"alice", "👍"},
+		{"bob", "👍"},
+		{"carol", "🎉"},
+	} {
+		if _, err := ToggleReaction(liked, reaction.username, reaction.emoji); err != nil {
+			t.Fatalf("ToggleReaction: %v", err)
+		}
+	}
+
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	replayed := map[int64]Msg{}
+	for _, msg := range drain(bob) {
+		if msg.ID != 0 {
+			replayed[msg.ID] = msg
+		}
+	}
+
+	want := []ReactionCount{{Emoji: "👍", Count: 2, Mine: true}, {Emoji: "🎉", Count: 1}}
+	got := replayed[liked].Reactions
+	if len(got) != len(want) {
+		t.Fatalf("replayed reactions = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("reaction %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if msg, ok := replayed[plain]; !ok || len(msg.Reactions) != 0 {
+		t.Errorf("the message without reactions was replayed as %+v", msg)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Which reactions users may add, set with REACTION_POLICY
+const (
+	ReactionsAny    = "any"    // Any emoji, and the custom reactions
+	ReactionsCustom = "custom" // Only the custom reactions
+)
+
+// maxReactionLength bounds a plain emoji reaction in characters, long enough
+// for flags and emoji joined into families
+const maxReactionLength = 16
+
+// CustomReaction is a reaction defined by the server, shown as an image.
+// Messages refer to it by its name between colons, like :partyparrot:.
+type CustomReaction struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// customReactions are the reactions loaded from CUSTOM_REACTIONS_FILE,
+// sorted by name. main sets them before the server starts.
+var customReactions []CustomReaction
+
+// checkReactionPolicy reports an unknown REACTION_POLICY, or one that leaves
+// nothing to react with
+func (c *Config) checkReactionPolicy(p *configProblems) {
+	switch c.ReactionPolicy {
+	case ReactionsAny:
+	case ReactionsCustom:
+		if c.CustomReactionsFile == "" {
+			p.add("REACTION_POLICY %s requires CUSTOM_REACTIONS_FILE", ReactionsCustom)
+		}
+	default:
+		p.add("Invalid REACTION_POLICY %q, expected %s or %s", c.ReactionPolicy, ReactionsAny, ReactionsCustom)
+	}
+}
+
+// loadCustomReactions reads CUSTOM_REACTIONS_FILE, a JSON object mapping
+// reaction names to the URLs of their images, e.g.
+// {"partyparrot": "https://example.com/parrot.gif"}. Names follow the rules
+// of emoji shortcodes.
+func loadCustomReactions() error {
+	if config.CustomReactionsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(config.CustomReactionsFile)
+	if err != nil {
+		return err
+	}
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", config.CustomReactionsFile, err)
+	}
+
+	reactions := make([]CustomReaction, 0, len(entries))
+	for name, image := range entries {
+		name = strings.Trim(strings.ToLower(name), ":")
+		if !shortcodeName.MatchString(name) {
+			return fmt.Errorf("invalid custom reaction name %q, use lowercase letters, digits, _, + and -", name)
+		}
+		u, err := url.Parse(image)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "") || u.Path == "" {
+			return fmt.Errorf("invalid image URL %q for custom reaction %s", image, name)
+		}
+		reactions = append(reactions, CustomReaction{Name: name, Image: image})
+	}
+	if config.ReactionPolicy == ReactionsCustom && len(reactions) == 0 {
+		return fmt.Errorf("%s defines no reactions, but REACTION_POLICY is %s", config.CustomReactionsFile, ReactionsCustom)
+	}
+	sort.Slice(reactions, func(i, j int) bool { return reactions[i].Name < reactions[j].Name })
+	customReactions = reactions
+	return nil
+}
+
+// isCustomReaction reports whether a reaction names a custom one
+func isCustomReaction(emoji string) bool {
+	name, ok := strings.CutPrefix(emoji, ":")
+	if !ok {
+		return false
+	}
+	name, ok = strings.CutSuffix(name, ":")
+	if !ok {
+		return false
+	}
+	for _, reaction := range customReactions {
+		if reaction.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReaction returns why users may not react with emoji, or "" if they
+// may. Anything in colons must be one of the custom reactions, and plain
+// emoji must be short and free of spaces and of ASCII letters, which would
+// make them words. Keycaps like 1️⃣ start with an ASCII digit, so digits are
+// let through.
+func checkReaction(emoji string) string {
+	if isCustomReaction(emoji) {
+		return ""
+	}
+	if strings.HasPrefix(emoji, ":") && strings.HasSuffix(emoji, ":") && len(emoji) > 1 {
+		return "Unknown reaction " + emoji
+	}
+	if config.ReactionPolicy == ReactionsCustom {
+		return "Only the server's custom reactions can be used"
+	}
+	if utf8.RuneCountInString(emoji) > maxReactionLength {
+		return "Reactions must be a single emoji"
+	}
+	for _, r := range emoji {
+		if (r < utf8.RuneSelf && unicode.IsLetter(r)) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return "Reactions must be a single emoji"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useCustomReactions loads custom reactions from a file for the rest of the
+// test
+func useCustomReactions(t *testing.T, file string) error {
+	t.Helper()
+	t.Cleanup(func() { customReactions = nil })
+	config.CustomReactionsFile = filepath.Join(t.TempDir(), "reactions.json")
+	if err := os.WriteFile(config.CustomReactionsFile, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return loadCustomReactions()
+}
+
+func TestLoadCustomReactions(t *testing.T) {
+	setupTest(t)
+	err := useCustomReactions(t, `{":PartyParrot:": "https://example.com/parrot.gif", "shipit": "/static/shipit.png"}`)
+	if err != nil {
+		t.Fatalf("loadCustomReactions: %v", err)
+	}
+	want := []CustomReaction{{Name: "partyparrot", Image: "https://example.com/parrot.gif"}, {Name: "shipit", Image: "/static/shipit.png"}}
+	if len(customReactions) != len(want) || customReactions[0] != want[0] || customReactions[1] != want[1] {
+		t.Errorf("loaded %+v, want %+v", customReactions, want)
+	}
+
+	for _, file := range []string{
+		`{"party parrot": "https://example.com/parrot.gif"}`,
+		`{"parrot": "javascript:alert(1)"}`,
+		`{"parrot": ""}`,
+		`["parrot"]`,
+	} {
+		if err := useCustomReactions(t, file); err == nil {
+			t.Errorf("%s was accepted", file)
+		}
+	}
+
+	config.ReactionPolicy = ReactionsCustom
+	if err := useCustomReactions(t, `{}`); err == nil {
+		t.Error("an empty set was accepted with REACTION_POLICY custom")
+	}
+}
+
+func TestCheckReaction(t *testing.T) {
+	setupTest(t)
+	if err := useCustomReactions(t, `{"parrot": "https://example.com/parrot.gif"}`); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		emoji   string
+		allowed bool
+	}{
+		{"👍", true},
+		{"🇫🇷", true},
+		{"1️⃣", true},
+		{":parrot:", true},
+		{":unknown:", false},
+		{"lol", false},
+		{"👍 👍", false},
+		{"👍👍👍👍👍👍👍👍👍👍👍👍👍👍👍👍👍", false},
+	} {
+		if problem := checkReaction(tc.emoji); (problem == "") != tc.allowed {
+			t.Errorf("checkReaction(%q) = %q, want allowed %v", tc.emoji, problem, tc.allowed)
+		}
+	}
+
+	config.ReactionPolicy = ReactionsCustom
+	if checkReaction("👍") == "" || checkReaction(":parrot:") != "" {
+		t.Error("REACTION_POLICY custom doesn't limit reactions to the custom ones")
+	}
+}
+
+func TestReactionsOutsideTheSetAreRejected(t *testing.T) {
+	setupTest(t)
+	if err := useCustomReactions(t, `{"parrot": "https://example.com/parrot.gif"}`); err != nil {
+		t.Fatal(err)
+	}
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	drain(alice)
+	id := saveTestMessage(t, "bob", "shipped")
+
+	for _, emoji := range []string{":unknown:", "lol"} {
+		alice.handleReaction(id, emoji, hub)
+		receive(t, alice, ErrorMessage)
+	}
+	alice.handleReaction(id, ":parrot:", hub)
+	if got := receive(t, alice, Reaction); got.Emoji != ":parrot:" || got.Removed {
+		t.Errorf("the custom reaction was broadcast as %+v", got)
+	}
+	alice.handleReaction(id, "👍", hub)
+	receive(t, alice, Reaction)
+
+	// Once only custom reactions are allowed, emoji are refused, but one
+	// added before can still be taken back
+	config.ReactionPolicy = ReactionsCustom
+	alice.handleReaction(id, "🎉", hub)
+	receive(t, alice, ErrorMessage)
+	alice.handleReaction(id, "👍", hub)
+	if got := receive(t, alice, Reaction); got.Emoji != "👍" || !got.Removed {
+		t.Errorf("taking the reaction back was broadcast as %+v", got)
+	}
+
+	reactions, err := GetReactionCounts([]int64{id}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reactions[id]; len(got) != 1 || got[0].Emoji != ":parrot:" {
+		t.Errorf("the message has the reactions %+v, want only :parrot:", got)
+	}
+}
+
+func TestReactionSetRequest(t *testing.T) {
+	setupTest(t)
+	config.ReactionPolicy = ReactionsCustom
+	if err := useCustomReactions(t, `{"parrot": "https://example.com/parrot.gif"}`); err != nil {
+		t.Fatal(err)
+	}
+	hub := newTestHub(t)
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	conn.send(Msg{Type: ReactionSet})
+	got := conn.expect(ReactionSet)
+	if got.ReactionPolicy != ReactionsCustom || len(got.CustomReactions) != 1 || got.CustomReactions[0].Name != "parrot" {
+		t.Errorf("the reaction set is %+v under %s", got.CustomReactions, got.ReactionPolicy)
+	}
+}
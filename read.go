@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+)
+
+// ReadPosition is the last message a user has read in a scope: the lobby
+// (both Room and ConversationID empty), a room or a group conversation. A
+// MessageID of 0 means the user has never read anything there.
+type ReadPosition struct {
+	Room           string `json:"room,omitempty"`
+	ConversationID string `json:"conversationID,omitempty"`
+	MessageID      int64  `json:"messageID"`
+}
+
+// InitReadTables creates the last_read table
+func InitReadTables() error {
+	createLastReadTable := `
+	CREATE TABLE IF NOT EXISTS last_read (
+		username TEXT NOT NULL,
+		room TEXT NOT NULL DEFAULT '',
+		conversation_id TEXT NOT NULL DEFAULT '',
+		message_id INTEGER NOT NULL,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (username, room, conversation_id)
+	);`
+
+	_, err := db.Exec(createLastReadTable)
+	return err
+}
+
+// SetLastRead records that the user has read up to messageID in a scope.
+// Positions only move forward, so a late report from another tab can't
+// bring back messages the user has already seen.
+func SetLastRead(username, room, conversationID string, messageID int64) error {
+	query := `
+		INSERT INTO last_read (username, room, conversation_id, message_id, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (username, room, conversation_id) DO UPDATE
+		SET message_id = MAX(message_id, excluded.message_id), updated_at = excluded.updated_at
+	`
+	_, err := db.Exec(query, username, room, conversationID, messageID, time.Now())
+	return err
+}
+
+// GetLastRead returns the last message the user has read in a scope, or 0
+// when they never reported reading there
+func GetLastRead(username, room, conversationID string) (int64, error) {
+	var messageID int64
+	query := `SELECT COALESCE(MAX(message_id), 0) FROM last_read WHERE username = ? AND room = ? AND conversation_id = ?`
+	err := db.QueryRow(query, username, room, conversationID).Scan(&messageID)
+	return messageID, err
+}
+
+// GetLastReadPositions returns every read position stored for the user
+func GetLastReadPositions(username string) ([]ReadPosition, error) {
+	rows, err := db.Query(`SELECT room, conversation_id, message_id FROM last_read WHERE username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var positions []ReadPosition
+	for rows.Next() {
+		var pos ReadPosition
+		if err := rows.Scan(&pos.Room, &pos.ConversationID, &pos.MessageID); err != nil {
+			return nil, err
+		}
+		positions = append(positions, pos)
+	}
+	return positions, rows.Err()
+}
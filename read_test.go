@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestLastReadPositions(t *testing.T) {
+	setupTest(t)
+	if id, err := GetLastRead("alice", "", ""); err != nil || id != 0 {
+		t.Errorf("first-time position = %d, %v, want 0", id, err)
+	}
+
+	for _, pos := range []ReadPosition{
+		{MessageID: 5},
+		{MessageID: 3}, // A late report from another tab
+		{Room: "dev", MessageID: 7},
+		{ConversationID: "conv-1", MessageID: 9},
+	} {
+		if err := SetLastRead("alice", pos.Room, pos.ConversationID, pos.MessageID); err != nil {
+			t.Fatalf("SetLastRead: %v", err)
+		}
+	}
+
+	tests := []struct {
+		room, conversationID string
+		want                 int64
+	}{
+		{"", "", 5},
+		{"dev", "", 7},
+		{"", "conv-1", 9},
+		{"ops", "", 0},
+	}
+	for _, tt := range tests {
+		if id, err := GetLastRead("alice", tt.room, tt.conversationID); err != nil || id != tt.want {
+			t.Errorf("position in %q/%q = %d, %v, want %d", tt.room, tt.conversationID, id, err, tt.want)
+		}
+	}
+	if id, _ := GetLastRead("bob", "", ""); id != 0 {
+		t.Errorf("bob's position is alice's %d", id)
+	}
+}
+
+func TestLastReadIsDeliveredOnConnect(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	if positions := receive(t, alice, LastRead).ReadPositions; len(positions) != 0 {
+		t.Errorf("a first-time user got positions %+v", positions)
+	}
+
+	alice.handleMarkRead("", "", 12, hub)
+	alice.handleMarkRead("ops", "", 3, hub)
+	if msg := receive(t, alice, ErrorMessage); msg.Content != "You are not a member of this room" {
+		t.Errorf("marking a room alice isn't in: %q", msg.Content)
+	}
+	unregister(t, hub, alice)
+
+	again := fakeClient("alice", true)
+	register(t, hub, again)
+	positions := receive(t, again, LastRead).ReadPositions
+	if len(positions) != 1 || positions[0] != (ReadPosition{MessageID: 12}) {
+		t.Errorf("alice got positions %+v on reconnecting, want message 12 in the lobby", positions)
+	}
+}
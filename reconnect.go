@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// pendingDisconnect is what a dropped connection had open, kept for
+// RECONNECT_GRACE seconds so that the user's next connection can pick it
+// up. Until then the user still counts as online.
+type pendingDisconnect struct {
+	InChat     bool
+	DocumentID string
+	ReadOnly   bool
+	Rooms      []string
+	Deadline   time.Time
+}
+
+// holdClient removes a dropped client from the hub but keeps its session
+// for RECONNECT_GRACE seconds. Its leave is only announced when the grace
+// period runs out without the user coming back.
+func (h *Hub) holdClient(client *Client) {
+	pending := pendingDisconnect{
+		InChat:     client.InChat,
+		DocumentID: client.CurrentDocumentID,
+		ReadOnly:   client.ReadOnly,
+		Rooms:      h.roomsOf(client),
+		Deadline:   time.Now().Add(time.Duration(config.ReconnectGrace) * time.Second),
+	}
+	h.Pending[client.Username] = append(h.Pending[client.Username], pending)
+
+	h.removeClient(client)
+	log.Printf("Client %s disconnected, holding its session for %ds. Total Clients %d", client.Username, config.ReconnectGrace, len(h.Clients))
+}
+
+// takePending returns the oldest session held for the user that matches the
+// kind of connection client is, removing it from the registry
+func (h *Hub) takePending(client *Client) (pendingDisconnect, bool) {
+	pending := h.Pending[client.Username]
+	for i, p := range pending {
+		if p.InChat != client.InChat {
+			continue
+		}
+		pending = append(pending[:i:i], pending[i+1:]...)
+		if len(pending) == 0 {
+			delete(h.Pending, client.Username)
+		} else {
+			h.Pending[client.Username] = pending
+		}
+		return p, true
+	}
+	return pendingDisconnect{}, false
+}
+
+// restoreSession puts a reconnected client back into the rooms and the
+// document its dropped connection had open
+func (h *Hub) restoreSession(client *Client, pending pendingDisconnect) {
+	log.Printf("Restoring session of %s", client.Username)
+	for _, room := range pending.Rooms {
+		h.joinRoom(client, room)
+	}
+
+	if pending.DocumentID == "" {
+		return
+	}
+	doc, err := GetDocument(pending.DocumentID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", pending.DocumentID, err)
+		return
+	}
+	if doc == nil {
+		// Deleted in the meantime
+		return
+	}
+	comments, err := GetDocumentComments(doc.ID)
+	if err != nil {
+		log.Printf("Error getting comments on %s: %v", doc.ID, err)
+		return
+	}
+	h.joinDocument(client, doc, comments, pending.ReadOnly)
+}
+
+// expireDisconnects drops the sessions held past their grace period and
+// announces that their users left
+func (h *Hub) expireDisconnects(now time.Time) {
+	for username, pending := range h.Pending {
+		var kept, expired []pendingDisconnect
+		for _, p := range pending {
+			if now.After(p.Deadline) {
+				expired = append(expired, p)
+			} else {
+				kept = append(kept, p)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if len(kept) == 0 {
+			delete(h.Pending, username)
+		} else {
+			h.Pending[username] = kept
+		}
+
+		log.Printf("Grace period of %s ran out", username)
+		if !h.userOnline(username) {
+			h.sendPresenceDiff(PresenceLeave, username)
+		}
+		for _, p := range expired {
+			if p.InChat {
+				h.announceLeft(username, p.Rooms)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+// chatNotices returns the system messages among msgs
+func chatNotices(msgs []Msg) []string {
+	var notices []string
+	for _, msg := range msgs {
+		if msg.Type == SystemMessage {
+			notices = append(notices, msg.Content)
+		}
+	}
+	return notices
+}
+
+func TestReconnectWithinGraceRestoresSession(t *testing.T) {
+	setupTest(t)
+	config.ReconnectGrace = 30
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	chat := fakeClient("alice", true)
+	register(t, hub, chat)
+	joinTestRoom(t, hub, chat, "dev")
+	editor := openTestDocument(t, hub, "alice", doc.ID)
+	drain(bob)
+
+	unregister(t, hub, chat)
+	unregister(t, hub, editor)
+
+	chat = fakeClient("alice", true)
+	register(t, hub, chat)
+	editor = fakeClient("alice", false)
+	register(t, hub, editor)
+	if got := receive(t, editor, DocContent); got.DocumentID != doc.ID {
+		t.Errorf("the new editor connection got %s, want the document it had open", got.DocumentID)
+	}
+	sessions := hub.DocumentSessions()
+	if len(sessions) != 1 || len(sessions[0].Editors) != 1 || sessions[0].Editors[0].SessionID != editor.ID {
+		t.Errorf("DocumentSessions = %+v, want the new connection editing", sessions)
+	}
+	var rooms []string
+	for _, client := range hub.ConnectedClients() {
+		if client.ID == chat.ID {
+			rooms = client.Rooms
+		}
+	}
+	if len(rooms) != 1 || rooms[0] != "dev" {
+		t.Errorf("the new chat connection is in rooms %v, want dev", rooms)
+	}
+	if notices := chatNotices(drain(bob)); len(notices) != 0 {
+		t.Errorf("bob was told %q about a quick reconnect", notices)
+	}
+}
+
+func TestGracePeriodRunsOut(t *testing.T) {
+	setupTest(t)
+	config.ReconnectGrace = 1
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	chat := fakeClient("alice", true)
+	register(t, hub, chat)
+	editor := openTestDocument(t, hub, "alice", doc.ID)
+	drain(bob)
+
+	// The editor goes first, so that its grace period has run out by the
+	// time the chat one has
+	unregister(t, hub, editor)
+	unregister(t, hub, chat)
+	for {
+		msg := receive(t, bob, SystemMessage)
+		if msg.Content == "alice left the chat" {
+			break
+		}
+	}
+
+	// Nothing is restored any more
+	editor = fakeClient("alice", false)
+	register(t, hub, editor)
+	if sessions := hub.DocumentSessions(); len(sessions) != 0 {
+		t.Errorf("DocumentSessions = %+v, want the expired session dropped", sessions)
+	}
+	chat = fakeClient("alice", true)
+	register(t, hub, chat)
+	for {
+		msg := receive(t, bob, SystemMessage)
+		if msg.Content == "alice joined the chat" {
+			break
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Errors of renaming and merging accounts
+var (
+	errUserNotFound  = errors.New("user not found")
+	errUsernameTaken = errors.New("username already exists")
+	errSameAccount   = errors.New("an account can't be merged into itself")
+)
+
+// moveUserContent hands everything stored under one username to another,
+// within the transaction tx. Rows that would collide with ones the new name
+// already has, like the same reaction on the same message, a second share of
+// the same document or a second read position in the same room, are merged
+// into those and dropped. Document shares are kept at the higher
+// permission, and read positions at the furthest message.
+func moveUserContent(tx execer, from, to string) error {
+	_, err := tx.Exec(`
+		UPDATE document_permissions SET permission = ?3 WHERE username = ?1
+		AND document_id IN (SELECT document_id FROM document_permissions WHERE username = ?2 AND permission = ?3)
+	`, to, from, PermissionEdit)
+	if err != nil {
+		return err
+	}
+	return runStatements(tx, []string{
+		// Client keys are only unique per sender
+		`UPDATE messages SET client_key = '' WHERE username = ?2 AND client_key IN (SELECT client_key FROM messages WHERE username = ?1 AND client_key != '')`,
+		`UPDATE messages SET username = ?1 WHERE username = ?2`,
+		`UPDATE messages SET from_user = ?1 WHERE from_user = ?2`,
+		`UPDATE messages SET to_user = ?1 WHERE to_user = ?2`,
+		`UPDATE OR IGNORE message_reactions SET username = ?1 WHERE username = ?2`,
+		`DELETE FROM message_reactions WHERE username = ?2`,
+
+		`UPDATE documents SET created_by = ?1 WHERE created_by = ?2`,
+		`UPDATE document_share_links SET created_by = ?1 WHERE created_by = ?2`,
+		`UPDATE OR IGNORE document_permissions SET username = ?1 WHERE username = ?2`,
+		`DELETE FROM document_permissions WHERE username = ?2`,
+		// A share of a document one now owns means nothing
+		`DELETE FROM document_permissions WHERE username = ?1 AND document_id IN (SELECT id FROM documents WHERE created_by = ?1)`,
+		`UPDATE document_comments SET username = ?1 WHERE username = ?2`,
+		`UPDATE document_events SET username = ?1 WHERE username = ?2`,
+		`UPDATE access_log SET username = ?1 WHERE username = ?2`,
+		`UPDATE document_snapshots SET username = ?1 WHERE username = ?2`,
+
+		`UPDATE conversations SET created_by = ?1 WHERE created_by = ?2`,
+		`UPDATE OR IGNORE conversation_members SET username = ?1 WHERE username = ?2`,
+		`DELETE FROM conversation_members WHERE username = ?2`,
+		`UPDATE last_read SET message_id = MAX(message_id, (SELECT other.message_id FROM last_read other
+			WHERE other.username = ?2 AND other.room = last_read.room AND other.conversation_id = last_read.conversation_id))
+			WHERE username = ?1 AND EXISTS (SELECT 1 FROM last_read other
+			WHERE other.username = ?2 AND other.room = last_read.room AND other.conversation_id = last_read.conversation_id)`,
+		`UPDATE OR IGNORE last_read SET username = ?1 WHERE username = ?2`,
+		`DELETE FROM last_read WHERE username = ?2`,
+		`UPDATE OR IGNORE notification_preferences SET username = ?1 WHERE username = ?2`,
+		`DELETE FROM notification_preferences WHERE username = ?2`,
+	}, to, from)
+}
+
+// RenameUser renames an account in one transaction, along with everything
+// stored under its name: messages, reactions, documents, shares, comments,
+// group memberships, read positions and preferences. Tokens issued to the
+// old name are revoked. It returns errUserNotFound when there is no such
+// account and errUsernameTaken when the new name is already registered.
+func RenameUser(username, newUsername string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, newUsername).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return errUsernameTaken
+	}
+	result, err := tx.Exec(`UPDATE users SET username = ? WHERE username = ?`, newUsername, username)
+	if err != nil {
+		return err
+	}
+	if renamed, err := result.RowsAffected(); err != nil {
+		return err
+	} else if renamed == 0 {
+		return errUserNotFound
+	}
+
+	if err := moveUserContent(tx, username, newUsername); err != nil {
+		return err
+	}
+	if err := revokeTokens(tx, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MergeUsers moves everything stored under the source account to the target
+// account and deletes the source, in one transaction. The target keeps its
+// password and role. Tokens issued to the source are revoked. It returns
+// errUserNotFound when either account doesn't exist.
+func MergeUsers(source, target string) error {
+	if source == target {
+		return errSameAccount
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var targetExists bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, target).Scan(&targetExists); err != nil {
+		return err
+	}
+	if !targetExists {
+		return errUserNotFound
+	}
+	result, err := tx.Exec(`DELETE FROM users WHERE username = ?`, source)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errUserNotFound
+	}
+
+	if err := moveUserContent(tx, source, target); err != nil {
+		return err
+	}
+	if err := revokeTokens(tx, source); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writeAccountError answers a failed rename or merge
+func writeAccountError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		http.Error(w, "User not found", http.StatusNotFound)
+	case errors.Is(err, errUsernameTaken):
+		http.Error(w, "Username already exists", http.StatusConflict)
+	case errors.Is(err, errSameAccount):
+		http.Error(w, "An account can't be merged into itself", http.StatusBadRequest)
+	default:
+		log.Printf("Error %s: %v", action, err)
+		http.Error(w, "Failed "+action, http.StatusInternalServerError)
+	}
+}
+
+// HandleAdminRename lets admins rename an account (POST), with
+// {"username": "...", "newUsername": "..."}. The user's connections are
+// closed, and they log in again under the new name.
+func HandleAdminRename(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Username    string `json:"username"`
+			NewUsername string `json:"newUsername"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		req.Username = strings.TrimSpace(req.Username)
+		req.NewUsername = strings.TrimSpace(req.NewUsername)
+		if req.Username == "" || req.NewUsername == "" {
+			http.Error(w, "Invalid request: username and newUsername are required", http.StatusBadRequest)
+			return
+		}
+		if IsReservedUsername(req.NewUsername) {
+			http.Error(w, "This username is reserved", http.StatusBadRequest)
+			return
+		}
+
+		if err := RenameUser(req.Username, req.NewUsername); err != nil {
+			writeAccountError(w, err, "renaming the user")
+			return
+		}
+		log.Printf("%s renamed %s to %s", claims.Username, req.Username, req.NewUsername)
+		hub.CloseUserConnections(req.Username, permanentClose(CloseAccountRemoved, "account renamed to "+req.NewUsername))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{Success: true, Message: "User renamed"})
+	}
+}
+
+// HandleAdminMerge lets admins merge an account created by mistake into
+// another one (POST), with {"source": "...", "target": "..."}. The source
+// account is deleted and its connections closed.
+func HandleAdminMerge(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		claims, ok := requireAdmin(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Source string `json:"source"`
+			Target string `json:"target"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request format", http.StatusBadRequest)
+			return
+		}
+		req.Source = strings.TrimSpace(req.Source)
+		req.Target = strings.TrimSpace(req.Target)
+		if req.Source == "" || req.Target == "" {
+			http.Error(w, "Invalid request: source and target are required", http.StatusBadRequest)
+			return
+		}
+
+		if err := MergeUsers(req.Source, req.Target); err != nil {
+			writeAccountError(w, err, "merging the users")
+			return
+		}
+		log.Printf("%s merged %s into %s", claims.Username, req.Source, req.Target)
+		hub.CloseUserConnections(req.Source, permanentClose(CloseAccountRemoved, "account merged into "+req.Target))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{Success: true, Message: "Users merged"})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// rowsOf counts the rows a query finds for a username
+func rowsOf(t *testing.T, query, username string) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(query, username).Scan(&count); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return count
+}
+
+// leftUnder counts what is still stored under a username that should have
+// gone: messages sent or received, documents, shares and reactions
+func leftUnder(t *testing.T, username string) int {
+	t.Helper()
+	return rowsOf(t, `SELECT COUNT(*) FROM messages WHERE ?1 IN (username, from_user, to_user)`, username) +
+		rowsOf(t, `SELECT COUNT(*) FROM documents WHERE created_by = ?`, username) +
+		rowsOf(t, `SELECT COUNT(*) FROM document_permissions WHERE username = ?`, username) +
+		rowsOf(t, `SELECT COUNT(*) FROM message_reactions WHERE username = ?`, username)
+}
+
+func TestRenameUserKeepsContent(t *testing.T) {
+	setupTest(t)
+	oldToken := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	public := saveTestMessage(t, "alice", "hello")
+	sent := savePrivateMessage(t, "alice", "bob", "psst")
+	received := savePrivateMessage(t, "bob", "alice", "psst back")
+	notes := createTestDocument(t, "notes.txt", "alice")
+	shared := createTestDocument(t, "plan.txt", "bob")
+	if err := GrantDocumentPermission(shared.ID, "alice", PermissionEdit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ToggleReaction(public, "alice", "👍"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RenameUser("alice", "alicia"); err != nil {
+		t.Fatalf("RenameUser: %v", err)
+	}
+
+	if msg, err := GetMessage(public); err != nil || msg.Username != "alicia" {
+		t.Errorf("the public message is %+v, %v", msg, err)
+	}
+	if msg, err := GetMessage(sent); err != nil || msg.Username != "alicia" || msg.From != "alicia" || msg.To != "bob" {
+		t.Errorf("the sent private message is %+v, %v", msg, err)
+	}
+	if msg, err := GetMessage(received); err != nil || msg.From != "bob" || msg.To != "alicia" {
+		t.Errorf("the received private message is %+v, %v", msg, err)
+	}
+	if doc, err := GetDocument(notes.ID); err != nil || doc.CreatedBy != "alicia" {
+		t.Errorf("the document is %+v, %v", doc, err)
+	}
+	if permission, err := GetDocumentPermission(shared.ID, "alicia"); err != nil || permission != PermissionEdit {
+		t.Errorf("the share is %q, %v", permission, err)
+	}
+	if counts, err := GetReactionCounts([]int64{public}, "alicia"); err != nil || len(counts[public]) != 1 || !counts[public][0].Mine {
+		t.Errorf("the reaction is %+v, %v", counts[public], err)
+	}
+	if left := leftUnder(t, "alice"); left != 0 {
+		t.Errorf("%d rows are still stored under the old name", left)
+	}
+
+	// The password goes with the account, and the old name is gone
+	if ok, err := ValidateUser("alicia", "secret1"); err != nil || !ok {
+		t.Errorf("logging in as alicia = %v, %v", ok, err)
+	}
+	if exists, _ := UserExists("alice"); exists {
+		t.Error("the old name still exists")
+	}
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Error("a token of the old name is still valid")
+	}
+}
+
+func TestRenameUserConflicts(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	saveTestMessage(t, "alice", "hello")
+
+	if err := RenameUser("alice", "bob"); !errors.Is(err, errUsernameTaken) {
+		t.Errorf("renaming to a taken name = %v, want errUsernameTaken", err)
+	}
+	if rowsOf(t, `SELECT COUNT(*) FROM messages WHERE username = ?`, "alice") != 1 {
+		t.Error("a refused rename moved the messages")
+	}
+	if err := RenameUser("carol", "caroline"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("renaming a missing user = %v, want errUserNotFound", err)
+	}
+}
+
+func TestMergeUsersKeepsContent(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "bob")
+	createTestUser(t, "bobby")
+	createTestUser(t, "carol")
+	mine := saveTestMessage(t, "bob", "first")
+	duplicate := saveTestMessage(t, "bobby", "second")
+	bobs := createTestDocument(t, "bob.txt", "bob")
+	bobbys := createTestDocument(t, "bobby.txt", "bobby")
+	carols := createTestDocument(t, "carol.txt", "carol")
+	for _, grant := range []struct{ docID, username, permission string }{
+		{carols.ID, "bob", PermissionRead},
+		{carols.ID, "bobby", PermissionEdit},
+		{bobs.ID, "bobby", PermissionEdit},
+	} {
+		if err := GrantDocumentPermission(grant.docID, grant.username, grant.permission); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, username := range []string{"bob", "bobby"} {
+		if _, err := ToggleReaction(mine, username, "👍"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MergeUsers("bobby", "bob"); err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+
+	if msg, err := GetMessage(duplicate); err != nil || msg.Username != "bob" {
+		t.Errorf("the merged account's message is %+v, %v", msg, err)
+	}
+	if doc, err := GetDocument(bobbys.ID); err != nil || doc.CreatedBy != "bob" {
+		t.Errorf("the merged account's document is %+v, %v", doc, err)
+	}
+	if rowsOf(t, `SELECT COUNT(*) FROM documents WHERE created_by = ?`, "bob") != 2 {
+		t.Error("bob doesn't own both documents")
+	}
+	// Both had the same document shared: the higher permission is kept. A
+	// share of a document bob owns is dropped.
+	if permission, _ := GetDocumentPermission(carols.ID, "bob"); permission != PermissionEdit {
+		t.Errorf("bob's share of carol's document is %q, want edit", permission)
+	}
+	if rowsOf(t, `SELECT COUNT(*) FROM document_permissions WHERE username = ?`, "bob") != 1 {
+		t.Error("bob kept a share of a document of their own")
+	}
+	// Both reacted alike: the reaction counts once
+	if counts, err := GetReactionCounts([]int64{mine}, "bob"); err != nil || len(counts[mine]) != 1 || counts[mine][0].Count != 1 {
+		t.Errorf("the reactions are %+v, %v", counts[mine], err)
+	}
+	if left := leftUnder(t, "bobby"); left != 0 {
+		t.Errorf("%d rows are still stored under the merged account", left)
+	}
+	if exists, _ := UserExists("bobby"); exists {
+		t.Error("the merged account still exists")
+	}
+	if ok, _ := ValidateUser("bob", "secret1"); !ok {
+		t.Error("bob can't log in any more")
+	}
+}
+
+func TestMergeUsersConflicts(t *testing.T) {
+	setupTest(t)
+	createTestUser(t, "bob")
+	saveTestMessage(t, "bob", "hello")
+
+	if err := MergeUsers("bob", "bob"); !errors.Is(err, errSameAccount) {
+		t.Errorf("merging into itself = %v, want errSameAccount", err)
+	}
+	if err := MergeUsers("bob", "robert"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("merging into a missing user = %v, want errUserNotFound", err)
+	}
+	if exists, _ := UserExists("bob"); !exists || rowsOf(t, `SELECT COUNT(*) FROM messages WHERE username = ?`, "bob") != 1 {
+		t.Error("a refused merge changed the source account")
+	}
+	if err := MergeUsers("bobby", "bob"); !errors.Is(err, errUserNotFound) {
+		t.Errorf("merging a missing user = %v, want errUserNotFound", err)
+	}
+}
+
+func TestAdminRenameAndMergeRequests(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	admin := createTestUser(t, "root")
+	alice := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		token   string
+		body    map[string]string
+		want    int
+	}{
+		{"not an admin", HandleAdminRename(hub), alice, map[string]string{"username": "bob", "newUsername": "robert"}, http.StatusForbidden},
+		{"taken name", HandleAdminRename(hub), admin, map[string]string{"username": "alice", "newUsername": "bob"}, http.StatusConflict},
+		{"missing user", HandleAdminRename(hub), admin, map[string]string{"username": "carol", "newUsername": "caroline"}, http.StatusNotFound},
+		{"reserved name", HandleAdminRename(hub), admin, map[string]string{"username": "alice", "newUsername": "System"}, http.StatusBadRequest},
+		{"no new name", HandleAdminRename(hub), admin, map[string]string{"username": "alice"}, http.StatusBadRequest},
+		{"merge not as admin", HandleAdminMerge(hub), alice, map[string]string{"source": "bob", "target": "alice"}, http.StatusForbidden},
+		{"merge into itself", HandleAdminMerge(hub), admin, map[string]string{"source": "bob", "target": "bob"}, http.StatusBadRequest},
+		{"merge a missing user", HandleAdminMerge(hub), admin, map[string]string{"source": "carol", "target": "bob"}, http.StatusNotFound},
+	} {
+		if w := callHandler(t, tc.handler, "POST", "/admin/users", tc.token, tc.body); w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
+
+func TestAdminRenameClosesConnections(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	admin := createTestUser(t, "root")
+	conn := dial(t, server, createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+
+	w := callHandler(t, HandleAdminRename(hub), "POST", "/admin/users/rename", admin, map[string]string{"username": "alice", "newUsername": "alicia"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("rename: status %d: %s", w.Code, w.Body)
+	}
+	closeErr, _ := conn.expectClose()
+	if closeErr.Code != CloseAccountRemoved || !strings.Contains(closeErr.Text, "alicia") {
+		t.Errorf("close = %d %q, want %d naming the new name", closeErr.Code, closeErr.Text, CloseAccountRemoved)
+	}
+}
+
+func TestAdminMergeClosesConnections(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	admin := createTestUser(t, "root")
+	createTestUser(t, "bob")
+	conn := dial(t, server, createTestUser(t, "bobby"), nil)
+	conn.expect(Session)
+
+	w := callHandler(t, HandleAdminMerge(hub), "POST", "/admin/users/merge", admin, map[string]string{"source": "bobby", "target": "bob"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: status %d: %s", w.Code, w.Body)
+	}
+	closeErr, _ := conn.expectClose()
+	if closeErr.Code != CloseAccountRemoved {
+		t.Errorf("close code = %d, want %d", closeErr.Code, CloseAccountRemoved)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+)
+
+// Roles of registered users. Other roles (e.g. "moderator") can be assigned
+// by setting the role column of the users table.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// GetUserRole returns the role of a registered user. Users listed in
+// ADMIN_USERS are admins whatever the database says.
+func GetUserRole(username string) (string, error) {
+	if contains(config.AdminUsers, username) {
+		return RoleAdmin, nil
+	}
+
+	var role string
+	err := db.QueryRow(`SELECT role FROM users WHERE username = ?`, username).Scan(&role)
+	if err == sql.ErrNoRows {
+		return RoleUser, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
+// roleOf returns the role of a connecting user, falling back to RoleUser
+// when it can't be looked up
+func roleOf(username string, guest bool) string {
+	if guest {
+		return RoleGuest
+	}
+	role, err := GetUserRole(username)
+	if err != nil {
+		log.Printf("Error getting role of %s: %v", username, err)
+		return RoleUser
+	}
+	return role
+}
+
+// handleRoleMessage sends a message to the users holding a role, e.g. an
+// announcement to all moderators. Only admins may address a role.
+func (c *Client) handleRoleMessage(msg Msg, hub *Hub) {
+	if c.Role != RoleAdmin {
+		c.sendError("Only admins can send messages to a role")
+		return
+	}
+	msg.Role = strings.TrimSpace(msg.Role)
+	if msg.Role == "" || strings.TrimSpace(msg.Content) == "" {
+		c.sendError("Role messages need a role and some content")
+		return
+	}
+
+	msg.From = c.Username
+	msg.IsSystem = false
+	log.Printf("Received message from %s to role %s: %s", c.Username, msg.Role, msg.Content)
+	hub.RoleMessages <- msg
+}
+
+// sendToRole delivers a role message to the chat connections of users with
+// its Role, and to the sender's own connections. Role messages are not
+// stored, so users outside the role can't come across them in history or
+// search either.
+func (h *Hub) sendToRole(msg Msg) {
+	for client := range h.Clients {
+		if !client.InChat || (client.Role != msg.Role && client.Username != msg.From) {
+			continue
+		}
+		select {
+		case client.Send <- msg:
+		default:
+			log.Printf("Failed to send message for role %s to %s", msg.Role, client.Username)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestRoleMessages(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	rootToken := createTestUser(t, "root")
+	modToken := createTestUser(t, "mod")
+	aliceToken := createTestUser(t, "alice")
+	if _, err := db.Exec(`UPDATE users SET role = 'moderator' WHERE username = 'mod'`); err != nil {
+		t.Fatal(err)
+	}
+	root := dial(t, server, rootToken, nil)
+	mod := dial(t, server, modToken, nil)
+	alice := dial(t, server, aliceToken, nil)
+	eventually(t, "everyone to connect", func() bool { return hub.LoadStatus().Connections.Total == 3 })
+
+	root.send(Msg{Type: RoleMessage, Role: "moderator", Content: "spam wave incoming"})
+	for _, conn := range []*testConn{mod, root} {
+		if got := conn.expect(RoleMessage); got.Content != "spam wave incoming" || got.From != "root" || got.Role != "moderator" {
+			t.Errorf("delivered %+v", got)
+		}
+	}
+
+	// Alice's next message is the one after, not the role message
+	root.send(Msg{Type: PublicMessage, Content: "all good here"})
+	for {
+		msg, err := alice.read()
+		if err != nil {
+			t.Fatalf("reading alice's messages: %v", err)
+		}
+		if msg.Type == RoleMessage || msg.Content == "spam wave incoming" {
+			t.Fatalf("alice saw the moderators' message: %+v", msg)
+		}
+		if msg.Type == PublicMessage && msg.Content == "all good here" {
+			break
+		}
+	}
+	// Nor does it turn up in history or search later
+	if history := lobbyHistory(t); len(history) != 1 || history[0].Content != "all good here" {
+		t.Errorf("the lobby history holds %+v", history)
+	}
+	if ids := searchIDs(t, "spam"); len(ids) != 0 {
+		t.Errorf("searching finds the role message: %v", ids)
+	}
+
+	alice.send(Msg{Type: RoleMessage, Role: "moderator", Content: "hi mods"})
+	if got := alice.expect(ErrorMessage); got.Content != "Only admins can send messages to a role" {
+		t.Errorf("a user addressing a role was answered with %q", got.Content)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxRoomNameLength is the longest room name accepted, in characters
+const maxRoomNameLength = 64
+
+// Member statuses reported in room rosters and the user list
+const (
+	StatusOnline  = "online"
+	StatusEditing = "editing" // At least one of the user's connections has a document open
+	StatusAway    = "away"    // Disconnected within RECONNECT_GRACE, only in the user list
+)
+
+// RoomMember describes one user in a room's roster or the user list
+type RoomMember struct {
+	Username string `json:"username"`
+	Color    string `json:"color"`
+	Status   string `json:"status"`
+}
+
+// roomRequest asks the hub to add a client to a room or remove it from one
+type roomRequest struct {
+	Client *Client
+	Room   string
+}
+
+// roomRosterRequest asks the hub for a room's members on behalf of Client.
+// Reply receives nil when Client isn't in the room.
+type roomRosterRequest struct {
+	Client *Client
+	Room   string
+	Reply  chan []RoomMember
+}
+
+// userRoomsRequest asks the hub which rooms a user is in
+type userRoomsRequest struct {
+	Username string
+	Reply    chan []string
+}
+
+// validRoomName reports whether name can be used as a room name
+func validRoomName(name string) bool {
+	if name == "" || name != strings.TrimSpace(name) || utf8.RuneCountInString(name) > maxRoomNameLength {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// joinRoom adds a chat client to a room, replays the room's recent history
+// and the user's read position to it and sends the updated roster to every
+// member.
+func (h *Hub) joinRoom(client *Client, room string) {
+	// The client may have disconnected in the meantime
+	if !h.Clients[client] {
+		return
+	}
+
+	// Users may only be in so many rooms at once, across their connections
+	if config.MaxRoomsPerUser > 0 && !h.inRoom(client.Username, room) && h.roomCount(client.Username) >= config.MaxRoomsPerUser {
+		h.sendError(client, fmt.Sprintf("You can be in at most %d rooms at a time, leave one first", config.MaxRoomsPerUser))
+		return
+	}
+
+	if h.Rooms[room] == nil {
+		h.Rooms[room] = make(map[*Client]bool)
+	}
+	if !h.Rooms[room][client] {
+		h.Rooms[room][client] = true
+		log.Printf("%s joined room %s", client.Username, room)
+
+		if !config.ChatPersistence {
+			// Messages aren't stored, there is no history to replay
+		} else if h.degraded.Load() {
+			log.Printf("Skipping history of room %s for %s while degraded", room, client.Username)
+		} else if history, err := GetRoomHistory(room, 0, config.HistoryPageSize, client.Username); err != nil {
+			log.Printf("Failed to get history of room %s: %v", room, err)
+		} else {
+			for _, msg := range history.Messages {
+				select {
+				case client.Send <- msg:
+				default:
+					log.Printf("Failed to send room history to %s", client.Username)
+				}
+			}
+			select {
+			case client.Send <- historyInfo(room, history):
+			default:
+				log.Printf("Failed to send history info of room %s to %s", room, client.Username)
+			}
+		}
+
+		lastRead, err := GetLastRead(client.Username, room, "")
+		if err != nil {
+			log.Printf("Failed to get read position of %s in room %s: %v", client.Username, room, err)
+		} else {
+			position := ReadPosition{Room: room, MessageID: lastRead}
+			select {
+			case client.Send <- Msg{Type: LastRead, Room: room, ReadPositions: []ReadPosition{position}, Time: time.Now()}:
+			default:
+			}
+		}
+	}
+
+	h.sendRoomMembers(room)
+	h.refreshRoomPresence(room)
+}
+
+// leaveRoom removes a client from a room and sends the updated roster to
+// the remaining members. It never writes to the leaving client, whose Send
+// channel may already be closed.
+func (h *Hub) leaveRoom(client *Client, room string) {
+	members, ok := h.Rooms[room]
+	if !ok || !members[client] {
+		return
+	}
+	delete(members, client)
+	log.Printf("%s left room %s", client.Username, room)
+
+	if len(members) == 0 {
+		delete(h.Rooms, room)
+		return
+	}
+	h.sendRoomMembers(room)
+	h.refreshRoomPresence(room)
+}
+
+// leaveAllRooms removes a disconnecting client from every room it is in
+func (h *Hub) leaveAllRooms(client *Client) {
+	for room, members := range h.Rooms {
+		if members[client] {
+			h.leaveRoom(client, room)
+		}
+	}
+}
+
+// roomMembers lists the users in a room, once per user however many of
+// their connections joined it
+func (h *Hub) roomMembers(room string) []RoomMember {
+	seen := make(map[string]bool)
+	var members []RoomMember
+	for client := range h.Rooms[room] {
+		if seen[client.Username] {
+			continue
+		}
+		seen[client.Username] = true
+
+		status := StatusOnline
+		for c := range h.Clients {
+			if c.Username == client.Username && c.CurrentDocumentID != "" {
+				status = StatusEditing
+				break
+			}
+		}
+
+		members = append(members, RoomMember{
+			Username: client.Username,
+			Color:    generateUserColor(client.Username),
+			Status:   status,
+		})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	return members
+}
+
+// inRoom reports whether any of the user's connections is in the room
+func (h *Hub) inRoom(username, room string) bool {
+	for client := range h.Rooms[room] {
+		if client.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// userRooms lists the rooms any of the user's connections is in
+func (h *Hub) userRooms(username string) []string {
+	var rooms []string
+	for room := range h.Rooms {
+		if h.inRoom(username, room) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// roomsOf lists the rooms a client is in
+func (h *Hub) roomsOf(client *Client) []string {
+	var rooms []string
+	for room, members := range h.Rooms {
+		if members[client] {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// inAnyRoom reports whether a client is in one of rooms
+func (h *Hub) inAnyRoom(client *Client, rooms []string) bool {
+	for _, room := range rooms {
+		if h.Rooms[room][client] {
+			return true
+		}
+	}
+	return false
+}
+
+// roomCount returns how many rooms any of the user's connections is in
+func (h *Hub) roomCount(username string) int {
+	count := 0
+	for room := range h.Rooms {
+		if h.inRoom(username, room) {
+			count++
+		}
+	}
+	return count
+}
+
+// sendRoomMembers delivers a room's roster to all of its members
+func (h *Hub) sendRoomMembers(room string) {
+	update := Msg{
+		Type:    RoomMembers,
+		Room:    room,
+		Members: h.roomMembers(room),
+		Time:    time.Now(),
+	}
+	for client := range h.Rooms[room] {
+		select {
+		case client.Send <- update:
+		default:
+			log.Printf("Failed to send members of room %s to %s", room, client.Username)
+		}
+	}
+}
+
+// RoomMembers returns the roster of a room as seen by client. The second
+// result is false when the client is not in the room, so that rooms can't
+// be enumerated from outside. It is safe to call from outside Run.
+func (h *Hub) RoomMembers(client *Client, room string) ([]RoomMember, bool) {
+	reply := make(chan []RoomMember, 1)
+	h.RoomRoster <- roomRosterRequest{Client: client, Room: room, Reply: reply}
+	members := <-reply
+	return members, members != nil
+}
+
+// RoomsOf returns the rooms any of the user's connections is in. It is safe
+// to call from outside Run.
+func (h *Hub) RoomsOf(username string) []string {
+	reply := make(chan []string, 1)
+	h.UserRooms <- userRoomsRequest{Username: username, Reply: reply}
+	return <-reply
+}
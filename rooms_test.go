@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// rosterNames returns the usernames of a room roster, comma-separated
+func rosterNames(members []RoomMember) string {
+	var names []string
+	for _, member := range members {
+		names = append(names, member.Username)
+	}
+	return strings.Join(names, ",")
+}
+
+// joinTestRoom puts a client in a room and waits for it to get the roster
+func joinTestRoom(t *testing.T, hub *Hub, client *Client, room string) {
+	t.Helper()
+	hub.JoinRoom <- roomRequest{Client: client, Room: room}
+	receive(t, client, RoomMembers)
+}
+
+func TestRoomMembership(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	bob := fakeClient("bob", true)
+	carol := fakeClient("carol", true)
+	for _, client := range []*Client{alice, bob, carol} {
+		register(t, hub, client)
+	}
+
+	joinTestRoom(t, hub, alice, "ops")
+	joinTestRoom(t, hub, bob, "ops")
+	if got := rosterNames(receive(t, alice, RoomMembers).Members); got != "alice,bob" {
+		t.Errorf("alice was told the members are %s after bob joined", got)
+	}
+	members, ok := hub.RoomMembers(bob, "ops")
+	if !ok || rosterNames(members) != "alice,bob" {
+		t.Errorf("bob sees members %s (%v)", rosterNames(members), ok)
+	}
+	if members[0].Color != generateUserColor("alice") || members[0].Status != StatusOnline {
+		t.Errorf("alice is listed as %+v", members[0])
+	}
+
+	// Outsiders can't list the room
+	if members, ok := hub.RoomMembers(carol, "ops"); ok || members != nil {
+		t.Errorf("carol, who isn't in the room, sees %v", members)
+	}
+
+	hub.LeaveRoom <- roomRequest{Client: bob, Room: "ops"}
+	if got := rosterNames(receive(t, alice, RoomMembers).Members); got != "alice" {
+		t.Errorf("alice was told the members are %s after bob left", got)
+	}
+
+	joinTestRoom(t, hub, carol, "ops")
+	receive(t, alice, RoomMembers)
+	unregister(t, hub, carol)
+	if got := rosterNames(receive(t, alice, RoomMembers).Members); got != "alice" {
+		t.Errorf("alice was told the members are %s after carol disconnected", got)
+	}
+	if _, ok := hub.RoomMembers(bob, "ops"); ok {
+		t.Error("bob can still list the room after leaving it")
+	}
+}
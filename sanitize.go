@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Ways of handling control and invisible characters in chat messages, set
+// with MESSAGE_CONTROL_CHARS
+const (
+	ControlCharsKeep   = "keep"   // Store messages as sent
+	ControlCharsStrip  = "strip"  // Drop the characters, and ANSI escape sequences as a whole
+	ControlCharsEscape = "escape" // Replace each character with a visible \uXXXX escape
+)
+
+// checkControlChars reports an unknown MESSAGE_CONTROL_CHARS
+func (c *Config) checkControlChars(p *configProblems) {
+	switch c.MessageControlChars {
+	case ControlCharsKeep, ControlCharsStrip, ControlCharsEscape:
+	default:
+		p.add("Invalid MESSAGE_CONTROL_CHARS %q, expected keep, strip or escape", c.MessageControlChars)
+	}
+}
+
+// isJoiner reports whether r is a zero-width joiner or non-joiner, which
+// are legitimate inside emoji sequences and some scripts
+func isJoiner(r rune) bool {
+	return r == '\u200C' || r == '\u200D'
+}
+
+// isEmojiTag reports whether r is a tag character, used after a black flag
+// to spell out subdivision flags
+func isEmojiTag(r rune) bool {
+	return r >= '\U000E0020' && r <= '\U000E007F'
+}
+
+// joinable reports whether a joiner next to r is doing its job, joining
+// letters, marks or symbols rather than hiding between words
+func joinable(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsSymbol(r)
+}
+
+// unsafeRune reports whether the rune at position i of runes is a control
+// or invisible formatting character that should not reach other users:
+// control characters other than tab, newline and carriage return, and
+// format characters like zero-width spaces, byte order marks and bidi
+// overrides. Joiners between letters or symbols and emoji tags are kept.
+func unsafeRune(runes []rune, i int) bool {
+	r := runes[i]
+	switch {
+	case r == '\t' || r == '\n' || r == '\r':
+		return false
+	case unicode.IsControl(r):
+		return true
+	case !unicode.Is(unicode.Cf, r):
+		return false
+	case isJoiner(r):
+		return i == 0 || i == len(runes)-1 || !joinable(runes[i-1]) || !joinable(runes[i+1])
+	case isEmojiTag(r):
+		return i == 0 || !(unicode.IsSymbol(runes[i-1]) || isEmojiTag(runes[i-1]))
+	}
+	return true
+}
+
+// ansiSequenceLength returns how many runes of the ANSI escape sequence
+// starting at runes[0], an ESC, to drop: the whole of a CSI (ESC [) or OSC
+// (ESC ]) sequence, or the ESC and the character after it
+func ansiSequenceLength(runes []rune) int {
+	if len(runes) < 2 {
+		return len(runes)
+	}
+	switch runes[1] {
+	case '[':
+		// Parameters and intermediates, up to the final byte
+		for i := 2; i < len(runes); i++ {
+			switch {
+			case runes[i] >= 0x40 && runes[i] <= 0x7E:
+				return i + 1
+			case runes[i] < 0x20 || runes[i] > 0x7E:
+				// Malformed, keep what follows
+				return i
+			}
+		}
+		return len(runes)
+	case ']':
+		// Terminated by BEL or by ESC \
+		for i := 2; i < len(runes); i++ {
+			if runes[i] == '\a' {
+				return i + 1
+			}
+			if runes[i] == 0x1B && i+1 < len(runes) && runes[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(runes)
+	}
+	return 2
+}
+
+// sanitizeControls handles the control and invisible characters in a chat
+// message according to MESSAGE_CONTROL_CHARS. Whitespace and emoji,
+// including their joiners, are left alone. The markers search highlights
+// matches with are removed in any case.
+func sanitizeControls(content string) string {
+	content = matchMarkers.Replace(content)
+	if config.MessageControlChars == ControlCharsKeep {
+		return content
+	}
+	runes := []rune(content)
+	var b strings.Builder
+	for i := 0; i < len(runes); i++ {
+		if !unsafeRune(runes, i) {
+			b.WriteRune(runes[i])
+			continue
+		}
+		if config.MessageControlChars == ControlCharsEscape {
+			fmt.Fprintf(&b, "\\u%04X", runes[i])
+			continue
+		}
+		if runes[i] == 0x1B {
+			i += ansiSequenceLength(runes[i:]) - 1
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestSanitizeControls(t *testing.T) {
+	setupTest(t)
+	config.MessageControlChars = ControlCharsStrip
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"ANSI colour", "\x1b[31mred\x1b[0m alert", "red alert"},
+		{"ANSI title", "\x1b]0;pwned\x07hi", "hi"},
+		{"ANSI title ended by ST", "\x1b]0;pwned\x1b\\hi", "hi"},
+		{"bell and backspace", "ding\a\bdong", "dingdong"},
+		{"zero-width space", "ad\u200Bmin", "admin"},
+		{"bidi override", "file\u202Egnp.exe", "filegnp.exe"},
+		{"byte order mark", "\uFEFFhello", "hello"},
+		{"joiner between words", "a \u200D b", "a  b"},
+		{"whitespace", "line one\n\tline two\r\n", "line one\n\tline two\r\n"},
+		{"emoji with joiners", "👩‍💻 and 👨‍👩‍👧", "👩‍💻 and 👨‍👩‍👧"},
+		{"flag with tags", "🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", "🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F"},
+		{"stray tag", "\U000E0067hi", "hi"},
+	} {
+		if got := sanitizeControls(tc.in); got != tc.want {
+			t.Errorf("%s: sanitizeControls(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+
+	config.MessageControlChars = ControlCharsEscape
+	if got := sanitizeControls("ad\u200Bmin\x1b[0m"); got != `ad\u200Bmin\u001B[0m` {
+		t.Errorf("escaped to %q", got)
+	}
+	config.MessageControlChars = ControlCharsKeep
+	if got := sanitizeControls("ad\u200Bmin"); got != "ad\u200Bmin" {
+		t.Errorf("kept as %q", got)
+	}
+}
+
+func TestControlCharsAreStrippedBeforeStoring(t *testing.T) {
+	setupTest(t)
+	config.MessageControlChars = ControlCharsStrip
+	hub := newTestHub(t)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	drain(bob)
+
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "alice", Content: "\x1b[2Jad\u200Bmin says hi"}
+	got := receive(t, bob, PublicMessage)
+	if got.Content != "admin says hi" {
+		t.Errorf("bob got %q", got.Content)
+	}
+	if stored, err := GetMessage(got.ID); err != nil || stored.Content != "admin says hi" {
+		t.Errorf("the message was stored as %+v, %v", stored, err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Markers that FTS5 puts around matched terms in snippets. They are control
+// characters that sanitizeControls removes from every message, whatever
+// MESSAGE_CONTROL_CHARS says, so that a message can't hold one and throw
+// the highlights off.
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// matchMarkers removes the match markers from text
+var matchMarkers = strings.NewReplacer(matchStart, "", matchEnd, "")
+
+// SearchResult is a message matching a search, with a short excerpt around
+// the match. Highlights holds the [start, end) character offsets of the
+// matched terms within Snippet.
+type SearchResult struct {
+	Message    Msg      `json:"message"`
+	Snippet    string   `json:"snippet"`
+	Highlights [][2]int `json:"highlights"`
+}
+
+// InitSearchTables creates the full-text index over message contents and
+// the triggers keeping it in sync. The index is built from the existing
+// messages the first time.
+func InitSearchTables() error {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name = 'messages_fts')`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	createSearchTable := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+		content,
+		content='messages',
+		content_rowid='id'
+	);
+
+	CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+		INSERT INTO messages_fts(messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO messages_fts(rowid, content) VALUES (new.id, new.content);
+	END;`
+
+	if _, err = db.Exec(createSearchTable); err != nil {
+		return err
+	}
+
+	if !exists {
+		_, err = db.Exec(`INSERT INTO messages_fts(messages_fts) VALUES ('rebuild')`)
+	}
+	return err
+}
+
+// SearchMessages finds the messages matching query that viewer is allowed
+// to see, as visibleTo selects them with the rooms they are in. Results are
+// newest first; before, when non-zero, only returns messages older than
+// that ID.
+func SearchMessages(query, viewer string, rooms []string, before int64, limit int) ([]SearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return nil, nil
+	}
+
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+	visible, visibleArgs := visibleTo("m", viewer, rooms)
+	args := append([]any{matchStart, matchEnd, match}, visibleArgs...)
+	args = append(args, before, limit)
+
+	sqlQuery := `
+		SELECT ` + messageColumns("m") + `, snippet(messages_fts, 0, ?, ?, '…', 16)
+		FROM messages_fts
+		JOIN messages m ON m.id = messages_fts.rowid
+		WHERE messages_fts MATCH ?
+		AND ` + visible + `
+		AND m.id < ?
+		ORDER BY m.id DESC
+		LIMIT ?
+	`
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var stored StoredMessage
+		var snippet string
+		if err := rows.Scan(append(stored.fields(), &snippet)...); err != nil {
+			return nil, err
+		}
+		msg := stored.Msg()
+
+		text, highlights := parseSnippet(snippet)
+		results = append(results, SearchResult{Message: msg, Snippet: text, Highlights: highlights})
+	}
+
+	return results, rows.Err()
+}
+
+// ftsQuery turns free text into an FTS5 query matching messages that
+// contain every word. Words are quoted so that FTS5 operators and
+// punctuation in user input are taken literally.
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// parseSnippet strips the match markers from an FTS5 snippet and returns
+// the character offsets they delimited
+func parseSnippet(snippet string) (string, [][2]int) {
+	var text strings.Builder
+	var highlights [][2]int
+	pos, start := 0, -1
+
+	for _, r := range snippet {
+		switch string(r) {
+		case matchStart:
+			start = pos
+		case matchEnd:
+			if start >= 0 {
+				highlights = append(highlights, [2]int{start, pos})
+				start = -1
+			}
+		default:
+			text.WriteRune(r)
+			pos++
+		}
+	}
+
+	return text.String(), highlights
+}
+
+// normalizeSearchLimit clamps a requested page size
+func normalizeSearchLimit(limit int) int {
+	return clampLimit(limit, config.SearchPageSize, config.SearchMaxPageSize)
+}
+
+// validSearchQuery reports whether a search query is worth running
+func validSearchQuery(query string) bool {
+	return strings.TrimSpace(query) != "" && utf8.RuneCountInString(query) <= 200
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchScoping(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		createTestUser(t, username)
+	}
+	ours, err := CreateConversation("ours", "bob", []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := CreateConversation("theirs", "bob", []string{"carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []Msg{
+		{Type: PublicMessage, Username: "bob", Content: "rollout in the lobby"},
+		{Type: PublicMessage, Username: "bob", Room: "dev", Content: "rollout in dev"},
+		{Type: PublicMessage, Username: "bob", Room: "ops", Content: "rollout in ops"},
+		{Type: PrivateMessage, Username: "bob", From: "bob", To: "alice", Content: "rollout for alice"},
+		{Type: PrivateMessage, Username: "bob", From: "bob", To: "carol", Content: "rollout for carol"},
+		{Type: GroupMessage, Username: "bob", ConversationID: ours.ID, Content: "rollout in our group"},
+		{Type: GroupMessage, Username: "bob", ConversationID: theirs.ID, Content: "rollout in their group"},
+	} {
+		if _, err := SaveMessage(msg); err != nil {
+			t.Fatalf("SaveMessage %q: %v", msg.Content, err)
+		}
+	}
+
+	// Rooms are searchable while alice is in them
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	joinTestRoom(t, hub, alice, "dev")
+
+	// Page through the results two at a time
+	var found []string
+	var before int64
+	for pages := 0; pages < 5; pages++ {
+		alice.handleSearch("rollout", before, 2, hub)
+		response := receive(t, alice, Search)
+		for _, result := range response.Results {
+			found = append(found, result.Message.Content)
+		}
+		if before = response.Before; before == 0 {
+			break
+		}
+	}
+	sort.Strings(found)
+	want := []string{"rollout for alice", "rollout in dev", "rollout in our group", "rollout in the lobby"}
+	if strings.Join(found, "|") != strings.Join(want, "|") {
+		t.Errorf("alice found %q, want %q", found, want)
+	}
+
+	// Her export holds the same messages
+	var exported []string
+	err = ExportMessages("alice", hub.RoomsOf("alice"), time.Time{}, time.Time{}, func(msg Msg) error {
+		exported = append(exported, msg.Content)
+		return nil
+	})
+	sort.Strings(exported)
+	if err != nil || strings.Join(exported, "|") != strings.Join(want, "|") {
+		t.Errorf("alice exported %q, %v, want %q", exported, err, want)
+	}
+}
+
+func TestSearchSnippets(t *testing.T) {
+	setupTest(t)
+	long := strings.Repeat("filler words before ", 10) + "the rollout starts" + strings.Repeat(" and filler words after", 10)
+	saveTestMessage(t, "alice", long)
+	saveTestMessage(t, "alice", "rollout rollback rollout")
+
+	results, err := SearchMessages("rollout", "alice", nil, 0, 10)
+	if err != nil {
+		t.Fatalf("SearchMessages: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("found %d messages, want 2", len(results))
+	}
+	for _, result := range results {
+		if len(result.Highlights) == 0 {
+			t.Errorf("no highlights in %q", result.Snippet)
+		}
+		runes := []rune(result.Snippet)
+		for _, h := range result.Highlights {
+			if got := string(runes[h[0]:h[1]]); got != "rollout" {
+				t.Errorf("highlight %v of %q covers %q", h, result.Snippet, got)
+			}
+		}
+	}
+	if snippet := results[1].Snippet; len(snippet) >= len(long) || !strings.Contains(snippet, "…") {
+		t.Errorf("the long message's snippet is %q, want an excerpt", snippet)
+	}
+	if got := len(results[0].Highlights); got != 2 {
+		t.Errorf("%d matches highlighted in %q, want 2", got, results[0].Snippet)
+	}
+}
+
+// A message holding the snippet markers itself, with control characters
+// kept, is stored without them so its highlights stay right
+func TestSearchMarkersInMessages(t *testing.T) {
+	setupTest(t)
+	config.MessageControlChars = ControlCharsKeep
+	hub := newTestHub(t)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	drain(bob)
+
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "alice", Content: "a" + matchEnd + "b rollout" + matchStart + " \a"}
+	if got := receive(t, bob, PublicMessage); got.Content != "ab rollout \a" {
+		t.Errorf("bob got %q", got.Content)
+	}
+	results, err := SearchMessages("rollout", "alice", nil, 0, 10)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("SearchMessages = %+v, %v", results, err)
+	}
+	if result := results[0]; result.Snippet != "ab rollout \a" || len(result.Highlights) != 1 || result.Highlights[0] != [2]int{3, 10} {
+		t.Errorf("the snippet is %q with highlights %v", result.Snippet, result.Highlights)
+	}
+}
+
+func TestParseSnippet(t *testing.T) {
+	text, highlights := parseSnippet("…née " + matchStart + "résumé" + matchEnd + " here")
+	if text != "…née résumé here" {
+		t.Errorf("text = %q", text)
+	}
+	if len(highlights) != 1 || highlights[0] != [2]int{5, 11} {
+		t.Errorf("highlights = %v, want the character offsets of résumé", highlights)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSessionIDs(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+	laptop := dial(t, server, token, nil)
+	phone := dial(t, server, token, nil)
+	laptopID := laptop.expect(Session).SessionID
+	phoneID := phone.expect(Session).SessionID
+	for _, id := range []string{laptopID, phoneID} {
+		if _, err := uuid.Parse(id); err != nil {
+			t.Errorf("session ID %q isn't a UUID: %v", id, err)
+		}
+	}
+	if laptopID == phoneID {
+		t.Fatal("two connections of one user share a session ID")
+	}
+	listed := map[string]bool{}
+	for _, client := range hub.ConnectedClients() {
+		listed[client.ID] = true
+	}
+	if !listed[laptopID] || !listed[phoneID] {
+		t.Errorf("ConnectedClients lists %v, want both sessions", listed)
+	}
+
+	// A resend is answered on the connection it came from only
+	msg := Msg{Type: PublicMessage, Content: "hello", ClientKey: "key-1"}
+	laptop.send(msg)
+	original := laptop.expect(PublicMessage)
+	if got := phone.expect(PublicMessage); got.ID != original.ID || got.SessionID != laptopID {
+		t.Errorf("the phone got %+v, want the message from the laptop's session", got)
+	}
+	laptop.send(msg)
+	if got := laptop.expect(PublicMessage); !got.Duplicate {
+		t.Errorf("the laptop's resend was answered with %+v", got)
+	}
+	phone.send(Msg{Type: PublicMessage, Content: "from the phone"})
+	if got := phone.expect(PublicMessage); got.Content != "from the phone" || got.Duplicate {
+		t.Errorf("the phone's next message is %+v, want its own, not the duplicate notice", got)
+	}
+}
+
+func TestClientBySession(t *testing.T) {
+	setupTest(t)
+	// Without Run, the hub's state can be set up and checked directly
+	hub := NewHub()
+	laptop := fakeClient("alice", true)
+	phone := fakeClient("alice", true)
+	phone.ID = laptop.ID + "-phone"
+	hub.Clients[laptop] = true
+	hub.Clients[phone] = true
+
+	if got := hub.clientBySession(phone.ID); got != phone {
+		t.Errorf("clientBySession(%s) = %v, want the phone", phone.ID, got)
+	}
+	if got := hub.clientBySession("unknown"); got != nil {
+		t.Errorf("an unknown session found %v", got)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ShareLink lets whoever holds its token open a document with a permission,
+// without the owner sharing it with them by name
+type ShareLink struct {
+	Token      string     `json:"token"`
+	DocumentID string     `json:"documentID"`
+	Permission string     `json:"permission"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	URL        string     `json:"url"` // Path of the editor page that redeems the link
+}
+
+// ShareLinkRequest is the body of POST /documents/links
+type ShareLinkRequest struct {
+	DocumentID string `json:"documentID"`
+	Permission string `json:"permission"` // PermissionRead or PermissionEdit (default)
+	ExpiresIn  int    `json:"expiresIn"`  // Seconds until the link stops working; 0 never
+}
+
+// ShareLinkResponse answers /documents/links
+type ShareLinkResponse struct {
+	Success bool       `json:"success"`
+	Message string     `json:"message,omitempty"`
+	Link    *ShareLink `json:"link,omitempty"`
+}
+
+// InitShareLinkTables creates the document_share_links table
+func InitShareLinkTables() error {
+	createLinksTable := `
+	CREATE TABLE IF NOT EXISTS document_share_links (
+		token TEXT PRIMARY KEY,
+		document_id TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS idx_document_share_links_document ON document_share_links(document_id);`
+
+	_, err := db.Exec(createLinksTable)
+	return err
+}
+
+// newShareToken returns a random, unguessable link token
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateShareLink stores a new link to a document. A nil expiresAt makes a
+// link that works until it is revoked.
+func CreateShareLink(docID, permission, username string, expiresAt *time.Time) (*ShareLink, error) {
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &ShareLink{
+		Token:      token,
+		DocumentID: docID,
+		Permission: permission,
+		CreatedBy:  username,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+		URL:        "/editor?share=" + token,
+	}
+
+	query := `
+		INSERT INTO document_share_links (token, document_id, permission, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err = db.Exec(query, link.Token, link.DocumentID, link.Permission, link.CreatedBy, link.CreatedAt, link.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// GetShareLink returns the link with the given token, or nil when there is
+// none or it has expired
+func GetShareLink(token string) (*ShareLink, error) {
+	query := `
+		SELECT token, document_id, permission, created_by, created_at, expires_at
+		FROM document_share_links
+		WHERE token = ? AND (expires_at IS NULL OR expires_at > ?)
+	`
+
+	var link ShareLink
+	var expiresAt sql.NullTime
+	err := db.QueryRow(query, token, time.Now()).Scan(&link.Token, &link.DocumentID, &link.Permission, &link.CreatedBy, &link.CreatedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+	link.URL = "/editor?share=" + link.Token
+	return &link, nil
+}
+
+// RevokeShareLink deletes a link, along with the permissions redeemed from
+// it. It reports false when there was no such link on the document.
+func RevokeShareLink(docID, token string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM document_share_links WHERE token = ? AND document_id = ?`, token, docID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM document_permissions WHERE link_token = ? AND document_id = ?`, token, docID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RedeemShareLink grants the user the link's permission on its document,
+// never lowering a permission they already have. It returns the permission
+// the user ends up with. A permission granted here lasts as long as the
+// link does.
+func RedeemShareLink(link *ShareLink, username string) (string, error) {
+	current, err := GetDocumentPermission(link.DocumentID, username)
+	if err != nil {
+		return "", err
+	}
+	if current == PermissionEdit || current == link.Permission {
+		return current, nil
+	}
+	if err := grantDocumentPermission(link.DocumentID, username, link.Permission, link.Token); err != nil {
+		return "", err
+	}
+	return link.Permission, nil
+}
+
+// HandleShareLinks creates (POST) and revokes (DELETE, with documentID and
+// token query parameters) share links for the owner of a document
+func HandleShareLinks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, resp ShareLinkResponse) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+	}
+
+	claims, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		reply(http.StatusUnauthorized, ShareLinkResponse{Message: "Invalid or expired token"})
+		return
+	}
+	if claims.Role == RoleGuest {
+		reply(http.StatusForbidden, ShareLinkResponse{Message: "Guests are not allowed to do this, please register"})
+		return
+	}
+
+	var req ShareLinkRequest
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			reply(http.StatusBadRequest, ShareLinkResponse{Message: "Invalid request body"})
+			return
+		}
+	} else {
+		req.DocumentID = r.URL.Query().Get("documentID")
+	}
+
+	doc, err := GetDocument(req.DocumentID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", req.DocumentID, err)
+		reply(http.StatusInternalServerError, ShareLinkResponse{Message: "Failed to load document"})
+		return
+	}
+	if doc == nil {
+		reply(http.StatusNotFound, ShareLinkResponse{Message: "Document not found"})
+		return
+	}
+	if doc.CreatedBy != claims.Username {
+		reply(http.StatusForbidden, ShareLinkResponse{Message: "Only the owner can share this document"})
+		return
+	}
+
+	if r.Method == "DELETE" {
+		revoked, err := RevokeShareLink(doc.ID, r.URL.Query().Get("token"))
+		if err != nil {
+			log.Printf("Error revoking share link on %s: %v", doc.ID, err)
+			reply(http.StatusInternalServerError, ShareLinkResponse{Message: "Failed to revoke link"})
+			return
+		}
+		if !revoked {
+			reply(http.StatusNotFound, ShareLinkResponse{Message: "Link not found"})
+			return
+		}
+		log.Printf("%s revoked a share link on document %s", claims.Username, doc.Name)
+		reply(http.StatusOK, ShareLinkResponse{Success: true, Message: "Link revoked"})
+		return
+	}
+
+	if req.Permission == "" {
+		req.Permission = PermissionEdit
+	}
+	if req.Permission != PermissionRead && req.Permission != PermissionEdit {
+		reply(http.StatusBadRequest, ShareLinkResponse{Message: "Unknown permission '" + req.Permission + "'"})
+		return
+	}
+	if req.ExpiresIn < 0 {
+		reply(http.StatusBadRequest, ShareLinkResponse{Message: "expiresIn can't be negative"})
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		expiresAt = &t
+	}
+
+	link, err := CreateShareLink(doc.ID, req.Permission, claims.Username, expiresAt)
+	if err != nil {
+		log.Printf("Error creating share link on %s: %v", doc.ID, err)
+		reply(http.StatusInternalServerError, ShareLinkResponse{Message: "Failed to create link"})
+		return
+	}
+
+	log.Printf("%s created a %s link to document %s", claims.Username, link.Permission, doc.Name)
+	RecordDocumentEvent(doc.ID, claims.Username, EventShare, "link:"+link.Permission)
+	reply(http.StatusOK, ShareLinkResponse{Success: true, Link: link})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// shareLinkRequest calls /documents/links and decodes the answer
+func shareLinkRequest(t *testing.T, method, target, token string, body any) (int, ShareLinkResponse) {
+	t.Helper()
+	w := callHandler(t, HandleShareLinks, method, target, token, body)
+	var resp ShareLinkResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding the share link response: %v", err)
+	}
+	return w.Code, resp
+}
+
+// openWithLink opens a document through a share link and returns what the
+// client was sent first: the content or an error
+func openWithLink(t *testing.T, hub *Hub, username, token string) Msg {
+	t.Helper()
+	client := fakeClient(username, false)
+	register(t, hub, client)
+	drain(client)
+	client.handleDocumentOpen("", token, hub)
+	for {
+		msg := receive(t, client, "")
+		if msg.Type == DocContent || msg.Type == ErrorMessage {
+			return msg
+		}
+	}
+}
+
+// openByID opens a document by its ID, without a share link, and returns
+// what the client was sent first: the content or an error
+func openByID(t *testing.T, hub *Hub, username, docID string) Msg {
+	t.Helper()
+	client := fakeClient(username, false)
+	register(t, hub, client)
+	drain(client)
+	client.handleDocumentOpen(docID, "", hub)
+	for {
+		msg := receive(t, client, "")
+		if msg.Type == DocContent || msg.Type == ErrorMessage {
+			return msg
+		}
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	aliceToken := createTestUser(t, "alice")
+	bobToken := createTestUser(t, "bob")
+	doc := createTestDocument(t, "plan.txt", "alice")
+
+	if code, _ := shareLinkRequest(t, "POST", "/documents/links", bobToken, ShareLinkRequest{DocumentID: doc.ID}); code != http.StatusForbidden {
+		t.Errorf("bob sharing alice's document = %d, want 403", code)
+	}
+	if code, _ := shareLinkRequest(t, "POST", "/documents/links", aliceToken, ShareLinkRequest{DocumentID: doc.ID, Permission: "own"}); code != http.StatusBadRequest {
+		t.Errorf("sharing with an unknown permission = %d, want 400", code)
+	}
+	code, readLink := shareLinkRequest(t, "POST", "/documents/links", aliceToken, ShareLinkRequest{DocumentID: doc.ID, Permission: PermissionRead})
+	if code != http.StatusOK || readLink.Link == nil || readLink.Link.Token == "" {
+		t.Fatalf("creating a read link = %d %+v", code, readLink)
+	}
+	_, editLink := shareLinkRequest(t, "POST", "/documents/links", aliceToken, ShareLinkRequest{DocumentID: doc.ID})
+	if editLink.Link == nil || editLink.Link.Permission != PermissionEdit || editLink.Link.Token == readLink.Link.Token {
+		t.Fatalf("creating a default link gave %+v", editLink.Link)
+	}
+
+	if msg := openWithLink(t, hub, "bob", readLink.Link.Token); msg.Type != DocContent || msg.DocumentID != doc.ID || !msg.ReadOnly {
+		t.Errorf("opening with the read link gave %+v, want the document read-only", msg)
+	}
+	if permission, err := GetDocumentPermission(doc.ID, "bob"); err != nil || permission != PermissionRead {
+		t.Errorf("bob kept permission %q, %v, want read", permission, err)
+	}
+	if msg := openWithLink(t, hub, "carol", editLink.Link.Token); msg.Type != DocContent || msg.ReadOnly {
+		t.Errorf("opening with the edit link gave %+v, want the document editable", msg)
+	}
+	// A read link doesn't take away the edit permission carol got before
+	openWithLink(t, hub, "carol", readLink.Link.Token)
+	if permission, _ := GetDocumentPermission(doc.ID, "carol"); permission != PermissionEdit {
+		t.Errorf("carol's permission dropped to %q", permission)
+	}
+
+	revoke := "/documents/links?" + url.Values{"documentID": {doc.ID}, "token": {readLink.Link.Token}}.Encode()
+	if code, _ := shareLinkRequest(t, "DELETE", revoke, bobToken, nil); code != http.StatusForbidden {
+		t.Errorf("bob revoking alice's link = %d, want 403", code)
+	}
+	if code, resp := shareLinkRequest(t, "DELETE", revoke, aliceToken, nil); code != http.StatusOK || !resp.Success {
+		t.Fatalf("revoking the read link = %d %+v", code, resp)
+	}
+	if code, _ := shareLinkRequest(t, "DELETE", revoke, aliceToken, nil); code != http.StatusNotFound {
+		t.Errorf("revoking the link again = %d, want 404", code)
+	}
+	if msg := openWithLink(t, hub, "dave", readLink.Link.Token); msg.Content != "This share link is invalid or has expired" {
+		t.Errorf("opening with a revoked link gave %+v", msg)
+	}
+}
+
+func TestExpiredShareLink(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "plan.txt", "alice")
+	other := createTestDocument(t, "other.txt", "alice")
+	past := time.Now().Add(-time.Second)
+	expired, err := CreateShareLink(doc.ID, PermissionEdit, "alice", &past)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := GetShareLink(expired.Token); link != nil || err != nil {
+		t.Errorf("GetShareLink of an expired link = %+v, %v", link, err)
+	}
+	if msg := openWithLink(t, hub, "bob", expired.Token); msg.Content != "This share link is invalid or has expired" {
+		t.Errorf("opening with an expired link gave %+v", msg)
+	}
+
+	// A link only opens its own document
+	link, err := CreateShareLink(doc.ID, PermissionEdit, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := fakeClient("bob", false)
+	register(t, hub, bob)
+	bob.handleDocumentOpen(other.ID, link.Token, hub)
+	if msg := receive(t, bob, ErrorMessage); msg.Content != "This share link is invalid or has expired" {
+		t.Errorf("opening another document with the link gave %q", msg.Content)
+	}
+}
+
+// Read access holds however the document is opened, and access redeemed
+// from a link ends with the link
+func TestReadGrantsStayReadOnly(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	doc := createTestDocument(t, "plan.txt", "alice")
+	readLink, err := CreateShareLink(doc.ID, PermissionRead, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editLink, err := CreateShareLink(doc.ID, PermissionEdit, "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := openWithLink(t, hub, "bob", readLink.Token); !msg.ReadOnly {
+		t.Fatalf("opening with the read link gave %+v", msg)
+	}
+	if msg := openByID(t, hub, "bob", doc.ID); msg.Type != DocContent || !msg.ReadOnly {
+		t.Errorf("bob reopening the document without the link got %+v, want it read-only", msg)
+	}
+	if err := GrantDocumentPermission(doc.ID, "erin", PermissionRead); err != nil {
+		t.Fatal(err)
+	}
+	if msg := openByID(t, hub, "erin", doc.ID); msg.Type != DocContent || !msg.ReadOnly {
+		t.Errorf("erin, shared the document to read, got %+v", msg)
+	}
+	if msg := openByID(t, hub, "alice", doc.ID); msg.ReadOnly {
+		t.Error("the owner opened her document read-only")
+	}
+
+	// carol redeems the edit link, then is shared the document by name
+	openWithLink(t, hub, "carol", editLink.Token)
+	if err := GrantDocumentPermission(doc.ID, "carol", PermissionRead); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{readLink.Token, editLink.Token} {
+		if revoked, err := RevokeShareLink(doc.ID, token); !revoked || err != nil {
+			t.Fatalf("RevokeShareLink = %v, %v", revoked, err)
+		}
+	}
+	for username, want := range map[string]string{"bob": "", "erin": PermissionRead, "carol": PermissionRead} {
+		if permission, err := GetDocumentPermission(doc.ID, username); err != nil || permission != want {
+			t.Errorf("after the links were revoked, %s has permission %q, %v, want %q", username, permission, err, want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Categories of events streamed at /events. Event types are a category and
+// what happened, like user.joined or document.update; document events are
+// named after the operations of the document event log.
+const (
+	StreamUser     = "user"     // user.joined, user.left
+	StreamMessage  = "message"  // message.posted
+	StreamDocument = "document" // document.create, document.update, document.rename, ...
+)
+
+// streamQueueSize bounds how many events may wait for a slow stream before
+// newer ones are dropped
+const streamQueueSize = 256
+
+// checkEventStream reports a heartbeat that can't be scheduled
+func (c *Config) checkEventStream(p *configProblems) {
+	if c.SSEHeartbeat <= 0 {
+		p.add("SSE_HEARTBEAT must be positive, got %d", c.SSEHeartbeat)
+	}
+}
+
+// eventStream is one client reading /events. Types holds the event types or
+// categories it asked for, empty for all of them.
+type eventStream struct {
+	Types      []string
+	DocumentID string
+	Events     chan WebhookEvent
+}
+
+// wants reports whether the stream asked for events of the given type
+func (s *eventStream) wants(event WebhookEvent) bool {
+	if s.DocumentID != "" {
+		doc, ok := event.Data.(DocumentEvent)
+		if !ok || doc.DocumentID != s.DocumentID {
+			return false
+		}
+	}
+	if len(s.Types) == 0 {
+		return true
+	}
+	category, _, _ := strings.Cut(event.Type, ".")
+	return contains(s.Types, event.Type) || contains(s.Types, category)
+}
+
+// The streams are owned by RunEventStreams; these channels are its inputs
+var (
+	streamEvents      = make(chan WebhookEvent, 1024)
+	streamSubscribe   = make(chan *eventStream)
+	streamUnsubscribe = make(chan *eventStream)
+)
+
+// publishEvent hands an event to the open streams. If the dispatcher has
+// fallen behind, the event is dropped rather than stalling the caller.
+func publishEvent(eventType string, data interface{}) {
+	select {
+	case streamEvents <- WebhookEvent{Type: eventType, Time: time.Now(), Data: data}:
+	default:
+		log.Printf("Event stream queue full, dropping %s event", eventType)
+	}
+}
+
+// RunEventStreams passes published events on to the streams that asked for
+// them. It runs in its own goroutine.
+func RunEventStreams() {
+	streams := make(map[*eventStream]bool)
+	for {
+		select {
+		case stream := <-streamSubscribe:
+			streams[stream] = true
+
+		case stream := <-streamUnsubscribe:
+			delete(streams, stream)
+
+		case event := <-streamEvents:
+			for stream := range streams {
+				if !stream.wants(event) {
+					continue
+				}
+				select {
+				case stream.Events <- event:
+				default:
+					log.Printf("Event stream fell behind, dropping %s event", event.Type)
+				}
+			}
+		}
+	}
+}
+
+// streamViewer decides which of the events a stream asked for its user may
+// see. Admins see everything. Others see user events only when
+// USER_DIRECTORY is "all", messages posted in the lobby, and the events of
+// documents they own or that are shared with them.
+type streamViewer struct {
+	Username  string
+	Admin     bool
+	documents map[string]bool // Whether the user may read each document seen so far
+}
+
+// mayRead reports whether the viewer may see an event
+func (v *streamViewer) mayRead(event WebhookEvent) bool {
+	if v.Admin {
+		return true
+	}
+	switch data := event.Data.(type) {
+	case webhookUser:
+		return config.UserDirectoryPolicy == DirectoryAll
+	case webhookMessage:
+		return data.Room == ""
+	case DocumentEvent:
+		return v.mayReadDocument(data.DocumentID)
+	}
+	return false
+}
+
+// mayReadDocument reports whether the viewer owns a document or had it
+// shared with them. The answer is remembered for the rest of the stream, so
+// the database is asked once per document.
+func (v *streamViewer) mayReadDocument(docID string) bool {
+	if allowed, ok := v.documents[docID]; ok {
+		return allowed
+	}
+	allowed := false
+	doc, err := GetDocument(docID)
+	if err != nil {
+		log.Printf("Error getting document %s: %v", docID, err)
+		return false
+	}
+	if doc != nil && doc.CreatedBy == v.Username {
+		allowed = true
+	} else if doc != nil {
+		permission, err := GetDocumentPermission(docID, v.Username)
+		if err != nil {
+			log.Printf("Error getting permission on %s: %v", docID, err)
+			return false
+		}
+		allowed = permission != ""
+	}
+	v.documents[docID] = allowed
+	return allowed
+}
+
+// HandleEventStream streams server events as Server-Sent Events (GET), for
+// dashboards that only watch. The types query parameter takes
+// comma-separated event types or categories (user, message, document), and
+// documentID restricts the stream to one document's events. A comment line
+// is sent every SSE_HEARTBEAT seconds to keep proxies from closing an idle
+// stream, and the stream ends when the token expires.
+//
+// The token is looked for like on WebSocket upgrades, so that EventSource,
+// which can't set headers, can pass it in the query or the cookie. Unlike
+// there, the cookie needs no Origin check: reading the stream from another
+// origin would need CORS headers, which aren't sent, and it changes nothing.
+func HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _ := requestToken(r)
+	claims, err := ValidateToken(token)
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return
+	}
+	if claims.Role == RoleGuest && !config.GuestAccess {
+		http.Error(w, "Unauthorized: Guest access is disabled", http.StatusUnauthorized)
+		return
+	}
+
+	types := splitList(r.URL.Query().Get("types"))
+	for _, eventType := range types {
+		category, _, _ := strings.Cut(eventType, ".")
+		if category != StreamUser && category != StreamMessage && category != StreamDocument {
+			http.Error(w, fmt.Sprintf("Unknown event type %q", eventType), http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	viewer := &streamViewer{
+		Username:  claims.Username,
+		Admin:     roleOf(claims.Username, claims.Role == RoleGuest) == RoleAdmin,
+		documents: make(map[string]bool),
+	}
+	stream := &eventStream{
+		Types:      types,
+		DocumentID: r.URL.Query().Get("documentID"),
+		Events:     make(chan WebhookEvent, streamQueueSize),
+	}
+	streamSubscribe <- stream
+	defer func() { streamUnsubscribe <- stream }()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	log.Printf("%s opened an event stream", claims.Username)
+
+	heartbeat := time.NewTicker(time.Duration(config.SSEHeartbeat) * time.Second)
+	defer heartbeat.Stop()
+	var expired <-chan time.Time
+	if claims.ExpiresAt != nil {
+		timer := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var id int64
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("%s closed their event stream", claims.Username)
+			return
+
+		case <-expired:
+			fmt.Fprint(w, "event: token-expired\ndata: {}\n\n")
+			flusher.Flush()
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+
+		case event := <-stream.Events:
+			if !viewer.mayRead(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode %s event: %v", event.Type, err)
+				continue
+			}
+			id++
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read from /events, or a comment line when Type is
+// empty
+type sseEvent struct {
+	Type    string
+	Data    string
+	Comment string
+}
+
+// eventStreamConn is a client reading /events
+type eventStreamConn struct {
+	t      *testing.T
+	events chan sseEvent
+}
+
+// openEventStream connects to /events with a token and query parameters,
+// and returns once the server has subscribed the stream
+func openEventStream(t *testing.T, server *httptest.Server, token string, query url.Values) *eventStreamConn {
+	t.Helper()
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("token", token)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/events?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("opening the event stream: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("the event stream answered %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	stream := &eventStreamConn{t: t, events: make(chan sseEvent, 64)}
+	go func() {
+		defer close(stream.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event != (sseEvent{}) {
+					stream.events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				event.Comment = strings.TrimSpace(line[1:])
+			case strings.HasPrefix(line, "event: "):
+				event.Type = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				event.Data = line[len("data: "):]
+			}
+		}
+	}()
+	if got := stream.next(); got.Comment != "connected" {
+		t.Fatalf("the stream opened with %+v", got)
+	}
+	return stream
+}
+
+// next returns the next event or comment of the stream
+func (s *eventStreamConn) next() sseEvent {
+	s.t.Helper()
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			s.t.Fatal("the event stream ended")
+		}
+		return event
+	case <-time.After(testTimeout):
+		s.t.Fatal("timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// expect returns the data of the next event, which must be of the given
+// type. Heartbeats are skipped.
+func (s *eventStreamConn) expect(eventType string) map[string]any {
+	s.t.Helper()
+	event := s.next()
+	for event.Type == "" {
+		event = s.next()
+	}
+	if event.Type != eventType {
+		s.t.Fatalf("got a %s event (%s), want %s", event.Type, event.Data, eventType)
+	}
+	var payload struct{ Data map[string]any }
+	if err := json.Unmarshal([]byte(event.Data), &payload); err != nil {
+		s.t.Fatalf("decoding %s: %v", event.Data, err)
+	}
+	return payload.Data
+}
+
+// newEventServer serves /events for a test
+func newEventServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", HandleEventStream)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEventStreamDeliversEvents(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	server := newEventServer(t)
+	stream := openEventStream(t, server, createTestUser(t, "root"), nil)
+
+	register(t, hub, fakeClient("bob", true))
+	if data := stream.expect(WebhookUserJoined); data["username"] != "bob" {
+		t.Errorf("user.joined carried %v", data)
+	}
+
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: "hello dashboards"}
+	if data := stream.expect(WebhookMessagePosted); data["username"] != "bob" || data["content"] != "hello dashboards" {
+		t.Errorf("message.posted carried %v", data)
+	}
+
+	doc := createTestDocument(t, "notes.txt", "bob")
+	RecordDocumentEvent(doc.ID, "bob", EventCreate, doc.Name)
+	RecordDocumentEvent(doc.ID, "bob", EventUpdate, "5 bytes")
+	if data := stream.expect("document.create"); data["document_id"] != doc.ID || data["username"] != "bob" {
+		t.Errorf("document.create carried %v", data)
+	}
+	stream.expect("document.update")
+}
+
+func TestEventStreamFilters(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	hub := newTestHub(t)
+	server := newEventServer(t)
+	token := createTestUser(t, "root")
+	documents := openEventStream(t, server, token, url.Values{"types": {"document"}})
+	creations := openEventStream(t, server, token, url.Values{"types": {"document.create,user.joined"}})
+	notes := createTestDocument(t, "notes.txt", "root")
+	one := openEventStream(t, server, token, url.Values{"documentID": {notes.ID}})
+
+	register(t, hub, fakeClient("bob", true))
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "bob", Content: "hi"}
+	other := createTestDocument(t, "other.txt", "root")
+	RecordDocumentEvent(other.ID, "root", EventCreate, other.Name)
+	RecordDocumentEvent(notes.ID, "root", EventUpdate, "5 bytes")
+
+	// Only the document events, in order
+	if data := documents.expect("document.create"); data["document_id"] != other.ID {
+		t.Errorf("the document stream got %v first", data)
+	}
+	documents.expect("document.update")
+
+	creations.expect(WebhookUserJoined)
+	creations.expect("document.create")
+
+	if data := one.expect("document.update"); data["document_id"] != notes.ID {
+		t.Errorf("the stream of %s got %v", notes.ID, data)
+	}
+}
+
+func TestEventStreamVisibility(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newEventServer(t)
+	createTestUser(t, "bob")
+	stream := openEventStream(t, server, createTestUser(t, "alice"), nil)
+	bobs := createTestDocument(t, "bob.txt", "bob")
+	shared := createTestDocument(t, "shared.txt", "bob")
+	if err := GrantDocumentPermission(shared.ID, "alice", PermissionRead); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing alice may not see reaches the stream: user events outside
+	// USER_DIRECTORY "all", messages in rooms, and others' documents
+	register(t, hub, fakeClient("carol", true))
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "carol", Room: "ops", Content: "in a room"}
+	RecordDocumentEvent(bobs.ID, "bob", EventUpdate, "5 bytes")
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "carol", Content: "in the lobby"}
+	if data := stream.expect(WebhookMessagePosted); data["content"] != "in the lobby" {
+		t.Errorf("alice got %v", data)
+	}
+	RecordDocumentEvent(shared.ID, "bob", EventUpdate, "6 bytes")
+	if data := stream.expect("document.update"); data["document_id"] != shared.ID {
+		t.Errorf("alice got the events of %v", data["document_id"])
+	}
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	setupTest(t)
+	config.SSEHeartbeat = 1
+	newTestHub(t)
+	stream := openEventStream(t, newEventServer(t), createTestUser(t, "alice"), nil)
+	if got := stream.next(); got.Comment != "heartbeat" {
+		t.Errorf("an idle stream got %+v, want a heartbeat", got)
+	}
+}
+
+func TestEventStreamRequests(t *testing.T) {
+	setupTest(t)
+	newTestHub(t)
+	token := createTestUser(t, "alice")
+	for _, tc := range []struct {
+		name, target, token string
+		want                int
+	}{
+		{"no token", "/events", "", http.StatusUnauthorized},
+		{"invalid token", "/events", "not-a-token", http.StatusUnauthorized},
+		{"unknown type", "/events?types=document,weather", token, http.StatusBadRequest},
+	} {
+		if w := callHandler(t, HandleEventStream, "GET", tc.target, tc.token, nil); w.Code != tc.want {
+			t.Errorf("%s: /events answered %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+}
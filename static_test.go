@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeMissingStaticFile(t *testing.T) {
+	setupTest(t)
+	config.StaticDir = t.TempDir()
+
+	for _, page := range []struct {
+		handler http.HandlerFunc
+		target  string
+		name    string
+	}{
+		{serveHome, "/", "index.html"},
+		{serveEditor, "/editor", "editor.html"},
+	} {
+		w := callHandler(t, page.handler, "GET", page.target, "", nil)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("GET %s without %s = %d, want 500", page.target, page.name, w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, page.name) || !strings.Contains(body, "STATIC_DIR") {
+			t.Errorf("GET %s without %s said %q", page.target, page.name, body)
+		}
+	}
+}
+
+func TestServeStaticFile(t *testing.T) {
+	setupTest(t)
+	config.StaticDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(config.StaticDir, "index.html"), []byte("<h1>chat</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := callHandler(t, serveHome, "GET", "/", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "<h1>chat</h1>" {
+		t.Errorf("GET / = %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// UserStats summarizes a user's activity
+type UserStats struct {
+	Username         string     `json:"username"`
+	MessagesSent     int        `json:"messagesSent"`
+	DocumentsCreated int        `json:"documentsCreated"`
+	FirstSeen        *time.Time `json:"firstSeen,omitempty"`  // When they registered, or posted first
+	LastActive       *time.Time `json:"lastActive,omitempty"` // Their latest message or document change
+}
+
+// GetUserStats computes a user's activity from the database. System notices
+// don't count as messages sent.
+func GetUserStats(username string) (*UserStats, error) {
+	stats := &UserStats{Username: username}
+
+	query := `SELECT COUNT(*) FROM messages WHERE username = ? AND is_system = 0`
+	if err := db.QueryRow(query, username).Scan(&stats.MessagesSent); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM documents WHERE created_by = ?`, username).Scan(&stats.DocumentsCreated); err != nil {
+		return nil, err
+	}
+
+	// Times are read from single rows rather than with MIN and MAX, which
+	// would return them as text
+	registered, err := queryTime(`SELECT created_at FROM users WHERE username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	firstMessage, err := queryTime(`SELECT created_at FROM messages WHERE username = ? AND is_system = 0 ORDER BY id LIMIT 1`, username)
+	if err != nil {
+		return nil, err
+	}
+	lastMessage, err := queryTime(`SELECT created_at FROM messages WHERE username = ? AND is_system = 0 ORDER BY id DESC LIMIT 1`, username)
+	if err != nil {
+		return nil, err
+	}
+	lastChange, err := queryTime(`SELECT timestamp FROM document_events WHERE username = ? ORDER BY id DESC LIMIT 1`, username)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.FirstSeen = registered
+	if stats.FirstSeen == nil {
+		stats.FirstSeen = firstMessage
+	}
+	stats.LastActive = lastMessage
+	if lastChange != nil && (stats.LastActive == nil || lastChange.After(*stats.LastActive)) {
+		stats.LastActive = lastChange
+	}
+	return stats, nil
+}
+
+// queryTime runs a query selecting one time column, returning nil when it
+// finds no row or a NULL
+func queryTime(query string, args ...any) (*time.Time, error) {
+	var t sql.NullTime
+	err := db.QueryRow(query, args...).Scan(&t)
+	if err == sql.ErrNoRows || (err == nil && !t.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t.Time, nil
+}
+
+// HandleStats returns the activity stats of the user whose token is in the
+// Authorization header. Admins can ask for anyone's with ?username=.
+func HandleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := ValidateToken(r.Header.Get("Authorization"))
+	if err != nil {
+		http.Error(w, "Unauthorized: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	username := claims.Username
+	if requested := r.URL.Query().Get("username"); requested != "" && requested != username {
+		role := roleOf(claims.Username, claims.Role == RoleGuest)
+		if role != RoleAdmin {
+			http.Error(w, "Only admins can see other users' stats", http.StatusForbidden)
+			return
+		}
+		exists, err := UserExists(requested)
+		if err != nil {
+			log.Printf("Error checking user existence: %v", err)
+			http.Error(w, "Failed to compute stats", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		username = requested
+	}
+
+	stats, err := GetUserStats(username)
+	if err != nil {
+		log.Printf("Error computing stats for %s: %v", username, err)
+		http.Error(w, "Failed to compute stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserStats(t *testing.T) {
+	setupTest(t)
+	config.AdminUsers = []string{"root"}
+	aliceToken := createTestUser(t, "alice")
+	bobToken := createTestUser(t, "bob")
+	rootToken := createTestUser(t, "root")
+	if _, err := db.Exec(`UPDATE users SET created_at = ? WHERE username = 'alice'`, time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, msg := range []Msg{
+		{Type: PublicMessage, Username: "alice", Content: "one"},
+		{Type: PrivateMessage, Username: "alice", From: "alice", To: "bob", Content: "two"},
+		{Type: PublicMessage, Username: "bob", Content: "not alice's"},
+		{Type: PublicMessage, Username: "alice", Content: "three", Room: "dev"},
+		{Type: PublicMessage, Username: "alice", Content: "alice joined the chat", IsSystem: true},
+	} {
+		msg.Time = base.Add(time.Duration(i) * time.Hour)
+		if _, err := SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createTestDocument(t, "a.txt", "alice")
+	createTestDocument(t, "b.txt", "alice")
+	createTestDocument(t, "c.txt", "bob")
+	lastEdit := base.Add(24 * time.Hour)
+	if _, err := db.Exec(`INSERT INTO document_events (document_id, username, operation, timestamp) VALUES ('x', 'alice', ?, ?)`, EventUpdate, lastEdit); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetUserStats("alice")
+	if err != nil {
+		t.Fatalf("GetUserStats: %v", err)
+	}
+	if stats.MessagesSent != 3 || stats.DocumentsCreated != 2 {
+		t.Errorf("alice sent %d messages and created %d documents, want 3 and 2", stats.MessagesSent, stats.DocumentsCreated)
+	}
+	if stats.FirstSeen == nil || !stats.FirstSeen.Equal(time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("alice was first seen %v, want when registering", stats.FirstSeen)
+	}
+	if stats.LastActive == nil || !stats.LastActive.Equal(lastEdit) {
+		t.Errorf("alice was last active %v, want the last document change at %v", stats.LastActive, lastEdit)
+	}
+
+	// Without document changes, the last message counts
+	stats, err = GetUserStats("bob")
+	if err != nil || stats.MessagesSent != 1 || stats.DocumentsCreated != 1 || stats.LastActive == nil || !stats.LastActive.Equal(base.Add(2*time.Hour)) {
+		t.Errorf("bob's stats = %+v, %v", stats, err)
+	}
+
+	get := func(token, target string) (int, UserStats) {
+		t.Helper()
+		w := callHandler(t, HandleStats, "GET", target, token, nil)
+		var stats UserStats
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, stats
+	}
+	if code, stats := get(aliceToken, "/stats"); code != http.StatusOK || stats.Username != "alice" || stats.MessagesSent != 3 {
+		t.Errorf("GET /stats as alice = %d %+v", code, stats)
+	}
+	if code, _ := get(bobToken, "/stats?username=alice"); code != http.StatusForbidden {
+		t.Errorf("bob asking for alice's stats = %d, want 403", code)
+	}
+	if code, stats := get(rootToken, "/stats?username=alice"); code != http.StatusOK || stats.Username != "alice" || stats.DocumentsCreated != 2 {
+		t.Errorf("an admin asking for alice's stats = %d %+v", code, stats)
+	}
+	if code, _ := get(rootToken, "/stats?username=nobody"); code != http.StatusNotFound {
+		t.Errorf("stats of an unknown user = %d, want 404", code)
+	}
+	if code, _ := get("", "/stats"); code != http.StatusUnauthorized {
+		t.Errorf("GET /stats without a token = %d, want 401", code)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// StoredMessage is a chat message as kept in the messages table, one field
+// per column. Msg is the wire format; messages are converted between the two
+// with newStoredMessage and StoredMessage.Msg, so the schema and the
+// protocol can change independently.
+type StoredMessage struct {
+	ID             int64
+	Type           MsgType
+	Username       string
+	Content        string
+	CreatedAt      time.Time
+	EditedAt       sql.NullTime
+	ToUser         sql.NullString
+	FromUser       sql.NullString
+	IsSystem       bool
+	Room           string
+	ConversationID string
+	Format         string
+	FormatLanguage string
+	ExpiresAt      sql.NullTime
+	ClientKey      string
+	ParentID       int64
+	ThreadID       int64
+	Depth          int
+}
+
+// storedMessageColumns lists the columns of the messages table in the order
+// StoredMessage.fields reads them
+var storedMessageColumns = []string{
+	"id", "type", "username", "content", "created_at", "edited_at", "to_user", "from_user",
+	"is_system", "room", "conversation_id", "format", "format_language", "expires_at", "client_key",
+	"parent_id", "thread_id", "depth",
+}
+
+// messageColumns returns the column list to select a StoredMessage, each
+// column qualified with the table alias if one is given
+func messageColumns(alias string) string {
+	if alias == "" {
+		return strings.Join(storedMessageColumns, ", ")
+	}
+	return alias + "." + strings.Join(storedMessageColumns, ", "+alias+".")
+}
+
+// visibleTo returns the condition selecting the messages viewer may see,
+// with its arguments: lobby messages, private messages they sent or
+// received, messages in their group conversations and in rooms, which are
+// the rooms they are in now, and none that expired. Export and search share
+// it so that both show the same messages. Columns are qualified with the
+// table alias if one is given.
+func visibleTo(alias, viewer string, rooms []string) (string, []any) {
+	col := func(name string) string {
+		if alias == "" {
+			return name
+		}
+		return alias + "." + name
+	}
+	args := []any{viewer, viewer, viewer}
+	roomFilter := "0"
+	if len(rooms) > 0 {
+		roomFilter = col("room") + " IN (?" + strings.Repeat(", ?", len(rooms)-1) + ")"
+		for _, room := range rooms {
+			args = append(args, room)
+		}
+	}
+	args = append(args, time.Now())
+
+	return `(
+			(` + col("room") + ` = '' AND ` + col("conversation_id") + ` = '' AND COALESCE(` + col("to_user") + `, '') = '')
+			OR (COALESCE(` + col("to_user") + `, '') != '' AND (` + col("to_user") + ` = ? OR ` + col("from_user") + ` = ?))
+			OR ` + col("conversation_id") + ` IN (SELECT conversation_id FROM conversation_members WHERE username = ?)
+			OR ` + roomFilter + `
+		)
+		AND (` + col("expires_at") + ` IS NULL OR ` + col("expires_at") + ` > ?)`, args
+}
+
+// fields returns the scan destinations of a row selected with
+// messageColumns
+func (s *StoredMessage) fields() []any {
+	return []any{
+		&s.ID, &s.Type, &s.Username, &s.Content, &s.CreatedAt, &s.EditedAt, &s.ToUser, &s.FromUser,
+		&s.IsSystem, &s.Room, &s.ConversationID, &s.Format, &s.FormatLanguage, &s.ExpiresAt, &s.ClientKey,
+		&s.ParentID, &s.ThreadID, &s.Depth,
+	}
+}
+
+// newStoredMessage maps a message received over the wire to its row. Fields
+// that only make sense on the wire, like the user list, are left out.
+func newStoredMessage(msg Msg) StoredMessage {
+	stored := StoredMessage{
+		ID:             msg.ID,
+		Type:           msg.Type,
+		Username:       msg.Username,
+		Content:        msg.Content,
+		CreatedAt:      msg.Time,
+		ToUser:         sql.NullString{String: msg.To, Valid: true},
+		FromUser:       sql.NullString{String: msg.From, Valid: true},
+		IsSystem:       msg.IsSystem,
+		Room:           msg.Room,
+		ConversationID: msg.ConversationID,
+		Format:         msg.Format,
+		FormatLanguage: msg.Language,
+		ClientKey:      msg.ClientKey,
+		ParentID:       msg.ParentID,
+		ThreadID:       msg.ThreadID,
+		Depth:          msg.Depth,
+	}
+	if msg.EditedAt != nil {
+		stored.EditedAt = sql.NullTime{Time: *msg.EditedAt, Valid: true}
+	}
+	if msg.ExpiresAt != nil {
+		stored.ExpiresAt = sql.NullTime{Time: *msg.ExpiresAt, Valid: true}
+	}
+	return stored
+}
+
+// Msg maps a stored message back to the wire format
+func (s StoredMessage) Msg() Msg {
+	msg := Msg{
+		ID:             s.ID,
+		Type:           s.Type,
+		Username:       s.Username,
+		Content:        s.Content,
+		Time:           s.CreatedAt,
+		To:             s.ToUser.String,
+		From:           s.FromUser.String,
+		IsSystem:       s.IsSystem,
+		Room:           s.Room,
+		ConversationID: s.ConversationID,
+		Format:         s.Format,
+		Language:       s.FormatLanguage,
+		ClientKey:      s.ClientKey,
+		ParentID:       s.ParentID,
+		ThreadID:       s.ThreadID,
+		Depth:          s.Depth,
+	}
+	if s.EditedAt.Valid {
+		editedAt := s.EditedAt.Time
+		msg.Edited = true
+		msg.EditedAt = &editedAt
+	}
+	if s.ExpiresAt.Valid {
+		expiresAt := s.ExpiresAt.Time
+		msg.ExpiresAt = &expiresAt
+	}
+	return msg
+}
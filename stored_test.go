@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStoredMessageMapping(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	edited := created.Add(time.Minute)
+	expires := created.Add(time.Hour)
+	msg := Msg{
+		ID: 7, Type: PrivateMessage, Username: "alice", Content: "hi", Time: created,
+		To: "bob", From: "alice", Room: "dev", ConversationID: "c1",
+		Format: FormatCode, Language: "go", ClientKey: "key-1",
+		ParentID: 3, ThreadID: 3, Depth: 1,
+		Edited: true, EditedAt: &edited, ExpiresAt: &expires,
+	}
+
+	stored := newStoredMessage(msg)
+	if stored.CreatedAt != created || stored.FormatLanguage != "go" || !stored.EditedAt.Valid || stored.ToUser.String != "bob" {
+		t.Errorf("the message was mapped to %+v", stored)
+	}
+	if back := stored.Msg(); !reflect.DeepEqual(back, msg) {
+		t.Errorf("the round trip gave\n%+v\nwant\n%+v", back, msg)
+	}
+
+	// Wire-only fields don't reach the row
+	withList := msg
+	withList.UserList = []string{"alice", "bob"}
+	if !reflect.DeepEqual(newStoredMessage(withList), stored) {
+		t.Error("the user list changed the stored message")
+	}
+
+	// NULL columns map to zero values
+	row := StoredMessage{ID: 1, Type: PublicMessage, Username: "alice", Content: "old", ToUser: sql.NullString{}, CreatedAt: created}
+	if got := row.Msg(); got.To != "" || got.Edited || got.EditedAt != nil || got.ExpiresAt != nil {
+		t.Errorf("a row with NULL columns was mapped to %+v", got)
+	}
+
+	// The storage type doesn't carry the wire format's JSON tags
+	fields := reflect.TypeOf(StoredMessage{})
+	for i := 0; i < fields.NumField(); i++ {
+		if tag, ok := fields.Field(i).Tag.Lookup("json"); ok {
+			t.Errorf("StoredMessage.%s has the JSON tag %q", fields.Field(i).Name, tag)
+		}
+	}
+	if len(storedMessageColumns) != len(stored.fields()) {
+		t.Errorf("%d columns for %d fields", len(storedMessageColumns), len(stored.fields()))
+	}
+}
+
+func TestStoredMessageDatabaseRoundTrip(t *testing.T) {
+	setupTest(t)
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	sent := Msg{Type: PublicMessage, Username: "alice", Content: "hello", Time: time.Now().UTC().Truncate(time.Second), Room: "dev", Format: FormatMarkdown, ClientKey: "key-1", ExpiresAt: &expires}
+	id, err := SaveMessage(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetMessage(id)
+	if err != nil || got == nil {
+		t.Fatalf("GetMessage = %v, %v", got, err)
+	}
+	if got.ID != id || got.Content != "hello" || !got.Time.Equal(sent.Time) || got.Room != "dev" || got.Format != FormatMarkdown || got.ClientKey != "key-1" || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) || got.Edited {
+		t.Errorf("the message was read back as %+v", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Ways of handling replies nested deeper than THREAD_MAX_DEPTH, set with
+// THREAD_DEPTH_POLICY
+const (
+	ThreadFlatten = "flatten" // Attach the reply to the deepest message it may reply to
+	ThreadReject  = "reject"  // Refuse the reply with an error
+)
+
+// maxThreadLength is the most messages a thread request returns, the
+// oldest first
+const maxThreadLength = 500
+
+// checkThread reports a negative THREAD_MAX_DEPTH or an unknown
+// THREAD_DEPTH_POLICY
+func (c *Config) checkThread(p *configProblems) {
+	if c.ThreadMaxDepth < 0 {
+		p.add("THREAD_MAX_DEPTH must not be negative, got %d", c.ThreadMaxDepth)
+	}
+	if c.ThreadDepthPolicy != ThreadFlatten && c.ThreadDepthPolicy != ThreadReject {
+		p.add("Invalid THREAD_DEPTH_POLICY %q, expected %s or %s", c.ThreadDepthPolicy, ThreadFlatten, ThreadReject)
+	}
+}
+
+// threadParent returns the message a reply to parent ends up replying to,
+// given THREAD_MAX_DEPTH: parent itself while the reply fits, otherwise,
+// when flattening, the nearest ancestor a reply to fits under. It fails when
+// the reply is rejected.
+func threadParent(parent *Msg) (*Msg, error) {
+	for config.ThreadMaxDepth > 0 && parent.Depth >= config.ThreadMaxDepth {
+		if config.ThreadDepthPolicy == ThreadReject {
+			return nil, fmt.Errorf("replies can be nested at most %d deep", config.ThreadMaxDepth)
+		}
+		ancestor, err := GetMessage(parent.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if ancestor == nil {
+			return nil, errors.New("the thread of this message is gone")
+		}
+		parent = ancestor
+	}
+	return parent, nil
+}
+
+// checkThread places a reply in its thread, setting its parent, thread and
+// depth, and tells the client when it can't be posted. Replies go to public
+// messages of the same room only.
+func (c *Client) checkThread(msg *Msg) bool {
+	if msg.ParentID == 0 {
+		msg.ThreadID = 0
+		msg.Depth = 0
+		return true
+	}
+
+	parent, err := GetMessage(msg.ParentID)
+	if err != nil {
+		log.Printf("Error getting message %d replied to by %s: %v", msg.ParentID, c.Username, err)
+		c.sendError("Failed to post reply")
+		return false
+	}
+	if parent == nil || parent.Type != PublicMessage || parent.Room != msg.Room {
+		c.sendError("Message to reply to not found")
+		return false
+	}
+
+	parent, err = threadParent(parent)
+	if err != nil {
+		c.sendError("Reply not sent: " + err.Error())
+		return false
+	}
+
+	msg.ParentID = parent.ID
+	msg.ThreadID = parent.ThreadID
+	if msg.ThreadID == 0 {
+		msg.ThreadID = parent.ID
+	}
+	msg.Depth = parent.Depth + 1
+	return true
+}
+
+// GetReplyCounts counts the direct replies to the given messages in a
+// single query. Messages without replies are left out.
+func GetReplyCounts(messageIDs []int64) (map[int64]int, error) {
+	counts := make(map[int64]int)
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	args := []any{}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	args = append(args, time.Now())
+
+	query := `
+		SELECT parent_id, COUNT(*)
+		FROM messages
+		WHERE parent_id IN (?` + strings.Repeat(", ?", len(messageIDs)-1) + `)
+		AND (expires_at IS NULL OR expires_at > ?)
+		GROUP BY parent_id
+	`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var parentID int64
+		var count int
+		if err := rows.Scan(&parentID, &count); err != nil {
+			return nil, err
+		}
+		counts[parentID] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// GetThread retrieves the message a thread started with and its replies,
+// oldest first, at most limit of them, and whether there are more. Each
+// message carries its reply count and reactions aggregated for viewer.
+func GetThread(rootID int64, limit int, viewer string) ([]Msg, bool, error) {
+	query := `
+		SELECT ` + messageColumns("") + `
+		FROM messages
+		WHERE (id = ? OR thread_id = ?)
+		AND (expires_at IS NULL OR expires_at > ?)
+		ORDER BY id
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, rootID, rootID, time.Now(), limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var messages []Msg
+	for rows.Next() {
+		var stored StoredMessage
+		if err := rows.Scan(stored.fields()...); err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, stored.Msg())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	reactions, err := GetReactionCounts(ids, viewer)
+	if err != nil {
+		return nil, false, err
+	}
+	replies, err := GetReplyCounts(ids)
+	if err != nil {
+		return nil, false, err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].ReplyCount = replies[messages[i].ID]
+	}
+	return messages, hasMore, nil
+}
+
+// handleThread sends the client the whole thread a message belongs to, so
+// that it can expand a collapsed thread
+func (c *Client) handleThread(messageID int64, hub *Hub) {
+	if !config.ChatPersistence {
+		c.sendError(historyOffMessage)
+		return
+	}
+	msg, err := GetMessage(messageID)
+	if err != nil {
+		log.Printf("Error getting message %d for %s: %v", messageID, c.Username, err)
+		c.sendError("Failed to load thread")
+		return
+	}
+	if msg == nil || msg.Type != PublicMessage {
+		c.sendError("Message not found")
+		return
+	}
+	if msg.Room != "" {
+		if _, ok := hub.RoomMembers(c, msg.Room); !ok {
+			c.sendError("You are not a member of this room")
+			return
+		}
+	}
+
+	rootID := msg.ThreadID
+	if rootID == 0 {
+		rootID = msg.ID
+	}
+	messages, hasMore, err := GetThread(rootID, maxThreadLength, c.Username)
+	if err != nil {
+		log.Printf("Error getting thread %d for %s: %v", rootID, c.Username, err)
+		c.sendError("Failed to load thread")
+		return
+	}
+
+	c.reply(Msg{
+		Type:      Thread,
+		Room:      msg.Room,
+		ThreadID:  rootID,
+		MessageID: messageID,
+		Messages:  messages,
+		HasMore:   hasMore,
+		Time:      time.Now(),
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+// post sends a lobby message, a reply if parentID is set, and returns it as
+// delivered
+func post(conn *testConn, content string, parentID int64) Msg {
+	conn.t.Helper()
+	conn.send(Msg{Type: PublicMessage, Content: content, ParentID: parentID})
+	for {
+		msg := conn.expect(PublicMessage)
+		if msg.Content == content {
+			return msg
+		}
+	}
+}
+
+func TestThreadDepthIsFlattened(t *testing.T) {
+	setupTest(t)
+	config.ThreadMaxDepth = 2
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	token := createTestUser(t, "alice")
+	alice := dial(t, server, token, nil)
+	alice.expect(Session)
+
+	root := post(alice, "root", 0)
+	first := post(alice, "first", root.ID)
+	second := post(alice, "second", first.ID)
+	// Too deep: attached to the deepest message it may reply to
+	third := post(alice, "third", second.ID)
+	for _, tc := range []struct {
+		msg    Msg
+		parent int64
+		depth  int
+	}{
+		{first, root.ID, 1},
+		{second, first.ID, 2},
+		{third, first.ID, 2},
+	} {
+		if tc.msg.ParentID != tc.parent || tc.msg.Depth != tc.depth || tc.msg.ThreadID != root.ID {
+			t.Errorf("%q was posted under %d at depth %d in thread %d, want under %d at depth %d in thread %d", tc.msg.Content, tc.msg.ParentID, tc.msg.Depth, tc.msg.ThreadID, tc.parent, tc.depth, root.ID)
+		}
+	}
+
+	alice.send(Msg{Type: PublicMessage, Content: "lost", ParentID: 9999})
+	if got := alice.expect(ErrorMessage); got.Content != "Message to reply to not found" {
+		t.Errorf("a reply to nothing was answered with %q", got.Content)
+	}
+
+	// The thread comes with the reply counts to collapse it by
+	alice.send(Msg{Type: Thread, MessageID: third.ID})
+	thread := alice.expect(Thread)
+	counts := map[string]int{}
+	for _, msg := range thread.Messages {
+		counts[msg.Content] = msg.ReplyCount
+	}
+	if len(thread.Messages) != 4 || thread.ThreadID != root.ID || counts["root"] != 1 || counts["first"] != 2 || counts["second"] != 0 {
+		t.Errorf("the thread has %d messages with reply counts %v", len(thread.Messages), counts)
+	}
+
+	// So do replayed messages
+	replay := dial(t, server, token, nil)
+	for {
+		msg := replay.expect(PublicMessage)
+		if msg.ID == root.ID {
+			if msg.ReplyCount != 1 {
+				t.Errorf("the root was replayed with %d replies, want 1", msg.ReplyCount)
+			}
+			break
+		}
+	}
+}
+
+func TestThreadDepthIsRejected(t *testing.T) {
+	setupTest(t)
+	config.ThreadMaxDepth = 1
+	config.ThreadDepthPolicy = ThreadReject
+	hub := newTestHub(t)
+	alice := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	alice.expect(Session)
+
+	root := post(alice, "root", 0)
+	reply := post(alice, "reply", root.ID)
+	alice.send(Msg{Type: PublicMessage, Content: "too deep", ParentID: reply.ID})
+	if got := alice.expect(ErrorMessage); got.Content != "Reply not sent: replies can be nested at most 1 deep" {
+		t.Errorf("a reply past the limit was answered with %q", got.Content)
+	}
+	if counts, err := GetReplyCounts([]int64{root.ID, reply.ID}); err != nil || counts[root.ID] != 1 || counts[reply.ID] != 0 {
+		t.Errorf("GetReplyCounts = %v, %v", counts, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsEnabled reports whether the server is configured to serve HTTPS
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCertFile != "" || len(c.AutocertDomains) > 0
+}
+
+// checkTLS reports contradictory TLS settings
+func (c *Config) checkTLS(p *configProblems) {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		p.add("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.TLSCertFile != "" && len(c.AutocertDomains) > 0 {
+		p.add("Set either TLS_CERT_FILE/TLS_KEY_FILE or AUTOCERT_DOMAINS, not both")
+	}
+	if c.HTTPRedirectAddr != "" && !c.tlsEnabled() {
+		p.add("HTTP_REDIRECT_ADDR requires TLS to be configured")
+	}
+}
+
+// serve runs the server on listenAddr, over TLS when a certificate or
+// autocert domains are configured. With HTTP_REDIRECT_ADDR set, plain HTTP
+// requests on that address are redirected to HTTPS.
+func serve(handler http.Handler) error {
+	server, redirectHandler := newServer(handler)
+	if !config.tlsEnabled() {
+		return server.ListenAndServe()
+	}
+
+	if config.HTTPRedirectAddr != "" {
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", config.HTTPRedirectAddr)
+			log.Fatal(http.ListenAndServe(config.HTTPRedirectAddr, redirectHandler))
+		}()
+	}
+
+	return server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+}
+
+// newServer sets up the server for listenAddr with the configured TLS
+// settings, along with the handler redirecting plain HTTP to it
+func newServer(handler http.Handler) (*http.Server, http.Handler) {
+	server := &http.Server{Addr: config.ListenAddr, Handler: handler}
+	var redirectHandler http.Handler = http.HandlerFunc(redirectToHTTPS)
+	if !config.tlsEnabled() {
+		return server, redirectHandler
+	}
+
+	if len(config.AutocertDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.AutocertDomains...),
+			Cache:      autocert.DirCache(config.AutocertCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+
+		// The redirect listener also answers Let's Encrypt HTTP-01 challenges
+		redirectHandler = manager.HTTPHandler(redirectHandler)
+	} else {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return server, redirectHandler
+}
+
+// redirectToHTTPS sends the client to the same URL on the HTTPS listener
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, err := net.SplitHostPort(config.ListenAddr); err == nil && port != "443" && port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// serverURL returns the base URL the server can be reached at locally
+func serverURL() string {
+	scheme := "http"
+	if config.tlsEnabled() {
+		scheme = "https"
+	}
+	host, port, err := net.SplitHostPort(config.ListenAddr)
+	if err != nil {
+		return scheme + "://" + config.ListenAddr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to the
+// current directory, and returns a pool trusting it
+func writeSelfSignedCert(t *testing.T) *x509.CertPool {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chat test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}
+
+func TestWebSocketOverTLS(t *testing.T) {
+	setupTest(t)
+	pool := writeSelfSignedCert(t)
+	config.TLSCertFile = "cert.pem"
+	config.TLSKeyFile = "key.pem"
+	hub := newTestHub(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, w, r)
+	}))
+	server, _ := newServer(mux)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+	t.Cleanup(func() { server.Close() })
+
+	query := url.Values{"token": {createTestUser(t, "alice")}}
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	conn, _, err := dialer.Dial("wss://"+listener.Addr().String()+"/ws?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("dialing over TLS: %v", err)
+	}
+	defer conn.Close()
+	ws := &testConn{t: t, conn: conn}
+	if notice := ws.expect(SystemMessage); notice.Content != "alice joined the chat" {
+		t.Errorf("the first notice over TLS is %q", notice.Content)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	setupTest(t)
+	config.ListenAddr = ":8443"
+	w := callHandler(t, redirectToHTTPS, "GET", "http://chat.example.com:8080/editor?doc=1", "", nil)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://chat.example.com:8443/editor?doc=1" {
+		t.Errorf("redirected with %d to %q", w.Code, w.Header().Get("Location"))
+	}
+
+	config.ListenAddr = ":443"
+	w = callHandler(t, redirectToHTTPS, "GET", "http://chat.example.com/", "", nil)
+	if got := w.Header().Get("Location"); got != "https://chat.example.com/" {
+		t.Errorf("redirected to %q on the default port", got)
+	}
+}
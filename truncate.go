@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// DocumentSnapshot is a copy of a document's content kept so that it can be
+// recovered, taken before an edit that removed most of it
+type DocumentSnapshot struct {
+	ID         int64     `json:"id"`
+	DocumentID string    `json:"documentID"`
+	Username   string    `json:"username"` // Whose edit triggered the snapshot
+	Content    string    `json:"content"`
+	Time       time.Time `json:"time"`
+}
+
+// checkTruncate reports truncation thresholds that can't work
+func (c *Config) checkTruncate(p *configProblems) {
+	if c.DocTruncatePercent < 0 || c.DocTruncatePercent > 100 {
+		p.add("DOC_TRUNCATE_PERCENT must be between 0 and 100, got %d", c.DocTruncatePercent)
+	}
+	if c.DocTruncateMinSize < 0 {
+		p.add("DOC_TRUNCATE_MIN_SIZE can't be negative, got %d", c.DocTruncateMinSize)
+	}
+}
+
+// InitSnapshotTables creates the document_snapshots table
+func InitSnapshotTables() error {
+	createSnapshotsTable := `
+	CREATE TABLE IF NOT EXISTS document_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id TEXT NOT NULL,
+		username TEXT NOT NULL,
+		content TEXT NOT NULL,
+		content_encoding TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_document_snapshots_document ON document_snapshots(document_id, id);`
+
+	_, err := db.Exec(createSnapshotsTable)
+	return err
+}
+
+// SaveDocumentSnapshot stores a copy of a document's content, compressed
+// like documents are, and returns its ID
+func SaveDocumentSnapshot(docID, username, content string) (int64, error) {
+	stored, encoding, err := encodeDocumentContent(content)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(`
+		INSERT INTO document_snapshots (document_id, username, content, content_encoding, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, docID, username, stored, encoding, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetDocumentSnapshot retrieves a snapshot of a document, or nil if the
+// document has no snapshot with that ID
+func GetDocumentSnapshot(docID string, id int64) (*DocumentSnapshot, error) {
+	var snapshot DocumentSnapshot
+	var content []byte
+	var encoding string
+	err := db.QueryRow(`
+		SELECT id, document_id, username, content, content_encoding, created_at
+		FROM document_snapshots
+		WHERE id = ? AND document_id = ?
+	`, id, docID).Scan(&snapshot.ID, &snapshot.DocumentID, &snapshot.Username, &content, &encoding, &snapshot.Time)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.Content, err = decodeDocumentContent(content, encoding)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot %d: %w", id, err)
+	}
+	return &snapshot, nil
+}
+
+// isTruncation reports whether replacing before with after removes at
+// least DOC_TRUNCATE_PERCENT of a document of DOC_TRUNCATE_MIN_SIZE bytes or
+// more
+func isTruncation(before, after string) bool {
+	if config.DocTruncatePercent <= 0 || len(before) < config.DocTruncateMinSize || len(after) >= len(before) {
+		return false
+	}
+	return (len(before)-len(after))*100 >= len(before)*config.DocTruncatePercent
+}
+
+// warnTruncation tells everyone editing a document that an edit removed
+// most of its content, after saving the previous content as a snapshot
+// they can recover it from
+func (h *Hub) warnTruncation(docID, username, before, after string) {
+	removed := (len(before) - len(after)) * 100 / len(before)
+	log.Printf("Edit by %s removed %d%% of document %s", username, removed, docID)
+
+	warning := Msg{
+		Type:       DocTruncated,
+		DocumentID: docID,
+		Username:   username,
+		Content:    fmt.Sprintf("%s removed %d%% of the document", username, removed),
+		Time:       time.Now(),
+	}
+	if config.DocTruncateSnapshot {
+		id, err := SaveDocumentSnapshot(docID, username, before)
+		if err != nil {
+			log.Printf("Failed to snapshot document %s: %v", docID, err)
+		} else {
+			warning.SnapshotID = id
+		}
+	}
+	RecordDocumentEvent(docID, username, EventTruncate, fmt.Sprintf("%d%% removed", removed))
+
+	for client := range h.DocumentClients[docID] {
+		select {
+		case client.Send <- warning:
+		default:
+			log.Printf("Failed to send truncation warning to %s", client.Username)
+		}
+	}
+}
+
+// handleDocumentSnapshot sends the client a snapshot of a document, so
+// that it can restore content an edit removed
+func (c *Client) handleDocumentSnapshot(docID string, id int64) {
+	snapshot, err := GetDocumentSnapshot(docID, id)
+	if err != nil {
+		log.Printf("Error getting snapshot %d of %s: %v", id, docID, err)
+		return
+	}
+	if snapshot == nil {
+		c.sendError("Snapshot not found")
+		return
+	}
+
+	RecordDocumentAccess(docID, c.Username, AccessSnapshot)
+
+	c.reply(Msg{
+		Type:       DocSnapshot,
+		DocumentID: docID,
+		SnapshotID: snapshot.ID,
+		Username:   snapshot.Username,
+		Content:    snapshot.Content,
+		Time:       snapshot.Time,
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLargeDeletionIsSnapshotted(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	server := newTestServer(t, hub)
+	owner := dial(t, server, createTestUser(t, "alice"), nil)
+	editor := dial(t, server, createTestUser(t, "bob"), nil)
+	doc := createTestDocument(t, "notes.txt", "alice")
+	original := strings.Repeat("a line of work worth keeping\n", 20)
+	if err := UpdateDocument(doc.ID, original); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*testConn{owner, editor} {
+		conn.send(Msg{Type: DocOpen, DocumentID: doc.ID})
+		conn.expect(DocContent)
+	}
+
+	// Trimming a little is an ordinary edit
+	trimmed := original[:len(original)-29]
+	editor.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: trimmed})
+	owner.expect(DocUpdate)
+
+	editor.send(Msg{Type: DocUpdate, DocumentID: doc.ID, Content: ""})
+	warning := owner.expect(DocTruncated)
+	if warning.Username != "bob" || warning.SnapshotID == 0 || warning.Content != "bob removed 100% of the document" {
+		t.Errorf("the owner was warned with %+v", warning)
+	}
+	if got := editor.expect(DocTruncated); got.SnapshotID != warning.SnapshotID {
+		t.Errorf("the editor was warned about snapshot %d, want %d", got.SnapshotID, warning.SnapshotID)
+	}
+
+	// The content before the deletion can be recovered
+	owner.send(Msg{Type: DocSnapshot, DocumentID: doc.ID, SnapshotID: warning.SnapshotID})
+	if got := owner.expect(DocSnapshot); got.Content != trimmed || got.Username != "bob" {
+		t.Errorf("the snapshot holds %d bytes by %s, want the %d bytes before the deletion", len(got.Content), got.Username, len(trimmed))
+	}
+	var snapshots int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM document_snapshots WHERE document_id = ?`, doc.ID).Scan(&snapshots); err != nil || snapshots != 1 {
+		t.Errorf("%d snapshots were taken, %v, want 1", snapshots, err)
+	}
+	owner.send(Msg{Type: DocSnapshot, DocumentID: doc.ID, SnapshotID: warning.SnapshotID + 1})
+	if got := owner.expect(ErrorMessage); got.Content != "Snapshot not found" {
+		t.Errorf("a missing snapshot was answered with %q", got.Content)
+	}
+}
+
+func TestIsTruncation(t *testing.T) {
+	setupTest(t)
+	long := strings.Repeat("x", 1000)
+	for _, tc := range []struct {
+		before, after string
+		want          bool
+	}{
+		{long, "", true},
+		{long, long[:200], true},
+		{long, long[:201], false},
+		{long, long + "more", false},
+		// Small documents are left alone
+		{long[:199], "", false},
+	} {
+		if got := isTruncation(tc.before, tc.after); got != tc.want {
+			t.Errorf("isTruncation(%d bytes, %d bytes) = %v, want %v", len(tc.before), len(tc.after), got, tc.want)
+		}
+	}
+	config.DocTruncatePercent = 0
+	if isTruncation(long, "") {
+		t.Error("clearing a document counts as truncation with DOC_TRUNCATE_PERCENT 0")
+	}
+}
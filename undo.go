@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+)
+
+// maxUndoHistory bounds how many operations a document session remembers
+const maxUndoHistory = 1000
+
+var (
+	errNothingToUndo = errors.New("nothing to undo")
+	errNothingToRedo = errors.New("nothing to redo")
+	errUndoConflict  = errors.New("the text was changed by another user since")
+)
+
+// textOp is a single splice on a document: Deleted is removed at byte offset
+// Pos and Inserted takes its place
+type textOp struct {
+	Pos      int
+	Deleted  string
+	Inserted string
+}
+
+// invert returns the operation that cancels op
+func (op textOp) invert() textOp {
+	return textOp{Pos: op.Pos, Deleted: op.Inserted, Inserted: op.Deleted}
+}
+
+// apply performs op on content, checking that the text it deletes is there
+func (op textOp) apply(content string) (string, bool) {
+	end := op.Pos + len(op.Deleted)
+	if op.Pos < 0 || end > len(content) || content[op.Pos:end] != op.Deleted {
+		return "", false
+	}
+	return content[:op.Pos] + op.Inserted + content[end:], true
+}
+
+// transform rebases op, made against some content, onto the result of
+// applying other to that same content. It fails when both operations touch
+// the same region, since there's no way to tell which change should win.
+func (op textOp) transform(other textOp) (textOp, bool) {
+	opEnd := op.Pos + len(op.Deleted)
+	otherEnd := other.Pos + len(other.Deleted)
+
+	switch {
+	case otherEnd <= op.Pos:
+		// other happened entirely before op, so op shifts along
+		op.Pos += len(other.Inserted) - len(other.Deleted)
+		return op, true
+	case other.Pos >= opEnd:
+		// other happened entirely after op
+		return op, true
+	default:
+		return op, false
+	}
+}
+
+// diffOp describes the change from before to after as one splice, found by
+// trimming the common prefix and suffix
+func diffOp(before, after string) textOp {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	for prefix > 0 && prefix < len(before) && !utf8.RuneStart(before[prefix]) {
+		prefix--
+	}
+
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+		before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(before[len(before)-suffix]) {
+		suffix--
+	}
+
+	return textOp{
+		Pos:      prefix,
+		Deleted:  before[prefix : len(before)-suffix],
+		Inserted: after[prefix : len(after)-suffix],
+	}
+}
+
+// documentHistory is the operation log of a document's editing session. It
+// keeps per-user undo and redo stacks so that each user only undoes their
+// own changes, rebased over whatever others did in the meantime.
+type documentHistory struct {
+	Content  string
+	Mode     string   // Collaboration mode, ModeOpen by default
+	Owner    string   // Creator of the document, the only editor in ModeOwnerOnly
+	Archived bool     // The document was archived when the session began
+	ops      []textOp // Applied operations, oldest first
+	revs     []int    // The revision each of ops made
+	base     int      // Sequence number of ops[0]
+	undo     map[string][]int
+	redo     map[string][]int
+
+	// The user holding the turn in ModeTurns, if any, and when they last
+	// edited or took it
+	Turn       string
+	TurnActive time.Time
+
+	// Every change, even one that left the content as it was, makes a new
+	// revision. Revisions before forgotten can no longer be rebuilt.
+	revision  int
+	forgotten int
+}
+
+func newDocumentHistory(content string) *documentHistory {
+	return &documentHistory{
+		Content:  content,
+		Mode:     ModeOpen,
+		undo:     make(map[string][]int),
+		redo:     make(map[string][]int),
+		revision: 1,
+	}
+}
+
+// Revision returns the current revision of the content. A session starts at
+// revision 1.
+func (d *documentHistory) Revision() int {
+	return d.revision
+}
+
+// ContentAt rebuilds the content as it was at a revision, by reverting the
+// operations made since. It reports false for revisions that are in the
+// future or no longer in the log.
+func (d *documentHistory) ContentAt(revision int) (string, bool) {
+	if revision > d.revision || revision < d.forgotten {
+		return "", false
+	}
+	content := d.Content
+	for i := len(d.ops) - 1; i >= 0 && d.revs[i] > revision; i-- {
+		var ok bool
+		if content, ok = d.ops[i].invert().apply(content); !ok {
+			return "", false
+		}
+	}
+	return content, true
+}
+
+// Record registers a regular edit that replaced the content. It goes on the
+// user's undo stack and invalidates their redo stack.
+func (d *documentHistory) Record(username, content string) {
+	op := diffOp(d.Content, content)
+	d.Content = content
+	if op.Deleted == "" && op.Inserted == "" {
+		d.revision++
+		return
+	}
+
+	d.undo[username] = append(d.undo[username], d.push(op))
+	d.redo[username] = nil
+}
+
+// Undo reverts the user's most recent operation and returns the new content
+func (d *documentHistory) Undo(username string) (string, error) {
+	seq, ok := pop(d.undo, username, d.base)
+	if !ok {
+		return "", errNothingToUndo
+	}
+
+	applied, err := d.revert(seq)
+	if err != nil {
+		return "", err
+	}
+	d.redo[username] = append(d.redo[username], applied)
+	return d.Content, nil
+}
+
+// Redo reapplies the operation the user undid last and returns the new content
+func (d *documentHistory) Redo(username string) (string, error) {
+	seq, ok := pop(d.redo, username, d.base)
+	if !ok {
+		return "", errNothingToRedo
+	}
+
+	applied, err := d.revert(seq)
+	if err != nil {
+		return "", err
+	}
+	d.undo[username] = append(d.undo[username], applied)
+	return d.Content, nil
+}
+
+// revert applies the inverse of operation seq, rebased over every later
+// operation, and returns the sequence number of the applied inverse
+func (d *documentHistory) revert(seq int) (int, error) {
+	inverse := d.ops[seq-d.base].invert()
+	for _, later := range d.ops[seq-d.base+1:] {
+		var ok bool
+		if inverse, ok = inverse.transform(later); !ok {
+			return 0, errUndoConflict
+		}
+	}
+
+	content, ok := inverse.apply(d.Content)
+	if !ok {
+		return 0, errUndoConflict
+	}
+	d.Content = content
+	return d.push(inverse), nil
+}
+
+// push appends an operation to the log, forgetting the oldest ones beyond
+// maxUndoHistory, and returns its sequence number
+func (d *documentHistory) push(op textOp) int {
+	d.revision++
+	d.ops = append(d.ops, op)
+	d.revs = append(d.revs, d.revision)
+	if len(d.ops) > maxUndoHistory {
+		d.forgotten = d.revs[0]
+		d.ops = d.ops[1:]
+		d.revs = d.revs[1:]
+		d.base++
+	}
+	return d.base + len(d.ops) - 1
+}
+
+// pop takes the newest sequence number off a user's stack, skipping entries
+// that fell out of the log
+func pop(stacks map[string][]int, username string, base int) (int, bool) {
+	stack := stacks[username]
+	for len(stack) > 0 {
+		seq := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seq >= base {
+			stacks[username] = stack
+			return seq, true
+		}
+	}
+	stacks[username] = nil
+	return 0, false
+}
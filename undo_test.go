@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// editDocument sends an edit through the hub and waits for another editor
+// to get it
+func editDocument(t *testing.T, hub *Hub, editor, other *Client, docID, content string) {
+	t.Helper()
+	hub.DocumentEdits <- documentEdit{Client: editor, Msg: Msg{Type: DocUpdate, DocumentID: docID, Username: editor.Username, Content: content}}
+	for receive(t, other, DocUpdate).Content != content {
+	}
+}
+
+func TestUndoAfterConcurrentEdit(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	createTestUser(t, "alice")
+	doc := createTestDocument(t, "notes.txt", "alice")
+	alice := openTestDocument(t, hub, "alice", doc.ID)
+	bob := openTestDocument(t, hub, "bob", doc.ID)
+
+	editDocument(t, hub, alice, bob, doc.ID, "one two")
+	editDocument(t, hub, alice, bob, doc.ID, "one two three")
+	editDocument(t, hub, bob, alice, doc.ID, "zero one two three")
+
+	// Alice's last change is undone where it moved to, keeping bob's
+	hub.DocumentUndo <- undoRequest{Client: alice, DocumentID: doc.ID}
+	for _, client := range []*Client{alice, bob} {
+		if got := receive(t, client, DocUpdate).Content; got != "zero one two" {
+			t.Errorf("%s got %q after the undo, want %q", client.Username, got, "zero one two")
+		}
+	}
+
+	hub.DocumentUndo <- undoRequest{Client: alice, DocumentID: doc.ID, Redo: true}
+	for _, client := range []*Client{alice, bob} {
+		if got := receive(t, client, DocUpdate).Content; got != "zero one two three" {
+			t.Errorf("%s got %q after the redo, want %q", client.Username, got, "zero one two three")
+		}
+	}
+
+	// Bob can undo one edit, and then has nothing left to undo
+	hub.DocumentUndo <- undoRequest{Client: bob, DocumentID: doc.ID}
+	if got := receive(t, alice, DocUpdate).Content; got != "one two three" {
+		t.Errorf("bob's undo left %q", got)
+	}
+	hub.DocumentUndo <- undoRequest{Client: bob, DocumentID: doc.ID}
+	if msg := receive(t, bob, ErrorMessage); msg.Content != "Cannot undo: nothing to undo" {
+		t.Errorf("undoing past the stack: %q", msg.Content)
+	}
+}
+
+func TestUndoConflictingWithLaterEdit(t *testing.T) {
+	history := newDocumentHistory("")
+	history.Record("alice", "hello")
+	history.Record("bob", "hello there")
+	history.Record("bob", "hallo there")
+
+	// Bob rewrote the text alice's edit inserted, so it can't be undone
+	if _, err := history.Undo("alice"); !errors.Is(err, errUndoConflict) {
+		t.Errorf("undoing an edit changed by someone else: %v, want errUndoConflict", err)
+	}
+	if history.Content != "hallo there" {
+		t.Errorf("a refused undo changed the content to %q", history.Content)
+	}
+
+	content, err := history.Undo("bob")
+	if err != nil || content != "hello there" {
+		t.Errorf("bob's undo gave %q, %v", content, err)
+	}
+	if _, err := history.Redo("alice"); !errors.Is(err, errNothingToRedo) {
+		t.Errorf("redo without an undo: %v, want errNothingToRedo", err)
+	}
+}
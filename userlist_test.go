@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// rosterOf describes a user list as name:status pairs
+func rosterOf(t *testing.T, members []RoomMember) string {
+	t.Helper()
+	roster := ""
+	for _, member := range members {
+		if member.Color != generateUserColor(member.Username) {
+			t.Errorf("%s has the color %s", member.Username, member.Color)
+		}
+		roster += fmt.Sprintf("%s:%s ", member.Username, member.Status)
+	}
+	return roster
+}
+
+func TestUserListRequest(t *testing.T) {
+	setupTest(t)
+	config.UserDirectoryPolicy = DirectoryAll
+	config.ReconnectGrace = 30
+	hub := newTestHub(t)
+	createTestUser(t, "carol")
+	doc := createTestDocument(t, "notes.txt", "carol")
+	conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+	conn.expect(Session)
+	register(t, hub, fakeClient("bob", true))
+	openTestDocument(t, hub, "carol", doc.ID)
+	dave := fakeClient("dave", true)
+	register(t, hub, dave)
+	unregister(t, hub, dave)
+
+	conn.send(Msg{Type: UserListRequest})
+	got := rosterOf(t, conn.expect(UserListRequest).Members)
+	if want := "alice:online bob:online carol:editing dave:away "; got != want {
+		t.Errorf("the user list is %q, want %q", got, want)
+	}
+
+	// A later request sees who came since
+	register(t, hub, fakeClient("erin", true))
+	conn.send(Msg{Type: UserListRequest})
+	got = rosterOf(t, conn.expect(UserListRequest).Members)
+	if want := "alice:online bob:online carol:editing dave:away erin:online "; got != want {
+		t.Errorf("the user list is %q, want %q", got, want)
+	}
+}
+
+func TestUserListFollowsTheDirectory(t *testing.T) {
+	setupTest(t)
+	hub := newTestHub(t)
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	bob := fakeClient("bob", true)
+	register(t, hub, bob)
+	register(t, hub, fakeClient("carol", true))
+	joinTestRoom(t, hub, alice, "dev")
+	joinTestRoom(t, hub, bob, "dev")
+
+	if got := rosterOf(t, hub.OnlineUsers(alice)); got != "alice:online bob:online " {
+		t.Errorf("alice's user list is %q, want only the users sharing a room", got)
+	}
+}
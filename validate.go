@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message validation modes, set with MESSAGE_VALIDATION
+const (
+	ValidationStrict = "strict" // Reject invalid messages with an error
+	ValidationWarn   = "warn"   // Log invalid messages but handle them anyway
+	ValidationOff    = "off"
+)
+
+// Ways of handling message and document content that isn't valid UTF-8 or
+// holds null bytes, set with INVALID_CONTENT
+const (
+	InvalidContentSanitize = "sanitize" // Replace invalid sequences with U+FFFD and drop null bytes
+	InvalidContentReject   = "reject"   // Refuse to store the content
+)
+
+// ErrInvalidContent is returned when storing content that isn't valid UTF-8
+// or holds null bytes while INVALID_CONTENT is "reject"
+var ErrInvalidContent = errors.New("content must be valid UTF-8 without null bytes")
+
+// messageRule lists the fields a client may set on one message type
+type messageRule struct {
+	Required []string
+	Optional []string
+}
+
+// messageRules defines the fields of every message type clients may send.
+// Fields the server always overwrites (username, time, user_list, from) are
+// ignored, and so is a false is_system.
+var messageRules = map[MsgType]messageRule{
+	PublicMessage:   {Required: []string{"content"}, Optional: []string{"room", "format", "language", "ttl", "clientKey", "parentID"}},
+	PrivateMessage:  {Required: []string{"to", "content"}, Optional: []string{"format", "language", "ttl", "clientKey"}},
+	GroupCreate:     {Required: []string{"participants"}, Optional: []string{"name"}},
+	GroupMessage:    {Required: []string{"conversationID", "content"}, Optional: []string{"format", "language", "ttl", "clientKey"}},
+	RoleMessage:     {Required: []string{"role", "content"}, Optional: []string{"format", "language"}},
+	Pong:            {Required: []string{"pingSent"}},
+	Reaction:        {Required: []string{"messageID", "emoji"}},
+	ReactionSet:     {},
+	MessageEdit:     {Required: []string{"messageID", "content"}},
+	MessageDelete:   {Required: []string{"messageID"}},
+	RoomJoin:        {Required: []string{"room"}},
+	RoomLeave:       {Required: []string{"room"}},
+	RoomMembers:     {Required: []string{"room"}},
+	UserListRequest: {},
+	MarkRead:        {Required: []string{"messageID"}, Optional: []string{"room", "conversationID"}},
+	Search:          {Required: []string{"content"}, Optional: []string{"before", "limit"}},
+	Thread:          {Required: []string{"messageID"}},
+	History:         {Optional: []string{"room", "before", "limit"}},
+	DocList:         {Optional: []string{"filter", "sort", "order", "limit", "offset"}},
+	DocOpen:         {Optional: []string{"documentID", "token"}},
+	DocCreate:       {Optional: []string{"name", "language", "dryRun"}},
+	DocUpdate:       {Required: []string{"documentID"}, Optional: []string{"content", "revision"}},
+	DocClose:        {Optional: []string{"documentID"}},
+	DocUsers:        {Required: []string{"documentID"}},
+	DocShare:        {Required: []string{"documentID", "to"}, Optional: []string{"permission"}},
+	DocHistory:      {Required: []string{"documentID"}},
+	DocSnapshot:     {Required: []string{"documentID", "snapshotID"}},
+	DocUndo:         {Required: []string{"documentID"}},
+	DocRedo:         {Required: []string{"documentID"}},
+	DocRename:       {Required: []string{"documentID"}, Optional: []string{"name", "language", "dryRun"}},
+	DocLanguages:    {},
+	DocComment:      {Required: []string{"documentID", "content"}, Optional: []string{"line"}},
+	DocBulk:         {Required: []string{"action", "documentIDs"}},
+	DocFreeze:       {Required: []string{"documentID"}},
+	DocUnfreeze:     {Required: []string{"documentID"}},
+	DocMode:         {Required: []string{"documentID", "mode"}},
+	DocTurn:         {Required: []string{"documentID", "action"}},
+	AuthRefresh:     {Required: []string{"token"}},
+}
+
+// setFields reports which client-settable fields of msg hold a value, by
+// their JSON names
+func setFields(msg Msg) map[string]bool {
+	return map[string]bool{
+		"id":              msg.ID != 0,
+		"content":         msg.Content != "",
+		"is_system":       msg.IsSystem,
+		"to":              msg.To != "",
+		"room":            msg.Room != "",
+		"role":            msg.Role != "",
+		"clientKey":       msg.ClientKey != "",
+		"frozen":          msg.Frozen,
+		"mode":            msg.Mode != "",
+		"holder":          msg.Holder != "",
+		"owner":           msg.Owner != "",
+		"duplicate":       msg.Duplicate,
+		"delivery":        msg.Delivery != "",
+		"token":           msg.Token != "",
+		"pingSent":        msg.PingSent != 0,
+		"notification":    msg.Notification != "",
+		"edited":          msg.Edited,
+		"editedAt":        msg.EditedAt != nil,
+		"format":          msg.Format != "",
+		"ttl":             msg.TTL != 0,
+		"expiresAt":       msg.ExpiresAt != nil,
+		"members":         len(msg.Members) > 0,
+		"readPositions":   len(msg.ReadPositions) > 0,
+		"results":         len(msg.Results) > 0,
+		"before":          msg.Before != 0,
+		"limit":           msg.Limit != 0,
+		"offset":          msg.Offset != 0,
+		"conversationID":  msg.ConversationID != "",
+		"participants":    len(msg.Participants) > 0,
+		"parentID":        msg.ParentID != 0,
+		"threadID":        msg.ThreadID != 0,
+		"depth":           msg.Depth != 0,
+		"replyCount":      msg.ReplyCount != 0,
+		"reactions":       len(msg.Reactions) > 0,
+		"messageID":       msg.MessageID != 0,
+		"emoji":           msg.Emoji != "",
+		"removed":         msg.Removed,
+		"documentID":      msg.DocumentID != "",
+		"documents":       len(msg.Documents) > 0,
+		"document":        msg.Document != nil,
+		"name":            msg.Name != "",
+		"language":        msg.Language != "",
+		"color":           msg.Color != "",
+		"filter":          msg.Filter != "",
+		"sort":            msg.Sort != "",
+		"order":           msg.Order != "",
+		"permission":      msg.Permission != "",
+		"events":          len(msg.Events) > 0,
+		"chunk":           msg.Chunk != 0,
+		"chunkCount":      msg.ChunkCount != 0,
+		"final":           msg.Final,
+		"languages":       len(msg.Languages) > 0,
+		"readOnly":        msg.ReadOnly,
+		"line":            msg.Line != 0,
+		"comment":         msg.Comment != nil,
+		"comments":        len(msg.Comments) > 0,
+		"snapshotID":      msg.SnapshotID != 0,
+		"stats":           msg.Stats != nil,
+		"revision":        msg.Revision != 0,
+		"action":          msg.Action != "",
+		"documentIDs":     len(msg.DocumentIDs) > 0,
+		"documentResults": len(msg.DocumentResults) > 0,
+		"dryRun":          msg.DryRun,
+		"errors":          len(msg.Errors) > 0,
+	}
+}
+
+// validateMessage checks an incoming message against the rule of its type
+func validateMessage(msg Msg) error {
+	rule, ok := messageRules[msg.Type]
+	if !ok {
+		return fmt.Errorf("unknown message type '%s'", msg.Type)
+	}
+
+	fields := setFields(msg)
+	for _, name := range rule.Required {
+		if !fields[name] {
+			return fmt.Errorf("%s messages require %s", msg.Type, name)
+		}
+		delete(fields, name)
+	}
+	for _, name := range rule.Optional {
+		delete(fields, name)
+	}
+
+	var unexpected []string
+	for name, set := range fields {
+		if set {
+			unexpected = append(unexpected, name)
+		}
+	}
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		return fmt.Errorf("%s messages can't have %s", msg.Type, strings.Join(unexpected, ", "))
+	}
+	return nil
+}
+
+// cleanContent makes message or document content safe to store according
+// to INVALID_CONTENT: invalid UTF-8 sequences and null bytes are either
+// sanitized or refused with ErrInvalidContent
+func cleanContent(content string) (string, error) {
+	if utf8.ValidString(content) && !strings.ContainsRune(content, 0) {
+		return content, nil
+	}
+	if config.InvalidContent == InvalidContentReject {
+		return "", ErrInvalidContent
+	}
+	return strings.ReplaceAll(strings.ToValidUTF8(content, "\uFFFD"), "\x00", ""), nil
+}
+
+// checkValidation reports an unknown MESSAGE_VALIDATION or INVALID_CONTENT
+func (c *Config) checkValidation(p *configProblems) {
+	switch c.MessageValidation {
+	case ValidationStrict, ValidationWarn, ValidationOff:
+	default:
+		p.add("Invalid MESSAGE_VALIDATION %q, expected strict, warn or off", c.MessageValidation)
+	}
+	switch c.InvalidContent {
+	case InvalidContentSanitize, InvalidContentReject:
+	default:
+		p.add("Invalid INVALID_CONTENT %q, expected sanitize or reject", c.InvalidContent)
+	}
+}
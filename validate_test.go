@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// sampleFields holds a value for every field clients may set, by JSON name
+var sampleFields = map[string]any{
+	"content":        "hello",
+	"to":             "bob",
+	"room":           "dev",
+	"role":           RoleAdmin,
+	"clientKey":      "key-1",
+	"format":         "markdown",
+	"language":       "go",
+	"ttl":            60,
+	"parentID":       1,
+	"participants":   []string{"bob"},
+	"conversationID": "conv-1",
+	"name":           "notes.txt",
+	"pingSent":       1,
+	"messageID":      1,
+	"emoji":          "👍",
+	"before":         1,
+	"limit":          10,
+	"offset":         10,
+	"filter":         DocFilterMine,
+	"sort":           DocSortName,
+	"order":          SortAscending,
+	"documentID":     "doc-1",
+	"token":          "token",
+	"dryRun":         true,
+	"revision":       1,
+	"permission":     PermissionEdit,
+	"snapshotID":     1,
+	"line":           1,
+	"action":         "delete",
+	"documentIDs":    []string{"doc-1"},
+	"mode":           ModeOpen,
+}
+
+// messageWith builds a message of the given type with the named fields set
+func messageWith(t *testing.T, msgType MsgType, fields []string) Msg {
+	t.Helper()
+	values := map[string]any{"type": msgType}
+	for _, name := range fields {
+		value, ok := sampleFields[name]
+		if !ok {
+			t.Fatalf("no sample value for %s", name)
+		}
+		values[name] = value
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Msg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestValidateMessage(t *testing.T) {
+	for msgType, rule := range messageRules {
+		all := append(append([]string{}, rule.Required...), rule.Optional...)
+		if err := validateMessage(messageWith(t, msgType, all)); err != nil {
+			t.Errorf("%s with every field it allows: %v", msgType, err)
+		}
+		if err := validateMessage(messageWith(t, msgType, rule.Required)); err != nil {
+			t.Errorf("%s with its required fields only: %v", msgType, err)
+		}
+
+		for i, missing := range rule.Required {
+			fields := append(append([]string{}, rule.Required[:i]...), rule.Required[i+1:]...)
+			err := validateMessage(messageWith(t, msgType, fields))
+			if err == nil || !strings.Contains(err.Error(), "require "+missing) {
+				t.Errorf("%s without %s: %v", msgType, missing, err)
+			}
+		}
+
+		for _, extra := range []string{"documentID", "to", "room"} {
+			if contains(all, extra) {
+				continue
+			}
+			err := validateMessage(messageWith(t, msgType, append(all, extra)))
+			if err == nil || !strings.Contains(err.Error(), "can't have "+extra) {
+				t.Errorf("%s with %s: %v", msgType, extra, err)
+			}
+			break
+		}
+	}
+
+	if err := validateMessage(Msg{Type: "bogus"}); err == nil {
+		t.Error("an unknown type was accepted")
+	}
+}
+
+func TestValidationModes(t *testing.T) {
+	invalid := Msg{Type: PublicMessage, Content: "hello", DocumentID: "doc-1"}
+	for _, mode := range []string{ValidationStrict, ValidationWarn, ValidationOff} {
+		t.Run(mode, func(t *testing.T) {
+			setupTest(t)
+			config.MessageValidation = mode
+			hub := newTestHub(t)
+			conn := dial(t, newTestServer(t, hub), createTestUser(t, "alice"), nil)
+
+			conn.send(invalid)
+			msg, err := conn.read()
+			for err == nil && msg.Type != ErrorMessage && msg.Type != PublicMessage {
+				msg, err = conn.read()
+			}
+			switch {
+			case err != nil:
+				t.Fatal(err)
+			case mode == ValidationStrict && msg.Content != "Invalid message: public messages can't have documentID":
+				t.Errorf("strict validation answered %+v", msg)
+			case mode != ValidationStrict && (msg.Type != PublicMessage || msg.Content != "hello"):
+				t.Errorf("%s validation answered %+v, want the message delivered", mode, msg)
+			}
+		})
+	}
+}
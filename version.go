@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Build information, set at compile time:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildTime = ""
+)
+
+// startTime is when the server process started, for uptime reporting
+var startTime = time.Now()
+
+// VersionInfo describes the running build
+type VersionInfo struct {
+	Version       string  `json:"version"`
+	GitCommit     string  `json:"git_commit"`
+	BuildTime     string  `json:"build_time"`
+	GoVersion     string  `json:"go_version"`
+	Uptime        string  `json:"uptime"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// GetVersionInfo reports the build information and current uptime. Fields
+// not set through -ldflags fall back to the VCS revision the Go toolchain
+// embeds, or "unknown".
+func GetVersionInfo() VersionInfo {
+	commit, built := gitCommit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = setting.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+
+	uptime := time.Since(startTime)
+	return VersionInfo{
+		Version:       version,
+		GitCommit:     commit,
+		BuildTime:     built,
+		GoVersion:     runtime.Version(),
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: uptime.Seconds(),
+	}
+}
+
+// HandleVersion reports the build information and uptime. It needs no
+// authentication and exposes nothing beyond build metadata.
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetVersionInfo())
+}
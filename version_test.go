@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// getVersion calls /version and decodes the answer
+func getVersion(t *testing.T) map[string]any {
+	t.Helper()
+	w := callHandler(t, HandleVersion, "GET", "/version", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /version = %d", w.Code)
+	}
+	var info map[string]any
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestVersion(t *testing.T) {
+	first := getVersion(t)
+	for _, field := range []string{"version", "git_commit", "build_time", "go_version", "uptime"} {
+		if value, _ := first[field].(string); value == "" {
+			t.Errorf("%s is missing from %v", field, first)
+		}
+	}
+	if first["go_version"] != runtime.Version() {
+		t.Errorf("go_version = %v, want %s", first["go_version"], runtime.Version())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	second := getVersion(t)
+	if second["uptime_seconds"].(float64) <= first["uptime_seconds"].(float64) {
+		t.Errorf("uptime went from %v to %v", first["uptime_seconds"], second["uptime_seconds"])
+	}
+
+	if w := callHandler(t, HandleVersion, "POST", "/version", "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /version = %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event types that can be delivered to webhooks
+const (
+	WebhookUserJoined      = "user.joined"
+	WebhookUserLeft        = "user.left"
+	WebhookMessagePosted   = "message.posted" // Public messages, in the lobby or a room
+	WebhookDocumentCreated = "document.created"
+)
+
+var webhookEventTypes = []string{WebhookUserJoined, WebhookUserLeft, WebhookMessagePosted, WebhookDocumentCreated}
+
+// WebhookEvent is the JSON body POSTed to webhooks
+type WebhookEvent struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// webhookUser is the payload of user.joined and user.left events
+type webhookUser struct {
+	Username string `json:"username"`
+}
+
+// webhookMessage is the payload of message.posted events
+type webhookMessage struct {
+	ID       int64     `json:"id"`
+	Username string    `json:"username"`
+	Content  string    `json:"content"`
+	Room     string    `json:"room,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Webhook is an endpoint receiving events. An empty Events set subscribes
+// to every event type.
+type Webhook struct {
+	URL    string
+	Events map[string]bool
+}
+
+// Subscribed reports whether the webhook wants events of the given type
+func (hook Webhook) Subscribed(eventType string) bool {
+	return len(hook.Events) == 0 || hook.Events[eventType]
+}
+
+// webhooks are the configured endpoints, loaded from WEBHOOKS at startup
+var webhooks []Webhook
+
+// webhookEvents buffers events for the dispatcher so that the hub never
+// waits on a slow endpoint
+var webhookEvents = make(chan WebhookEvent, 1024)
+
+// maxWebhookDeliveries bounds how many deliveries are in flight at once
+const maxWebhookDeliveries = 16
+
+// ParseWebhooks parses a comma-separated list of webhook URLs. A URL may be
+// followed by #type|type to subscribe to some event types only, e.g.
+// "https://example.com/hook#user.joined|user.left".
+func ParseWebhooks(spec string) ([]Webhook, error) {
+	var hooks []Webhook
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rawURL, events, _ := strings.Cut(entry, "#")
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", rawURL)
+		}
+
+		hook := Webhook{URL: rawURL, Events: make(map[string]bool)}
+		if events != "" {
+			for _, eventType := range strings.Split(events, "|") {
+				if !contains(webhookEventTypes, eventType) {
+					return nil, fmt.Errorf("unknown webhook event type %q", eventType)
+				}
+				hook.Events[eventType] = true
+			}
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// EmitWebhookEvent queues an event for the webhooks subscribed to it. If
+// the dispatcher has fallen behind, the event is dropped rather than
+// stalling the caller.
+func EmitWebhookEvent(eventType string, data interface{}) {
+	subscribed := false
+	for _, hook := range webhooks {
+		subscribed = subscribed || hook.Subscribed(eventType)
+	}
+	if !subscribed {
+		return
+	}
+
+	select {
+	case webhookEvents <- WebhookEvent{Type: eventType, Time: time.Now(), Data: data}:
+	default:
+		log.Printf("Webhook queue full, dropping %s event", eventType)
+	}
+}
+
+// RunWebhookDispatcher delivers queued events to the webhooks subscribed to
+// them. It runs in its own goroutine.
+func RunWebhookDispatcher() {
+	client := &http.Client{Timeout: time.Duration(config.WebhookTimeout) * time.Second}
+	inFlight := make(chan struct{}, maxWebhookDeliveries)
+
+	for event := range webhookEvents {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode %s webhook event: %v", event.Type, err)
+			continue
+		}
+
+		for _, hook := range webhooks {
+			if !hook.Subscribed(event.Type) {
+				continue
+			}
+			inFlight <- struct{}{}
+			go func(hook Webhook) {
+				defer func() { <-inFlight }()
+				deliverWebhook(client, hook, event.Type, body)
+			}(hook)
+		}
+	}
+}
+
+// deliverWebhook POSTs an event, retrying with exponential backoff on
+// network errors, 429 and 5xx responses
+func deliverWebhook(client *http.Client, hook Webhook, eventType string, body []byte) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Post(hook.URL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				log.Printf("Webhook %s rejected %s event: %v", hook.URL, eventType, err)
+				return
+			}
+		}
+
+		if attempt >= config.WebhookRetries {
+			log.Printf("Giving up on %s event for webhook %s: %v", eventType, hook.URL, err)
+			return
+		}
+		log.Printf("Webhook %s failed for %s event, retrying in %v: %v", hook.URL, eventType, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
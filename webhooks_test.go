@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStub is an HTTP server recording the webhook events POSTed to it.
+// It answers with the given statuses in turn, then with 200.
+type webhookStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	attempts int
+	events   []WebhookEvent
+}
+
+func newWebhookStub(t *testing.T, statuses ...int) *webhookStub {
+	t.Helper()
+	stub := &webhookStub{statuses: statuses}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		stub.attempts++
+		if len(stub.statuses) > 0 {
+			status := stub.statuses[0]
+			stub.statuses = stub.statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+		var event WebhookEvent
+		if r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &event) != nil {
+			t.Errorf("the webhook got %q as %s", body, r.Header.Get("Content-Type"))
+		}
+		stub.events = append(stub.events, event)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// received returns how many requests the stub got and the events it took
+func (stub *webhookStub) received() (int, []WebhookEvent) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	return stub.attempts, stub.events
+}
+
+// useWebhooks subscribes hooks until the test ends. Call it before starting
+// the hub, so that the hub is gone before they are restored.
+func useWebhooks(t *testing.T, hooks []Webhook) {
+	t.Helper()
+	saved := webhooks
+	webhooks = hooks
+	t.Cleanup(func() { webhooks = saved })
+}
+
+// nextWebhookEvent returns the next queued webhook event
+func nextWebhookEvent(t *testing.T) WebhookEvent {
+	t.Helper()
+	select {
+	case event := <-webhookEvents:
+		return event
+	case <-time.After(testTimeout):
+		t.Fatal("no webhook event was emitted")
+		return WebhookEvent{}
+	}
+}
+
+func TestWebhookEventsFromTheHub(t *testing.T) {
+	setupTest(t)
+	stub := newWebhookStub(t)
+	hooks, err := ParseWebhooks(stub.URL + "#user.joined|message.posted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useWebhooks(t, hooks)
+	hub := newTestHub(t)
+
+	alice := fakeClient("alice", true)
+	register(t, hub, alice)
+	hub.BroadCast <- Msg{Type: PublicMessage, Username: "alice", Content: "hello hooks"}
+	receive(t, alice, PublicMessage)
+	unregister(t, hub, alice) // user.left isn't subscribed
+
+	for _, want := range []string{WebhookUserJoined, WebhookMessagePosted} {
+		event := nextWebhookEvent(t)
+		body, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverWebhook(http.DefaultClient, hooks[0], event.Type, body)
+		if event.Type != want {
+			t.Errorf("event %s was emitted, want %s", event.Type, want)
+		}
+	}
+	select {
+	case event := <-webhookEvents:
+		t.Errorf("unsubscribed event %s was emitted", event.Type)
+	default:
+	}
+
+	_, events := stub.received()
+	if len(events) != 2 {
+		t.Fatalf("the webhook got %d events, want 2", len(events))
+	}
+	joined := events[0].Data.(map[string]any)
+	posted := events[1].Data.(map[string]any)
+	if joined["username"] != "alice" || posted["content"] != "hello hooks" || posted["id"] == nil {
+		t.Errorf("payloads = %v and %v", joined, posted)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	setupTest(t)
+	config.WebhookRetries = 1
+	body, _ := json.Marshal(WebhookEvent{Type: WebhookUserJoined, Data: webhookUser{Username: "alice"}})
+	deliver := func(statuses ...int) (int, int) {
+		stub := newWebhookStub(t, statuses...)
+		deliverWebhook(http.DefaultClient, Webhook{URL: stub.URL}, WebhookUserJoined, body)
+		attempts, events := stub.received()
+		return attempts, len(events)
+	}
+
+	// A server error is retried
+	if attempts, delivered := deliver(http.StatusServiceUnavailable); attempts != 2 || delivered != 1 {
+		t.Errorf("after a 503, %d attempts delivered %d events, want 2 attempts and the event", attempts, delivered)
+	}
+
+	// Up to WEBHOOK_RETRIES times
+	if attempts, delivered := deliver(http.StatusBadGateway, http.StatusBadGateway); attempts != 2 || delivered != 0 {
+		t.Errorf("after two 502s, %d attempts delivered %d events, want 2 failed attempts", attempts, delivered)
+	}
+
+	// A rejection is final
+	if attempts, _ := deliver(http.StatusBadRequest); attempts != 1 {
+		t.Errorf("a 400 was retried, %d attempts", attempts)
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	hooks, err := ParseWebhooks("https://a.example/hook, http://b.example/x#user.left|document.created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || !hooks[0].Subscribed(WebhookMessagePosted) {
+		t.Fatalf("parsed %+v", hooks)
+	}
+	if !hooks[1].Subscribed(WebhookUserLeft) || hooks[1].Subscribed(WebhookUserJoined) {
+		t.Errorf("the second hook subscribes to %v", hooks[1].Events)
+	}
+	for _, spec := range []string{"ftp://a.example/", "https://", "https://a.example/#user.renamed"} {
+		if _, err := ParseWebhooks(spec); err == nil {
+			t.Errorf("%q was accepted", spec)
+		}
+	}
+}
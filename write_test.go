@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client that stops reading must not hold its writer forever: once the
+// socket buffers fill up, the write times out and the connection is dropped
+func TestStuckWriteTimesOut(t *testing.T) {
+	setupTest(t)
+	config.WSWriteTimeout = 1
+	client := fakeClient("alice", true)
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		client.Conn = conn
+		go func() {
+			defer close(done)
+			client.writeMessages()
+		}()
+	}))
+	defer server.Close()
+
+	// The other end never reads
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// Far more than Send and the socket buffers hold, so every message is
+	// only taken once the writer has given up and drains what is left
+	big := strings.Repeat("x", 1<<20)
+	start := time.Now()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < cap(client.Send)+64; i++ {
+			client.Send <- Msg{Type: PublicMessage, Content: big}
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(testTimeout):
+		t.Fatal("the writer is still stuck on a client that doesn't read")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("the writer gave up after %v, before WS_WRITE_TIMEOUT", elapsed)
+	}
+	close(client.Send)
+	<-done
+}
+
+// A write to a connection that is gone fails at once rather than waiting
+// for the deadline
+func TestWriteToClosedConnection(t *testing.T) {
+	setupTest(t)
+	config.WSWriteTimeout = 30
+	client := fakeClient("alice", true)
+	upgraded := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		client.Conn = conn
+		close(upgraded)
+	}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+	<-upgraded
+	client.Conn.Close()
+
+	start := time.Now()
+	if client.writeMessage(Msg{Type: PublicMessage, Content: "anyone there?"}) {
+		t.Error("writing to a closed connection reported it still usable")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the failed write took %v", elapsed)
+	}
+}
+
+// After a failed write the writer keeps taking what is sent to the client,
+// so that a reader in the middle of a reply isn't stuck on a full Send
+func TestWriterDrainsSendAfterFailedWrite(t *testing.T) {
+	setupTest(t)
+	client := fakeClient("alice", true)
+	upgraded := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		client.Conn = conn
+		close(upgraded)
+	}))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+	<-upgraded
+	client.Conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		client.writeMessages()
+		close(done)
+	}()
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*cap(client.Send); i++ {
+			client.Send <- Msg{Type: PublicMessage, Content: "anyone there?"}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(testTimeout):
+		t.Fatal("sending to a client whose writer has failed blocked")
+	}
+
+	close(client.Send)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("the writer didn't finish once Send was closed")
+	}
+}